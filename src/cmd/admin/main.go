@@ -0,0 +1,12 @@
+// The admin binary serves the admin API through a Lambda function URL
+package main
+
+import (
+	"github.com/andreswebs/go-ado-ecs-lambda/internal/controller"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	controller.Bootstrap(controller.RoleAdmin)
+	lambda.StartWithOptions(controller.Handler, lambda.WithEnableSIGTERM())
+}
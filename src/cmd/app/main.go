@@ -0,0 +1,17 @@
+// The app binary serves every invocation, the single-function deployment, and runs the controller from the command line, see controller.RunCLI
+package main
+
+import (
+	"os"
+
+	"github.com/andreswebs/go-ado-ecs-lambda/internal/controller"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	controller.Bootstrap(controller.RoleAll)
+	if len(os.Args) > 1 {
+		os.Exit(controller.RunCLI(os.Args[1:]))
+	}
+	lambda.StartWithOptions(controller.Handler, lambda.WithEnableSIGTERM())
+}
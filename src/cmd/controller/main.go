@@ -0,0 +1,12 @@
+// The controller binary serves the SQS events of ADO payloads, including webhook frontends, and the ECS task state change events
+package main
+
+import (
+	"github.com/andreswebs/go-ado-ecs-lambda/internal/controller"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	controller.Bootstrap(controller.RoleController)
+	lambda.StartWithOptions(controller.Handler, lambda.WithEnableSIGTERM())
+}
@@ -0,0 +1,12 @@
+// The janitor binary serves the scheduled controller commands, such as agentgc or reconcile
+package main
+
+import (
+	"github.com/andreswebs/go-ado-ecs-lambda/internal/controller"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	controller.Bootstrap(controller.RoleJanitor)
+	lambda.StartWithOptions(controller.Handler, lambda.WithEnableSIGTERM())
+}
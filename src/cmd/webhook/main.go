@@ -0,0 +1,12 @@
+// The webhook binary forwards the webhooks received through a Lambda function URL to the queues of the controller
+package main
+
+import (
+	"github.com/andreswebs/go-ado-ecs-lambda/internal/controller"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	controller.Bootstrap(controller.RoleWebhook)
+	lambda.StartWithOptions(controller.Handler, lambda.WithEnableSIGTERM())
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ErrPayloadNotAllowed is returned for payloads of projects or organizations that aren't allowed to use the controller
+var ErrPayloadNotAllowed = errors.New("payload not allowed")
+
+/*
+AccessPolicy restricts which ADO organizations and projects a shared controller serves.
+Deny-lists take precedence over allow-lists, and empty allow-lists allow everything that isn't denied.
+*/
+type AccessPolicy struct {
+	AllowedOrgs     []string // The organizations allowed, any if empty
+	DeniedOrgs      []string // The organizations denied
+	AllowedProjects []string // The project IDs allowed, any if empty
+	DeniedProjects  []string // The project IDs denied
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values, organizations and project IDs are case-insensitive:
+  - ADO_ALLOWED_ORGS: A comma-separated list of the organizations served, matched against the plan URL of the payload (default: any)
+  - ADO_DENIED_ORGS: A comma-separated list of the organizations never served
+  - ADO_ALLOWED_PROJECTS: A comma-separated list of the project IDs served (default: any)
+  - ADO_DENIED_PROJECTS: A comma-separated list of the project IDs never served
+*/
+func (policy *AccessPolicy) ReadFromEnv() {
+	policy.AllowedOrgs = readListEnvVar("ADO_ALLOWED_ORGS")
+	policy.DeniedOrgs = readListEnvVar("ADO_DENIED_ORGS")
+	policy.AllowedProjects = readListEnvVar("ADO_ALLOWED_PROJECTS")
+	policy.DeniedProjects = readListEnvVar("ADO_DENIED_PROJECTS")
+}
+
+// readListEnvVar reads an optional comma-separated list environment variable, lowercased
+func readListEnvVar(name string) (values []string) {
+	for _, value := range strings.Split(ReadEnvVarWithDefault(name, ""), ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			values = append(values, value)
+		}
+	}
+	return
+}
+
+/*
+CheckOrganization returns an ErrPayloadNotAllowed error if the organization of the payload, parsed from its plan URL,
+isn't served. Checks of other organizations can't be failed, since callbacks are sent to the configured organization.
+*/
+func (policy *AccessPolicy) CheckOrganization(payload *ADOPayload) error {
+	if len(policy.AllowedOrgs) == 0 && len(policy.DeniedOrgs) == 0 {
+		return nil
+	}
+	return checkAllowed("organization", payloadOrganization(payload), policy.AllowedOrgs, policy.DeniedOrgs)
+}
+
+// CheckProject returns an ErrPayloadNotAllowed error if the project of the payload isn't served
+func (policy *AccessPolicy) CheckProject(payload *ADOPayload) error {
+	return checkAllowed("project", strings.ToLower(payload.ProjectID), policy.AllowedProjects, policy.DeniedProjects)
+}
+
+// checkAllowed returns an ErrPayloadNotAllowed error if the value is denied, or not allowed by a non-empty allow-list
+func checkAllowed(kind string, value string, allowed []string, denied []string) error {
+	if slices.Contains(denied, value) {
+		return fmt.Errorf("%w: %s %q is denied", ErrPayloadNotAllowed, kind, value)
+	}
+	if len(allowed) > 0 && !slices.Contains(allowed, value) {
+		return fmt.Errorf("%w: %s %q is not allowed", ErrPayloadNotAllowed, kind, value)
+	}
+	return nil
+}
+
+/*
+payloadOrganization returns the lowercased organization of the plan URL of a payload,
+e.g. 'contoso' for https://dev.azure.com/contoso/ and https://contoso.visualstudio.com/, or an empty string if unknown.
+*/
+func payloadOrganization(payload *ADOPayload) string {
+	planURL, err := url.Parse(payload.PlanURL)
+	if err != nil {
+		return ""
+	}
+
+	host := strings.ToLower(planURL.Hostname())
+	if org, ok := strings.CutSuffix(host, ".visualstudio.com"); ok {
+		return org
+	}
+
+	org, _, _ := strings.Cut(strings.Trim(planURL.Path, "/"), "/")
+	return strings.ToLower(org)
+}
+
+// logSecurityRejection logs a security entry for a payload rejected by the access policy
+func logSecurityRejection(payload *ADOPayload, err error) {
+	slog.Warn("security: rejected payload",
+		slog.Bool("security", true),
+		slog.String("jobId", payload.JobID),
+		slog.String("projectId", payload.ProjectID),
+		slog.String("organization", payloadOrganization(payload)),
+		slog.String("planUrl", payload.PlanURL),
+		slog.Any("err", err),
+	)
+	EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "AccessPolicy"})
+}
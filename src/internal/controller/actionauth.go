@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ErrActionUnauthorized is returned for action messages that are neither signed nor carry a valid job access token
+var ErrActionUnauthorized = errors.New("action message not authorized")
+
+// actionSigner is the principal of signed action messages
+const actionSigner = "hmac"
+
+// Message attributes of signed action messages, see authorizeAction
+const (
+	actionSignatureAttribute = "X-Signature-256"       // The 'sha256=<hex>' HMAC-SHA256 signature of the timestamp and the body
+	actionTimestampAttribute = "X-Signature-Timestamp" // The RFC 3339 time at which the message was signed
+)
+
+// ActionSigningConfig contains configuration values for the signatures of action messages, such as stop and kill switch messages
+type ActionSigningConfig struct {
+	Secret string        // The secret of the HMAC-SHA256 signatures, signed messages are rejected if empty
+	MaxAge time.Duration // How far the signing time of a message may be from the current time
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - ACTION_SIGNING_SECRET: The secret of the HMAC-SHA256 signatures of action messages, e.g. held by the platform team or the frontend
+    forwarding ADO service hooks, which can be KMS-encrypted, messages are only authorized by job access tokens if unset (optional)
+  - ACTION_SIGNING_MAX_AGE_SECONDS: How far the signing time of a message may be from the current time, so captured messages can't be replayed later (default: 300)
+*/
+func (config *ActionSigningConfig) ReadFromEnv() {
+	config.Secret = ReadEnvVarWithDefault("ACTION_SIGNING_SECRET", "")
+
+	maxAgeStr := ReadEnvVarWithDefault("ACTION_SIGNING_MAX_AGE_SECONDS", "300")
+	maxAge, err := strconv.Atoi(maxAgeStr)
+	if err != nil || maxAge < 1 {
+		slog.Error("failed to parse ACTION_SIGNING_MAX_AGE_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxAge = time.Duration(maxAge) * time.Second
+}
+
+// ActionAuthorization is the sender of an authorized action message
+type ActionAuthorization struct {
+	Signed    bool   // Whether the message was signed with ACTION_SIGNING_SECRET, which authorizes any target
+	ProjectID string // The ADO project of the job access token of an unsigned message, the only project it may target
+	Principal string // Who sent the message, hmac or the project and job of the token, for logs and records
+}
+
+/*
+verifySignedRecord verifies the HMAC-SHA256 signature of a record, the 'sha256=<hex>' signature of '<timestamp>.<body>'
+with the secret in the X-Signature-256 message attribute, and its RFC 3339 signing time in the X-Signature-Timestamp message attribute,
+which must be within ACTION_SIGNING_MAX_AGE_SECONDS of the current time.
+*/
+func verifySignedRecord(record events.SQSMessage, secret string) error {
+	signature := aws.ToString(record.MessageAttributes[actionSignatureAttribute].StringValue)
+	if signature == "" {
+		return fmt.Errorf("the message isn't signed")
+	}
+
+	timestamp := aws.ToString(record.MessageAttributes[actionTimestampAttribute].StringValue)
+	signedAt, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid signing time %q", timestamp)
+	}
+	if age := time.Since(signedAt).Abs(); age > actionSigningCfg.MaxAge {
+		return fmt.Errorf("signed at %s, %s from now", formatTimestamp(signedAt), formatDuration(age))
+	}
+	if !verifySignature(secret, timestamp+"."+record.Body, signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+/*
+authorizeAction authorizes an action message, either:
+  - signed, with the HMAC-SHA256 of '<timestamp>.<body>' with ACTION_SIGNING_SECRET as 'sha256=<hex>' in the X-Signature-256 message attribute,
+    and the RFC 3339 signing time in the X-Signature-Timestamp message attribute, within ACTION_SIGNING_MAX_AGE_SECONDS of the current time
+  - or carrying the Job of a pipeline, with its job access token (system.AccessToken), whose plan must be in progress, see ADOValidatePlan,
+    and whose organization and project are allowed by the access policy, see AccessPolicy
+
+Unauthorized messages return an error wrapping ErrActionUnauthorized, and are meant to be dropped.
+Other errors, e.g. ADO outages while validating the token, are returned as is, so the message is redelivered.
+*/
+func authorizeAction(record events.SQSMessage, message *ActionMessage) (*ActionAuthorization, error) {
+	if aws.ToString(record.MessageAttributes[actionSignatureAttribute].StringValue) != "" {
+		if actionSigningCfg.Secret == "" {
+			return nil, fmt.Errorf("%w: signed messages are not accepted without ACTION_SIGNING_SECRET", ErrActionUnauthorized)
+		}
+		err := verifySignedRecord(record, actionSigningCfg.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrActionUnauthorized, err)
+		}
+		return &ActionAuthorization{Signed: true, Principal: actionSigner}, nil
+	}
+
+	job := message.Job
+	if job == nil || job.AuthToken == "" {
+		return nil, fmt.Errorf("%w: the message is neither signed nor carries a job access token", ErrActionUnauthorized)
+	}
+
+	err := job.Sanitize()
+	if err == nil {
+		err = accessPolicy.CheckOrganization(job)
+	}
+	if err == nil {
+		err = accessPolicy.CheckProject(job)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrActionUnauthorized, err)
+	}
+
+	err = ADOValidatePlan(adoClient, adoCfg, job)
+	var adoErr *ADOError
+	if errors.Is(err, ErrInvalidPayload) || errors.As(err, &adoErr) && (adoErr.StatusCode == http.StatusUnauthorized || adoErr.StatusCode == http.StatusForbidden) {
+		return nil, fmt.Errorf("%w: %w", ErrActionUnauthorized, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate the job access token: %w", err)
+	}
+
+	return &ActionAuthorization{ProjectID: job.ProjectID, Principal: fmt.Sprintf("project %s, job %s", job.ProjectID, job.JobID)}, nil
+}
+
+// rejectActionMessage logs a security entry for an unauthorized action message and emits the RejectedPayloads metric
+func rejectActionMessage(message *ActionMessage, err error) {
+	slog.Warn("security: rejected action message",
+		slog.Bool("security", true),
+		slog.String("action", message.Action),
+		slog.String("jobId", message.JobID),
+		slog.String("taskArn", message.TaskARN),
+		slog.String("projectId", message.ProjectID),
+		slog.Any("err", err),
+	)
+	EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "ActionAuthorization"})
+}
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// activitySchemaVersion is the version of the ActivityRecord schema, incremented on incompatible changes
+const activitySchemaVersion = 1
+
+// Limits of the Firehose PutRecordBatch API
+const (
+	firehoseMaxBatchRecords = 500        // The maximum number of records of a call
+	firehoseMaxBatchBytes   = 4 << 20    // The maximum size of the records of a call
+	firehoseMaxRecordBytes  = 1000 << 10 // The maximum size of a record
+	activityPackBytes       = 900 << 10  // The maximum uncompressed size of the lines packed in a compressed record, below firehoseMaxRecordBytes
+)
+
+// Compressions of exported activity records, see ActivityExporter
+const (
+	ActivityCompressionNone = "none" // Every activity record is a Firehose record
+	ActivityCompressionGzip = "gzip" // The activity records of an invocation are packed in gzip-compressed Firehose records
+)
+
+// Events of the activity timeline of a job, in their usual order
+const (
+	ActivityReceived     = "received"     // The job's message was received
+	ActivityStarted      = "started"      // The runner accepted the agent launch
+	ActivityProvisioning = "provisioning" // The agent wasn't ready within the wait of the record, and is re-checked later
+	ActivityRunning      = "running"      // The agent is ready
+	ActivityStopped      = "stopped"      // The agent stopped before becoming ready
+	ActivityCallback     = "callback"     // The TaskCompleted callback was sent
+)
+
+/*
+ActivityRecord is an event of the activity timeline of a job, exported as a line of JSON.
+
+The schema, version 1:
+  - schemaVersion: the version of the schema, 1
+  - controller: the controller ID, see controllerID
+  - event: the event, one of received, started, provisioning, running, stopped and callback
+  - time: when the event happened, RFC 3339
+  - jobId, checkId, projectId, planId: the IDs of the job
+  - taskArn: the ID of the agent, from the started event on
+  - profile: the task profile serving the job, from the started event on
+  - result: the reported outcome, succeeded or failed, for callback events
+*/
+type ActivityRecord struct {
+	SchemaVersion int       `json:"schemaVersion"`     // The version of the schema
+	Controller    string    `json:"controller"`        // The controller ID
+	Event         string    `json:"event"`             // The event, one of the Activity values
+	Time          time.Time `json:"time"`              // When the event happened
+	JobID         string    `json:"jobId"`             // The ADO job ID
+	CheckID       string    `json:"checkId"`           // The check ID of the job, see ADOPayload.CheckID
+	ProjectID     string    `json:"projectId"`         // The ADO project ID
+	PlanID        string    `json:"planId"`            // The ADO plan ID
+	TaskARN       string    `json:"taskArn,omitempty"` // The ID of the agent
+	Profile       string    `json:"profile,omitempty"` // The task profile serving the job
+	Result        string    `json:"result,omitempty"`  // The reported outcome
+}
+
+/*
+ActivityExporter buffers the activity records of an invocation and delivers them to an Amazon Data Firehose stream,
+e.g. into S3 for analytics, on Flush, in as few PutRecordBatch calls as the API limits allow.
+
+With gzip compression, the JSON lines of the invocation are packed into gzip members of up to about 900 KiB uncompressed,
+one per Firehose record, which Firehose concatenates into valid gzip objects if the stream itself doesn't compress,
+so high-throughput controllers send fewer, smaller records.
+*/
+type ActivityExporter struct {
+	Client      *firehose.Client // The Firehose client
+	StreamName  string           // The name of the Firehose delivery stream
+	Compression string           // The compression of the records, none or gzip
+
+	mu      sync.Mutex
+	records []ActivityRecord
+}
+
+/*
+NewActivityExporterFromEnv reads the following optional environment variables
+and returns the activity exporter, or nil if activity isn't exported:
+  - ACTIVITY_DELIVERY_STREAM: The name of the Amazon Data Firehose delivery stream of activity records, requires firehose:PutRecordBatch
+  - ACTIVITY_COMPRESSION: The compression of the records, none or gzip, which requires a stream without compression of its own (default: none)
+*/
+func NewActivityExporterFromEnv(cfg aws.Config) *ActivityExporter {
+	streamName := ReadEnvVarWithDefault("ACTIVITY_DELIVERY_STREAM", "")
+	if streamName == "" {
+		return nil
+	}
+
+	compression := ReadEnvVarWithDefault("ACTIVITY_COMPRESSION", ActivityCompressionNone)
+	if compression != ActivityCompressionNone && compression != ActivityCompressionGzip {
+		slog.Error("failed to parse ACTIVITY_COMPRESSION", slog.String("compression", compression))
+		os.Exit(1)
+	}
+
+	return &ActivityExporter{Client: firehose.NewFromConfig(cfg), StreamName: streamName, Compression: compression}
+}
+
+// Record buffers an activity record of a job
+func (e *ActivityExporter) Record(record ActivityRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.records = append(e.records, record)
+}
+
+// Flush delivers the buffered activity records, which are dropped if the delivery fails
+func (e *ActivityExporter) Flush(ctx context.Context) {
+	e.mu.Lock()
+	records := e.records
+	e.records = nil
+	e.mu.Unlock()
+
+	entries, err := e.entries(records)
+	if err != nil {
+		dependencies.Fallback(DependencyActivity, "export activity records", err)
+		return
+	}
+
+	for len(entries) > 0 {
+		size, count := 0, 0
+		for count < min(len(entries), firehoseMaxBatchRecords) && (count == 0 || size+len(entries[count].Data) <= firehoseMaxBatchBytes) {
+			size += len(entries[count].Data)
+			count++
+		}
+
+		err = e.putBatch(ctx, entries[:count])
+		if err != nil {
+			dependencies.Fallback(DependencyActivity, "export activity records", err)
+			return
+		}
+		entries = entries[count:]
+	}
+
+	if len(records) > 0 {
+		dependencies.Recover(DependencyActivity)
+	}
+}
+
+// entries returns the Firehose records of activity records, a JSON line each, or packed into gzip members
+func (e *ActivityExporter) entries(records []ActivityRecord) (entries []fhtypes.Record, err error) {
+	var packed bytes.Buffer
+	pack := func() error {
+		if packed.Len() == 0 {
+			return nil
+		}
+
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, writeErr := writer.Write(packed.Bytes())
+		if writeErr == nil {
+			writeErr = writer.Close()
+		}
+		if writeErr != nil {
+			return fmt.Errorf("failed to compress activity records: %w", writeErr)
+		}
+
+		entries = append(entries, fhtypes.Record{Data: compressed.Bytes()})
+		packed.Reset()
+		return nil
+	}
+
+	for _, record := range records {
+		data, marshalErr := json.Marshal(record)
+		if marshalErr != nil {
+			err = fmt.Errorf("failed to marshal activity record: %w", marshalErr)
+			return
+		}
+		data = append(data, '\n')
+
+		if e.Compression != ActivityCompressionGzip {
+			entries = append(entries, fhtypes.Record{Data: data})
+			continue
+		}
+
+		if packed.Len()+len(data) > activityPackBytes {
+			err = pack()
+			if err != nil {
+				return
+			}
+		}
+		packed.Write(data)
+	}
+
+	err = pack()
+	return
+}
+
+// putBatch delivers a batch of Firehose records with PutRecordBatch
+func (e *ActivityExporter) putBatch(ctx context.Context, entries []fhtypes.Record) error {
+	result, err := e.Client.PutRecordBatch(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(e.StreamName),
+		Records:            entries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put activity records: %w", err)
+	}
+
+	if failed := aws.ToInt32(result.FailedPutCount); failed > 0 {
+		slog.Warn("failed to export some activity records", slog.Int("failed", int(failed)), slog.Int("records", len(entries)))
+	}
+	return nil
+}
+
+// recordActivity records an event of the activity timeline of a job, if activity is exported, and counts it in the invocation summary
+func recordActivity(event string, payload *ADOPayload, record *JobRecord, result string) {
+	invocationSummary.Activity(event)
+	if activity == nil || payload == nil {
+		return
+	}
+
+	entry := ActivityRecord{
+		SchemaVersion: activitySchemaVersion,
+		Controller:    controllerID,
+		Event:         event,
+		Time:          time.Now().UTC(),
+		JobID:         payload.JobID,
+		CheckID:       payload.CheckID(),
+		ProjectID:     payload.ProjectID,
+		PlanID:        payload.PlanID,
+		Result:        result,
+	}
+	if record != nil {
+		entry.TaskARN = record.TaskARN
+		entry.Profile = record.Profile
+	}
+	activity.Record(entry)
+}
@@ -0,0 +1,266 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// AdminJob is a job listed by the admin API
+type AdminJob struct {
+	JobID      string    `json:"jobId"`      // The check ID of the job
+	TaskARN    string    `json:"taskArn"`    // The ID of the agent started by the runner
+	Status     string    `json:"status"`     // The job lifecycle status
+	Profile    string    `json:"profile"`    // The task profile of the job
+	Attempts   int       `json:"attempts"`   // The number of agents started for the job
+	CreatedAt  time.Time `json:"createdAt"`  // When the job was first seen
+	AgeSeconds int64     `json:"ageSeconds"` // How long ago the job was first seen
+	PlanURL    string    `json:"planUrl"`    // The plan URL of the job
+}
+
+// adminCfg configures the admin API, nil in the binaries that don't serve it
+var adminCfg *AdminConfig
+
+// AdminConfig contains configuration values for the admin API
+type AdminConfig struct {
+	AllowedPrincipals []string // The ARNs of the IAM principals allowed to call the admin API, an entry ending with * matches ARNs by prefix
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - ADMIN_ALLOWED_PRINCIPALS: A comma-separated list of the ARNs of the IAM principals allowed to call the admin API,
+    as reported by the function URL, e.g. 'arn:aws:sts::123456789012:assumed-role/Operators/*',
+    an entry ending with * matches the ARNs with its prefix (default: no principals, every admin request is denied)
+*/
+func (config *AdminConfig) ReadFromEnv() {
+	for _, principal := range strings.Split(ReadEnvVarWithDefault("ADMIN_ALLOWED_PRINCIPALS", ""), ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			config.AllowedPrincipals = append(config.AllowedPrincipals, principal)
+		}
+	}
+}
+
+// Allows reports whether the IAM principal with the given ARN may call the admin API
+func (config *AdminConfig) Allows(principalARN string) bool {
+	if principalARN == "" {
+		return false
+	}
+	for _, allowed := range config.AllowedPrincipals {
+		prefix, wildcard := strings.CutSuffix(allowed, "*")
+		if allowed == principalARN || wildcard && strings.HasPrefix(principalARN, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFunctionURLRequest reports whether an invocation is a Lambda function URL request
+func isFunctionURLRequest(request *events.LambdaFunctionURLRequest) bool {
+	return request.RequestContext.HTTP.Method != ""
+}
+
+/*
+handleAdmin serves the admin API for in-flight jobs through a Lambda function URL,
+which must use the AWS_IAM auth type, and which only serves the callers listed in ADMIN_ALLOWED_PRINCIPALS, see AdminConfig,
+since lambda:InvokeFunctionUrl is often granted more widely than to operators:
+  - GET /jobs: lists the in-flight jobs
+  - GET /jobs/{jobId}: returns a job and the IDs of its agents
+  - GET /tasks/{taskArn}: returns the job that owns an agent task, see ResolveTask, the ARN may be URL-encoded
+  - POST /jobs/{jobId}/stop: stops the agents of a job and reports its check as failed
+  - POST /jobs/{jobId}/retry: stops the agents of a job and starts a replacement of each of them, requires the ecs backend
+  - POST /projects/{projectId}/stop: stops every in-flight agent of a project, see stopProjectAgents
+  - GET /messages/{messageId}: returns the outcome of the last delivery of a queue message, see recordMessageOutcomes
+
+The admin API requires the state store.
+*/
+func handleAdmin(ctx context.Context, request *events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	if request.RequestContext.Authorizer == nil || request.RequestContext.Authorizer.IAM == nil {
+		return adminResponse(http.StatusForbidden, map[string]string{"error": "the function URL must use the AWS_IAM auth type"})
+	}
+
+	caller := request.RequestContext.Authorizer.IAM.UserARN
+	if adminCfg == nil || !adminCfg.Allows(caller) {
+		slog.Warn("admin request denied", slog.String("method", request.RequestContext.HTTP.Method), slog.String("path", request.RawPath), slog.String("caller", caller))
+		return adminResponse(http.StatusForbidden, map[string]string{"error": "the caller isn't allowed to use the admin API"})
+	}
+
+	if stateStore == nil {
+		return adminResponse(http.StatusNotImplemented, map[string]string{"error": "the admin API requires the state store"})
+	}
+
+	slog.Info("admin request", slog.String("method", request.RequestContext.HTTP.Method), slog.String("path", request.RawPath), slog.String("caller", caller))
+
+	segments := strings.Split(strings.Trim(request.RawPath, "/"), "/")
+	method := request.RequestContext.HTTP.Method
+
+	switch {
+	case method == http.MethodGet && len(segments) == 1 && segments[0] == "jobs":
+		jobs, err := listInFlightJobs(ctx)
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, map[string]any{"jobs": jobs})
+	case method == http.MethodGet && len(segments) == 2 && segments[0] == "jobs":
+		record, err := stateStore.Get(ctx, segments[1])
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, adminJobOf(record))
+	case method == http.MethodGet && len(segments) >= 2 && segments[0] == "tasks":
+		task, err := url.PathUnescape(strings.Join(segments[1:], "/"))
+		if err != nil {
+			return adminResponse(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		owner, err := ResolveTask(ctx, task)
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, owner)
+	case method == http.MethodPost && len(segments) == 3 && segments[0] == "jobs" && segments[2] == "stop":
+		err := stopJob(ctx, segments[1])
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, map[string]string{"jobId": segments[1], "status": JobStatusFailed})
+	case method == http.MethodPost && len(segments) == 3 && segments[0] == "jobs" && segments[2] == "retry":
+		taskARNs, err := retryJob(ctx, segments[1])
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, map[string]string{"jobId": segments[1], "taskArn": taskARNs})
+	case method == http.MethodPost && len(segments) == 3 && segments[0] == "projects" && segments[2] == "stop":
+		stopped, err := stopProjectAgents(ctx, segments[1], "Stopped by an operator")
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, map[string]any{"projectId": segments[1], "stopped": stopped})
+	case method == http.MethodGet && len(segments) == 2 && segments[0] == "messages":
+		trace, err := stateStore.GetMessageOutcome(ctx, segments[1])
+		if err != nil {
+			return adminError(err)
+		}
+		return adminResponse(http.StatusOK, trace)
+	default:
+		return adminResponse(http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+// listInFlightJobs returns the jobs whose agents are started
+func listInFlightJobs(ctx context.Context) (jobs []AdminJob, err error) {
+	records, err := stateStore.ListByStatus(ctx, JobStatusStarted)
+	if err != nil {
+		return
+	}
+
+	jobs = []AdminJob{}
+	for _, record := range records {
+		jobs = append(jobs, adminJobOf(record))
+	}
+
+	return
+}
+
+// adminJobOf returns the admin API view of a job record
+func adminJobOf(record *JobRecord) AdminJob {
+	job := AdminJob{
+		JobID:      record.JobID,
+		TaskARN:    record.TaskARN,
+		Status:     record.Status,
+		Profile:    record.Profile,
+		Attempts:   record.Attempts,
+		CreatedAt:  record.CreatedAt,
+		AgeSeconds: int64(time.Since(record.CreatedAt).Seconds()),
+	}
+	if record.Payload != nil {
+		job.PlanURL = record.Payload.PlanURL
+	}
+	return job
+}
+
+// stopJob stops the agents of a job, marks it as failed and reports its check as failed
+func stopJob(ctx context.Context, jobID string) error {
+	record, err := stateStore.Get(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	err = runner.Stop(ctx, record.TaskARN, "Stopped by an operator")
+	if err != nil {
+		return fmt.Errorf("failed to stop agent: %w", err)
+	}
+
+	err = stateStore.UpdateStatus(ctx, jobID, JobStatusFailed)
+	if err != nil {
+		return err
+	}
+
+	if record.Payload != nil {
+		return failCheck(ctx, record.Payload, "The agent was stopped by an operator")
+	}
+
+	return nil
+}
+
+// retryJob stops the agents of a job and starts a replacement of each of them, returning the comma-separated ARNs of the replacements
+func retryJob(ctx context.Context, jobID string) (string, error) {
+	if taskCfg == nil {
+		return "", fmt.Errorf("retry requires the ecs backend")
+	}
+
+	record, err := stateStore.Get(ctx, jobID)
+	if err != nil {
+		return "", err
+	}
+
+	err = runner.Stop(ctx, record.TaskARN, "Retried by an operator")
+	if err != nil {
+		slog.Warn("failed to stop agent before retry", slog.String("jobId", jobID), slog.Any("err", err))
+	}
+
+	for _, taskARN := range strings.Split(record.TaskARN, ",") {
+		_, err = redispatchTask(ctx, record, taskARN)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	slog.Info("job retried by an operator", slog.String("jobId", jobID), slog.String("taskArn", record.TaskARN))
+	return record.TaskARN, nil
+}
+
+// adminError returns the admin API response for an error
+func adminError(err error) events.LambdaFunctionURLResponse {
+	if errors.Is(err, ErrJobNotFound) || errors.Is(err, ErrMessageNotFound) {
+		return adminResponse(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if errors.Is(err, ErrPayloadNotAllowed) {
+		return adminResponse(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
+	slog.Error("admin request failed", slog.Any("err", err))
+	return adminResponse(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+// adminResponse returns a JSON admin API response
+func adminResponse(statusCode int, body any) events.LambdaFunctionURLResponse {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		bodyBytes = []byte(`{"error": "failed to marshal response"}`)
+	}
+
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(bodyBytes),
+	}
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Compressions of the log content appended by ADOLogUpload
+const (
+	ADOLogCompressionGzip = "gzip" // The content is sent gzip-compressed, with Content-Encoding: gzip
+	ADOLogCompressionNone = "none" // The content is sent as is
+)
+
+// stopLogsEnabled uploads the description of agents that stopped before becoming ready as a log of their check if set with ADO_STOP_LOGS_ENABLED, see reportStoppedAgent
+var stopLogsEnabled = ReadEnvVarWithDefault("ADO_STOP_LOGS_ENABLED", "false") == "true"
+
+// ADOStreamBody is the raw body of an ADO request, sent by sendADORequest instead of a JSON body
+type ADOStreamBody struct {
+	ContentType     string // The content type of the body
+	ContentEncoding string // The content encoding of the body, if compressed
+	Data            []byte // The body
+}
+
+/*
+ADOLogUpload uploads content as a log of the check's plan, attached to the timeline record of its task instance,
+which shows it in the check's logs in the Azure DevOps UI, and returns the ID of the log:
+  - the log is created with the given path, its name in the UI
+  - the content is appended in chunks of at most ADO_LOG_CHUNK_BYTES, split at line ends where possible,
+    so large content doesn't hit the request size limits of ADO, and compressed with ADO_LOG_COMPRESSION
+  - the log is set as the log of the timeline record
+
+Unlike ADOTimelineFeed, whose lines are only kept while the check runs, uploaded logs are kept with the run.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/logs
+*/
+func ADOLogUpload(client *http.Client, config *ADOConfig, payload *ADOPayload, path string, content string) (logID int, err error) {
+	resBytes, err := adoRequest(client, config, payload.AuthToken, http.MethodPost, payload.ADOLogsURL(config.Instance, config.APIVersion, 0), map[string]string{"path": path})
+	if err != nil {
+		err = fmt.Errorf("failed to create log: %w", err)
+		return
+	}
+
+	var log struct {
+		ID int `json:"id"`
+	}
+	err = json.Unmarshal(resBytes, &log)
+	if err != nil {
+		err = fmt.Errorf("failed to parse log: %w", err)
+		return
+	}
+	logID = log.ID
+
+	for _, chunk := range logChunks(content, config.LogChunkBytes) {
+		var body *ADOStreamBody
+		body, err = adoLogBody(chunk, config.LogCompression)
+		if err != nil {
+			return
+		}
+
+		_, err = adoRequest(client, config, payload.AuthToken, http.MethodPost, payload.ADOLogsURL(config.Instance, config.APIVersion, logID), body)
+		if err != nil {
+			err = fmt.Errorf("failed to append to log %d: %w", logID, err)
+			return
+		}
+	}
+
+	body := map[string]any{
+		"value": []map[string]any{
+			{
+				"id":  payload.TaskInstanceID,
+				"log": map[string]int{"id": logID},
+			},
+		},
+		"count": 1,
+	}
+
+	_, err = adoRequest(client, config, payload.AuthToken, http.MethodPatch, payload.ADOTimelineRecordsURL(config.Instance, config.APIVersion), body)
+	if err != nil {
+		err = fmt.Errorf("failed to attach log %d: %w", logID, err)
+	}
+
+	return
+}
+
+// logChunks splits content into chunks of at most maxBytes bytes, after the last line end of each chunk if it has one, and never within a UTF-8 character
+func logChunks(content string, maxBytes int) (chunks []string) {
+	for len(content) > maxBytes {
+		end := strings.LastIndexByte(content[:maxBytes], '\n') + 1
+		if end == 0 {
+			end = maxBytes
+			for end > 1 && !utf8.RuneStart(content[end]) {
+				end--
+			}
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+
+	if content != "" {
+		chunks = append(chunks, content)
+	}
+	return
+}
+
+// adoLogBody returns the body of a request appending a chunk of log content, compressed as configured
+func adoLogBody(chunk string, compression string) (body *ADOStreamBody, err error) {
+	body = &ADOStreamBody{ContentType: "application/octet-stream", Data: []byte(chunk)}
+	if compression != ADOLogCompressionGzip {
+		return
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write(body.Data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to compress log content: %w", err)
+		return
+	}
+
+	body.ContentEncoding = "gzip"
+	body.Data = compressed.Bytes()
+	return
+}
+
+/*
+uploadStopLog uploads the description of an agent that stopped before becoming ready as a log of its check, if enabled with ADO_STOP_LOGS_ENABLED,
+with the details of its tasks if the runner can describe them.
+*/
+func uploadStopLog(ctx context.Context, payload *ADOPayload, detail *StopDetail) {
+	if !stopLogsEnabled {
+		return
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "The %s\n", detail.String())
+	if detail.AvailabilityZone != "" {
+		fmt.Fprintf(&content, "Availability zone: %s\n", detail.AvailabilityZone)
+	}
+	if detail.Subnet != "" {
+		fmt.Fprintf(&content, "Subnet: %s\n", detail.Subnet)
+	}
+
+	if detailer, ok := runner.(TaskDetailer); ok {
+		details, err := detailer.TaskDetails(ctx, detail.ID)
+		if err != nil {
+			slog.Warn("failed to describe stopped agent tasks", slog.String("jobId", payload.JobID), slog.Any("err", err))
+		} else {
+			detailBytes, _ := json.MarshalIndent(details, "", "  ")
+			fmt.Fprintf(&content, "Tasks:\n%s\n", detailBytes)
+		}
+	}
+
+	logID, err := ADOLogUpload(adoClient, adoCfg, payload, "Agent stopped before becoming ready", content.String())
+	if err != nil {
+		dependencies.Fallback(DependencyTimeline, "upload stop log", err)
+		return
+	}
+	dependencies.Recover(DependencyTimeline)
+	slog.Info("uploaded stop log", slog.String("jobId", payload.JobID), slog.Int("logId", logID))
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AgentGCConfig contains configuration values for the offline agent garbage collection
+type AgentGCConfig struct {
+	NamePrefix string        // Only agents whose name starts with this prefix are considered ephemeral, required to collect agents
+	TTL        time.Duration // How long an agent must have been offline before it is deleted
+	MaxDeletes int           // Upper bound for the number of agents deleted per run
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - AGENT_GC_NAME_PREFIX: Only agents whose name starts with this prefix are considered ephemeral,
+    required by the agentgc command, so persistent agents and agents of other controllers are never deleted
+    (default: the AGENT_NAME_PREFIX of deterministic agent names, followed by '-', if set)
+  - AGENT_GC_TTL_HOURS: How long an agent must have been offline before it is deleted (default: 24)
+  - AGENT_GC_MAX_DELETES: Upper bound for the number of agents deleted per run (default: 500)
+*/
+func (config *AgentGCConfig) ReadFromEnv() {
+	defaultPrefix := ""
+	if agentNamePrefix != "" {
+		defaultPrefix = agentNamePrefix + "-"
+	}
+	config.NamePrefix = ReadEnvVarWithDefault("AGENT_GC_NAME_PREFIX", defaultPrefix)
+
+	ttlStr := ReadEnvVarWithDefault("AGENT_GC_TTL_HOURS", "24")
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil {
+		slog.Error("failed to parse AGENT_GC_TTL_HOURS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.TTL = time.Duration(ttl) * time.Hour
+
+	maxDeletesStr := ReadEnvVarWithDefault("AGENT_GC_MAX_DELETES", "500")
+	maxDeletes, err := strconv.Atoi(maxDeletesStr)
+	if err != nil {
+		slog.Error("failed to parse AGENT_GC_MAX_DELETES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxDeletes = maxDeletes
+}
+
+// Collectable reports whether an agent is ephemeral, by its name prefix, and has been offline since before the cutoff
+func (config *AgentGCConfig) Collectable(agent *ADOAgent, cutoff time.Time) bool {
+	return config.NamePrefix != "" && agent.Status == "offline" && strings.HasPrefix(agent.Name, config.NamePrefix) && agent.StatusSince().Before(cutoff)
+}
+
+/*
+handleAgentGC lists the agents of the configured ADO agent pool
+and deletes ephemeral agents offline for longer than AGENT_GC_TTL_HOURS, see AgentGCConfig.Collectable,
+as well as the offline ephemeral targets of the deployment group, if configured.
+It is meant to run on a schedule.
+
+It requires ADO_PAT or AZURE_CLIENT_ID, ADO_POOL_ID, and AGENT_GC_NAME_PREFIX or AGENT_NAME_PREFIX.
+*/
+func handleAgentGC(ctx context.Context) error {
+	if !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return fmt.Errorf("agent garbage collection requires ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID")
+	}
+	if agentGCCfg.NamePrefix == "" {
+		return fmt.Errorf("agent garbage collection requires AGENT_GC_NAME_PREFIX or AGENT_NAME_PREFIX, so only ephemeral agents are deleted")
+	}
+
+	agents, err := ADOListAgents(adoClient, adoCfg)
+	if err != nil {
+		return fmt.Errorf("failed to list agents: %w", err)
+	}
+
+	cutoff := time.Now().Add(-agentGCCfg.TTL)
+	deleted := 0
+	for _, agent := range agents {
+		if deleted >= agentGCCfg.MaxDeletes {
+			slog.Warn("agent garbage collection reached the maximum deletes per run", slog.Int("maxDeletes", agentGCCfg.MaxDeletes))
+			break
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !agentGCCfg.Collectable(&agent, cutoff) {
+			continue
+		}
+
+		err = ADODeleteAgent(adoClient, adoCfg, agent.ID)
+		if err != nil {
+			slog.Error("failed to delete agent", slog.String("agent", agent.Name), slog.Any("err", err))
+			continue
+		}
+
+		deleted++
+	}
+
+	slog.Info("agent garbage collection", slog.Int("agents", len(agents)), slog.Int("deleted", deleted))
+
+	if deploymentGroupCfg != nil {
+		targetsDeleted, err := collectDeploymentTargets(adoClient, cutoff, agentGCCfg.MaxDeletes-deleted)
+		if err != nil {
+			return err
+		}
+		slog.Info("deployment target garbage collection", slog.Int("deploymentGroupId", deploymentGroupCfg.ID), slog.Int("deleted", targetsDeleted))
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"strings"
+)
+
+/*
+agentNamePrefix enables deterministic agent names if set with AGENT_NAME_PREFIX, e.g. 'ado', see ADOPayload.AgentName.
+
+agentNameVariable is the agent container environment variable set to the name, set with AGENT_NAME_VARIABLE (default: AZP_AGENT_NAME).
+*/
+var (
+	agentNamePrefix   = ReadEnvVarWithDefault("AGENT_NAME_PREFIX", "")
+	agentNameVariable = ReadEnvVarWithDefault("AGENT_NAME_VARIABLE", "AZP_AGENT_NAME")
+)
+
+/*
+AgentName returns the deterministic name of the agent of a job, '<AGENT_NAME_PREFIX>-<project>-<check>',
+where project is the start of the project ID and check is the start of the SHA-256 hash of the check ID,
+or an empty string if deterministic names are disabled.
+
+The same name is set in the agent container environment, tagged on the agent task with TagAgentName,
+and matched by the ADO pool queries registration waits, pool metadata and deregistration,
+so every subsystem finds the same agent. Agents started without it are matched by a name containing their task ID.
+*/
+func (payload *ADOPayload) AgentName() string {
+	if payload == nil || agentNamePrefix == "" {
+		return ""
+	}
+
+	project := strings.ToLower(strings.ReplaceAll(payload.ProjectID, "-", ""))
+	project = project[:min(len(project), 8)]
+
+	hash := sha256.Sum256([]byte(payload.CheckID()))
+	return strings.Join([]string{agentNamePrefix, project, hex.EncodeToString(hash[:])[:16]}, "-")
+}
+
+/*
+applyAgentName returns a copy of the task configuration with the agent name of the payload
+set in the agent container environment, if deterministic names are enabled.
+
+Tasks of multi-agent jobs share their container overrides, so they keep naming themselves after their task ID.
+*/
+func applyAgentName(config *ECSTaskConfig, payload *ADOPayload) *ECSTaskConfig {
+	name := payload.AgentName()
+	if name == "" || config.Count > 1 {
+		return config
+	}
+
+	result := *config
+	result.Environment = maps.Clone(config.Environment)
+	if result.Environment == nil {
+		result.Environment = map[string]string{}
+	}
+	result.Environment[agentNameVariable] = name
+	return &result
+}
+
+// agentMatches reports whether a pool agent is the agent of a task, by the deterministic name of its job if known, or by a name containing the task ID, if any
+func agentMatches(agent ADOAgent, taskARN string, name string) bool {
+	if name != "" && agent.Name == name {
+		return true
+	}
+	taskID := taskARN[strings.LastIndex(taskARN, "/")+1:]
+	return taskID != "" && strings.Contains(agent.Name, taskID)
+}
@@ -0,0 +1,306 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Prefixes of the state table keys of the availability zone health windows and subnet cool-downs
+const (
+	azHealthPrefix   = "azhealth#"
+	azCooldownPrefix = "azcooldown#"
+)
+
+// azCooldownRefresh is how long the subnet cool-downs are cached by an execution environment
+const azCooldownRefresh = time.Minute
+
+// AZHealthConfig contains configuration values for the deprioritization of availability zones with elevated provisioning failures
+type AZHealthConfig struct {
+	Enabled     bool          // Whether provisioning outcomes are tracked per availability zone
+	Window      time.Duration // The window over which failure rates are computed
+	MinSamples  int           // The minimum number of outcomes in a window before an availability zone can cool down
+	FailureRate float64       // The failure rate of a window above which an availability zone cools down
+	Cooldown    time.Duration // How long the subnets of a cooling availability zone are avoided
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - AZ_HEALTH_ENABLED: Whether provisioning outcomes are tracked per availability zone, requires the state store (default: false)
+  - AZ_HEALTH_WINDOW_MINUTES: The window over which failure rates are computed (default: 15)
+  - AZ_HEALTH_MIN_SAMPLES: The minimum number of outcomes in a window before an availability zone can cool down (default: 5)
+  - AZ_HEALTH_FAILURE_RATE: The failure rate, between 0 and 1, above which an availability zone cools down (default: 0.5)
+  - AZ_HEALTH_COOLDOWN_MINUTES: How long the subnets of a cooling availability zone are avoided (default: 30)
+*/
+func (config *AZHealthConfig) ReadFromEnv() {
+	config.Enabled = ReadEnvVarWithDefault("AZ_HEALTH_ENABLED", "false") == "true"
+
+	windowStr := ReadEnvVarWithDefault("AZ_HEALTH_WINDOW_MINUTES", "15")
+	window, err := strconv.Atoi(windowStr)
+	if err != nil || window < 1 {
+		slog.Error("failed to parse AZ_HEALTH_WINDOW_MINUTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Window = time.Duration(window) * time.Minute
+
+	samplesStr := ReadEnvVarWithDefault("AZ_HEALTH_MIN_SAMPLES", "5")
+	samples, err := strconv.Atoi(samplesStr)
+	if err != nil || samples < 1 {
+		slog.Error("failed to parse AZ_HEALTH_MIN_SAMPLES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MinSamples = samples
+
+	rateStr := ReadEnvVarWithDefault("AZ_HEALTH_FAILURE_RATE", "0.5")
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		slog.Error("failed to parse AZ_HEALTH_FAILURE_RATE", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.FailureRate = rate
+
+	cooldownStr := ReadEnvVarWithDefault("AZ_HEALTH_COOLDOWN_MINUTES", "30")
+	cooldown, err := strconv.Atoi(cooldownStr)
+	if err != nil || cooldown < 1 {
+		slog.Error("failed to parse AZ_HEALTH_COOLDOWN_MINUTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Cooldown = time.Duration(cooldown) * time.Minute
+}
+
+/*
+AZHealthTracker records the provisioning outcomes of the agent tasks per availability zone in the state store,
+agents that become ready or stop before becoming ready, and the subnets the tasks were placed in.
+
+When the failure rate of an availability zone exceeds the threshold within a window,
+its subnets cool down: they are left out of the RunTask subnets until the cool-down ends,
+as long as other subnets remain, and an 'AZ Cool-down' alert is sent.
+*/
+type AZHealthTracker struct {
+	Store  *StateStore     // The state store
+	Config *AZHealthConfig // The configuration
+
+	mu          sync.Mutex
+	cooldowns   map[string]time.Time
+	refreshedAt time.Time
+}
+
+// azHealthWindow is the state table item counting the provisioning outcomes of an availability zone in a window
+type azHealthWindow struct {
+	Successes int      `dynamodbav:"Successes"`         // The agents that became ready
+	Failures  int      `dynamodbav:"Failures"`          // The agents that stopped before becoming ready
+	Subnets   []string `dynamodbav:"Subnets,stringset"` // The subnets the tasks were placed in
+}
+
+// azCooldown is the state table item of a cooling subnet
+type azCooldown struct {
+	Key              string `dynamodbav:"JobId"`            // azCooldownPrefix followed by the subnet ID (partition key)
+	AvailabilityZone string `dynamodbav:"AvailabilityZone"` // The availability zone of the subnet
+	Until            int64  `dynamodbav:"Until"`            // Epoch seconds when the cool-down ends
+	ExpiresAt        int64  `dynamodbav:"ExpiresAt"`        // Epoch seconds after which DynamoDB TTL deletes the item
+}
+
+// taskSubnet returns the subnet of the elastic network interface of an awsvpc task, or an empty string
+func taskSubnet(task ecstypes.Task) string {
+	for _, attachment := range task.Attachments {
+		for _, detail := range attachment.Details {
+			if aws.ToString(detail.Name) == "subnetId" {
+				return aws.ToString(detail.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// Record records the provisioning outcome of an agent task, and cools its availability zone down if its failure rate is elevated
+func (t *AZHealthTracker) Record(ctx context.Context, availabilityZone string, subnet string, failed bool) {
+	if t == nil || availabilityZone == "" {
+		return
+	}
+
+	outcome, counter := "succeeded", "Successes"
+	if failed {
+		outcome, counter = "failed", "Failures"
+	}
+	EmitMetric("ProvisioningOutcomes", 1, MetricUnitCount, map[string]string{"AvailabilityZone": availabilityZone, "Outcome": outcome})
+
+	now := time.Now()
+	windowStart := now.Truncate(t.Config.Window)
+	update := "ADD " + counter + " :one SET ExpiresAt = :expires"
+	values := map[string]types.AttributeValue{
+		":one":     &types.AttributeValueMemberN{Value: "1"},
+		":expires": &types.AttributeValueMemberN{Value: fmt.Sprint(windowStart.Add(2 * t.Config.Window).Unix())},
+	}
+	if subnet != "" {
+		update = "ADD " + counter + " :one, Subnets :subnets SET ExpiresAt = :expires"
+		values[":subnets"] = &types.AttributeValueMemberSS{Value: []string{subnet}}
+	}
+
+	result, err := t.Store.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(t.Store.Config.TableName),
+		Key:                       map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: fmt.Sprintf("%s%s#%d", azHealthPrefix, availabilityZone, windowStart.Unix())}},
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "record availability zone outcome", err)
+		return
+	}
+
+	var window azHealthWindow
+	err = attributevalue.UnmarshalMap(result.Attributes, &window)
+	if err != nil {
+		slog.Error("failed to unmarshal availability zone health", slog.Any("err", err))
+		return
+	}
+
+	total := window.Successes + window.Failures
+	if !failed || total < t.Config.MinSamples || float64(window.Failures)/float64(total) < t.Config.FailureRate {
+		return
+	}
+
+	t.cooldown(ctx, availabilityZone, window)
+}
+
+// cooldown starts the cool-down of the subnets of an availability zone, and alerts once per cool-down
+func (t *AZHealthTracker) cooldown(ctx context.Context, availabilityZone string, window azHealthWindow) {
+	now := time.Now()
+	until := now.Add(t.Config.Cooldown)
+
+	started := false
+	for _, subnet := range window.Subnets {
+		item, err := attributevalue.MarshalMap(&azCooldown{
+			Key:              azCooldownPrefix + subnet,
+			AvailabilityZone: availabilityZone,
+			Until:            until.Unix(),
+			ExpiresAt:        until.Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			slog.Error("failed to marshal subnet cool-down", slog.Any("err", err))
+			return
+		}
+
+		_, err = t.Store.Client().PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(t.Store.Config.TableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(JobId) OR #until < :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#until": "Until",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			},
+		})
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			continue
+		}
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "put subnet cool-down", err)
+			return
+		}
+		started = true
+	}
+
+	if !started {
+		return
+	}
+
+	t.mu.Lock()
+	t.refreshedAt = time.Time{}
+	t.mu.Unlock()
+
+	alert := map[string]any{
+		"controller":       controllerID,
+		"availabilityZone": availabilityZone,
+		"subnets":          window.Subnets,
+		"successes":        window.Successes,
+		"failures":         window.Failures,
+		"until":            formatTimestamp(until),
+	}
+	slog.Error("availability zone cooling down after elevated provisioning failures", slog.Any("alert", alert))
+	EmitMetric("AZCooldowns", 1, MetricUnitCount, map[string]string{"AvailabilityZone": availabilityZone})
+	putAlertEvent(ctx, "AZ Cool-down", alert)
+}
+
+// Apply returns the task configuration without the cooling subnets, unless every subnet is cooling down
+func (t *AZHealthTracker) Apply(ctx context.Context, config *ECSTaskConfig) *ECSTaskConfig {
+	if t == nil || len(config.Subnets) == 0 {
+		return config
+	}
+
+	cooldowns := t.subnetCooldowns(ctx, config.Subnets)
+	now := time.Now()
+	subnets := slices.DeleteFunc(slices.Clone(config.Subnets), func(subnet string) bool {
+		return cooldowns[subnet].After(now)
+	})
+
+	if len(subnets) == len(config.Subnets) {
+		return config
+	}
+	if len(subnets) == 0 {
+		slog.Warn("every subnet is cooling down, using all of them", slog.Any("subnets", config.Subnets))
+		return config
+	}
+
+	result := *config
+	result.Subnets = subnets
+	return &result
+}
+
+// subnetCooldowns returns when the cool-downs of the subnets end, refreshed from the state store at most every azCooldownRefresh
+func (t *AZHealthTracker) subnetCooldowns(ctx context.Context, subnets []string) map[string]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.refreshedAt) < azCooldownRefresh {
+		return t.cooldowns
+	}
+
+	keys := make([]map[string]types.AttributeValue, 0, len(subnets))
+	for _, subnet := range subnets {
+		keys = append(keys, map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: azCooldownPrefix + subnet}})
+	}
+
+	result, err := t.Store.Client().BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]types.KeysAndAttributes{
+			t.Store.Config.TableName: {Keys: keys},
+		},
+	})
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "get subnet cool-downs", err)
+		return t.cooldowns
+	}
+
+	var items []azCooldown
+	err = attributevalue.UnmarshalListOfMaps(result.Responses[t.Store.Config.TableName], &items)
+	if err != nil {
+		slog.Error("failed to unmarshal subnet cool-downs", slog.Any("err", err))
+		return t.cooldowns
+	}
+
+	t.cooldowns = map[string]time.Time{}
+	for _, item := range items {
+		t.cooldowns[item.Key[len(azCooldownPrefix):]] = time.Unix(item.Until, 0)
+	}
+	t.refreshedAt = time.Now()
+	return t.cooldowns
+}
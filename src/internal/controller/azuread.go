@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+)
+
+// adoResourceScope is the scope of Azure AD tokens for the Azure DevOps REST API
+const adoResourceScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+
+// azureADTokenRefreshMargin is how long before they expire Azure AD tokens are refreshed
+const azureADTokenRefreshMargin = 5 * time.Minute
+
+/*
+AzureADConfig contains configuration values to call organization-level ADO APIs, such as agent pools,
+with Azure AD tokens of an app registration or managed identity trusting the controller through workload identity federation,
+instead of a long-lived ADO_PAT.
+
+The federated token asserting the controller's identity is read from a file, or requested from an Amazon Cognito identity pool
+with developer authenticated identities, whose OpenID tokens the federated credential of the app trusts
+(issuer https://cognito-identity.amazonaws.com, audience the identity pool ID, subject the Cognito identity ID).
+
+See:
+
+https://learn.microsoft.com/en-us/entra/workload-id/workload-identity-federation
+
+https://learn.microsoft.com/en-us/azure/devops/integrate/get-started/authentication/service-principal-managed-identity
+*/
+type AzureADConfig struct {
+	TenantID          string // The Azure AD tenant
+	ClientID          string // The client ID of the app registration or managed identity, federation is disabled if empty
+	AuthorityHost     string // The Azure AD authority host
+	TokenFile         string // The file of the federated token, if set the Cognito identity pool isn't used
+	CognitoPoolID     string // The Cognito identity pool issuing the federated token
+	CognitoProvider   string // The developer provider name of the Cognito identity pool
+	CognitoIdentifier string // The developer user identifier of the controller in the Cognito identity pool
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values, federation is disabled unless AZURE_CLIENT_ID is set:
+  - AZURE_TENANT_ID: The Azure AD tenant, required with AZURE_CLIENT_ID
+  - AZURE_CLIENT_ID: The client ID of the app registration or managed identity added to the ADO organization (optional)
+  - AZURE_AUTHORITY_HOST: The Azure AD authority host (default: https://login.microsoftonline.com)
+  - AZURE_FEDERATED_TOKEN_FILE: The file of the federated token, e.g. mounted from a secret (optional)
+  - AZURE_COGNITO_IDENTITY_POOL_ID: The Cognito identity pool issuing the federated token, required without AZURE_FEDERATED_TOKEN_FILE
+  - AZURE_COGNITO_DEVELOPER_PROVIDER: The developer provider name of the Cognito identity pool (default: ado-controller)
+  - AZURE_COGNITO_IDENTIFIER: The developer user identifier of the controller (default: AWS_LAMBDA_FUNCTION_NAME)
+*/
+func (config *AzureADConfig) ReadFromEnv() {
+	config.ClientID = ReadEnvVarWithDefault("AZURE_CLIENT_ID", "")
+	if config.ClientID == "" {
+		return
+	}
+
+	config.TenantID = ReadRequiredEnvVar("AZURE_TENANT_ID")
+	config.AuthorityHost = strings.TrimSuffix(ReadEnvVarWithDefault("AZURE_AUTHORITY_HOST", "https://login.microsoftonline.com"), "/")
+	config.TokenFile = ReadEnvVarWithDefault("AZURE_FEDERATED_TOKEN_FILE", "")
+	if config.TokenFile != "" {
+		return
+	}
+
+	config.CognitoPoolID = ReadRequiredEnvVar("AZURE_COGNITO_IDENTITY_POOL_ID")
+	config.CognitoProvider = ReadEnvVarWithDefault("AZURE_COGNITO_DEVELOPER_PROVIDER", "ado-controller")
+	config.CognitoIdentifier = ReadEnvVarWithDefault("AZURE_COGNITO_IDENTIFIER", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"))
+}
+
+// AzureADCredential acquires Azure AD tokens for the ADO API by workload identity federation, and caches them until they are about to expire
+type AzureADCredential struct {
+	Config     *AzureADConfig          // The federation configuration
+	HTTPClient *http.Client            // The client of the Azure AD token endpoint
+	Cognito    *cognitoidentity.Client // The Cognito client, used without a federated token file
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// Token returns a cached Azure AD access token for the ADO API, or exchanges a new federated token for one
+func (c *AzureADCredential) Token(ctx context.Context) (token string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expiresAt.Add(-azureADTokenRefreshMargin)) {
+		token = c.token
+		return
+	}
+
+	assertion, err := c.federatedToken(ctx)
+	if err != nil {
+		return
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {c.Config.ClientID},
+		"scope":                 {adoResourceScope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", c.Config.AuthorityHost, url.PathEscape(c.Config.TenantID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		err = fmt.Errorf("failed to create HTTP request: %w", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to execute HTTP request: %w", err)
+		return
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, adoCfg.MaxResponseBytes)).Decode(&result)
+	if err != nil {
+		err = fmt.Errorf("failed to parse Azure AD token response (status %d): %w", res.StatusCode, err)
+		return
+	}
+	if res.StatusCode != http.StatusOK || result.AccessToken == "" {
+		err = fmt.Errorf("failed to acquire Azure AD token (status %d): %s: %s", res.StatusCode, result.Error, result.ErrorDescription)
+		return
+	}
+
+	c.token = result.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	token = c.token
+	return
+}
+
+// federatedToken returns the token asserting the controller's identity, from the token file or the Cognito identity pool
+func (c *AzureADCredential) federatedToken(ctx context.Context) (token string, err error) {
+	if c.Config.TokenFile != "" {
+		data, readErr := os.ReadFile(c.Config.TokenFile)
+		if readErr != nil {
+			err = fmt.Errorf("failed to read federated token: %w", readErr)
+			return
+		}
+		token = strings.TrimSpace(string(data))
+		return
+	}
+
+	result, err := c.Cognito.GetOpenIdTokenForDeveloperIdentity(ctx, &cognitoidentity.GetOpenIdTokenForDeveloperIdentityInput{
+		IdentityPoolId: aws.String(c.Config.CognitoPoolID),
+		Logins:         map[string]string{c.Config.CognitoProvider: c.Config.CognitoIdentifier},
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to get Cognito OpenID token: %w", err)
+		return
+	}
+	token = aws.ToString(result.Token)
+	return
+}
+
+// hasADOOrgCredentials reports whether organization-level ADO APIs can be called, with ADO_PAT or an Azure AD token
+func hasADOOrgCredentials() bool {
+	return adoCfg.PAT != "" || azureAD != nil
+}
+
+/*
+adoOrgRequest sends a JSON request to an organization-level ADO API, such as agent pools,
+authenticated with ADO_PAT if set, or else with an Azure AD token, see AzureADCredential.
+*/
+func adoOrgRequest(client *http.Client, config *ADOConfig, method string, url string, body any) (data []byte, err error) {
+	if config.PAT != "" || azureAD == nil {
+		return adoRequest(client, config, config.PAT, method, url, body)
+	}
+
+	token, err := azureAD.Token(context.Background())
+	if err != nil {
+		return
+	}
+	return sendADORequest(client, config, method, url, body, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
+}
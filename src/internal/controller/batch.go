@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/batch/types"
+)
+
+// BatchJobConfig contains configuration values to trigger the AWS Batch SubmitJob API
+type BatchJobConfig struct {
+	JobQueue      string // The job queue name or ARN
+	JobDefinition string // The job definition name, name:revision or ARN. If a revision isn't specified, the latest ACTIVE revision is used
+	Attempts      int32  // The number of attempts for the job retry strategy, 0 keeps the job definition value
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - BATCH_JOB_QUEUE: The AWS Batch job queue name or ARN (required)
+  - BATCH_JOB_DEFINITION: The AWS Batch job definition (required)
+  - BATCH_JOB_ATTEMPTS: The number of attempts for the job retry strategy (default: use the job definition value)
+*/
+func (config *BatchJobConfig) ReadFromEnv() {
+	config.JobQueue = ReadRequiredEnvVar("BATCH_JOB_QUEUE")
+	config.JobDefinition = ReadRequiredEnvVar("BATCH_JOB_DEFINITION")
+
+	attemptsStr := ReadEnvVarWithDefault("BATCH_JOB_ATTEMPTS", "0")
+	attempts, err := strconv.ParseInt(attemptsStr, 10, 32)
+	if err != nil {
+		slog.Error("failed to parse BATCH_JOB_ATTEMPTS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Attempts = int32(attempts)
+}
+
+// BatchRunner is a Runner that starts agents as AWS Batch jobs
+type BatchRunner struct {
+	Client *batch.Client   // The Batch client
+	Config *BatchJobConfig // The job configuration
+}
+
+var batchJobNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// batchJobName returns a valid AWS Batch job name for an ADO check
+func batchJobName(checkID string) string {
+	name := "ado-agent-" + batchJobNameInvalidChars.ReplaceAllString(checkID, "-")
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return name
+}
+
+// Run submits a Batch job and returns its ID
+func (r *BatchRunner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	input := &batch.SubmitJobInput{
+		JobName:       aws.String(batchJobName(payload.CheckID())),
+		JobQueue:      aws.String(r.Config.JobQueue),
+		JobDefinition: aws.String(r.Config.JobDefinition),
+		PropagateTags: aws.Bool(true),
+	}
+
+	if r.Config.Attempts > 0 {
+		input.RetryStrategy = &types.RetryStrategy{
+			Attempts: aws.Int32(r.Config.Attempts),
+		}
+	}
+
+	result, err := r.Client.SubmitJob(ctx, input)
+	if err != nil {
+		return
+	}
+
+	slog.Info("submit job", slog.Any("res", result))
+
+	id = aws.ToString(result.JobId)
+	return
+}
+
+/*
+Status returns the job status normalized to the Runner statuses:
+  - SUBMITTED, PENDING, RUNNABLE and STARTING are reported as PENDING
+  - RUNNING is reported as RUNNING
+  - SUCCEEDED and FAILED are reported as STOPPED
+*/
+func (r *BatchRunner) Status(ctx context.Context, id string) (status string, err error) {
+	result, err := r.Client.DescribeJobs(ctx, &batch.DescribeJobsInput{
+		Jobs: []string{id},
+	})
+	if err != nil {
+		return
+	}
+
+	if len(result.Jobs) == 0 {
+		err = fmt.Errorf("failed to describe job %s", id)
+		return
+	}
+
+	switch result.Jobs[0].Status {
+	case types.JobStatusRunning:
+		status = TaskStatusRunning
+	case types.JobStatusSucceeded, types.JobStatusFailed:
+		status = TaskStatusStopped
+	default:
+		status = TaskStatusPending
+	}
+
+	return
+}
+
+// Stop terminates the job
+func (r *BatchRunner) Stop(ctx context.Context, id string, reason string) error {
+	_, err := r.Client.TerminateJob(ctx, &batch.TerminateJobInput{
+		JobId:  aws.String(id),
+		Reason: aws.String(reason),
+	})
+	return err
+}
@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var (
+	cfg           *aws.Config
+	taskCfg       *ECSTaskConfig
+	adoCfg        *ADOConfig
+	ecsClient     *ecs.Client
+	runner        Runner
+	reporter      Reporter
+	stateStore    *StateStore
+	taskProfiles  []TaskProfile
+	queueProfiles map[string]QueueProfile
+	hubProfiles   map[string]string
+	projectQuotas map[string]ProjectQuota
+	runBreaker    *CircuitBreaker
+	adoBreaker    *CircuitBreaker
+
+	preScaleCfg *PreScaleConfig
+	warmPoolCfg *WarmPoolConfig
+	agentGCCfg  *AgentGCConfig
+
+	imagePrewarmCfg *ImagePrewarmConfig
+)
+
+// reconcileCfg configures the reconciliation of the state store, reconcileOnStart runs it once per execution environment
+var (
+	reconcileCfg     *ReconcileConfig
+	reconcileOnStart sync.Once
+)
+
+// sqsClient changes the visibility of requeued messages and sends continuations
+var sqsClient *sqs.Client
+
+// requeueCfg configures the backoff of records that failed with a transient error
+var requeueCfg *RequeueConfig
+
+// rollbackCfg configures the automatic rollback of canary revisions
+var rollbackCfg *RollbackConfig
+
+// smokeTestCfg configures the scheduled smoke test
+var smokeTestCfg *SmokeTestConfig
+
+// costReportCfg configures the cost attribution reports
+var costReportCfg *CostReportConfig
+
+// maintenanceCfg configures how jobs are handled while pools are drained
+var maintenanceCfg *MaintenanceConfig
+
+// dedupe is nil unless duplicate messages are dropped within DEDUPE_WINDOW_SECONDS
+var dedupe *Deduplicator
+
+// continuations is nil unless waits for slow agents are persisted as delayed re-checks
+var continuations *ContinuationClient
+
+// activity is nil unless the activity timelines of jobs are exported to ACTIVITY_DELIVERY_STREAM
+var activity *ActivityExporter
+
+// latencyTracker tracks the queue to RUNNING latency of agents against the SLO
+var latencyTracker *LatencyTracker
+
+// reevaluationCfg configures how checks re-evaluated by ADO are handled
+var reevaluationCfg *ReevaluationConfig
+
+// runTaskMutators are applied to the RunTask input of every agent task
+var runTaskMutators []RunTaskMutator
+
+// faultCfg configures the fault injection of test environments
+var faultCfg *FaultConfig
+
+// clientTokenMode is how the idempotency tokens of agent launches are derived, one of the ClientTokenMode values
+var clientTokenMode string
+
+// deploymentGroupCfg configures the registration of agents as deployment group targets, nil if disabled
+var deploymentGroupCfg *DeploymentGroupConfig
+
+// accessPolicy restricts the organizations and projects served by the controller
+var accessPolicy *AccessPolicy
+
+// fairShareCfg configures the scheduling of the records of a batch across projects
+var fairShareCfg *FairShareConfig
+
+// azHealth deprioritizes the subnets of availability zones with elevated provisioning failures, nil if disabled
+var azHealth *AZHealthTracker
+
+// untaggedFallback is whether agent tasks are started untagged when tagging them is denied
+var untaggedFallback bool
+
+// cancelPollInterval is how often the job of an agent is checked for cancellation while the agent is waited for, 0 if never
+var cancelPollInterval time.Duration
+
+// debugExecCfg configures keeping agents that failed readiness running for debugging, nil if disabled
+var debugExecCfg *DebugExecConfig
+
+// githubCfg configures the GitHub Actions compatibility mode, nil if disabled
+var githubCfg *GitHubConfig
+
+// gitlabCfg configures the GitLab CI compatibility mode, nil if disabled
+var gitlabCfg *GitLabConfig
+
+// jenkinsCfg configures the Jenkins compatibility mode
+var jenkinsCfg *JenkinsConfig
+
+// githubClient is shared by GitHub API calls
+var githubClient = &http.Client{}
+
+// statusRetryPolicy retries errors reading an agent's status while waiting for it
+var statusRetryPolicy *RetryPolicy
+
+// adoRetryPolicy retries ADO requests that fail without a response or with a 5xx or 429 status code
+var adoRetryPolicy *RetryPolicy
+
+// azureAD acquires Azure AD tokens for organization-level ADO APIs, nil unless workload identity federation is configured
+var azureAD *AzureADCredential
+
+// taskMissingCfg configures the handling of agent tasks that DescribeTasks reports as MISSING
+var taskMissingCfg *TaskMissingConfig
+
+// actionSigningCfg configures the signatures of action messages, see authorizeAction
+var actionSigningCfg *ActionSigningConfig
+
+// adoClient is shared by ADO calls so connections are reused across records and invocations
+var adoClient = &http.Client{}
+
+/*
+Bootstrap loads the configuration and creates the clients used by the invocations that a role serves, see roleInvocations,
+and exits if any of them is invalid. Every entry point under cmd calls it once before starting the Lambda handler:
+  - every role sets up the logger, the AWS configuration, the KMS-encrypted environment variables and the metrics, see bootstrapCore
+  - the webhook role only creates the SQS client of the queue that webhooks are forwarded to, see bootstrapWebhook
+  - the other roles set up ADO, the runner, the task profiles and the state store, see bootstrapShared,
+    and only the features of their invocations on top, see bootstrapQueue and bootstrapJanitor
+*/
+func Bootstrap(role string) {
+	ctx := context.TODO()
+	binaryRole = role
+	awsCfg := bootstrapCore(ctx)
+
+	if binaryRole == RoleWebhook {
+		bootstrapWebhook(awsCfg)
+		return
+	}
+
+	bootstrapShared(ctx, awsCfg)
+	if checkRole(InvocationQueue) == nil {
+		bootstrapQueue()
+	}
+	if checkRole(InvocationCommand) == nil {
+		bootstrapJanitor()
+	}
+	if checkRole(InvocationAdmin) == nil {
+		adminCfg = new(AdminConfig)
+		adminCfg.ReadFromEnv()
+	}
+
+	if ReadEnvVarWithDefault("SELF_CHECK_ON_START", "false") == "true" {
+		RunSelfCheck(ctx, awsCfg)
+	}
+}
+
+// bootstrapCore sets up the logger, loads the AWS configuration, decrypts the KMS-encrypted environment variables and configures the metrics
+func bootstrapCore(ctx context.Context) aws.Config {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{ReplaceAttr: replaceLogAttr}))
+	slog.SetDefault(logger)
+
+	err := validateRole()
+	if err != nil {
+		slog.Error("invalid binary role", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	// the AWS configuration loads while the environment is scanned for KMS ciphertexts, which only wait for it to decrypt them
+	loadAWSConfig := sync.OnceValues(func() (aws.Config, error) { return config.LoadDefaultConfig(ctx) })
+	go loadAWSConfig()
+
+	err = DecryptKMSEnvVars(ctx, func() (*kms.Client, error) {
+		awsCfg, err := loadAWSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		return kms.NewFromConfig(awsCfg), nil
+	})
+	if err != nil {
+		slog.Error("unable to decrypt configuration", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	awsCfg, err := loadAWSConfig()
+	if err != nil {
+		slog.Error("unable to load AWS configuration", slog.Any("err", err))
+		os.Exit(1)
+	}
+	cfg = &awsCfg
+
+	prometheusCfg := new(PrometheusConfig)
+	prometheusCfg.ReadFromEnv()
+	emfEnabled = prometheusCfg.EMFEnabled
+	if prometheusCfg.EMFBatch {
+		metricBatch = new(MetricBatch)
+	}
+	if prometheusCfg.ListenAddress != "" {
+		prometheusMetrics, err = NewPrometheusRegistry(prometheusCfg.ListenAddress)
+		if err != nil {
+			slog.Error("unable to serve Prometheus metrics", slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	return awsCfg
+}
+
+/*
+bootstrapShared sets up what the controller, janitor and admin roles have in common:
+the ADO client and callbacks, the runner and its task profiles, the access policy, the state store and the alerts.
+*/
+func bootstrapShared(ctx context.Context, awsCfg aws.Config) {
+	adoCfg = new(ADOConfig)
+	adoCfg.ReadFromEnv()
+	adoRetryPolicy = ReadADORetryPolicyFromEnv()
+
+	azureADCfg := new(AzureADConfig)
+	azureADCfg.ReadFromEnv()
+	if azureADCfg.ClientID != "" {
+		azureAD = &AzureADCredential{Config: azureADCfg, HTTPClient: adoClient}
+		if azureADCfg.TokenFile == "" {
+			azureAD.Cognito = cognitoidentity.NewFromConfig(awsCfg)
+		}
+	}
+
+	taskMissingCfg = new(TaskMissingConfig)
+	taskMissingCfg.ReadFromEnv()
+
+	faultCfg = new(FaultConfig)
+	faultCfg.ReadFromEnv()
+	recordingCfg := new(ADORecordingConfig)
+	recordingCfg.ReadFromEnv()
+	adoClient.Transport = faultCfg.ADOTransport(recordingCfg.ADOTransport(awsCfg, http.DefaultTransport))
+	adoClient.CheckRedirect = adoCfg.CheckRedirect
+
+	stateCfg := new(StateStoreConfig)
+	stateCfg.ReadFromEnv()
+	if stateCfg.TableName != "" {
+		stateStore = &StateStore{Client: sync.OnceValue(func() *dynamodb.Client { return dynamodb.NewFromConfig(awsCfg) }), Config: stateCfg}
+	}
+
+	var err error
+	runner, err = NewRunnerFromEnv(ctx, awsCfg)
+	if err != nil {
+		slog.Error("unable to create runner", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	statusRetryPolicy = ReadStatusRetryPolicyFromEnv()
+	deploymentGroupCfg = ReadDeploymentGroupFromEnv()
+	untaggedFallback = ReadUntaggedFallbackFromEnv()
+	cancelPollInterval = ReadCancelPollIntervalFromEnv()
+	maxAgentCount = ReadMaxAgentCountFromEnv()
+	debugExecCfg = ReadDebugExecFromEnv()
+
+	accessPolicy = new(AccessPolicy)
+	accessPolicy.ReadFromEnv()
+	clientTokenMode = ReadClientTokenModeFromEnv()
+	runTaskMutators = ReadRunTaskMutatorsFromEnv()
+	taskProfiles = ReadTaskProfilesFromEnv()
+	queueProfiles = ReadQueueProfilesFromEnv(taskProfiles)
+	hubProfiles = ReadHubProfilesFromEnv(taskProfiles)
+
+	breakerCfg := new(CircuitBreakerConfig)
+	breakerCfg.ReadFromEnv()
+	runBreaker = &CircuitBreaker{Name: "RunTask", Config: breakerCfg}
+	adoBreaker = &CircuitBreaker{Name: "ADO", Config: breakerCfg}
+	reporter = NewReporterFromEnv(awsCfg)
+
+	azHealthCfg := new(AZHealthConfig)
+	azHealthCfg.ReadFromEnv()
+	if azHealthCfg.Enabled && stateStore != nil {
+		azHealth = &AZHealthTracker{Store: stateStore, Config: azHealthCfg}
+	}
+
+	rollbackCfg = new(RollbackConfig)
+	rollbackCfg.ReadFromEnv()
+
+	reconcileCfg = new(ReconcileConfig)
+	reconcileCfg.ReadFromEnv()
+
+	sqsClient = sqs.NewFromConfig(awsCfg)
+
+	continuationCfg := new(ContinuationConfig)
+	continuationCfg.ReadFromEnv()
+	if continuationCfg.QueueURL != "" && stateStore != nil {
+		continuations = &ContinuationClient{Client: sqsClient, Config: continuationCfg}
+	}
+
+	activity = NewActivityExporterFromEnv(awsCfg)
+}
+
+// bootstrapQueue sets up the features of the SQS events of ADO payloads and the ECS task state change events
+func bootstrapQueue() {
+	fairShareCfg = new(FairShareConfig)
+	fairShareCfg.ReadFromEnv()
+	projectQuotas = ReadProjectQuotasFromEnv()
+
+	githubCfg = new(GitHubConfig)
+	githubCfg.ReadFromEnv()
+	if githubCfg.Token == "" {
+		githubCfg = nil
+	}
+
+	jenkinsCfg = new(JenkinsConfig)
+	jenkinsCfg.ReadFromEnv()
+
+	gitlabCfg = new(GitLabConfig)
+	gitlabCfg.ReadFromEnv()
+	if gitlabCfg.RunnerToken == "" {
+		gitlabCfg = nil
+	}
+
+	requeueCfg = new(RequeueConfig)
+	requeueCfg.ReadFromEnv()
+
+	dedupeCfg := new(DedupeConfig)
+	dedupeCfg.ReadFromEnv()
+	if dedupeCfg.Window > 0 {
+		dedupe = &Deduplicator{Store: stateStore, Config: dedupeCfg}
+	}
+
+	maintenanceCfg = new(MaintenanceConfig)
+	maintenanceCfg.ReadFromEnv()
+
+	actionSigningCfg = new(ActionSigningConfig)
+	actionSigningCfg.ReadFromEnv()
+
+	reevaluationCfg = new(ReevaluationConfig)
+	reevaluationCfg.ReadFromEnv()
+
+	latencySLOCfg := new(LatencySLOConfig)
+	latencySLOCfg.ReadFromEnv()
+	latencyTracker = &LatencyTracker{Config: latencySLOCfg}
+}
+
+// bootstrapJanitor sets up the scheduled controller commands, see handleCommand
+func bootstrapJanitor() {
+	preScaleCfg = new(PreScaleConfig)
+	preScaleCfg.ReadFromEnv()
+
+	warmPoolCfg = new(WarmPoolConfig)
+	warmPoolCfg.ReadFromEnv()
+
+	imagePrewarmCfg = new(ImagePrewarmConfig)
+	imagePrewarmCfg.ReadFromEnv()
+
+	agentGCCfg = new(AgentGCConfig)
+	agentGCCfg.ReadFromEnv()
+
+	costReportCfg = new(CostReportConfig)
+	costReportCfg.ReadFromEnv()
+
+	smokeTestCfg = new(SmokeTestConfig)
+	smokeTestCfg.ReadFromEnv()
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a dependency is short-circuited after consecutive failures
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerConfig contains configuration values for the dependency circuit breakers
+type CircuitBreakerConfig struct {
+	Threshold int           // Number of consecutive failures that open the circuit, 0 disables the circuit breakers
+	Cooldown  time.Duration // How long the circuit stays open before a trial call is allowed
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - CIRCUIT_BREAKER_THRESHOLD: Number of consecutive failures that open the circuit, 0 disables the circuit breakers (default: 5)
+  - CIRCUIT_BREAKER_COOLDOWN_SECONDS: How long the circuit stays open before a trial call is allowed (default: 60)
+*/
+func (config *CircuitBreakerConfig) ReadFromEnv() {
+	thresholdStr := ReadEnvVarWithDefault("CIRCUIT_BREAKER_THRESHOLD", "5")
+	threshold, err := strconv.Atoi(thresholdStr)
+	if err != nil {
+		slog.Error("failed to parse CIRCUIT_BREAKER_THRESHOLD", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Threshold = threshold
+
+	cooldownStr := ReadEnvVarWithDefault("CIRCUIT_BREAKER_COOLDOWN_SECONDS", "60")
+	cooldown, err := strconv.Atoi(cooldownStr)
+	if err != nil {
+		slog.Error("failed to parse CIRCUIT_BREAKER_COOLDOWN_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Cooldown = time.Duration(cooldown) * time.Second
+}
+
+/*
+CircuitBreaker short-circuits calls to a dependency after consecutive failures.
+
+The breaker opens after Threshold consecutive failures and rejects calls until the cool-down
+elapses, then lets calls through again; the next failure re-opens it immediately.
+State is kept in memory, so it is shared by the invocations of one execution environment.
+*/
+type CircuitBreaker struct {
+	Name   string                // The dependency name, used in errors and metrics
+	Config *CircuitBreakerConfig // The circuit breaker configuration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+// Allow returns an error wrapping ErrCircuitOpen if the circuit is open
+func (b *CircuitBreaker) Allow() error {
+	if b == nil || b.Config.Threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.Config.Threshold {
+		remaining := b.Config.Cooldown - time.Since(b.openedAt)
+		if remaining > 0 {
+			return fmt.Errorf("%w: %s is unavailable after %d consecutive failures, retrying in %s", ErrCircuitOpen, b.Name, b.failures, formatDuration(remaining))
+		}
+	}
+
+	return nil
+}
+
+// Record records the outcome of a call, opening the circuit when the failure threshold is reached
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil || b.Config.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Config.Threshold {
+		b.openedAt = time.Now()
+		slog.Error("circuit breaker open", slog.String("dependency", b.Name), slog.Int("failures", b.failures))
+		EmitMetric("CircuitBreakerOpen", 1, MetricUnitCount, map[string]string{"Dependency": b.Name})
+	}
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"context"
+	"time"
+)
+
+// batchCallbackReserve is the invocation time kept for sending the callbacks of a batch after its wait loops
+const batchCallbackReserve = 10 * time.Second
+
+/*
+waitBudget returns the share of the remaining invocation time of the records left in a batch that the next record may wait,
+or 0 if the invocation has no deadline.
+
+Records that finish early leave their unused share to the records after them,
+so the last records of a batch aren't starved by the first ones.
+*/
+func waitBudget(ctx context.Context, remaining int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining < 1 {
+		return 0
+	}
+
+	budget := (time.Until(deadline) - batchCallbackReserve) / time.Duration(remaining)
+	return max(budget, time.Second)
+}
+
+// shorterWait returns the shorter of two wait limits, where 0 means unlimited
+func shorterWait(a time.Duration, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
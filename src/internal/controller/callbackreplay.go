@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// failedCallbackPrefix prefixes the state table keys of failed callbacks
+const failedCallbackPrefix = "callback#"
+
+// FailedCallback is the intent of a TaskCompleted callback that failed during an ADO outage, kept until it is replayed
+type FailedCallback struct {
+	Key       string            `dynamodbav:"JobId"`              // The state table key, failedCallbackPrefix followed by the check ID (partition key)
+	Payload   *ADOPayload       `dynamodbav:"Payload"`            // The ADO payload
+	Result    string            `dynamodbav:"Result"`             // The outcome to report
+	Metadata  map[string]string `dynamodbav:"Metadata,omitempty"` // Metadata of the agent, set as variables of the check's timeline record
+	Attempts  int               `dynamodbav:"Attempts"`           // The number of times the callback was sent
+	LastError string            `dynamodbav:"LastError"`          // The error of the last attempt
+	CreatedAt time.Time         `dynamodbav:"CreatedAt"`          // When the callback first failed
+	ExpiresAt int64             `dynamodbav:"ExpiresAt"`          // Epoch seconds after which DynamoDB TTL deletes the callback
+}
+
+// PutFailedCallback writes the intent of a failed callback, replacing the previous one of the same check
+func (s *StateStore) PutFailedCallback(ctx context.Context, callback *FailedCallback) error {
+	now := time.Now().UTC()
+	if callback.CreatedAt.IsZero() {
+		callback.CreatedAt = now
+	}
+	callback.ExpiresAt = now.Add(s.Config.TTL).Unix()
+
+	item, err := attributevalue.MarshalMap(callback)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failed callback: %w", err)
+	}
+
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put failed callback: %w", err)
+	}
+
+	return nil
+}
+
+// ListFailedCallbacks returns the intents of the failed callbacks waiting to be replayed
+func (s *StateStore) ListFailedCallbacks(ctx context.Context) (callbacks []*FailedCallback, err error) {
+	paginator := dynamodb.NewScanPaginator(s.Client(), &dynamodb.ScanInput{
+		TableName:        aws.String(s.Config.TableName),
+		FilterExpression: aws.String("begins_with(JobId, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: failedCallbackPrefix},
+		},
+	})
+
+	for paginator.HasMorePages() {
+		page, pageErr := paginator.NextPage(ctx)
+		if pageErr != nil {
+			err = fmt.Errorf("failed to scan failed callbacks: %w", pageErr)
+			return
+		}
+
+		var pageCallbacks []*FailedCallback
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageCallbacks)
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal failed callbacks: %w", err)
+			return
+		}
+		callbacks = append(callbacks, pageCallbacks...)
+	}
+
+	return
+}
+
+// DeleteFailedCallback deletes the intent of a failed callback
+func (s *StateStore) DeleteFailedCallback(ctx context.Context, key string) error {
+	_, err := s.Client().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Key:       map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: key}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete failed callback: %w", err)
+	}
+
+	return nil
+}
+
+/*
+isADOOutage reports whether a callback failed because ADO is unavailable, rather than rejecting the callback:
+the ADO circuit breaker is open, the request failed without a response,
+or ADO responded with a 5xx or 429 status code.
+*/
+func isADOOutage(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+
+	var adoErr *ADOError
+	if !errors.As(err, &adoErr) {
+		return true
+	}
+	return adoErr.StatusCode >= 500 || adoErr.StatusCode == http.StatusTooManyRequests
+}
+
+/*
+persistFailedCallback saves the intent of a callback that failed during an ADO outage, for handleReplayCallbacks,
+and reports whether it was saved, in which case its record needs no redelivery.
+*/
+func persistFailedCallback(ctx context.Context, callback *pendingCallback, callbackErr error) bool {
+	if stateStore == nil || !isADOOutage(callbackErr) {
+		return false
+	}
+
+	err := stateStore.PutFailedCallback(ctx, &FailedCallback{
+		Key:       failedCallbackPrefix + callback.Payload.CheckID(),
+		Payload:   callback.Payload,
+		Result:    callback.Result,
+		Metadata:  callback.Metadata,
+		Attempts:  1,
+		LastError: callbackErr.Error(),
+	})
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "persist failed callback", err)
+		return false
+	}
+
+	slog.Warn("persisted failed ADO callback for replay", slog.String("jobId", callback.Payload.JobID), slog.String("result", callback.Result))
+	EmitMetric("PersistedCallbacks", 1, MetricUnitCount, nil)
+	return true
+}
+
+/*
+handleReplayCallbacks sends the callbacks persisted during an ADO outage, run on a schedule
+with the 'replaycallbacks' command:
+  - callbacks that are sent, or rejected by ADO, e.g. because the pipeline was cancelled, are deleted
+  - callbacks that fail again during the outage are kept, with their attempts and last error,
+    until they are replayed or expire with the state store TTL
+*/
+func handleReplayCallbacks(ctx context.Context) error {
+	if stateStore == nil {
+		return fmt.Errorf("replaying callbacks requires the state store")
+	}
+
+	callbacks, err := stateStore.ListFailedCallbacks(ctx)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, callback := range callbacks {
+		logger := slog.With(slog.String("jobId", callback.Payload.JobID), slog.String("result", callback.Result), slog.Int("attempts", callback.Attempts))
+
+		outcome := "sent"
+		callbackErr := reporter.Report(ctx, callback.Payload, callback.Result, callback.Metadata)
+		switch {
+		case callbackErr == nil:
+			logger.Info("replayed ADO callback")
+		case isADOOutage(callbackErr):
+			outcome = "failed"
+			logger.Warn("failed to replay ADO callback", slog.Any("err", callbackErr))
+			callback.Attempts++
+			callback.LastError = callbackErr.Error()
+			err = stateStore.PutFailedCallback(ctx, callback)
+			if err != nil {
+				return err
+			}
+		default:
+			outcome = "dropped"
+			logger.Error("dropped ADO callback rejected on replay", slog.Any("err", callbackErr))
+		}
+		counts[outcome]++
+
+		if outcome != "failed" {
+			err = stateStore.DeleteFailedCallback(ctx, callback.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for outcome, count := range counts {
+		EmitMetric("ReplayedCallbacks", float64(count), MetricUnitCount, map[string]string{"Outcome": outcome})
+	}
+	slog.Info("replayed ADO callbacks", slog.Int("callbacks", len(callbacks)), slog.Int("sent", counts["sent"]))
+	return nil
+}
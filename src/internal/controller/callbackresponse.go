@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Kinds of soft failures of the TaskCompleted callback
+const (
+	CallbackSoftFailurePlanNotFound = "PlanNotFound" // The plan of the check no longer exists
+	CallbackSoftFailureCompleted    = "Completed"    // The check or job was already completed
+	CallbackSoftFailureOther        = "Other"        // Any other error reported in the response body
+)
+
+// ADOCallbackRejectedError is a soft failure of the TaskCompleted callback, an error reported with a successful status code
+type ADOCallbackRejectedError struct {
+	Kind    string // The kind of soft failure, one of the CallbackSoftFailure values
+	TypeKey string // The error type reported by ADO, if any
+	Message string // The error message reported by ADO
+}
+
+func (e *ADOCallbackRejectedError) Error() string {
+	return fmt.Sprintf("callback rejected: %s: %s", e.Kind, e.Message)
+}
+
+/*
+validateCallbackResponse returns an *ADOCallbackRejectedError if the response body of a TaskCompleted callback,
+sent with a successful status code, reports an error, e.g. a plan that no longer exists or a job that already completed.
+
+Empty and non-JSON bodies, and JSON bodies without a message or typeKey, are successes.
+*/
+func validateCallbackResponse(data []byte) error {
+	var body struct {
+		Message string `json:"message"`
+		TypeKey string `json:"typeKey"`
+	}
+	if json.Unmarshal(data, &body) != nil || (body.Message == "" && body.TypeKey == "") {
+		return nil
+	}
+
+	text := strings.ToLower(body.TypeKey + " " + body.Message)
+	kind := CallbackSoftFailureOther
+	switch {
+	case strings.Contains(text, "notfound") || strings.Contains(text, "not found"):
+		kind = CallbackSoftFailurePlanNotFound
+	case strings.Contains(text, "completed"):
+		kind = CallbackSoftFailureCompleted
+	}
+
+	return &ADOCallbackRejectedError{Kind: kind, TypeKey: body.TypeKey, Message: body.Message}
+}
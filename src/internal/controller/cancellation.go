@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrJobCanceled is returned when the job of an agent that is waited for was canceled or abandoned in ADO
+var ErrJobCanceled = errors.New("job canceled")
+
+// adoCanceledResults are the timeline record results of canceled jobs and checks
+var adoCanceledResults = []string{"canceled", "abandoned"}
+
+// ReadCancelPollIntervalFromEnv reads ADO_CANCEL_POLL_SECONDS, how often the job of an agent is checked for cancellation while the agent is waited for, 0 disables it (default: 15)
+func ReadCancelPollIntervalFromEnv() time.Duration {
+	intervalStr := ReadEnvVarWithDefault("ADO_CANCEL_POLL_SECONDS", "15")
+	interval, err := strconv.Atoi(intervalStr)
+	if err != nil || interval < 0 {
+		slog.Error("failed to parse ADO_CANCEL_POLL_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return time.Duration(interval) * time.Second
+}
+
+/*
+ADOJobCanceled reports whether the job or the check of a payload was canceled or abandoned,
+from the records of the plan's timeline, using the payload's own job access token.
+This detects cancellations without the service hook integration, see handleStopMessage.
+*/
+func ADOJobCanceled(client *http.Client, config *ADOConfig, payload *ADOPayload) (bool, error) {
+	url := payload.ADOTimelineRecordsURL(config.Instance, config.APIVersion)
+
+	data, err := adoRequest(client, config, payload.AuthToken, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to get timeline records: %w", err)
+	}
+
+	var result struct {
+		Value []struct {
+			ID     string `json:"id"`
+			Result string `json:"result"`
+		} `json:"value"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse timeline records: %w", err)
+	}
+
+	for _, record := range result.Value {
+		if !strings.EqualFold(record.ID, payload.JobID) && !strings.EqualFold(record.ID, payload.TaskInstanceID) {
+			continue
+		}
+		if slices.Contains(adoCanceledResults, strings.ToLower(record.Result)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// cancellationPoller checks the job of a payload for cancellation at most every ADO_CANCEL_POLL_SECONDS
+type cancellationPoller struct {
+	payload  *ADOPayload
+	polledAt time.Time
+}
+
+// Canceled reports whether the job was canceled, errors are logged and treated as not canceled
+func (p *cancellationPoller) Canceled() bool {
+	if p == nil || p.payload == nil || cancelPollInterval == 0 || time.Since(p.polledAt) < cancelPollInterval {
+		return false
+	}
+	p.polledAt = time.Now()
+
+	canceled, err := ADOJobCanceled(adoClient, adoCfg, p.payload)
+	if err != nil {
+		slog.Warn("failed to check job for cancellation", slog.String("jobId", p.payload.JobID), slog.Any("err", err))
+		return false
+	}
+	return canceled
+}
+
+// stopCanceledAgent stops the agent of a canceled job and marks the job as failed, no callback is sent since ADO rejects it
+func stopCanceledAgent(ctx context.Context, checkID string, taskARN string) {
+	slog.Warn("job canceled while waiting for its agent, stopping it", slog.String("jobId", checkID), slog.String("taskArn", taskARN))
+	EmitMetric("CanceledJobs", 1, MetricUnitCount, map[string]string{"Source": "TimelinePoll"})
+
+	err := runner.Stop(ctx, taskARN, "Job canceled in Azure DevOps")
+	if err != nil {
+		slog.Error("failed to stop agent of canceled job", slog.String("jobId", checkID), slog.Any("err", err))
+	}
+
+	if stateStore == nil {
+		return
+	}
+
+	err = stateStore.UpdateStatus(ctx, checkID, JobStatusFailed)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "update job status", err)
+	}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// User-facing categories of failures, included in the messages of failed checks
+const (
+	FailureCategoryCapacity = "capacity" // Not enough capacity to start the agent, retrying later may succeed
+	FailureCategoryImage    = "image"    // The agent image couldn't be pulled or exited, the image needs fixing
+	FailureCategoryNetwork  = "network"  // The agent couldn't reach its dependencies, such as the registry or secrets
+	FailureCategoryAuth     = "auth"     // The controller or the agent isn't allowed to do something
+	FailureCategoryTimeout  = "timeout"  // The agent wasn't ready in time
+	FailureCategoryInternal = "internal" // Any other failure, the platform team needs to look into it
+)
+
+// failureCategoryHints tell pipeline owners what to do about the failures of each category
+var failureCategoryHints = map[string]string{
+	FailureCategoryCapacity: "Retrying the job later may succeed.",
+	FailureCategoryImage:    "Check the agent image of the pool.",
+	FailureCategoryNetwork:  "Retrying the job may succeed, contact the platform team if it persists.",
+	FailureCategoryAuth:     "Contact the platform team to grant the missing permissions.",
+	FailureCategoryTimeout:  "Retrying the job may succeed, contact the platform team if it persists.",
+	FailureCategoryInternal: "Contact the platform team.",
+}
+
+// categorizeError returns the user-facing category of an error that prevented an agent from starting
+func categorizeError(err error) string {
+	var failure *RunTaskFailureError
+	switch {
+	case errors.As(err, &failure) && failure.Kind == ErrMissingResource:
+		return FailureCategoryInternal
+	case errors.Is(err, ErrInsufficientResources), errors.Is(err, ErrCapacityUnavailable), errors.Is(err, ErrAgentUnavailable),
+		errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrProjectQuotaExceeded), errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrLaunchesDisabled):
+		return FailureCategoryCapacity
+	case errors.Is(err, ErrPayloadNotAllowed), isTagPermissionError(err), strings.Contains(err.Error(), "AccessDenied"):
+		return FailureCategoryAuth
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errAgentPending):
+		return FailureCategoryTimeout
+	default:
+		return FailureCategoryInternal
+	}
+}
+
+/*
+Category returns the user-facing category of an agent that stopped before becoming ready:
+image pull failures and exited agent containers are image failures,
+resource initialization failures, e.g. unreachable secrets or log groups, are network failures,
+and Spot interruptions are capacity failures.
+*/
+func (detail *StopDetail) Category() string {
+	switch {
+	case strings.Contains(detail.Reason, "CannotPullContainerError"), strings.Contains(detail.Reason, "CannotStartContainerError"), detail.StopCode == "EssentialContainerExited":
+		return FailureCategoryImage
+	case strings.Contains(detail.Reason, "ResourceInitializationError"):
+		return FailureCategoryNetwork
+	case detail.StopCode == "SpotInterruption", strings.Contains(detail.Reason, "capacity"):
+		return FailureCategoryCapacity
+	default:
+		return FailureCategoryInternal
+	}
+}
+
+// categorizedMessage returns the message of a failed check with its category and what to do about it, and emits the FailuresByCategory metric
+func categorizedMessage(category string, message string) string {
+	invocationSummary.Failure(category)
+	EmitMetric("FailuresByCategory", 1, MetricUnitCount, map[string]string{"Category": category})
+	return fmt.Sprintf("[%s] %s. %s", category, strings.TrimSuffix(message, "."), failureCategoryHints[category])
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+/*
+Modes of deriving the idempotency tokens of agent launches, sent as the RunTask client token
+or the idempotency token of the other backends.
+
+Tokens are never derived from the AuthToken: ADO may re-issue it for the same job,
+which would defeat the idempotency of the launch.
+*/
+const (
+	ClientTokenModeJob     = "job"     // Derived from the job and task instance IDs, so every delivery of a check starts the same agents
+	ClientTokenModePayload = "payload" // Derived from a hash of the whole payload but its AuthToken, so only redeliveries of an identical payload are idempotent
+	ClientTokenModeRandom  = "random"  // Random for every delivery, so launches are never deduplicated by the backend
+)
+
+// ReadClientTokenModeFromEnv reads CLIENT_TOKEN_MODE, how idempotency tokens are derived: job, payload or random (default: job)
+func ReadClientTokenModeFromEnv() string {
+	mode := ReadEnvVarWithDefault("CLIENT_TOKEN_MODE", ClientTokenModeJob)
+	if mode != ClientTokenModeJob && mode != ClientTokenModePayload && mode != ClientTokenModeRandom {
+		slog.Error(fmt.Sprintf("failed to parse CLIENT_TOKEN_MODE: unsupported mode %s", mode))
+		os.Exit(1)
+	}
+	return mode
+}
+
+/*
+ClientToken returns the idempotency token of the given attempt at starting the agents of the check, starting at 1,
+derived as configured by CLIENT_TOKEN_MODE.
+Replacements of an attempt, e.g. after a Spot interruption, get a new token.
+*/
+func (payload *ADOPayload) ClientToken(attempt int) string {
+	var input string
+	switch clientTokenMode {
+	case ClientTokenModeRandom:
+		return GenerateClientToken(rand.Text())
+	case ClientTokenModePayload:
+		hashed := *payload
+		hashed.AuthToken = ""
+		data, err := json.Marshal(&hashed)
+		if err != nil {
+			slog.Warn("failed to hash payload, deriving the client token from the job", slog.String("jobId", payload.JobID), slog.Any("err", err))
+			input = payload.JobID + "#" + payload.TaskInstanceID
+			break
+		}
+		input = string(data)
+	default:
+		input = payload.JobID + "#" + payload.TaskInstanceID
+	}
+
+	if attempt > 1 {
+		input = fmt.Sprintf("%s#%d", input, attempt)
+	}
+	return GenerateClientToken(input)
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild/types"
+)
+
+// codeBuildPhases lists the CodeBuild build phases in execution order
+var codeBuildPhases = []types.BuildPhaseType{
+	types.BuildPhaseTypeSubmitted,
+	types.BuildPhaseTypeQueued,
+	types.BuildPhaseTypeProvisioning,
+	types.BuildPhaseTypeDownloadSource,
+	types.BuildPhaseTypeInstall,
+	types.BuildPhaseTypePreBuild,
+	types.BuildPhaseTypeBuild,
+	types.BuildPhaseTypePostBuild,
+	types.BuildPhaseTypeUploadArtifacts,
+	types.BuildPhaseTypeFinalizing,
+	types.BuildPhaseTypeCompleted,
+}
+
+// CodeBuildConfig contains configuration values to trigger the AWS CodeBuild StartBuild API
+type CodeBuildConfig struct {
+	ProjectName string               // The CodeBuild project name
+	ReadyPhase  types.BuildPhaseType // The first build phase in which the agent is considered running
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - CODEBUILD_PROJECT: The AWS CodeBuild project name (required)
+  - CODEBUILD_READY_PHASE: The first build phase in which the agent is considered running (default: INSTALL)
+*/
+func (config *CodeBuildConfig) ReadFromEnv() {
+	config.ProjectName = ReadRequiredEnvVar("CODEBUILD_PROJECT")
+	config.ReadyPhase = types.BuildPhaseType(ReadEnvVarWithDefault("CODEBUILD_READY_PHASE", string(types.BuildPhaseTypeInstall)))
+
+	if !slices.Contains(codeBuildPhases, config.ReadyPhase) {
+		slog.Error(fmt.Sprintf("invalid CODEBUILD_READY_PHASE %s", config.ReadyPhase))
+		os.Exit(1)
+	}
+}
+
+// CodeBuildRunner is a Runner that starts agents as AWS CodeBuild builds
+type CodeBuildRunner struct {
+	Client *codebuild.Client // The CodeBuild client
+	Config *CodeBuildConfig  // The build configuration
+}
+
+// Run starts a build and returns its ID
+func (r *CodeBuildRunner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	result, err := r.Client.StartBuild(ctx, &codebuild.StartBuildInput{
+		ProjectName:      aws.String(r.Config.ProjectName),
+		IdempotencyToken: aws.String(payload.ClientToken(1)),
+	})
+	if err != nil {
+		return
+	}
+
+	slog.Info("start build", slog.Any("res", result))
+
+	id = aws.ToString(result.Build.Id)
+	return
+}
+
+/*
+Status returns the build status normalized to the Runner statuses:
+  - a build that is no longer IN_PROGRESS is reported as STOPPED
+  - a build in the configured ready phase or any later phase is reported as RUNNING
+  - a build in an earlier phase is reported as PENDING
+*/
+func (r *CodeBuildRunner) Status(ctx context.Context, id string) (status string, err error) {
+	result, err := r.Client.BatchGetBuilds(ctx, &codebuild.BatchGetBuildsInput{
+		Ids: []string{id},
+	})
+	if err != nil {
+		return
+	}
+
+	if len(result.Builds) == 0 {
+		err = fmt.Errorf("failed to describe build %s", id)
+		return
+	}
+
+	build := result.Builds[0]
+	if build.BuildStatus != types.StatusTypeInProgress {
+		status = TaskStatusStopped
+		return
+	}
+
+	phase := types.BuildPhaseType(aws.ToString(build.CurrentPhase))
+	if slices.Index(codeBuildPhases, phase) >= slices.Index(codeBuildPhases, r.Config.ReadyPhase) {
+		status = TaskStatusRunning
+	} else {
+		status = TaskStatusPending
+	}
+
+	return
+}
+
+// Stop stops the build
+func (r *CodeBuildRunner) Stop(ctx context.Context, id string, reason string) error {
+	_, err := r.Client.StopBuild(ctx, &codebuild.StopBuildInput{
+		Id: aws.String(id),
+	})
+	return err
+}
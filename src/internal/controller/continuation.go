@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// errAgentPending is returned when an agent isn't ready by the end of the inline wait or of the record's wait budget
+var errAgentPending = errors.New("agent is still pending")
+
+// ContinuationConfig contains configuration values for delayed re-checks of agents that are slow to start
+type ContinuationConfig struct {
+	QueueURL     string        // The SQS queue URL that delayed re-checks are sent to, continuations are disabled if empty
+	InlineWait   time.Duration // How long an invocation waits for an agent before scheduling a re-check
+	DelaySeconds int32         // The delay of each re-check
+	MaxRechecks  int           // The number of re-checks after which a still pending agent is reported as failed
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - CONTINUATION_QUEUE_URL: The SQS queue URL that delayed re-checks are sent to, usually the controller's own queue, continuations are disabled if unset
+  - CONTINUATION_INLINE_WAIT_SECONDS: How long an invocation waits for an agent before scheduling a re-check, at least 1 (default: 60)
+  - CONTINUATION_DELAY_SECONDS: The delay of each re-check, at most 900 (default: 60)
+  - CONTINUATION_MAX_RECHECKS: The number of re-checks after which a still pending agent is reported as failed, at least 0 (default: 30)
+
+Continuations also require the state store.
+*/
+func (config *ContinuationConfig) ReadFromEnv() {
+	config.QueueURL = ReadEnvVarWithDefault("CONTINUATION_QUEUE_URL", "")
+
+	inlineWaitStr := ReadEnvVarWithDefault("CONTINUATION_INLINE_WAIT_SECONDS", "60")
+	inlineWait, err := strconv.Atoi(inlineWaitStr)
+	if err != nil || inlineWait < 1 {
+		slog.Error("failed to parse CONTINUATION_INLINE_WAIT_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.InlineWait = time.Duration(inlineWait) * time.Second
+
+	delayStr := ReadEnvVarWithDefault("CONTINUATION_DELAY_SECONDS", "60")
+	delay, err := strconv.ParseInt(delayStr, 10, 32)
+	if err != nil || delay < 0 || delay > 900 {
+		slog.Error("failed to parse CONTINUATION_DELAY_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.DelaySeconds = int32(delay)
+
+	maxRechecksStr := ReadEnvVarWithDefault("CONTINUATION_MAX_RECHECKS", "30")
+	maxRechecks, err := strconv.Atoi(maxRechecksStr)
+	if err != nil || maxRechecks < 0 {
+		slog.Error("failed to parse CONTINUATION_MAX_RECHECKS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxRechecks = maxRechecks
+}
+
+/*
+ContinuationMessage is the SQS message body of a delayed re-check of a started agent,
+the job's payload and task are read from the state store.
+*/
+type ContinuationMessage struct {
+	JobID    string `json:"JobId"`    // The check ID of the job
+	Rechecks int    `json:"Rechecks"` // The number of re-checks already done
+}
+
+// continuationEnvelope distinguishes continuation messages from ADO payloads in the queue
+type continuationEnvelope struct {
+	Continuation *ContinuationMessage `json:"Continuation"`
+}
+
+/*
+ContinuationClient persists waits for agents that are slow to start, such as agents with large images,
+as delayed SQS messages, instead of keeping the invocation open until the agent is ready.
+*/
+type ContinuationClient struct {
+	Client *sqs.Client         // The SQS client
+	Config *ContinuationConfig // The continuation configuration
+}
+
+// sendContinuation schedules a delayed re-check of a started agent
+func (client *ContinuationClient) sendContinuation(ctx context.Context, message *ContinuationMessage) error {
+	body, err := json.Marshal(&continuationEnvelope{Continuation: message})
+	if err != nil {
+		return fmt.Errorf("failed to marshal continuation: %w", err)
+	}
+
+	_, err = client.Client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(client.Config.QueueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: client.Config.DelaySeconds,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send continuation: %w", err)
+	}
+
+	slog.Info("scheduled agent re-check", slog.String("jobId", message.JobID), slog.Int("rechecks", message.Rechecks))
+	return nil
+}
+
+/*
+handleContinuation re-checks the agent of a job whose wait was persisted,
+and returns the job record and outcome to report, or a nil record if there is nothing to report,
+e.g. because another re-check was scheduled.
+*/
+func handleContinuation(ctx context.Context, message *ContinuationMessage, budget time.Duration) (record *JobRecord, outcome string, err error) {
+	logger := slog.With(slog.String("jobId", message.JobID))
+
+	record, err = stateStore.Get(ctx, message.JobID)
+	if errors.Is(err, ErrJobNotFound) {
+		logger.Info("agent re-check ignored, job is not tracked")
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if record.Status != JobStatusStarted {
+		logger.Info("agent re-check ignored, job is already finished", slog.String("status", record.Status))
+		record = nil
+		return
+	}
+
+	outcome, err = waitForAgent(ctx, record.TaskARN, FindProfile(taskProfiles, record.Profile).Readiness(), shorterWait(continuations.Config.InlineWait, budget), record.Payload)
+	if errors.Is(err, ErrJobCanceled) {
+		stopCanceledAgent(ctx, record.JobID, record.TaskARN)
+		record = nil
+		err = nil
+		return
+	}
+	if errors.Is(err, ErrDeadlineExceeded) {
+		err = abandonAtDeadline(ctx, record.Payload, record.TaskARN)
+		record = nil
+		return
+	}
+	if !errors.Is(err, errAgentPending) {
+		return
+	}
+
+	if message.Rechecks >= continuations.Config.MaxRechecks {
+		logger.Warn("agent still pending after the last re-check")
+		outcome = "failed"
+		err = nil
+		return
+	}
+
+	err = continuations.sendContinuation(ctx, &ContinuationMessage{JobID: message.JobID, Rechecks: message.Rechecks + 1})
+	record = nil
+	return
+}
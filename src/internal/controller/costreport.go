@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CostReportConfig contains configuration values for cost attribution reports
+type CostReportConfig struct {
+	Period time.Duration // The period covered by each report, ending when the report runs
+	Bucket string        // The S3 bucket that reports are written to, reports are only emitted as metrics if empty
+	Prefix string        // The S3 key prefix of the reports
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - COST_REPORT_PERIOD_HOURS: The period covered by each report, ending when the report runs (default: 24)
+  - COST_REPORT_BUCKET: The S3 bucket that reports are written to as JSON, reports are only emitted as metrics if unset
+  - COST_REPORT_PREFIX: The S3 key prefix of the reports (default: cost-reports/)
+*/
+func (config *CostReportConfig) ReadFromEnv() {
+	periodStr := ReadEnvVarWithDefault("COST_REPORT_PERIOD_HOURS", "24")
+	period, err := strconv.Atoi(periodStr)
+	if err != nil || period < 1 {
+		slog.Error("failed to parse COST_REPORT_PERIOD_HOURS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Period = time.Duration(period) * time.Hour
+	config.Bucket = ReadEnvVarWithDefault("COST_REPORT_BUCKET", "")
+	config.Prefix = ReadEnvVarWithDefault("COST_REPORT_PREFIX", "cost-reports/")
+}
+
+// ProjectUsage is the compute used by the agents of an ADO project
+type ProjectUsage struct {
+	ProjectID     string  `json:"projectId"`     // The ADO project ID
+	Jobs          int     `json:"jobs"`          // The number of jobs
+	Tasks         int     `json:"tasks"`         // The number of stopped agent tasks
+	VCPUHours     float64 `json:"vcpuHours"`     // The Fargate vCPU-hours
+	MemoryGBHours float64 `json:"memoryGbHours"` // The Fargate memory GB-hours
+}
+
+// CostReport is the per-project usage of the agent platform over a period
+type CostReport struct {
+	From     time.Time      `json:"from"`     // The start of the period
+	To       time.Time      `json:"to"`       // The end of the period
+	Projects []ProjectUsage `json:"projects"` // The usage of each project
+}
+
+// mebibytesToGB converts an ECS memory string in MiB, e.g. "2048", to GB
+func mebibytesToGB(mebibytes string) float64 {
+	value, err := strconv.ParseFloat(mebibytes, 64)
+	if err != nil {
+		return 0
+	}
+	return value / 1024
+}
+
+/*
+handleCostReport aggregates the usage recorded in the state store from the start and stop timestamps
+and sizes of stopped agent tasks, per ADO project, for chargeback of the shared agent platform.
+
+The report is emitted as the ProjectTasks, ProjectVCPUHours and ProjectMemoryGBHours metrics,
+and written to S3 if COST_REPORT_BUCKET is set.
+Jobs are attributed to the period in which their last task stopped.
+*/
+func handleCostReport(ctx context.Context) error {
+	if stateStore == nil {
+		return fmt.Errorf("cost reports require the state store")
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-costReportCfg.Period)
+
+	records, err := stateStore.ListStoppedSince(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	usage := map[string]*ProjectUsage{}
+	for _, record := range records {
+		if record.Payload == nil {
+			continue
+		}
+
+		projectID := record.Payload.ProjectID
+		if usage[projectID] == nil {
+			usage[projectID] = &ProjectUsage{ProjectID: projectID}
+		}
+		usage[projectID].Jobs++
+		usage[projectID].Tasks += record.UsageTasks
+		usage[projectID].VCPUHours += record.VCPUHours
+		usage[projectID].MemoryGBHours += record.MemoryGBHours
+	}
+
+	report := &CostReport{From: from, To: to, Projects: []ProjectUsage{}}
+	for _, projectID := range slices.Sorted(maps.Keys(usage)) {
+		project := usage[projectID]
+		report.Projects = append(report.Projects, *project)
+
+		dimensions := map[string]string{"ProjectId": projectID}
+		EmitMetric("ProjectTasks", float64(project.Tasks), MetricUnitCount, dimensions)
+		EmitMetric("ProjectVCPUHours", project.VCPUHours, MetricUnitNone, dimensions)
+		EmitMetric("ProjectMemoryGBHours", project.MemoryGBHours, MetricUnitNone, dimensions)
+	}
+
+	slog.Info("cost report", slog.Time("from", from), slog.Time("to", to), slog.Int("projects", len(report.Projects)))
+
+	if costReportCfg.Bucket == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cost report: %w", err)
+	}
+
+	key := fmt.Sprintf("%s%s.json", costReportCfg.Prefix, to.Format("2006-01-02T15-04-05Z"))
+	_, err = s3.NewFromConfig(*cfg).PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(costReportCfg.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write cost report: %w", err)
+	}
+
+	slog.Info("cost report written", slog.String("bucket", costReportCfg.Bucket), slog.String("key", key))
+	return nil
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronFieldBounds lists the minimum and maximum values of the cron fields: minute, hour, day of month, month, day of week
+var cronFieldBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+/*
+CronSchedule is a parsed 5-field cron expression: minute, hour, day of month, month and day of week.
+
+Each field supports '*', single values, ranges ('a-b'), steps over wildcards or ranges ('a-b/n')
+and comma-separated lists.
+Day of week uses 0-6 starting on Sunday, 7 is accepted as Sunday.
+As in standard cron, when both day of month and day of week are restricted, a time matches if either matches.
+*/
+type CronSchedule struct {
+	expr          string
+	fields        [5]map[int]bool
+	domRestricted bool
+	dowRestricted bool
+}
+
+// ParseCron parses a 5-field cron expression
+func ParseCron(expr string) (*CronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+	}
+
+	schedule := &CronSchedule{expr: expr}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronFieldBounds[i][0], cronFieldBounds[i][1], i == 4)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		schedule.fields[i] = values
+	}
+
+	schedule.domRestricted = parts[2] != "*"
+	schedule.dowRestricted = parts[4] != "*"
+
+	return schedule, nil
+}
+
+// parseCronField returns the set of values matched by a single cron field
+func parseCronField(field string, lo int, hi int, dow bool) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, item := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", item)
+			}
+		}
+
+		start, end := lo, hi
+		if rangePart != "*" {
+			startStr, endStr, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			start, err = strconv.Atoi(startStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", item)
+			}
+
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endStr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value %q", item)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+
+		upper := hi
+		if dow {
+			upper = 7
+		}
+		if start < lo || end > upper || start > end {
+			return nil, fmt.Errorf("value out of range %q", item)
+		}
+
+		for v := start; v <= end; v += step {
+			if dow {
+				values[v%7] = true
+			} else {
+				values[v] = true
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// Matches reports whether the minute of t matches the schedule
+func (s *CronSchedule) Matches(t time.Time) bool {
+	if !s.fields[0][t.Minute()] || !s.fields[1][t.Hour()] || !s.fields[3][int(t.Month())] {
+		return false
+	}
+
+	dom := s.fields[2][t.Day()]
+	dow := s.fields[4][int(t.Weekday())]
+
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+// String returns the cron expression
+func (s *CronSchedule) String() string {
+	return s.expr
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned when the agent of a job isn't ready by the Deadline of its payload
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+// DeadlineExceeded reports whether the payload sets a Deadline that passed, it's false for a nil payload
+func (payload *ADOPayload) DeadlineExceeded() bool {
+	return payload != nil && !payload.Deadline.IsZero() && time.Now().After(payload.Deadline)
+}
+
+// deadlineMessage returns the message of the check of a payload whose deadline passed
+func deadlineMessage(payload *ADOPayload) string {
+	return categorizedMessage(FailureCategoryTimeout, fmt.Sprintf("The deadline of the check, %s, was exceeded before the agent was ready", formatTimestamp(payload.Deadline)))
+}
+
+/*
+abandonAtDeadline stops the agent of a job whose payload Deadline passed while it was provisioning,
+marks the job as failed and reports its check as failed with a 'deadline exceeded' message,
+so the controller gives up when the ADO check times out.
+*/
+func abandonAtDeadline(ctx context.Context, payload *ADOPayload, taskARN string) error {
+	slog.Warn("deadline exceeded while waiting for the agent, stopping it", slog.String("jobId", payload.CheckID()), slog.String("taskArn", taskARN), slog.Time("deadline", payload.Deadline))
+	EmitMetric("DeadlineExceeded", 1, MetricUnitCount, map[string]string{"Stage": "Provisioning"})
+
+	err := runner.Stop(ctx, taskARN, "Deadline exceeded")
+	if err != nil {
+		slog.Error("failed to stop agent at its deadline", slog.String("jobId", payload.CheckID()), slog.Any("err", err))
+	}
+
+	if stateStore != nil {
+		err = stateStore.UpdateStatus(ctx, payload.CheckID(), JobStatusFailed)
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "update job status", err)
+		}
+	}
+
+	return failCheck(ctx, payload, deadlineMessage(payload))
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	tagtypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+)
+
+// TagDebugUntil is the key of the tag of agent tasks kept for debugging, whose value is the epoch second of the end of their debug window
+const TagDebugUntil = "ado:debug-until"
+
+// DebugExecConfig contains configuration values for keeping agents that failed readiness running, to debug them with ECS Exec
+type DebugExecConfig struct {
+	Window    time.Duration // How long failed agents are kept running
+	Container string        // The container of the ECS Exec session
+	Shell     string        // The command of the ECS Exec session
+}
+
+/*
+ReadDebugExecFromEnv reads the following optional environment variables
+and returns the configuration, or nil if debugging is disabled:
+  - DEBUG_EXEC_ENABLED: Whether agents that failed readiness but are still running are kept for debugging (default: false)
+  - DEBUG_EXEC_WINDOW_MINUTES: How long failed agents are kept running before the 'debugreap' command stops them (default: 30)
+  - DEBUG_EXEC_CONTAINER: The container of the ECS Exec session (default: ECS_AGENT_CONTAINER)
+  - DEBUG_EXEC_SHELL: The command of the ECS Exec session (default: /bin/sh)
+*/
+func ReadDebugExecFromEnv() *DebugExecConfig {
+	if ReadEnvVarWithDefault("DEBUG_EXEC_ENABLED", "false") != "true" {
+		return nil
+	}
+
+	windowStr := ReadEnvVarWithDefault("DEBUG_EXEC_WINDOW_MINUTES", "30")
+	window, err := strconv.Atoi(windowStr)
+	if err != nil || window < 1 {
+		slog.Error("failed to parse DEBUG_EXEC_WINDOW_MINUTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	return &DebugExecConfig{
+		Window:    time.Duration(window) * time.Minute,
+		Container: ReadEnvVarWithDefault("DEBUG_EXEC_CONTAINER", ReadEnvVarWithDefault("ECS_AGENT_CONTAINER", "agent")),
+		Shell:     ReadEnvVarWithDefault("DEBUG_EXEC_SHELL", "/bin/sh"),
+	}
+}
+
+/*
+debugFailedAgent keeps the tasks of an agent that failed readiness running for debugging, if debugging is enabled with the ecs backend:
+the tasks that are still running are tagged with the end of their debug window, see handleDebugReap,
+and the 'aws ecs execute-command' invocation opening a session in them is logged and added to the check's timeline.
+
+Tasks started without execute-command enabled, e.g. by a RUN_TASK_MUTATORS override, can't be debugged and are stopped,
+since ECS can't enable it on running tasks.
+*/
+func debugFailedAgent(ctx context.Context, payload *ADOPayload, id string) {
+	ecsRunner, ok := runner.(*ECSRunner)
+	if debugExecCfg == nil || !ok {
+		return
+	}
+
+	until := time.Now().Add(debugExecCfg.Window).UTC()
+	for _, taskARN := range strings.Split(id, ",") {
+		logger := slog.With(slog.String("jobId", payload.JobID), slog.String("taskArn", taskARN))
+
+		task, err := DescribeTask(ctx, ecsRunner.Client, &ECSTaskReadConfig{Cluster: ecsRunner.Config.Cluster, TaskARN: taskARN})
+		if err != nil {
+			logger.Error("failed to describe failed agent for debugging", slog.Any("err", err))
+			continue
+		}
+		if aws.ToString(task.LastStatus) == TaskStatusStopped {
+			continue
+		}
+
+		message := fmt.Sprintf("The agent task %s failed readiness and can't be debugged: execute-command isn't enabled. The task was stopped.", taskARN)
+		if task.EnableExecuteCommand {
+			_, err = ecsRunner.Client.TagResource(ctx, &ecs.TagResourceInput{
+				ResourceArn: aws.String(taskARN),
+				Tags:        ecsTags(map[string]string{TagDebugUntil: strconv.FormatInt(until.Unix(), 10)}),
+			})
+			if err != nil {
+				logger.Error("failed to tag failed agent for debugging", slog.Any("err", err))
+				continue
+			}
+
+			command := fmt.Sprintf("aws ecs execute-command --region %s --cluster %s --task %s --container %s --interactive --command %q",
+				cfg.Region, taskCluster(taskARN, ecsRunner.Config.Cluster), taskARN, debugExecCfg.Container, debugExecCfg.Shell)
+			message = fmt.Sprintf("The agent task %s failed readiness and is kept running for debugging until %s: %s", taskARN, formatTimestamp(until), command)
+			logger.Warn("failed agent kept for debugging", slog.Time("until", until), slog.String("command", command))
+			EmitMetric("DebugSessions", 1, MetricUnitCount, nil)
+		} else {
+			logger.Warn("failed agent can't be debugged without execute-command")
+			err = ecsRunner.Stop(ctx, taskARN, "Failed readiness without execute-command")
+			if err != nil {
+				logger.Error("failed to stop agent", slog.Any("err", err))
+			}
+		}
+
+		err = ADOTimelineFeed(adoClient, adoCfg, payload, message)
+		if err != nil {
+			dependencies.Fallback(DependencyTimeline, "post timeline note", err)
+			continue
+		}
+		dependencies.Recover(DependencyTimeline)
+	}
+}
+
+/*
+handleDebugReap stops the agent tasks kept for debugging whose debug window ended, see debugFailedAgent,
+run on a schedule with the 'debugreap' command. It requires the ecs backend.
+*/
+func handleDebugReap(ctx context.Context) error {
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		return fmt.Errorf("reaping debugged agents requires the ecs backend")
+	}
+
+	running, err := ecsRunner.RunningTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	resources := resourcegroupstaggingapi.NewGetResourcesPaginator(ecsRunner.Tagging, &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: []string{"ecs:task"},
+		TagFilters:          []tagtypes.TagFilter{{Key: aws.String(TagDebugUntil)}},
+	})
+
+	reaped := 0
+	for resources.HasMorePages() {
+		page, pageErr := resources.NextPage(ctx)
+		if pageErr != nil {
+			return fmt.Errorf("failed to get tagged resources: %w", pageErr)
+		}
+
+		for _, resource := range page.ResourceTagMappingList {
+			taskARN := aws.ToString(resource.ResourceARN)
+			if !running[taskARN] {
+				continue
+			}
+
+			for _, tag := range resource.Tags {
+				until, parseErr := strconv.ParseInt(aws.ToString(tag.Value), 10, 64)
+				if aws.ToString(tag.Key) != TagDebugUntil || parseErr != nil || time.Now().Unix() < until {
+					continue
+				}
+
+				err = ecsRunner.Stop(ctx, taskARN, "Debug window ended")
+				if err != nil {
+					slog.Error("failed to stop debugged agent", slog.String("taskArn", taskARN), slog.Any("err", err))
+					continue
+				}
+				slog.Info("stopped debugged agent", slog.String("taskArn", taskARN))
+				reaped++
+			}
+		}
+	}
+
+	EmitMetric("ReapedDebugSessions", float64(reaped), MetricUnitCount, nil)
+	return nil
+}
@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Outcomes of claiming the check of a message, see Deduplicator.Claim
+const (
+	DedupeClaimed   = "claimed"   // The check was claimed by the invocation
+	DedupeInFlight  = "inflight"  // The check is claimed by another invocation that is still handling it
+	DedupeCompleted = "completed" // An agent was launched for the check within the window, the message is a duplicate
+)
+
+// ErrDedupeInFlight is returned for messages whose check is claimed by another invocation, so they are redelivered later
+var ErrDedupeInFlight = errors.New("check claimed by another invocation")
+
+// DedupeConfig contains configuration values for the deduplication of queue messages
+type DedupeConfig struct {
+	Window    time.Duration // How long the messages of a check are dropped after an agent was launched for it, 0 disables deduplication
+	Lease     time.Duration // How long the claim of a check being handled blocks the other deliveries of its messages
+	CacheSize int           // The maximum number of claims kept in memory by an execution environment
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - DEDUPE_WINDOW_SECONDS: How long the messages of a check are dropped after an agent was launched for it, 0 disables deduplication (default: 60)
+  - DEDUPE_LEASE_SECONDS: How long the claim of a check being handled blocks the other deliveries of its messages,
+    at least the function timeout, so the claims of invocations that crashed expire (default: 900)
+  - DEDUPE_CACHE_SIZE: The maximum number of claims kept in memory, the least recently used are evicted first (default: 4096)
+*/
+func (config *DedupeConfig) ReadFromEnv() {
+	windowStr := ReadEnvVarWithDefault("DEDUPE_WINDOW_SECONDS", "60")
+	window, err := strconv.Atoi(windowStr)
+	if err != nil || window < 0 {
+		slog.Error("failed to parse DEDUPE_WINDOW_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Window = time.Duration(window) * time.Second
+
+	leaseStr := ReadEnvVarWithDefault("DEDUPE_LEASE_SECONDS", "900")
+	lease, err := strconv.Atoi(leaseStr)
+	if err != nil || lease < 1 {
+		slog.Error("failed to parse DEDUPE_LEASE_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Lease = time.Duration(lease) * time.Second
+
+	sizeStr := ReadEnvVarWithDefault("DEDUPE_CACHE_SIZE", "4096")
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 1 {
+		slog.Error("failed to parse DEDUPE_CACHE_SIZE", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.CacheSize = size
+}
+
+/*
+Deduplicator drops the queue messages of checks for which an agent was already launched within the window,
+whatever their message ID, since ADO and SQS may both deliver the same check more than once.
+
+A check is claimed while its message is handled, and the claim is completed once its agent is launched, see Complete:
+only completed claims drop messages, while the messages of checks still claimed by another invocation are redelivered later,
+so that a check is never dropped because an invocation that failed before launching its agent had claimed it.
+
+Claims are kept in a bounded in-memory LRU cache, so duplicates within a batch or a warm environment
+are dropped without a state store call, and in the state store, if enabled,
+so they are shared across concurrently running Lambda instances.
+*/
+type Deduplicator struct {
+	Store  *StateStore   // The state store sharing claims across instances, nil for in-memory claims only
+	Config *DedupeConfig // The deduplication configuration
+
+	mu     sync.Mutex
+	claims map[string]*list.Element
+	lru    *list.List
+}
+
+// dedupeClaim is an in-memory claim of the LRU cache of a Deduplicator
+type dedupeClaim struct {
+	key       string
+	state     string
+	expiresAt time.Time
+}
+
+// dedupeKey returns the claim key of the check of a message
+func dedupeKey(checkID string) string {
+	return "dedupe#check#" + checkID
+}
+
+/*
+Claim claims the check of a message unless it is already claimed, and returns DedupeClaimed,
+or DedupeCompleted if an agent was launched for it within the window, or DedupeInFlight if another invocation is handling it.
+Claims expire after the lease unless they are completed, or released if the message fails, see Release.
+*/
+func (d *Deduplicator) Claim(ctx context.Context, key string) (outcome string, err error) {
+	now := time.Now()
+
+	outcome = d.remember(key, DedupeClaimed, now, d.Config.Lease, false)
+	if outcome != DedupeClaimed || d.Store == nil {
+		return
+	}
+
+	outcome, err = d.Store.claimKey(ctx, key, now, d.Config.Lease)
+	if outcome != DedupeClaimed || err != nil {
+		d.forget(key)
+	}
+	if err != nil {
+		outcome = DedupeClaimed
+	}
+	return
+}
+
+// Complete completes the claim of a check whose agent was launched, so its other messages are dropped within the window
+func (d *Deduplicator) Complete(ctx context.Context, key string) {
+	now := time.Now()
+	d.remember(key, DedupeCompleted, now, d.Config.Window, true)
+
+	if d.Store == nil {
+		return
+	}
+
+	err := d.Store.completeKey(ctx, key, now, d.Config.Window)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "complete dedupe claim", err)
+	}
+}
+
+// Release releases the claim of a check whose message failed, so that its redeliveries are processed
+func (d *Deduplicator) Release(ctx context.Context, key string) {
+	d.forget(key)
+
+	if d.Store == nil {
+		return
+	}
+
+	err := d.Store.releaseKey(ctx, key)
+	if err != nil {
+		slog.Error("failed to release dedupe claim", slog.String("key", key), slog.Any("err", err))
+	}
+}
+
+/*
+remember keeps the in-memory claim of a key in the given state until the given duration from now,
+and returns DedupeClaimed, or the outcome of an unexpired claim of the key unless the claim is overwritten.
+*/
+func (d *Deduplicator) remember(key string, state string, now time.Time, duration time.Duration, overwrite bool) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.claims == nil {
+		d.claims = map[string]*list.Element{}
+		d.lru = list.New()
+	}
+
+	if element, claimed := d.claims[key]; claimed {
+		claim := element.Value.(*dedupeClaim)
+		if !overwrite && now.Before(claim.expiresAt) {
+			d.lru.MoveToFront(element)
+			if claim.state == DedupeCompleted {
+				return DedupeCompleted
+			}
+			return DedupeInFlight
+		}
+		d.lru.Remove(element)
+		delete(d.claims, key)
+	}
+
+	d.claims[key] = d.lru.PushFront(&dedupeClaim{key: key, state: state, expiresAt: now.Add(duration)})
+	for d.lru.Len() > d.Config.CacheSize {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.claims, oldest.Value.(*dedupeClaim).key)
+	}
+	return DedupeClaimed
+}
+
+// forget removes the in-memory claim of a key
+func (d *Deduplicator) forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if element, claimed := d.claims[key]; claimed {
+		d.lru.Remove(element)
+		delete(d.claims, key)
+	}
+}
+
+/*
+claimKey writes the claim item of a key in the claimed state, unless it holds an unexpired claim,
+whose state is returned instead: DedupeCompleted if the claim was completed, DedupeInFlight otherwise.
+*/
+func (s *StateStore) claimKey(ctx context.Context, key string, now time.Time, lease time.Duration) (outcome string, err error) {
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item: map[string]types.AttributeValue{
+			"JobId":     &types.AttributeValueMemberS{Value: key},
+			"State":     &types.AttributeValueMemberS{Value: DedupeClaimed},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(lease).Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(JobId) OR ExpiresAt < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		state, _ := conditionErr.Item["State"].(*types.AttributeValueMemberS)
+		if state != nil && state.Value == DedupeCompleted {
+			return DedupeCompleted, nil
+		}
+		return DedupeInFlight, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to claim dedupe key: %w", err)
+	}
+
+	return DedupeClaimed, nil
+}
+
+// completeKey writes the claim item of a key in the completed state, until the window from now
+func (s *StateStore) completeKey(ctx context.Context, key string, now time.Time, window time.Duration) error {
+	_, err := s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item: map[string]types.AttributeValue{
+			"JobId":     &types.AttributeValueMemberS{Value: key},
+			"State":     &types.AttributeValueMemberS{Value: DedupeCompleted},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(window).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete dedupe claim: %w", err)
+	}
+	return nil
+}
+
+// releaseKey deletes the claim item of a key
+func (s *StateStore) releaseKey(ctx context.Context, key string) error {
+	_, err := s.Client().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Key:       map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: key}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete dedupe claim: %w", err)
+	}
+	return nil
+}
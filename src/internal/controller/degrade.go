@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Optional dependencies that the controller degrades without, keeping the core start-and-callback path
+const (
+	DependencyStateStore = "StateStore"  // The DynamoDB state store
+	DependencyAlerts     = "Alerts"      // The EventBridge bus of alerts
+	DependencyTimeline   = "ADOTimeline" // The timeline notes and variables of the check
+	DependencyActivity   = "Activity"    // The Firehose stream of activity records
+)
+
+/*
+DependencyHealth contains the health flags of the optional dependencies.
+
+A dependency is flagged as degraded when a call to it fails, and healthy again when a call succeeds,
+so the DegradedDependency metric is emitted once per outage in a warm environment rather than on every call.
+*/
+type DependencyHealth struct {
+	mu       sync.Mutex
+	degraded map[string]bool
+}
+
+// dependencies tracks the health of the optional dependencies of the controller
+var dependencies = new(DependencyHealth)
+
+/*
+Fallback flags a dependency as degraded after a failed call,
+and logs that the controller continues without the result of the operation.
+*/
+func (h *DependencyHealth) Fallback(dependency string, operation string, err error) {
+	h.mu.Lock()
+	if h.degraded == nil {
+		h.degraded = map[string]bool{}
+	}
+	transition := !h.degraded[dependency]
+	h.degraded[dependency] = true
+	h.mu.Unlock()
+
+	slog.Warn("continuing without optional dependency", slog.String("dependency", dependency), slog.String("operation", operation), slog.Any("err", err))
+	if transition {
+		EmitMetric("DegradedDependency", 1, MetricUnitCount, map[string]string{"Dependency": dependency})
+	}
+}
+
+// Recover flags a dependency as healthy after a successful call
+func (h *DependencyHealth) Recover(dependency string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.degraded[dependency] {
+		slog.Info("optional dependency recovered", slog.String("dependency", dependency))
+		delete(h.degraded, dependency)
+	}
+}
+
+// Degraded reports whether a dependency is flagged as degraded
+func (h *DependencyHealth) Degraded(dependency string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degraded[dependency]
+}
@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DeploymentGroupConfig contains configuration values for registering the agents as targets of a deployment group,
+for Classic release pipelines, in addition to the agent pool.
+
+ADO only lets agents register themselves, so the agent image is expected to configure the agent
+as a deployment group target with the injected environment variables, see Environment.
+Offline targets are deleted by the agent garbage collection, see handleAgentGC.
+*/
+type DeploymentGroupConfig struct {
+	ID      int      // The ID of the deployment group
+	Project string   // The project of the deployment group, the project of the payload if empty
+	Tags    []string // The tags of the targets
+}
+
+/*
+ReadDeploymentGroupFromEnv reads the following optional environment variables
+and returns the deployment group configuration, or nil if agents don't register as deployment group targets:
+  - ADO_DEPLOYMENT_GROUP_ID: The ID of the deployment group the agents register in as targets (optional)
+  - ADO_DEPLOYMENT_GROUP_PROJECT: The project ID or name of the deployment group (default: the project of the payload)
+  - ADO_DEPLOYMENT_GROUP_TAGS: The comma-separated tags of the targets (optional)
+*/
+func ReadDeploymentGroupFromEnv() *DeploymentGroupConfig {
+	idStr := ReadEnvVarWithDefault("ADO_DEPLOYMENT_GROUP_ID", "")
+	if idStr == "" {
+		return nil
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		slog.Error("failed to parse ADO_DEPLOYMENT_GROUP_ID", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config := &DeploymentGroupConfig{ID: id, Project: ReadEnvVarWithDefault("ADO_DEPLOYMENT_GROUP_PROJECT", "")}
+	for _, tag := range strings.Split(ReadEnvVarWithDefault("ADO_DEPLOYMENT_GROUP_TAGS", ""), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			config.Tags = append(config.Tags, tag)
+		}
+	}
+	return config
+}
+
+/*
+Environment returns the environment variables of the agent container configuring the deployment group target
+of a payload: AZP_DEPLOYMENT_GROUP_ID, AZP_DEPLOYMENT_GROUP_PROJECT and AZP_DEPLOYMENT_GROUP_TAGS.
+*/
+func (config *DeploymentGroupConfig) Environment(payload *ADOPayload) map[string]string {
+	return map[string]string{
+		"AZP_DEPLOYMENT_GROUP_ID":      strconv.Itoa(config.ID),
+		"AZP_DEPLOYMENT_GROUP_PROJECT": config.ProjectOf(payload),
+		"AZP_DEPLOYMENT_GROUP_TAGS":    strings.Join(config.Tags, ","),
+	}
+}
+
+// ProjectOf returns the project of the deployment group of a payload
+func (config *DeploymentGroupConfig) ProjectOf(payload *ADOPayload) string {
+	if config.Project != "" || payload == nil {
+		return config.Project
+	}
+	return payload.ProjectID
+}
+
+// applyDeploymentGroup returns a copy of the task configuration with the deployment group environment of a payload, if configured
+func applyDeploymentGroup(config *ECSTaskConfig, payload *ADOPayload) *ECSTaskConfig {
+	if deploymentGroupCfg == nil {
+		return config
+	}
+
+	result := *config
+	result.Environment = maps.Clone(config.Environment)
+	if result.Environment == nil {
+		result.Environment = map[string]string{}
+	}
+	maps.Copy(result.Environment, deploymentGroupCfg.Environment(payload))
+	return &result
+}
+
+// ADODeploymentTarget contains the fields used by the controller from an Azure DevOps deployment group target
+type ADODeploymentTarget struct {
+	ID    int      `json:"id"`    // The target ID
+	Tags  []string `json:"tags"`  // The target tags
+	Agent ADOAgent `json:"agent"` // The agent of the target
+}
+
+// ADODeploymentTargetsURL generates an Azure DevOps API URL for the targets of a deployment group, or a single target if targetID is not 0
+func ADODeploymentTargetsURL(instance string, apiVersion string, project string, groupID int, targetID int) string {
+	if targetID != 0 {
+		return fmt.Sprintf("https://%s/%s/_apis/distributedtask/deploymentgroups/%d/targets/%d?api-version=%s", instance, project, groupID, targetID, apiVersion)
+	}
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/deploymentgroups/%d/targets?api-version=%s", instance, project, groupID, apiVersion)
+}
+
+/*
+ADOListDeploymentTargets returns the targets of a deployment group.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/targets/list
+*/
+func ADOListDeploymentTargets(client *http.Client, config *ADOConfig, project string, groupID int) (targets []ADODeploymentTarget, err error) {
+	url := ADODeploymentTargetsURL(config.Instance, config.APIVersion, project, groupID, 0)
+
+	data, err := adoOrgRequest(client, config, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []ADODeploymentTarget `json:"value"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		err = fmt.Errorf("failed to parse deployment targets: %w", err)
+		return
+	}
+
+	targets = result.Value
+	return
+}
+
+/*
+ADODeleteDeploymentTarget deletes a target from a deployment group.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/targets/delete
+*/
+func ADODeleteDeploymentTarget(client *http.Client, config *ADOConfig, project string, groupID int, targetID int) error {
+	url := ADODeploymentTargetsURL(config.Instance, config.APIVersion, project, groupID, targetID)
+
+	_, err := adoOrgRequest(client, config, http.MethodDelete, url, nil)
+	return err
+}
+
+// collectDeploymentTargets deletes at most maxDeletes offline ephemeral targets of the deployment group registered before the cutoff, and returns how many were deleted
+func collectDeploymentTargets(client *http.Client, cutoff time.Time, maxDeletes int) (deleted int, err error) {
+	if deploymentGroupCfg.Project == "" {
+		return 0, fmt.Errorf("deployment target garbage collection requires ADO_DEPLOYMENT_GROUP_PROJECT")
+	}
+
+	targets, err := ADOListDeploymentTargets(client, adoCfg, deploymentGroupCfg.Project, deploymentGroupCfg.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list deployment targets: %w", err)
+	}
+
+	for _, target := range targets {
+		if deleted >= maxDeletes {
+			break
+		}
+
+		agent := target.Agent
+		if !agentGCCfg.Collectable(&agent, cutoff) {
+			continue
+		}
+
+		err = ADODeleteDeploymentTarget(client, adoCfg, deploymentGroupCfg.Project, deploymentGroupCfg.ID, target.ID)
+		if err != nil {
+			slog.Error("failed to delete deployment target", slog.String("agent", agent.Name), slog.Any("err", err))
+			continue
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+/*
+pinnedRevision returns the family and revision of a task definition pinned to a revision,
+'family:revision' or the ARN of a revision, and false for a family, which runs its latest ACTIVE revision.
+*/
+func pinnedRevision(taskDefinition string) (family string, revision int, pinned bool) {
+	name := taskDefinition[strings.LastIndex(taskDefinition, "/")+1:]
+	family, revisionStr, found := strings.Cut(name, ":")
+	if !found {
+		return
+	}
+
+	revision, err := strconv.Atoi(revisionStr)
+	pinned = err == nil
+	return
+}
+
+/*
+handleDriftCheck compares the task definition revisions that ECS_TASK_DEFINITION and the task profiles are pinned to
+against the latest ACTIVE revision of their families, run on a schedule with the 'driftcheck' command,
+so operators know when the infrastructure templates registered revisions that the controller configuration doesn't run yet.
+
+Pinned revisions that are behind, or were deregistered, emit the TaskDefinitionDrift metric
+and a 'Task Definition Drift' alert event. It requires the ecs backend.
+*/
+func handleDriftCheck(ctx context.Context) error {
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		return fmt.Errorf("checking task definition drift requires the ecs backend")
+	}
+
+	taskDefinitions := map[string]string{"": ecsRunner.Config.TaskDefinition}
+	for _, profile := range taskProfiles {
+		if profile.TaskDefinition != "" {
+			taskDefinitions[profile.Name] = profile.TaskDefinition
+		}
+	}
+
+	checked, drifted := 0, 0
+	for profile, taskDefinition := range taskDefinitions {
+		family, revision, pinned := pinnedRevision(taskDefinition)
+		if !pinned {
+			continue
+		}
+		checked++
+
+		logger := slog.With(slog.String("profile", profile), slog.String("taskDefinition", taskDefinition))
+
+		current, err := ecsRunner.Client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskDefinition)})
+		if err != nil {
+			return fmt.Errorf("failed to describe task definition %s: %w", taskDefinition, err)
+		}
+		latest, err := ecsRunner.Client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(family)})
+		if err != nil {
+			return fmt.Errorf("failed to describe task definition %s: %w", family, err)
+		}
+
+		status := string(current.TaskDefinition.Status)
+		latestRevision := int(latest.TaskDefinition.Revision)
+		if latestRevision == revision && status == "ACTIVE" {
+			logger.Info("task definition revision is current")
+			continue
+		}
+
+		alert := map[string]any{
+			"profile":        profile,
+			"taskDefinition": taskDefinition,
+			"family":         family,
+			"revision":       revision,
+			"status":         status,
+			"latestRevision": latestRevision,
+		}
+		logger.Warn("task definition drift", slog.Any("alert", alert))
+		EmitMetric("TaskDefinitionDrift", float64(latestRevision-revision), MetricUnitCount, map[string]string{"Family": family})
+		putAlertEvent(ctx, "Task Definition Drift", alert)
+		drifted++
+	}
+
+	slog.Info("task definition drift checked", slog.Int("pinned", checked), slog.Int("drifted", drifted))
+	return nil
+}
@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// ec2TokenParameterTag is the instance tag naming the SSM parameter holding the job access token of its agent
+const ec2TokenParameterTag = "ado:token-parameter"
+
+// EC2InstanceConfig contains configuration values to trigger the AWS EC2 RunInstances API
+type EC2InstanceConfig struct {
+	LaunchTemplate        string             // The launch template ID (lt-...) or name
+	LaunchTemplateVersion string             // The launch template version
+	Spot                  bool               // Whether to launch spot instances instead of on-demand instances
+	UserData              *template.Template // Template for the user-data script that registers the agent
+	TokenParameterPrefix  string             // The prefix of the SSM parameters holding the job access tokens of the agents
+	TokenKMSKeyID         string             // The KMS key encrypting the SSM parameters, empty for the AWS managed key
+}
+
+// EC2UserData is the data of the user-data template: the payload without its job access token, and the SSM parameter holding it
+type EC2UserData struct {
+	*ADOPayload
+	TokenParameter string // The name of the SecureString SSM parameter holding the job access token of the agent
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - EC2_LAUNCH_TEMPLATE: The launch template ID (lt-...) or name (required)
+  - EC2_LAUNCH_TEMPLATE_VERSION: The launch template version (default: $Default)
+  - EC2_MARKET_TYPE: The instance market type, spot or on-demand (default: on-demand)
+  - EC2_USER_DATA_TEMPLATE: A Go text/template for the user-data script, executed with EC2UserData as data (required),
+    which must not include the AuthToken: user data is readable by anyone allowed to ec2:DescribeInstanceAttribute and from the instance metadata,
+    so the script reads the token from the {{.TokenParameter}} SSM parameter instead, e.g. with 'aws ssm get-parameter --with-decryption',
+    and deletes it once read
+  - EC2_TOKEN_PARAMETER_PREFIX: The prefix of the SecureString SSM parameters holding the job access tokens, followed by the check ID,
+    the instance role must be allowed to ssm:GetParameter and ssm:DeleteParameter under it (default: /ado-agent/token/)
+  - EC2_TOKEN_KMS_KEY_ID: The KMS key encrypting the SSM parameters, the instance role must be allowed to kms:Decrypt with it (default: the AWS managed key)
+*/
+func (config *EC2InstanceConfig) ReadFromEnv() {
+	config.LaunchTemplate = ReadRequiredEnvVar("EC2_LAUNCH_TEMPLATE")
+	config.LaunchTemplateVersion = ReadEnvVarWithDefault("EC2_LAUNCH_TEMPLATE_VERSION", "$Default")
+
+	marketType := ReadEnvVarWithDefault("EC2_MARKET_TYPE", "on-demand")
+	switch marketType {
+	case "spot":
+		config.Spot = true
+	case "on-demand":
+		config.Spot = false
+	default:
+		slog.Error(fmt.Sprintf("invalid EC2_MARKET_TYPE %s", marketType))
+		os.Exit(1)
+	}
+
+	userData := ReadRequiredEnvVar("EC2_USER_DATA_TEMPLATE")
+	if strings.Contains(userData, ".AuthToken") {
+		slog.Error("EC2_USER_DATA_TEMPLATE must not include the AuthToken, read it from the {{.TokenParameter}} SSM parameter")
+		os.Exit(1)
+	}
+
+	tmpl, err := template.New("user-data").Parse(userData)
+	if err != nil {
+		slog.Error("failed to parse EC2_USER_DATA_TEMPLATE", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.UserData = tmpl
+	config.TokenParameterPrefix = ReadEnvVarWithDefault("EC2_TOKEN_PARAMETER_PREFIX", "/ado-agent/token/")
+	config.TokenKMSKeyID = ReadEnvVarWithDefault("EC2_TOKEN_KMS_KEY_ID", "")
+}
+
+/*
+EC2Runner is a Runner that starts agents on dedicated AWS EC2 instances.
+
+Instances are launched with a shutdown behavior of 'terminate', so a user-data
+script that powers off the instance when the agent exits terminates it on job completion.
+
+The job access token of the agent is never part of the user data: it is written to a SecureString SSM parameter
+named after the check, tagged on the instance as ado:token-parameter, which the instance reads at boot,
+and which is deleted when the instance is stopped, if the instance didn't delete it already.
+*/
+type EC2Runner struct {
+	Client *ec2.Client        // The EC2 client
+	SSM    *ssm.Client        // The SSM client writing the job access tokens
+	Config *EC2InstanceConfig // The instance configuration
+}
+
+// Run writes the job access token to its SSM parameter, launches an instance and returns its ID
+func (r *EC2Runner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	parameter := r.Config.TokenParameterPrefix + payload.CheckID()
+	input := &ssm.PutParameterInput{
+		Name:        aws.String(parameter),
+		Value:       aws.String(payload.AuthToken),
+		Type:        ssmtypes.ParameterTypeSecureString,
+		Overwrite:   aws.Bool(true),
+		Description: aws.String("The job access token of the agent of ADO job " + payload.JobID),
+	}
+	if r.Config.TokenKMSKeyID != "" {
+		input.KeyId = aws.String(r.Config.TokenKMSKeyID)
+	}
+	_, err = r.SSM.PutParameter(ctx, input)
+	if err != nil {
+		err = fmt.Errorf("failed to write the job access token parameter: %w", err)
+		return
+	}
+
+	redacted := *payload
+	redacted.AuthToken = ""
+
+	var userData bytes.Buffer
+	err = r.Config.UserData.Execute(&userData, &EC2UserData{ADOPayload: &redacted, TokenParameter: parameter})
+	if err != nil {
+		err = fmt.Errorf("failed to render user data: %w", err)
+		return
+	}
+
+	launchTemplate := &types.LaunchTemplateSpecification{
+		Version: aws.String(r.Config.LaunchTemplateVersion),
+	}
+	if strings.HasPrefix(r.Config.LaunchTemplate, "lt-") {
+		launchTemplate.LaunchTemplateId = aws.String(r.Config.LaunchTemplate)
+	} else {
+		launchTemplate.LaunchTemplateName = aws.String(r.Config.LaunchTemplate)
+	}
+
+	runInput := &ec2.RunInstancesInput{
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		LaunchTemplate:                    launchTemplate,
+		ClientToken:                       aws.String(payload.ClientToken(1)),
+		InstanceInitiatedShutdownBehavior: types.ShutdownBehaviorTerminate,
+		UserData:                          aws.String(base64.StdEncoding.EncodeToString(userData.Bytes())),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeInstance,
+				Tags: []types.Tag{
+					{Key: aws.String("ado:job-id"), Value: aws.String(payload.JobID)},
+					{Key: aws.String("ado:plan-id"), Value: aws.String(payload.PlanID)},
+					{Key: aws.String(ec2TokenParameterTag), Value: aws.String(parameter)},
+				},
+			},
+		},
+	}
+
+	if r.Config.Spot {
+		runInput.InstanceMarketOptions = &types.InstanceMarketOptionsRequest{
+			MarketType: types.MarketTypeSpot,
+		}
+	}
+
+	result, err := r.Client.RunInstances(ctx, runInput)
+	if err != nil {
+		return
+	}
+
+	if len(result.Instances) == 0 {
+		err = fmt.Errorf("no instances launched")
+		return
+	}
+
+	id = aws.ToString(result.Instances[0].InstanceId)
+	slog.Info("run instances", slog.String("instanceId", id))
+	return
+}
+
+/*
+Status returns the instance status normalized to the Runner statuses:
+  - a running instance that passes both the system and instance status checks is reported as RUNNING
+  - a pending instance, or a running instance still initializing, is reported as PENDING
+  - a stopping, stopped, shutting-down or terminated instance is reported as STOPPED
+*/
+func (r *EC2Runner) Status(ctx context.Context, id string) (status string, err error) {
+	result, err := r.Client.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         []string{id},
+		IncludeAllInstances: aws.Bool(true),
+	})
+	if err != nil {
+		return
+	}
+
+	if len(result.InstanceStatuses) == 0 {
+		err = fmt.Errorf("failed to describe instance %s", id)
+		return
+	}
+
+	instance := result.InstanceStatuses[0]
+
+	switch instance.InstanceState.Name {
+	case types.InstanceStateNamePending:
+		status = TaskStatusPending
+	case types.InstanceStateNameRunning:
+		status = TaskStatusPending
+		if instance.SystemStatus != nil && instance.SystemStatus.Status == types.SummaryStatusOk &&
+			instance.InstanceStatus != nil && instance.InstanceStatus.Status == types.SummaryStatusOk {
+			status = TaskStatusRunning
+		}
+	default:
+		status = TaskStatusStopped
+	}
+
+	return
+}
+
+// Stop terminates the instance and deletes the SSM parameter of its job access token
+func (r *EC2Runner) Stop(ctx context.Context, id string, reason string) error {
+	_, err := r.Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{id},
+	})
+	if err != nil {
+		return err
+	}
+
+	tags, err := r.Client.DescribeTags(ctx, &ec2.DescribeTagsInput{
+		Filters: []types.Filter{
+			{Name: aws.String("resource-id"), Values: []string{id}},
+			{Name: aws.String("key"), Values: []string{ec2TokenParameterTag}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe the tags of instance %s: %w", id, err)
+	}
+
+	for _, tag := range tags.Tags {
+		_, err = r.SSM.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: tag.Value})
+		var notFound *ssmtypes.ParameterNotFound
+		if err != nil && !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to delete the job access token parameter: %w", err)
+		}
+	}
+	return nil
+}
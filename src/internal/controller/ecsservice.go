@@ -0,0 +1,540 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// serviceSyncAttempts bounds how often the desired count is set while other invocations change the counter, see syncDesiredCount
+const serviceSyncAttempts = 5
+
+// ECSServiceConfig contains configuration values to scale a long-lived AWS ECS service hosting agents
+type ECSServiceConfig struct {
+	Cluster          string // The cluster name
+	Service          string // The service name
+	BaseDesiredCount int32  // The desired count of the service without jobs
+	MaxDesiredCount  int32  // Upper bound for the service desired count
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - ECS_CLUSTER: The ECS cluster name (required)
+  - ECS_SERVICE: The ECS service name (required)
+  - ECS_SERVICE_BASE_DESIRED_COUNT: The desired count of the service without jobs, e.g. agents kept warm (default: 0)
+  - ECS_SERVICE_MAX_DESIRED_COUNT: Upper bound for the service desired count (default: 10)
+*/
+func (config *ECSServiceConfig) ReadFromEnv() {
+	config.Cluster = ReadRequiredEnvVar("ECS_CLUSTER")
+	config.Service = ReadRequiredEnvVar("ECS_SERVICE")
+
+	baseStr := ReadEnvVarWithDefault("ECS_SERVICE_BASE_DESIRED_COUNT", "0")
+	baseCount, err := strconv.ParseInt(baseStr, 10, 32)
+	if err != nil || baseCount < 0 {
+		slog.Error("failed to parse ECS_SERVICE_BASE_DESIRED_COUNT", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.BaseDesiredCount = int32(baseCount)
+
+	maxStr := ReadEnvVarWithDefault("ECS_SERVICE_MAX_DESIRED_COUNT", "10")
+	maxCount, err := strconv.ParseInt(maxStr, 10, 32)
+	if err != nil || maxCount < baseCount {
+		slog.Error("failed to parse ECS_SERVICE_MAX_DESIRED_COUNT", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxDesiredCount = int32(maxCount)
+}
+
+/*
+ECSServiceRunner is a Runner that scales a long-lived AWS ECS service hosting agents
+instead of starting standalone tasks, which requires the state store.
+
+The agents of the jobs are counted in the state store, in the 'service#<cluster>/<service>' item,
+so concurrent invocations never overwrite each other's desired count: Run and Stop update the counter conditionally,
+and the desired count of the service is set to the base desired count plus the counter, see syncDesiredCount.
+Run returns an identifier of the form '<service>#<checkId>', and counts a job at most once.
+
+The first RUNNING task of the service that no other job holds is assigned to the job by Status,
+in the 'servicetask#<taskArn>' item, so the agent of a job maps back to its task:
+the job reports the status of its task from then on, and Stop stops it before scaling in.
+The agent of a job is released, and its task unassigned, once the task stops, see releaseStoppedTask,
+or once the job failed without it, see Release, so the counter only holds the agents of jobs in flight.
+Jobs are reported as STOPPED if the service deployment circuit breaker rolls back or fails the deployment.
+*/
+type ECSServiceRunner struct {
+	Client *ecs.Client       // The ECS client
+	Store  *StateStore       // The state store counting the agents of the service
+	Config *ECSServiceConfig // The service configuration
+}
+
+// counterKey returns the state table key of the counter of the agents of the service
+func (r *ECSServiceRunner) counterKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: fmt.Sprintf("service#%s/%s", r.Config.Cluster, r.Config.Service)}}
+}
+
+// validateID returns an error unless an identifier is of an agent of the service, '<service>#<checkId>'
+func (r *ECSServiceRunner) validateID(id string) error {
+	service, checkID, found := strings.Cut(id, "#")
+	if !found || service != r.Config.Service || checkID == "" {
+		return fmt.Errorf("invalid service agent id %s", id)
+	}
+	return nil
+}
+
+// describeService returns the configured ECS service
+func (r *ECSServiceRunner) describeService(ctx context.Context) (service ecstypes.Service, err error) {
+	result, err := r.Client.DescribeServices(ctx, &ecs.DescribeServicesInput{
+		Cluster:  aws.String(r.Config.Cluster),
+		Services: []string{r.Config.Service},
+	})
+	if err != nil {
+		return
+	}
+
+	if len(result.Services) == 0 {
+		err = fmt.Errorf("failed to describe service %s", r.Config.Service)
+		return
+	}
+
+	service = result.Services[0]
+	return
+}
+
+/*
+syncDesiredCount sets the desired count of the service to the base desired count plus the counter,
+and sets it again while other invocations change the counter in between, so the last change always wins.
+*/
+func (r *ECSServiceRunner) syncDesiredCount(ctx context.Context) error {
+	count, err := r.Store.serviceCount(ctx, r.counterKey())
+	if err != nil {
+		return err
+	}
+
+	for range serviceSyncAttempts {
+		desired := r.Config.BaseDesiredCount + count
+		_, err = r.Client.UpdateService(ctx, &ecs.UpdateServiceInput{
+			Cluster:      aws.String(r.Config.Cluster),
+			Service:      aws.String(r.Config.Service),
+			DesiredCount: aws.Int32(desired),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set the desired count of service %s: %w", r.Config.Service, err)
+		}
+
+		current, err := r.Store.serviceCount(ctx, r.counterKey())
+		if err != nil {
+			return err
+		}
+		if current == count {
+			slog.Info("set service desired count", slog.String("service", r.Config.Service), slog.Int("desiredCount", int(desired)))
+			return nil
+		}
+		count = current
+	}
+
+	// the invocations still changing the counter set the desired count themselves
+	return nil
+}
+
+// Run counts the agent of the job and scales out the service
+func (r *ECSServiceRunner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	id = r.Config.Service + "#" + payload.CheckID()
+
+	err = r.Store.acquireServiceAgent(ctx, r.counterKey(), id, r.Config.MaxDesiredCount-r.Config.BaseDesiredCount)
+	if err != nil {
+		return "", err
+	}
+
+	err = r.syncDesiredCount(ctx)
+	if err != nil {
+		releaseErr := r.Store.releaseServiceAgent(ctx, r.counterKey(), id)
+		if releaseErr != nil {
+			slog.Error("failed to release service agent", slog.String("id", id), slog.Any("err", releaseErr))
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Status reports the status of the task assigned to the job, assigning it the first unassigned RUNNING task of the service
+func (r *ECSServiceRunner) Status(ctx context.Context, id string) (status string, err error) {
+	err = r.validateID(id)
+	if err != nil {
+		return
+	}
+
+	taskARN, err := r.Store.serviceAgentTask(ctx, id)
+	if err != nil {
+		return
+	}
+	if taskARN != "" {
+		return r.taskStatus(ctx, taskARN)
+	}
+
+	service, err := r.describeService(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, deployment := range service.Deployments {
+		if aws.ToString(deployment.Status) == "PRIMARY" && deployment.RolloutState == ecstypes.DeploymentRolloutStateFailed {
+			status = TaskStatusStopped
+			return
+		}
+	}
+
+	running, err := r.runningTasks(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, candidate := range running {
+		var assigned bool
+		assigned, err = r.Store.assignServiceTask(ctx, id, candidate)
+		if err != nil {
+			return
+		}
+		if assigned {
+			slog.Info("assigned service task", slog.String("id", id), slog.String("taskArn", candidate))
+			status = TaskStatusRunning
+			return
+		}
+	}
+
+	status = TaskStatusPending
+	return
+}
+
+// taskStatus returns the normalized status of a task of the service
+func (r *ECSServiceRunner) taskStatus(ctx context.Context, taskARN string) (status string, err error) {
+	lastStatus, err := GetTaskLastStatus(ctx, r.Client, &ECSTaskReadConfig{Cluster: r.Config.Cluster, TaskARN: taskARN})
+	if errors.Is(err, ErrTaskMissing) {
+		return TaskStatusStopped, nil
+	}
+	if err != nil {
+		return
+	}
+
+	switch lastStatus {
+	case TaskStatusRunning:
+		status = TaskStatusRunning
+	case TaskStatusStopped, "DEACTIVATING", "STOPPING", "DEPROVISIONING":
+		status = TaskStatusStopped
+	default:
+		status = TaskStatusPending
+	}
+	return
+}
+
+// runningTasks returns the ARNs of the RUNNING tasks of the service
+func (r *ECSServiceRunner) runningTasks(ctx context.Context) (taskARNs []string, err error) {
+	paginator := ecs.NewListTasksPaginator(r.Client, &ecs.ListTasksInput{
+		Cluster:       aws.String(r.Config.Cluster),
+		ServiceName:   aws.String(r.Config.Service),
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+	})
+
+	for paginator.HasMorePages() {
+		page, pageErr := paginator.NextPage(ctx)
+		if pageErr != nil {
+			err = fmt.Errorf("failed to list the tasks of service %s: %w", r.Config.Service, pageErr)
+			return
+		}
+		if len(page.TaskArns) == 0 {
+			continue
+		}
+
+		result, describeErr := r.Client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(r.Config.Cluster),
+			Tasks:   page.TaskArns,
+		})
+		if describeErr != nil {
+			err = fmt.Errorf("failed to describe the tasks of service %s: %w", r.Config.Service, describeErr)
+			return
+		}
+		for _, task := range result.Tasks {
+			if aws.ToString(task.LastStatus) == TaskStatusRunning {
+				taskARNs = append(taskARNs, aws.ToString(task.TaskArn))
+			}
+		}
+	}
+
+	return
+}
+
+/*
+Stop stops the task assigned to the job, if any, and scales in the service, at most once per job, see Release,
+so the service doesn't scale in by stopping the busy agent of another job.
+*/
+func (r *ECSServiceRunner) Stop(ctx context.Context, id string, reason string) error {
+	err := r.validateID(id)
+	if err != nil {
+		return err
+	}
+
+	taskARN, err := r.Store.serviceAgentTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	if taskARN != "" {
+		_, err = r.Client.StopTask(ctx, &ecs.StopTaskInput{
+			Cluster: aws.String(r.Config.Cluster),
+			Task:    aws.String(taskARN),
+			Reason:  aws.String(reason),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to stop service task %s: %w", taskARN, err)
+		}
+	}
+
+	slog.Info("scale in service", slog.String("service", r.Config.Service), slog.String("id", id), slog.String("reason", reason))
+	return r.Release(ctx, id)
+}
+
+/*
+Release removes the agent of a job from the counter, unassigns its task, and scales in the service, at most once per job.
+It doesn't stop the task: the agents of the service exit once their job is done, or keep serving the pool.
+*/
+func (r *ECSServiceRunner) Release(ctx context.Context, id string) error {
+	err := r.validateID(id)
+	if err != nil {
+		return err
+	}
+
+	taskARN, err := r.Store.serviceAgentTask(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = r.Store.unassignServiceTask(ctx, id, taskARN)
+	if err != nil {
+		return err
+	}
+
+	err = r.Store.releaseServiceAgent(ctx, r.counterKey(), id)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// the agent was already released
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("released service agent", slog.String("service", r.Config.Service), slog.String("id", id))
+	return r.syncDesiredCount(ctx)
+}
+
+// releaseStoppedTask releases the agent of the job a stopped task of the service was assigned to, if any, see Release, and returns its ID
+func (r *ECSServiceRunner) releaseStoppedTask(ctx context.Context, taskARN string) (id string, err error) {
+	id, err = r.Store.serviceTaskAgent(ctx, taskARN)
+	if err != nil || id == "" {
+		return
+	}
+
+	slog.Info("service task stopped", slog.String("taskArn", taskARN), slog.String("id", id))
+	err = r.Release(ctx, id)
+	return
+}
+
+// serviceCount returns the number of agents counted for an ECS service
+func (s *StateStore) serviceCount(ctx context.Context, key map[string]types.AttributeValue) (int32, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Config.TableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get service agent count: %w", err)
+	}
+
+	count, ok := result.Item["Running"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(count.Value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid service agent count %s: %w", count.Value, err)
+	}
+	return int32(value), nil
+}
+
+/*
+acquireServiceAgent counts the agent of a job in the counter of an ECS service, unless the counter reached the maximum.
+Agents already counted aren't counted again, so that redelivered messages don't scale out twice.
+*/
+func (s *StateStore) acquireServiceAgent(ctx context.Context, key map[string]types.AttributeValue, id string, maxCount int32) error {
+	_, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Config.TableName),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD Running :one, Agents :ids"),
+		ConditionExpression: aws.String("NOT contains(Agents, :id) AND (attribute_not_exists(Running) OR Running < :max)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":ids": &types.AttributeValueMemberSS{Value: []string{id}},
+			":id":  &types.AttributeValueMemberS{Value: id},
+			":max": &types.AttributeValueMemberN{Value: fmt.Sprint(maxCount)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		agents, _ := conditionErr.Item["Agents"].(*types.AttributeValueMemberSS)
+		if agents != nil && slices.Contains(agents.Value, id) {
+			return nil // the agent was already counted
+		}
+		return fmt.Errorf("%w: the service reached its maximum desired count", ErrCapacityUnavailable)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to count service agent: %w", err)
+	}
+
+	return nil
+}
+
+// releaseServiceAgent removes the agent of a job from the counter of an ECS service, failing with a ConditionalCheckFailedException if it isn't counted
+func (s *StateStore) releaseServiceAgent(ctx context.Context, key map[string]types.AttributeValue, id string) error {
+	_, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Config.TableName),
+		Key:                 key,
+		UpdateExpression:    aws.String("ADD Running :minus DELETE Agents :ids"),
+		ConditionExpression: aws.String("contains(Agents, :id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minus": &types.AttributeValueMemberN{Value: "-1"},
+			":ids":   &types.AttributeValueMemberSS{Value: []string{id}},
+			":id":    &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release service agent: %w", err)
+	}
+	return nil
+}
+
+// serviceAgentTask returns the ARN of the task assigned to the agent of a job, empty if none is assigned yet
+func (s *StateStore) serviceAgentTask(ctx context.Context, id string) (string, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Config.TableName),
+		Key:            map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "serviceagent#" + id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get service agent task: %w", err)
+	}
+
+	taskARN, _ := result.Item["TaskArn"].(*types.AttributeValueMemberS)
+	if taskARN == nil {
+		return "", nil
+	}
+	return taskARN.Value, nil
+}
+
+// serviceTaskAgent returns the agent of the job a task of an ECS service is assigned to, empty if it isn't assigned
+func (s *StateStore) serviceTaskAgent(ctx context.Context, taskARN string) (string, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Config.TableName),
+		Key:            map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "servicetask#" + taskARN}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get service task agent: %w", err)
+	}
+
+	agent, _ := result.Item["Agent"].(*types.AttributeValueMemberS)
+	if agent == nil {
+		return "", nil
+	}
+	return agent.Value, nil
+}
+
+/*
+unassignServiceTask deletes the assignment of the agent of a job and of its task, if any,
+so the task can serve another job as soon as its agent is free. The task is only unassigned if it is still assigned to the job.
+*/
+func (s *StateStore) unassignServiceTask(ctx context.Context, id string, taskARN string) error {
+	if taskARN != "" {
+		_, err := s.Client().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                aws.String(s.Config.TableName),
+			Key:                      map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "servicetask#" + taskARN}},
+			ConditionExpression:      aws.String("#agent = :id"),
+			ExpressionAttributeNames: map[string]string{"#agent": "Agent"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id": &types.AttributeValueMemberS{Value: id},
+			},
+		})
+		var conditionErr *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &conditionErr) {
+			return fmt.Errorf("failed to unassign service task: %w", err)
+		}
+	}
+
+	_, err := s.Client().DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Key:       map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "serviceagent#" + id}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unassign service agent: %w", err)
+	}
+	return nil
+}
+
+// assignServiceTask assigns a task of an ECS service to the agent of a job, and reports whether the task wasn't held by another job
+func (s *StateStore) assignServiceTask(ctx context.Context, id string, taskARN string) (bool, error) {
+	expires := &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Add(s.Config.TTL).Unix())}
+
+	_, err := s.Client().TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: aws.String(s.Config.TableName),
+					Item: map[string]types.AttributeValue{
+						"JobId":     &types.AttributeValueMemberS{Value: "servicetask#" + taskARN},
+						"Agent":     &types.AttributeValueMemberS{Value: id},
+						"ExpiresAt": expires,
+					},
+					ConditionExpression:      aws.String("attribute_not_exists(JobId) OR #agent = :id"),
+					ExpressionAttributeNames: map[string]string{"#agent": "Agent"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":id": &types.AttributeValueMemberS{Value: id},
+					},
+				},
+			},
+			{
+				Put: &types.Put{
+					TableName: aws.String(s.Config.TableName),
+					Item: map[string]types.AttributeValue{
+						"JobId":     &types.AttributeValueMemberS{Value: "serviceagent#" + id},
+						"TaskArn":   &types.AttributeValueMemberS{Value: taskARN},
+						"ExpiresAt": expires,
+					},
+				},
+			},
+		},
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 && aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to assign service task: %w", err)
+	}
+	return true, nil
+}
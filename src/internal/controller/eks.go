@@ -0,0 +1,286 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// EKSJobConfig contains configuration values to create Kubernetes Jobs on an AWS EKS cluster
+type EKSJobConfig struct {
+	ClusterName string         // The EKS cluster name
+	Namespace   string         // The Kubernetes namespace where jobs are created
+	JobTemplate map[string]any // The batch/v1 Job manifest used as a template for every agent
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - EKS_CLUSTER_NAME: The AWS EKS cluster name (required)
+  - K8S_NAMESPACE: The Kubernetes namespace where jobs are created (default: default)
+  - K8S_JOB_TEMPLATE: A JSON batch/v1 Job manifest used as a template for every agent (required)
+*/
+func (config *EKSJobConfig) ReadFromEnv() {
+	config.ClusterName = ReadRequiredEnvVar("EKS_CLUSTER_NAME")
+	config.Namespace = ReadEnvVarWithDefault("K8S_NAMESPACE", "default")
+
+	err := json.Unmarshal([]byte(ReadRequiredEnvVar("K8S_JOB_TEMPLATE")), &config.JobTemplate)
+	if err != nil {
+		slog.Error("failed to parse K8S_JOB_TEMPLATE", slog.Any("err", err))
+		os.Exit(1)
+	}
+}
+
+/*
+EKSRunner is a Runner that starts agents as Kubernetes Jobs on an AWS EKS cluster.
+
+The runner authenticates with EKS IAM authentication, using a presigned
+STS GetCallerIdentity request as the bearer token, and reports the status
+of the job's pod.
+
+The Kubernetes API is called over REST rather than with client-go: the runner only creates, reads and deletes Jobs and lists their pods,
+and client-go with its API machinery dependencies would add dozens of modules to the binary and to the cold start of every function.
+
+See:
+
+https://docs.aws.amazon.com/eks/latest/userguide/cluster-auth.html
+*/
+type EKSRunner struct {
+	Config     *EKSJobConfig      // The job configuration
+	Endpoint   string             // The Kubernetes API server endpoint
+	HTTPClient *http.Client       // HTTP client trusting the cluster certificate authority
+	Presign    *sts.PresignClient // STS presign client used to generate authentication tokens
+}
+
+var k8sNameInvalidChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+// k8sJobName returns a valid Kubernetes object name for an ADO check, keeping the end of IDs that are too long
+func k8sJobName(checkID string) string {
+	id := k8sNameInvalidChars.ReplaceAllString(strings.ToLower(checkID), "-")
+	if len(id) > 53 {
+		id = id[len(id)-53:]
+	}
+	return strings.TrimRight("ado-agent-"+strings.TrimLeft(id, "-"), "-")
+}
+
+// NewEKSRunner looks up the cluster endpoint and certificate authority and returns an EKSRunner
+func NewEKSRunner(ctx context.Context, cfg aws.Config, config *EKSJobConfig) (*EKSRunner, error) {
+	result, err := eks.NewFromConfig(cfg).DescribeCluster(ctx, &eks.DescribeClusterInput{
+		Name: aws.String(config.ClusterName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe EKS cluster: %w", err)
+	}
+
+	caData, err := base64.StdEncoding.DecodeString(aws.ToString(result.Cluster.CertificateAuthority.Data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode EKS cluster certificate authority: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("failed to load EKS cluster certificate authority")
+	}
+
+	return &EKSRunner{
+		Config:   config,
+		Endpoint: aws.ToString(result.Cluster.Endpoint),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		Presign: sts.NewPresignClient(sts.NewFromConfig(cfg)),
+	}, nil
+}
+
+// token generates a Kubernetes bearer token for the cluster
+func (r *EKSRunner) token(ctx context.Context) (string, error) {
+	req, err := r.Presign.PresignGetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}, func(opts *sts.PresignOptions) {
+		opts.ClientOptions = append(opts.ClientOptions, sts.WithAPIOptions(
+			smithyhttp.AddHeaderValue("x-k8s-aws-id", r.Config.ClusterName),
+			smithyhttp.AddHeaderValue("X-Amz-Expires", "60"),
+		))
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to presign EKS token: %w", err)
+	}
+
+	return "k8s-aws-v1." + base64.RawURLEncoding.EncodeToString([]byte(req.URL)), nil
+}
+
+// eksMaxResponseBytes is the maximum size of Kubernetes API response bodies read into memory
+const eksMaxResponseBytes = 1 << 20
+
+// do sends a request to the Kubernetes API server and returns the response body
+func (r *EKSRunner) do(ctx context.Context, method string, path string, body any) (data []byte, err error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		err = json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal JSON body: %w", err)
+			return
+		}
+	}
+
+	token, err := r.token(ctx)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.Endpoint+path, &reqBody)
+	if err != nil {
+		err = fmt.Errorf("failed to create HTTP request: %w", err)
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := r.HTTPClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to execute HTTP request: %w", err)
+		return
+	}
+
+	return readResponse(res, eksMaxResponseBytes)
+}
+
+// Run creates a Kubernetes Job from the configured template and returns its name, also if an earlier delivery of the check created it
+func (r *EKSRunner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	id = k8sJobName(payload.CheckID())
+
+	job := make(map[string]any, len(r.Config.JobTemplate))
+	for k, v := range r.Config.JobTemplate {
+		job[k] = v
+	}
+
+	metadata := map[string]any{}
+	if m, ok := job["metadata"].(map[string]any); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	delete(metadata, "generateName")
+	metadata["name"] = id
+	job["metadata"] = metadata
+
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs", url.PathEscape(r.Config.Namespace))
+	result, err := r.do(ctx, http.MethodPost, path, job)
+	var apiErr *ADOError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		// the job was created by an earlier delivery of the check, its name is derived from the check ID
+		slog.Info("job already exists", slog.String("job", id))
+		return id, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to create job: %w", err)
+		return
+	}
+
+	slog.Info("create job", slog.Any("res", string(result)))
+	return
+}
+
+/*
+Status returns the status of the job normalized to the Runner statuses:
+  - jobs with a true Complete or Failed condition, e.g. after exhausting their backoffLimit, are reported as STOPPED
+  - otherwise the phase of the newest pod of the job, by creation timestamp, since a job that retries has several pods:
+    Pending, or no pod scheduled yet, is reported as PENDING, Running as RUNNING, and Succeeded as STOPPED,
+    while a Failed pod is reported as PENDING until the job creates its retry or fails
+*/
+func (r *EKSRunner) Status(ctx context.Context, id string) (status string, err error) {
+	jobPath := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", url.PathEscape(r.Config.Namespace), url.PathEscape(id))
+	data, err := r.do(ctx, http.MethodGet, jobPath, nil)
+	if err != nil {
+		return
+	}
+
+	var job struct {
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		err = fmt.Errorf("failed to parse job: %w", err)
+		return
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == "Complete" || condition.Type == "Failed") && condition.Status == "True" {
+			status = TaskStatusStopped
+			return
+		}
+	}
+
+	podsPath := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", url.PathEscape(r.Config.Namespace), url.QueryEscape("job-name="+id))
+	data, err = r.do(ctx, http.MethodGet, podsPath, nil)
+	if err != nil {
+		return
+	}
+
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				CreationTimestamp time.Time `json:"creationTimestamp"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	err = json.Unmarshal(data, &pods)
+	if err != nil {
+		err = fmt.Errorf("failed to parse pod list: %w", err)
+		return
+	}
+
+	status = TaskStatusPending
+	if len(pods.Items) == 0 {
+		return
+	}
+
+	newest := pods.Items[0]
+	for _, pod := range pods.Items[1:] {
+		if pod.Metadata.CreationTimestamp.After(newest.Metadata.CreationTimestamp) {
+			newest = pod
+		}
+	}
+
+	switch newest.Status.Phase {
+	case "Running":
+		status = TaskStatusRunning
+	case "Succeeded":
+		status = TaskStatusStopped
+	}
+
+	return
+}
+
+// Stop deletes the job and its pods
+func (r *EKSRunner) Stop(ctx context.Context, id string, reason string) error {
+	path := fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s?propagationPolicy=Background", url.PathEscape(r.Config.Namespace), url.PathEscape(id))
+	_, err := r.do(ctx, http.MethodDelete, path, nil)
+	return err
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Kinds of AWS ECS RunTask failures
+var (
+	ErrInsufficientResources = errors.New("insufficient resources")
+	ErrAgentUnavailable      = errors.New("container instance agent unavailable")
+	ErrCapacityUnavailable   = errors.New("capacity unavailable")
+	ErrMissingResource       = errors.New("missing resource")
+	ErrRunTaskFailed         = errors.New("task failed to start")
+)
+
+/*
+RunTaskFailureError is a failure reported by the AWS ECS RunTask API for a task that wasn't started,
+it wraps the kind of failure derived from the reason.
+
+See:
+
+https://docs.aws.amazon.com/AmazonECS/latest/developerguide/api_failures_messages.html
+*/
+type RunTaskFailureError struct {
+	Kind   error  // The kind of failure, e.g. ErrCapacityUnavailable
+	Reason string // The failure reason, e.g. RESOURCE:MEMORY
+	Detail string // The failure detail
+	ARN    string // The ARN of the failed resource
+}
+
+func (e *RunTaskFailureError) Error() string {
+	message := fmt.Sprintf("%s: %s", e.Kind, e.Reason)
+	if e.Detail != "" {
+		message += ": " + e.Detail
+	}
+	return message
+}
+
+func (e *RunTaskFailureError) Unwrap() error {
+	return e.Kind
+}
+
+// NewRunTaskFailureError creates a RunTaskFailureError from a RunTask failure, mapping known reasons to a kind
+func NewRunTaskFailureError(failure types.Failure) *RunTaskFailureError {
+	reason := aws.ToString(failure.Reason)
+
+	var kind error
+	switch {
+	case strings.HasPrefix(reason, "RESOURCE:"):
+		kind = ErrInsufficientResources
+	case reason == "AGENT":
+		kind = ErrAgentUnavailable
+	case strings.Contains(strings.ToLower(reason), "capacity"):
+		kind = ErrCapacityUnavailable
+	case reason == "MISSING":
+		kind = ErrMissingResource
+	default:
+		kind = ErrRunTaskFailed
+	}
+
+	return &RunTaskFailureError{
+		Kind:   kind,
+		Reason: reason,
+		Detail: aws.ToString(failure.Detail),
+		ARN:    aws.ToString(failure.Arn),
+	}
+}
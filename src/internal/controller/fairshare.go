@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrFairShareDeferred is returned for records deferred because their project reached its share of the batch
+var ErrFairShareDeferred = errors.New("project reached its share of the batch")
+
+// FairShareConfig contains configuration values for scheduling the records of a batch fairly across projects
+type FairShareConfig struct {
+	MaxPerProject     int   // The maximum number of records of a project handled per batch, 0 for no limit
+	DeferDelaySeconds int32 // The delay before the redelivery of deferred records
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - FAIR_SHARE_MAX_PER_PROJECT: The maximum number of records of a project handled per batch, excess records are deferred (default: 0, no limit)
+  - FAIR_SHARE_DEFER_SECONDS: The delay before the redelivery of deferred records (default: 5)
+
+Deferred records are received again, so the maxReceiveCount of the queue's redrive policy
+must allow for them when the limit is set.
+*/
+func (config *FairShareConfig) ReadFromEnv() {
+	maxStr := ReadEnvVarWithDefault("FAIR_SHARE_MAX_PER_PROJECT", "0")
+	maxPerProject, err := strconv.Atoi(maxStr)
+	if err != nil || maxPerProject < 0 {
+		slog.Error("failed to parse FAIR_SHARE_MAX_PER_PROJECT", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxPerProject = maxPerProject
+
+	delayStr := ReadEnvVarWithDefault("FAIR_SHARE_DEFER_SECONDS", "5")
+	delay, err := strconv.ParseInt(delayStr, 10, 32)
+	if err != nil || delay < 0 || delay > sqsMaxVisibilityTimeout {
+		slog.Error("failed to parse FAIR_SHARE_DEFER_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.DeferDelaySeconds = int32(delay)
+}
+
+/*
+Schedule orders the records of a batch round-robin across their projects, instead of message order,
+so the fan-out of a project doesn't starve the jobs of other projects of the wait budget,
+and returns the records beyond the share of their project separately, to be deferred.
+
+Records without a project, such as continuations and control messages, are scheduled as a project of their own.
+*/
+func (config *FairShareConfig) Schedule(records []events.SQSMessage) (scheduled []events.SQSMessage, deferred []events.SQSMessage) {
+	var projects []string
+	byProject := map[string][]events.SQSMessage{}
+	for _, record := range records {
+		project := recordProject(record)
+		if _, seen := byProject[project]; !seen {
+			projects = append(projects, project)
+		}
+		byProject[project] = append(byProject[project], record)
+	}
+
+	for round := 0; len(scheduled)+len(deferred) < len(records); round++ {
+		for _, project := range projects {
+			if round >= len(byProject[project]) {
+				continue
+			}
+			if config.MaxPerProject > 0 && round >= config.MaxPerProject && project != "" {
+				deferred = append(deferred, byProject[project][round])
+				continue
+			}
+			scheduled = append(scheduled, byProject[project][round])
+		}
+	}
+
+	return
+}
+
+// recordProject returns the ADO project ID of the payload of a record, or an empty string if it has none
+func recordProject(record events.SQSMessage) string {
+	var payload struct {
+		ProjectID string `json:"ProjectId"`
+	}
+	if json.Unmarshal([]byte(record.Body), &payload) != nil {
+		return ""
+	}
+	return payload.ProjectID
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ErrInvalidTaskSize is returned when the CPU, memory, OS family and architecture of a task aren't a supported Fargate configuration
+var ErrInvalidTaskSize = errors.New("unsupported Fargate task size")
+
+// fargateMemoryRange is the memory supported by a Fargate CPU size, in MiB
+type fargateMemoryRange struct {
+	Min       int // The minimum memory
+	Max       int // The maximum memory
+	Increment int // The increment of the memory between the minimum and maximum
+}
+
+/*
+fargateSizes are the memory ranges supported by each Fargate CPU size, in CPU units.
+
+See:
+
+https://docs.aws.amazon.com/AmazonECS/latest/developerguide/fargate-tasks-services.html#fargate-tasks-size
+*/
+var fargateSizes = map[int]fargateMemoryRange{
+	256:   {Min: 512, Max: 2048, Increment: 512},
+	512:   {Min: 1024, Max: 4096, Increment: 1024},
+	1024:  {Min: 2048, Max: 8192, Increment: 1024},
+	2048:  {Min: 4096, Max: 16384, Increment: 1024},
+	4096:  {Min: 8192, Max: 30720, Increment: 1024},
+	8192:  {Min: 16384, Max: 61440, Increment: 4096},
+	16384: {Min: 32768, Max: 122880, Increment: 8192},
+}
+
+/*
+ValidateFargateSize returns an error wrapping ErrInvalidTaskSize, with a message pipeline users can act on,
+unless the task-level CPU and memory are a supported Fargate combination for the OS family and CPU architecture:
+  - the CPU is one of the Fargate sizes, from 0.25 to 16 vCPU
+  - the memory is within the range of the CPU size, in its increments, e.g. 0.25 vCPU supports 0.5, 1 or 2 GB
+  - Windows tasks use at least 1 vCPU and the X86_64 architecture
+
+The CPU and memory are ECS values, CPU units and MiB, e.g. 1024, or with units, e.g. '1 vCPU' and '2 GB'.
+An empty OS family or architecture is Linux on X86_64.
+*/
+func ValidateFargateSize(cpu string, memory string, family types.OSFamily, architecture types.CPUArchitecture) error {
+	cpuUnits, err := parseTaskSize(cpu, "vcpu", 1024)
+	if err != nil {
+		return fmt.Errorf("%w: invalid CPU %q", ErrInvalidTaskSize, cpu)
+	}
+	memoryMiB, err := parseTaskSize(memory, "gb", 1024)
+	if err != nil {
+		return fmt.Errorf("%w: invalid memory %q", ErrInvalidTaskSize, memory)
+	}
+
+	sizes, ok := fargateSizes[cpuUnits]
+	if !ok {
+		return fmt.Errorf("%w: %s vCPU is not a Fargate CPU size, use 0.25, 0.5, 1, 2, 4, 8 or 16 vCPU", ErrInvalidTaskSize, formatVCPU(cpuUnits))
+	}
+
+	windows := family != "" && family != types.OSFamilyLinux
+	if windows && cpuUnits < 1024 {
+		return fmt.Errorf("%w: %s tasks require at least 1 vCPU, not %s vCPU", ErrInvalidTaskSize, family, formatVCPU(cpuUnits))
+	}
+	if windows && architecture == types.CPUArchitectureArm64 {
+		return fmt.Errorf("%w: %s tasks don't support the %s architecture", ErrInvalidTaskSize, family, architecture)
+	}
+
+	switch {
+	case memoryMiB < sizes.Min:
+		return fmt.Errorf("%w: %s vCPU requires at least %s GB of memory, not %s GB", ErrInvalidTaskSize, formatVCPU(cpuUnits), formatGB(sizes.Min), formatGB(memoryMiB))
+	case memoryMiB > sizes.Max:
+		return fmt.Errorf("%w: %s vCPU cannot exceed %s GB of memory, not %s GB", ErrInvalidTaskSize, formatVCPU(cpuUnits), formatGB(sizes.Max), formatGB(memoryMiB))
+	case (memoryMiB-sizes.Min)%sizes.Increment != 0:
+		return fmt.Errorf("%w: %s vCPU requires memory in increments of %s GB, not %s GB", ErrInvalidTaskSize, formatVCPU(cpuUnits), formatGB(sizes.Increment), formatGB(memoryMiB))
+	}
+
+	return nil
+}
+
+// parseTaskSize parses an ECS CPU or memory value, in units or with the given unit suffix, e.g. '1 vCPU', which is multiplied by the factor
+func parseTaskSize(value string, unit string, factor float64) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if scaled, found := strings.CutSuffix(value, unit); found {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(scaled), 64)
+		return int(parsed * factor), err
+	}
+	return strconv.Atoi(value)
+}
+
+// formatVCPU formats CPU units as vCPU, e.g. 0.25
+func formatVCPU(units int) string {
+	return strconv.FormatFloat(float64(units)/1024, 'f', -1, 64)
+}
+
+// formatGB formats MiB as GB, e.g. 0.5
+func formatGB(mebibytes int) string {
+	return strconv.FormatFloat(float64(mebibytes)/1024, 'f', -1, 64)
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+/*
+FaultConfig contains configuration values for the injection of faults into the ECS and ADO calls of the controller,
+to validate the retries, circuit breakers and dead-letter queue end-to-end.
+
+It is for test environments only: faults are never injected unless FAULT_INJECTION is true.
+*/
+type FaultConfig struct {
+	Enabled             bool          // Whether faults are injected
+	RunTaskCapacityRate float64       // The fraction of RunTask calls that fail with a capacity failure
+	DescribeTasksRate   float64       // The fraction of DescribeTasks calls that are delayed
+	DescribeTasksDelay  time.Duration // How long delayed DescribeTasks calls are delayed
+	ADOErrorRate        float64       // The fraction of ADO requests that fail with a 500 status code
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - FAULT_INJECTION: Whether faults are injected, true or false, never enable it in production (default: false)
+  - FAULT_RUNTASK_CAPACITY_RATE: The fraction of RunTask calls that fail with a capacity failure, e.g. 0.1 (default: 0)
+  - FAULT_DESCRIBETASKS_RATE: The fraction of DescribeTasks calls that are delayed (default: 0)
+  - FAULT_DESCRIBETASKS_DELAY_SECONDS: How long delayed DescribeTasks calls are delayed (default: 5)
+  - FAULT_ADO_ERROR_RATE: The fraction of ADO requests that fail with a 500 status code (default: 0)
+*/
+func (config *FaultConfig) ReadFromEnv() {
+	config.Enabled = ReadEnvVarWithDefault("FAULT_INJECTION", "false") == "true"
+	config.RunTaskCapacityRate = readFaultRate("FAULT_RUNTASK_CAPACITY_RATE")
+	config.DescribeTasksRate = readFaultRate("FAULT_DESCRIBETASKS_RATE")
+	config.ADOErrorRate = readFaultRate("FAULT_ADO_ERROR_RATE")
+
+	delayStr := ReadEnvVarWithDefault("FAULT_DESCRIBETASKS_DELAY_SECONDS", "5")
+	delay, err := strconv.Atoi(delayStr)
+	if err != nil || delay < 0 {
+		slog.Error("failed to parse FAULT_DESCRIBETASKS_DELAY_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.DescribeTasksDelay = time.Duration(delay) * time.Second
+
+	if config.Enabled {
+		slog.Warn("fault injection is enabled", slog.Any("faults", config))
+	}
+}
+
+// readFaultRate reads a fault rate between 0 and 1 from an environment variable (default: 0)
+func readFaultRate(name string) float64 {
+	rate, err := strconv.ParseFloat(ReadEnvVarWithDefault(name, "0"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		slog.Error(fmt.Sprintf("failed to parse %s", name), slog.Any("err", err))
+		os.Exit(1)
+	}
+	return rate
+}
+
+// inject reports whether a fault with the given rate is injected into a call, emitting the InjectedFaults metric if so
+func (config *FaultConfig) inject(fault string, rate float64) bool {
+	if !config.Enabled || rand.Float64() >= rate {
+		return false
+	}
+
+	slog.Warn("injected fault", slog.String("fault", fault))
+	EmitMetric("InjectedFaults", 1, MetricUnitCount, map[string]string{"Fault": fault})
+	return true
+}
+
+// ECSOptions adds the injection of RunTask and DescribeTasks faults to the options of an ECS client
+func (config *FaultConfig) ECSOptions(o *ecs.Options) {
+	if !config.Enabled {
+		return
+	}
+
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(config.ecsFaultMiddleware(), middleware.After)
+	})
+}
+
+// ecsFaultMiddleware fails RunTask calls with a capacity failure and delays DescribeTasks calls, at the configured rates
+func (config *FaultConfig) ecsFaultMiddleware() middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("FaultInjection", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		switch in.Parameters.(type) {
+		case *ecs.RunTaskInput:
+			if config.inject("RunTaskCapacity", config.RunTaskCapacityRate) {
+				output := &ecs.RunTaskOutput{
+					Failures: []types.Failure{{
+						Reason: aws.String("Capacity is unavailable at this time. Please try again later or in a different availability zone"),
+						Detail: aws.String("injected fault"),
+					}},
+				}
+				return middleware.InitializeOutput{Result: output}, middleware.Metadata{}, nil
+			}
+		case *ecs.DescribeTasksInput:
+			if config.inject("DescribeTasksDelay", config.DescribeTasksRate) {
+				select {
+				case <-time.After(config.DescribeTasksDelay):
+				case <-ctx.Done():
+					return middleware.InitializeOutput{}, middleware.Metadata{}, ctx.Err()
+				}
+			}
+		}
+		return next.HandleInitialize(ctx, in)
+	})
+}
+
+// faultTransport fails HTTP requests with a 500 status code at the configured ADO error rate
+type faultTransport struct {
+	Config *FaultConfig      // The fault configuration
+	Next   http.RoundTripper // The transport of requests that don't fail
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Config.inject("ADOServerError", t.Config.ADOErrorRate) {
+		return t.Next.RoundTrip(req)
+	}
+
+	return &http.Response{
+		Status:     "500 Internal Server Error",
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"message": "injected fault", "typeKey": "InjectedFaultException"}`)),
+		Request:    req,
+	}, nil
+}
+
+// ADOTransport returns the transport of the ADO client, failing requests at the configured rate if enabled
+func (config *FaultConfig) ADOTransport(next http.RoundTripper) http.RoundTripper {
+	if !config.Enabled {
+		return next
+	}
+	return &faultTransport{Config: config, Next: next}
+}
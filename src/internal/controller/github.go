@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// githubRunnerPrefix prefixes the names of the runners started for GitHub Actions jobs, which are also their StartedBy tag
+const githubRunnerPrefix = "ecs-gh-"
+
+/*
+GitHubConfig contains configuration values for the GitHub Actions compatibility mode,
+which starts ephemeral just-in-time runners for 'workflow_job' webhooks delivered through the queue.
+
+See:
+
+https://docs.github.com/en/webhooks/webhook-events-and-payloads#workflow_job
+*/
+type GitHubConfig struct {
+	Token         string   // The token allowed to create runners of the repositories or organization
+	APIURL        string   // The GitHub API URL
+	Organization  string   // The organization whose runners are created, repository runners are created if empty
+	RunnerGroupID int      // The runner group of organization runners
+	Labels        []string // The labels of the runners, jobs are served only if all of their labels are among them
+	WebhookSecret string   // The secret of the webhook, webhooks are rejected if empty
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values, the mode is disabled unless GITHUB_TOKEN is set:
+  - GITHUB_TOKEN: A token allowed to create self-hosted runners of the repositories or organization (optional)
+  - GITHUB_API_URL: The GitHub API URL, e.g. for GitHub Enterprise Server (default: https://api.github.com)
+  - GITHUB_ORG: The organization whose runners are created, repository runners are created if unset (optional)
+  - GITHUB_RUNNER_GROUP_ID: The runner group of the runners (default: 1)
+  - GITHUB_RUNNER_LABELS: The comma-separated labels of the runners (default: self-hosted,ecs)
+  - GITHUB_WEBHOOK_SECRET: The secret of the webhook, verified against the X-Hub-Signature-256 message attribute, webhooks are rejected if unset (optional)
+*/
+func (config *GitHubConfig) ReadFromEnv() {
+	config.Token = ReadEnvVarWithDefault("GITHUB_TOKEN", "")
+	config.APIURL = strings.TrimSuffix(ReadEnvVarWithDefault("GITHUB_API_URL", "https://api.github.com"), "/")
+	config.Organization = ReadEnvVarWithDefault("GITHUB_ORG", "")
+	config.WebhookSecret = ReadEnvVarWithDefault("GITHUB_WEBHOOK_SECRET", "")
+
+	groupStr := ReadEnvVarWithDefault("GITHUB_RUNNER_GROUP_ID", "1")
+	group, err := strconv.Atoi(groupStr)
+	if err != nil || group < 1 {
+		slog.Error("failed to parse GITHUB_RUNNER_GROUP_ID", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.RunnerGroupID = group
+
+	for _, label := range strings.Split(ReadEnvVarWithDefault("GITHUB_RUNNER_LABELS", "self-hosted,ecs"), ",") {
+		config.Labels = append(config.Labels, strings.TrimSpace(label))
+	}
+}
+
+// GitHubWorkflowJobEvent is the payload of a GitHub 'workflow_job' webhook
+type GitHubWorkflowJobEvent struct {
+	Action      string `json:"action"` // The action, queued, in_progress or completed
+	WorkflowJob struct {
+		ID         int64    `json:"id"`          // The job ID
+		RunID      int64    `json:"run_id"`      // The workflow run ID
+		Name       string   `json:"name"`        // The job name
+		Labels     []string `json:"labels"`      // The labels of the runners the job can run on
+		RunnerName string   `json:"runner_name"` // The name of the runner that ran the job, once assigned
+		Conclusion string   `json:"conclusion"`  // The outcome of a completed job, e.g. success
+	} `json:"workflow_job"`
+	Repository struct {
+		FullName string `json:"full_name"` // The repository, owner/name
+	} `json:"repository"`
+}
+
+// parseGitHubWorkflowJob returns the workflow_job event of a message body, or nil if it isn't one
+func parseGitHubWorkflowJob(body string) *GitHubWorkflowJobEvent {
+	var event GitHubWorkflowJobEvent
+	if json.Unmarshal([]byte(body), &event) != nil || event.WorkflowJob.ID == 0 {
+		return nil
+	}
+	return &event
+}
+
+// verifySignature verifies the 'sha256=' HMAC-SHA256 signature of a message body, such as a GitHub webhook
+func verifySignature(secret string, body string, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+/*
+handleGitHubRecord handles a record carrying a GitHub 'workflow_job' webhook, which requires the ecs backend:
+  - queued jobs whose labels are all served start an ephemeral just-in-time runner,
+    with the task profile of the queue, see SelectQueueProfile, unless a redelivery already started it
+  - completed jobs stop the runner that ran them, if it was started by the controller
+
+Unlike ADO checks, nothing is reported back: the runner reports the job to GitHub itself.
+Forwarders of the webhooks must pass its X-Hub-Signature-256 header as a message attribute:
+webhooks with an invalid signature, and every webhook without GITHUB_WEBHOOK_SECRET, are dropped.
+*/
+func handleGitHubRecord(ctx context.Context, record events.SQSMessage, event *GitHubWorkflowJobEvent) error {
+	logger := slog.With(slog.Int64("githubJobId", event.WorkflowJob.ID), slog.String("repository", event.Repository.FullName), slog.String("action", event.Action))
+
+	if githubCfg.WebhookSecret == "" {
+		logger.Error("rejected GitHub webhook, GITHUB_WEBHOOK_SECRET is required")
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "GitHubSignature"})
+		return nil
+	}
+	signature := aws.ToString(record.MessageAttributes["X-Hub-Signature-256"].StringValue)
+	if !verifySignature(githubCfg.WebhookSecret, record.Body, signature) {
+		logger.Error("rejected GitHub webhook with an invalid signature")
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "GitHubSignature"})
+		return nil
+	}
+
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		return fmt.Errorf("the GitHub Actions mode requires the ecs backend")
+	}
+
+	switch event.Action {
+	case "queued":
+		for _, label := range event.WorkflowJob.Labels {
+			if !slices.Contains(githubCfg.Labels, label) {
+				logger.Info("ignored GitHub job with unserved labels", slog.Any("labels", event.WorkflowJob.Labels))
+				return nil
+			}
+		}
+
+		name := githubRunnerPrefix + strconv.FormatInt(event.WorkflowJob.ID, 10)
+		taskARNs, err := ListStartedByTasks(ctx, ecsRunner.Client, ecsRunner.Config.Cluster, name)
+		if err != nil {
+			return err
+		}
+		if len(taskARNs) > 0 {
+			logger.Info("GitHub runner already started", slog.String("runner", name), slog.Any("taskArns", taskARNs))
+			return nil
+		}
+
+		jitConfig, err := githubJITConfig(event.Repository.FullName, name)
+		var adoErr *ADOError
+		if errors.As(err, &adoErr) && adoErr.StatusCode == http.StatusConflict {
+			// the runner was created by an earlier delivery whose task failed to start, it never ran
+			err = githubDeleteRunner(event.Repository.FullName, name)
+			if err != nil {
+				return err
+			}
+			jitConfig, err = githubJITConfig(event.Repository.FullName, name)
+		}
+		if err != nil {
+			return err
+		}
+
+		taskARNs, err = startRunnerTask(ctx, ecsRunner, record.EventSourceARN, name, nil, map[string]string{"ACTIONS_RUNNER_INPUT_JITCONFIG": jitConfig})
+		if err != nil {
+			return err
+		}
+
+		logger.Info("started GitHub runner", slog.String("runner", name), slog.Any("taskArns", taskARNs))
+		EmitMetric("GitHubRunnersStarted", 1, MetricUnitCount, nil)
+	case "completed":
+		name := event.WorkflowJob.RunnerName
+		logger.Info("GitHub job completed", slog.String("runner", name), slog.String("conclusion", event.WorkflowJob.Conclusion))
+		if !strings.HasPrefix(name, githubRunnerPrefix) {
+			return nil
+		}
+		return stopRunnerTask(ctx, ecsRunner, name, "GitHub job completed")
+	}
+
+	return nil
+}
+
+// githubJITConfig creates a just-in-time runner of the repository, or of the organization if configured, and returns its encoded configuration
+func githubJITConfig(repository string, name string) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"name":            name,
+		"runner_group_id": githubCfg.RunnerGroupID,
+		"labels":          githubCfg.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal JSON body: %w", err)
+	}
+
+	data, err := githubRequest(http.MethodPost, githubRunnersURL(repository)+"/generate-jitconfig", body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GitHub runner: %w", err)
+	}
+
+	var result struct {
+		EncodedJITConfig string `json:"encoded_jit_config"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse GitHub runner: %w", err)
+	}
+	return result.EncodedJITConfig, nil
+}
+
+// githubRunnersURL returns the runners URL of the repository, or of the organization if configured
+func githubRunnersURL(repository string) string {
+	if githubCfg.Organization != "" {
+		return fmt.Sprintf("%s/orgs/%s/actions/runners", githubCfg.APIURL, githubCfg.Organization)
+	}
+	return fmt.Sprintf("%s/repos/%s/actions/runners", githubCfg.APIURL, repository)
+}
+
+// githubRequest executes an authenticated GitHub API request and returns the response body
+func githubRequest(method string, endpoint string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+githubCfg.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute HTTP request: %w", err)
+	}
+	return readResponse(res, adoCfg.MaxResponseBytes)
+}
+
+// githubDeleteRunner deletes the runner of the repository, or of the organization if configured, with the name, if any
+func githubDeleteRunner(repository string, name string) error {
+	data, err := githubRequest(http.MethodGet, githubRunnersURL(repository)+"?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return fmt.Errorf("failed to list GitHub runners: %w", err)
+	}
+
+	var result struct {
+		Runners []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"runners"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return fmt.Errorf("failed to parse GitHub runners: %w", err)
+	}
+
+	for _, r := range result.Runners {
+		if r.Name != name {
+			continue
+		}
+		_, err = githubRequest(http.MethodDelete, githubRunnersURL(repository)+"/"+strconv.FormatInt(r.ID, 10), nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete GitHub runner: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// gitlabRunnerPrefix prefixes the names of the runners started for GitLab CI jobs, which are also their StartedBy tag
+const gitlabRunnerPrefix = "ecs-gl-"
+
+/*
+GitLabConfig contains configuration values for the GitLab CI compatibility mode,
+which starts a single-job GitLab runner for each pending job of the 'Job events' webhooks delivered through the queues
+whose queue profile has the gitlab frontend, see QueueProfile.
+
+See:
+
+https://docs.gitlab.com/user/project/integrations/webhook_events/#job-events
+*/
+type GitLabConfig struct {
+	URL          string // The GitLab instance URL
+	RunnerToken  string // The authentication token of the runner, injected into the agent task
+	WebhookToken string // The secret token of the webhook, webhooks are rejected if empty
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values, the mode is disabled unless GITLAB_RUNNER_TOKEN is set:
+  - GITLAB_URL: The GitLab instance URL (default: https://gitlab.com)
+  - GITLAB_RUNNER_TOKEN: The authentication token of the runner, a 'glrt-' token (optional)
+  - GITLAB_WEBHOOK_TOKEN: The secret token of the webhook, verified against the X-Gitlab-Token message attribute, webhooks are rejected if unset (optional)
+
+The agent image is expected to register and run a single job with the runner environment variables:
+CI_SERVER_URL, CI_SERVER_TOKEN, RUNNER_NAME and GITLAB_JOB_ID, e.g. with 'gitlab-runner run-single --max-builds 1'.
+*/
+func (config *GitLabConfig) ReadFromEnv() {
+	config.URL = strings.TrimSuffix(ReadEnvVarWithDefault("GITLAB_URL", "https://gitlab.com"), "/")
+	config.RunnerToken = ReadEnvVarWithDefault("GITLAB_RUNNER_TOKEN", "")
+	config.WebhookToken = ReadEnvVarWithDefault("GITLAB_WEBHOOK_TOKEN", "")
+}
+
+// GitLabJobEvent is the payload of a GitLab 'Job events' webhook
+type GitLabJobEvent struct {
+	ObjectKind  string `json:"object_kind"`  // The kind of event, build
+	BuildID     int64  `json:"build_id"`     // The job ID
+	BuildName   string `json:"build_name"`   // The job name
+	BuildStatus string `json:"build_status"` // The job status, e.g. pending, running, success, failed or canceled
+	ProjectID   int64  `json:"project_id"`   // The project ID
+	ProjectName string `json:"project_name"` // The project name
+	Runner      *struct {
+		Description string `json:"description"` // The name of the runner that picked the job
+	} `json:"runner"` // The runner that picked the job, once assigned
+}
+
+// verifyGitLabToken verifies the secret token of a webhook
+func verifyGitLabToken(secret string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1
+}
+
+/*
+handleGitLabRecord handles a record of a queue with the gitlab frontend, which requires the ecs backend:
+  - pending jobs start a single-job runner, with the task profile of the queue, see SelectQueueProfile
+  - finished jobs, succeeded, failed or canceled, stop the runner that picked them, if it was started by the controller
+
+A runner may pick any pending job the token allows, not necessarily the one it was started for,
+so runners are stopped by the runner that picked the finished job.
+Unlike ADO checks, nothing is reported back: the runner reports the job to GitLab itself.
+Forwarders of the webhooks must pass its X-Gitlab-Token header as a message attribute:
+webhooks with an invalid token, and every webhook without GITLAB_WEBHOOK_TOKEN, are dropped.
+*/
+func handleGitLabRecord(ctx context.Context, record events.SQSMessage) error {
+	if gitlabCfg == nil {
+		return fmt.Errorf("the gitlab frontend requires GITLAB_RUNNER_TOKEN")
+	}
+
+	var event GitLabJobEvent
+	err := json.Unmarshal([]byte(record.Body), &event)
+	if err != nil || event.ObjectKind != "build" {
+		slog.Error("rejected message that isn't a GitLab job event", slog.Any("err", err))
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "GitLabEvent"})
+		return nil
+	}
+
+	logger := slog.With(slog.Int64("gitlabJobId", event.BuildID), slog.String("project", event.ProjectName), slog.String("status", event.BuildStatus))
+
+	if gitlabCfg.WebhookToken == "" {
+		logger.Error("rejected GitLab webhook, GITLAB_WEBHOOK_TOKEN is required")
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "GitLabToken"})
+		return nil
+	}
+	token := aws.ToString(record.MessageAttributes["X-Gitlab-Token"].StringValue)
+	if !verifyGitLabToken(gitlabCfg.WebhookToken, token) {
+		logger.Error("rejected GitLab webhook with an invalid token")
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "GitLabToken"})
+		return nil
+	}
+
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		return fmt.Errorf("the GitLab CI mode requires the ecs backend")
+	}
+
+	switch event.BuildStatus {
+	case "pending":
+		name := gitlabRunnerPrefix + strconv.FormatInt(event.BuildID, 10)
+		taskARNs, err := startRunnerTask(ctx, ecsRunner, record.EventSourceARN, name, nil, map[string]string{
+			"CI_SERVER_URL":   gitlabCfg.URL,
+			"CI_SERVER_TOKEN": gitlabCfg.RunnerToken,
+			"RUNNER_NAME":     name,
+			"GITLAB_JOB_ID":   strconv.FormatInt(event.BuildID, 10),
+		})
+		if err != nil {
+			return err
+		}
+
+		logger.Info("started GitLab runner", slog.String("runner", name), slog.Any("taskArns", taskARNs))
+		EmitMetric("GitLabRunnersStarted", 1, MetricUnitCount, nil)
+	case "success", "failed", "canceled":
+		if event.Runner == nil || !strings.HasPrefix(event.Runner.Description, gitlabRunnerPrefix) {
+			logger.Info("GitLab job finished")
+			return nil
+		}
+
+		logger.Info("GitLab job finished", slog.String("runner", event.Runner.Description))
+		return stopRunnerTask(ctx, ecsRunner, event.Runner.Description, "GitLab job finished")
+	}
+
+	return nil
+}
@@ -0,0 +1,760 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type Event events.SQSEvent
+
+/*
+Handler is the Lambda handler of every binary, it routes an invocation by the shape of its event:
+  - ControllerCommand payloads run the named maintenance job
+  - Lambda function URL requests are served by the admin API, or forwarded to the queue by the webhook binary, see handleWebhookRequest
+  - Amazon EventBridge 'ECS Task State Change' events are handled by handleTaskStateChange
+  - any other event is handled as an Amazon SQS event carrying ADO payloads, and returns the batch item failures
+
+Binaries only serve the invocations of their role, see binaryRole, which must be set up by Bootstrap first.
+With RECONCILE_ON_START, the first invocation of an execution environment reconciles the state store first,
+within RECONCILE_ON_START_BUDGET_SECONDS, see reconcileOnStartContext, the scheduled reconcile command reconciles the rest.
+*/
+func Handler(ctx context.Context, raw json.RawMessage) (any, error) {
+	defer metricBatch.Flush()
+
+	if reconcileCfg != nil && reconcileCfg.OnStart && stateStore != nil {
+		reconcileOnStart.Do(func() {
+			reconcileCtx, cancel := reconcileOnStartContext(ctx)
+			defer cancel()
+
+			err := handleReconcile(reconcileCtx)
+			if err != nil {
+				slog.Error("failed to reconcile state store", slog.Any("err", err))
+			}
+		})
+	}
+
+	var command ControllerCommand
+	err := json.Unmarshal(raw, &command)
+	if err == nil && command.Command != "" {
+		err = checkRole(InvocationCommand)
+		if err != nil {
+			return nil, err
+		}
+		return nil, handleCommand(ctx, &command)
+	}
+
+	var request events.LambdaFunctionURLRequest
+	err = json.Unmarshal(raw, &request)
+	if err == nil && isFunctionURLRequest(&request) {
+		if binaryRole == RoleWebhook {
+			return handleWebhookRequest(ctx, &request), nil
+		}
+		err = checkRole(InvocationAdmin)
+		if err != nil {
+			return adminResponse(http.StatusNotFound, map[string]string{"error": err.Error()}), nil
+		}
+		return handleAdmin(ctx, &request), nil
+	}
+
+	var envelope events.CloudWatchEvent
+	err = json.Unmarshal(raw, &envelope)
+	if err != nil {
+		slog.Error("failed to parse event", slog.Any("err", err))
+		return nil, err
+	}
+
+	switch envelope.DetailType {
+	case "ECS Task State Change":
+		var detail *ECSTaskStateChange
+		err = json.Unmarshal(envelope.Detail, &detail)
+		if err != nil {
+			slog.Error("failed to parse event detail", slog.Any("err", err))
+			return nil, err
+		}
+		err = checkRole(InvocationTaskEvent)
+		if err != nil {
+			return nil, err
+		}
+		return nil, handleTaskStateChange(ctx, detail)
+	}
+
+	var event Event
+	err = json.Unmarshal(raw, &event)
+	if err != nil {
+		slog.Error("failed to parse event", slog.Any("err", err))
+		return nil, err
+	}
+
+	err = checkRole(InvocationQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	return handleQueue(ctx, event)
+}
+
+// handleCommand runs the maintenance job named by a ControllerCommand
+func handleCommand(ctx context.Context, command *ControllerCommand) (err error) {
+	switch command.Command {
+	case "prescale":
+		err = handlePreScale(ctx)
+	case "warmpool":
+		err = handleWarmPool(ctx)
+	case "prewarm":
+		err = handleImagePrewarm(ctx)
+	case "agentgc":
+		err = handleAgentGC(ctx)
+	case "costreport":
+		err = handleCostReport(ctx)
+	case "smoketest":
+		err = handleSmokeTest(ctx)
+	case "reconcile":
+		err = handleReconcile(ctx)
+	case "healthcheck":
+		err = handleSelfCheck(ctx)
+	case "replaycallbacks":
+		err = handleReplayCallbacks(ctx)
+	case "debugreap":
+		err = handleDebugReap(ctx)
+	case "driftcheck":
+		err = handleDriftCheck(ctx)
+	default:
+		err = fmt.Errorf("unknown command: %s", command.Command)
+	}
+
+	if err != nil {
+		slog.Error("command failed", slog.String("command", command.Command), slog.Any("err", err))
+	}
+
+	return
+}
+
+/*
+handleQueue starts an agent for every record, round-robin across projects, see FairShareConfig.Schedule, then sends the TaskCompleted callbacks
+of the batch concurrently, up to ADO_CALLBACK_CONCURRENCY at a time.
+
+Records that fail are reported as batch item failures, so SQS redelivers only them,
+which requires ReportBatchItemFailures on the event source mapping.
+Records that fail with a transient error are redelivered after an exponential backoff.
+Records whose callback fails release their dedupe claims, so that their redeliveries are processed,
+unless the callback failed during an ADO outage and was persisted for replay.
+
+The remaining invocation time is shared between the wait loops of the records left in the batch,
+records whose agent isn't ready within their share are re-checked by a continuation, or redelivered.
+The batch ends with an 'invocation summary' log record, see InvocationSummary,
+and the response includes the outcome of every record, see QueueResponse.
+*/
+func handleQueue(ctx context.Context, event Event) (response *QueueResponse, err error) {
+	var callbacks []*pendingCallback
+	outcomes := []*MessageOutcome{}
+	response = &QueueResponse{Version: QueueResponseVersion}
+	invocationSummary = NewInvocationSummary()
+
+	records, deferred := fairShareCfg.Schedule(event.Records)
+	invocationSummary.DeferredRecords = len(deferred)
+	for _, record := range deferred {
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		requeueWithBackoff(ctx, record, ErrFairShareDeferred)
+		outcomes = append(outcomes, newMessageOutcome(record, MessageOutcomeDeferred, nil))
+	}
+
+	for i, record := range records {
+		recordStart := time.Now()
+		callback, recordErr := handleRecord(ctx, record, waitBudget(ctx, len(records)-i))
+		invocationSummary.Record(time.Since(recordStart))
+		if recordErr != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			requeueWithBackoff(ctx, record, recordErr)
+			outcomes = append(outcomes, newMessageOutcome(record, MessageOutcomeRedelivered, recordErr))
+			continue
+		}
+		if callback == nil {
+			outcomes = append(outcomes, newMessageOutcome(record, MessageOutcomeHandled, nil))
+			continue
+		}
+		callbacks = append(callbacks, callback)
+		trace := newMessageOutcome(record, callback.Result, nil)
+		trace.CheckID = callback.Payload.CheckID()
+		trace.TaskARN = callback.Metadata["AgentId"]
+		outcomes = append(outcomes, trace)
+	}
+
+	for _, messageID := range sendCallbacks(ctx, callbacks) {
+		response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: messageID})
+		for _, trace := range outcomes {
+			if trace.MessageID == messageID {
+				trace.Outcome = MessageOutcomeCallbackFailed
+			}
+		}
+		if dedupe == nil {
+			continue
+		}
+		for _, callback := range callbacks {
+			if callback.MessageID == messageID {
+				dedupe.Release(ctx, dedupeKey(callback.Payload.CheckID()))
+			}
+		}
+	}
+
+	recordMessageOutcomes(ctx, outcomes)
+	latencyTracker.Flush(ctx)
+	if activity != nil {
+		activity.Flush(ctx)
+	}
+
+	invocationSummary.FailedRecords = len(response.BatchItemFailures) - len(deferred)
+	invocationSummary.Log()
+	invocationSummary = nil
+	response.Records = outcomes
+	return
+}
+
+/*
+handleRecord starts an agent for a record and returns the callback to send, if any.
+
+Records carrying an ActionMessage run its action instead, see handleStopMessage and handleKillSwitchMessage.
+Records carrying a GitHub 'workflow_job' webhook are handled in the GitHub Actions mode, if enabled, see handleGitHubRecord.
+Records of queues with the gitlab frontend are handled in the GitLab CI mode, see handleGitLabRecord.
+Records of queues with the jenkins frontend are handled in the Jenkins mode, see handleJenkinsRecord.
+Records of queues with the webhook frontend are mapped to ADO payloads first, see mapWebhookBody.
+Records of checks whose agent was launched within the dedupe window are dropped, and records of checks claimed by another invocation are redelivered, see Deduplicator.
+Payloads with fields that are too long or contain unsafe characters are dropped, see ADOPayload.Sanitize.
+Payloads of organizations or projects not allowed by the access policy are rejected, see AccessPolicy.
+Payloads whose Deadline passed fail their check without starting an agent, and agents not ready by it are abandoned, see abandonAtDeadline.
+Payloads of profiles whose launches are disabled fail their check without starting an agent, see checkKillSwitch.
+The agent is waited for at most the budget, if positive.
+Failures of the optional dependencies, such as the state store, degrade to starting the agent
+and sending the callback without them.
+*/
+func handleRecord(ctx context.Context, record events.SQSMessage, budget time.Duration) (callback *pendingCallback, err error) {
+	var envelope continuationEnvelope
+	if json.Unmarshal([]byte(record.Body), &envelope) == nil && envelope.Continuation != nil && continuations != nil {
+		jobRecord, outcome, err := handleContinuation(ctx, envelope.Continuation, budget)
+		if err != nil {
+			slog.Error("failed to re-check agent", slog.Any("err", err))
+			return nil, err
+		}
+		if jobRecord != nil {
+			if outcome == "failed" {
+				reportStoppedAgent(ctx, jobRecord.Payload, jobRecord.TaskARN)
+				debugFailedAgent(ctx, jobRecord.Payload, jobRecord.TaskARN)
+			}
+			err = finishJob(ctx, jobRecord, outcome)
+			if err != nil {
+				return nil, err
+			}
+			metadata := agentMetadata(ctx, jobRecord.TaskARN, jobRecord.Payload.AgentName(), jobRecord.CreatedAt)
+			return &pendingCallback{MessageID: record.MessageId, Payload: jobRecord.Payload, Result: outcome, Metadata: metadata}, nil
+		}
+		return nil, nil
+	}
+
+	switch queueFrontend(queueProfiles, record.EventSourceARN) {
+	case FrontendGitLab:
+		return nil, handleGitLabRecord(ctx, record)
+	case FrontendJenkins:
+		return nil, handleJenkinsRecord(ctx, record)
+	case FrontendWebhook:
+		queueProfile, _ := queueProfileFor(queueProfiles, record.EventSourceARN)
+		body, mapErr := mapWebhookBody(queueProfile, record.Body)
+		if mapErr != nil {
+			slog.Error("rejected webhook", slog.String("messageId", record.MessageId), slog.Any("err", mapErr))
+			EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "WebhookMapping"})
+			return nil, nil
+		}
+		record.Body = body
+	}
+
+	if githubCfg != nil {
+		if event := parseGitHubWorkflowJob(record.Body); event != nil {
+			return nil, handleGitHubRecord(ctx, record, event)
+		}
+	}
+
+	var action ActionMessage
+	if json.Unmarshal([]byte(record.Body), &action) == nil && action.Action != "" {
+		switch action.Action {
+		case ActionStop:
+			err = handleStopMessage(ctx, record, &action)
+			if err != nil {
+				slog.Error("failed to stop agent", slog.Any("err", err))
+			}
+		case ActionDisable, ActionEnable:
+			err = handleKillSwitchMessage(ctx, record, &action)
+			if err != nil {
+				slog.Error("failed to toggle kill switch", slog.Any("err", err))
+			}
+		default:
+			slog.Error("unsupported message action", slog.String("action", action.Action))
+			err = fmt.Errorf("unsupported message action: %s", action.Action)
+		}
+		return nil, err
+	}
+
+	var payload *ADOPayload
+	err = json.Unmarshal([]byte(record.Body), &payload)
+	if err != nil {
+		slog.Error("failed to parse message body", slog.Any("err", err))
+		return nil, err
+	}
+
+	err = payload.Sanitize()
+	if err != nil {
+		slog.Error("rejected payload", slog.String("messageId", record.MessageId), slog.Any("err", err))
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "Sanitization"})
+		return nil, nil
+	}
+
+	if payload.DryRun {
+		plan, planErr := NewPlan(payload, record.EventSourceARN)
+		if planErr != nil {
+			slog.Error("failed to plan dry run", slog.String("jobId", payload.JobID), slog.Any("err", planErr))
+			return nil, nil
+		}
+		slog.Info("dry run plan", slog.String("jobId", payload.JobID), slog.Any("plan", plan))
+		return nil, nil
+	}
+
+	// the dedupe claim of the check is completed once its agent is launched, and released if the record fails or launches no agent
+	launched := false
+	if dedupe != nil {
+		key := dedupeKey(payload.CheckID())
+		claim, dedupeErr := dedupe.Claim(ctx, key)
+		if dedupeErr != nil {
+			dependencies.Fallback(DependencyStateStore, "claim dedupe key", dedupeErr)
+		}
+		switch claim {
+		case DedupeCompleted:
+			slog.Warn("dropped duplicate record", slog.String("messageId", record.MessageId), slog.String("jobId", payload.JobID))
+			EmitMetric("DuplicateRecords", 1, MetricUnitCount, nil)
+			return nil, nil
+		case DedupeInFlight:
+			slog.Warn("check claimed by another invocation", slog.String("messageId", record.MessageId), slog.String("jobId", payload.JobID))
+			return nil, ErrDedupeInFlight
+		}
+		defer func() {
+			if err != nil || !launched {
+				dedupe.Release(ctx, key)
+			}
+		}()
+	}
+
+	recordActivity(ActivityReceived, payload, nil, "")
+
+	err = accessPolicy.CheckOrganization(payload)
+	if err != nil {
+		logSecurityRejection(payload, err)
+		return nil, nil
+	}
+
+	err = accessPolicy.CheckProject(payload)
+	if err != nil {
+		logSecurityRejection(payload, err)
+		err = failCheck(ctx, payload, "This project is not allowed to use the agent controller")
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	switch maintenanceCfg.Mode {
+	case MaintenanceModeFail:
+		slog.Warn("failing check, pools are under maintenance", slog.String("jobId", payload.JobID))
+		err = failCheck(ctx, payload, maintenanceCfg.Message)
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	case MaintenanceModeRequeue:
+		return nil, ErrMaintenanceMode
+	}
+
+	if payload.DeadlineExceeded() {
+		slog.Warn("deadline exceeded before provisioning", slog.String("jobId", payload.JobID), slog.Time("deadline", payload.Deadline))
+		EmitMetric("DeadlineExceeded", 1, MetricUnitCount, map[string]string{"Stage": "Received"})
+		err = failCheck(ctx, payload, deadlineMessage(payload))
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if adoCfg.ValidatePayload {
+		err = ADOValidatePlan(adoClient, adoCfg, payload)
+		if errors.Is(err, ErrInvalidPayload) {
+			slog.Error("rejected payload", slog.String("jobId", payload.JobID), slog.String("planId", payload.PlanID), slog.Any("err", err))
+			EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "PlanValidation"})
+			return nil, nil
+		}
+		if err != nil {
+			slog.Error("failed to validate payload", slog.Any("err", err))
+			return nil, err
+		}
+	}
+
+	previous, err := reevaluatedCheck(ctx, payload)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "detect re-evaluated check", err)
+	}
+	if previous != nil {
+		reused := &JobRecord{
+			JobID:          payload.CheckID(),
+			TaskARN:        previous.TaskARN,
+			Status:         JobStatusSucceeded,
+			Profile:        previous.Profile,
+			TaskDefinition: previous.TaskDefinition,
+			Payload:        payload,
+		}
+		err = stateStore.Put(ctx, reused)
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "save job record", err)
+		}
+		slog.Info("reusing the agent of the previous check", slog.String("jobId", payload.JobID), slog.String("taskArn", previous.TaskARN))
+		metadata := agentMetadata(ctx, previous.TaskARN, previous.Payload.AgentName(), previous.CreatedAt)
+		return &pendingCallback{MessageID: record.MessageId, Payload: payload, Result: "succeeded", Metadata: metadata}, nil
+	}
+
+	profile, err := SelectPayloadProfile(payload, record.EventSourceARN)
+	if err != nil {
+		slog.Error("failed to select task profile", slog.String("jobId", payload.JobID), slog.Any("err", err))
+		err = failCheck(ctx, payload, categorizedMessage(categorizeError(err), err.Error()))
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	stable := profile
+	profile, canary := profile.WithRevision()
+	if canary && stateStore != nil {
+		rolledBack, rollbackErr := stateStore.IsRolledBack(ctx, profile.TaskDefinition)
+		if rollbackErr != nil {
+			dependencies.Fallback(DependencyStateStore, "check canary rollback", rollbackErr)
+		}
+		if rolledBack || rollbackErr != nil {
+			profile, canary = stable, false
+		}
+	}
+
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+		slog.Info("selected task profile", slog.String("jobId", payload.JobID), slog.String("profile", profileName), slog.Bool("canary", canary))
+	}
+
+	err = checkKillSwitch(ctx, profileName)
+	if err != nil {
+		slog.Warn("launch disabled by kill switch", slog.String("jobId", payload.JobID), slog.String("profile", profileName), slog.Any("err", err))
+		err = failCheck(ctx, payload, categorizedMessage(categorizeError(err), err.Error()))
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	taskDefinition := ""
+	if taskCfg != nil {
+		taskDefinition = profile.ApplyToTaskConfig(taskCfg).TaskDefinition
+	}
+
+	err = runBreaker.Allow()
+	if err != nil {
+		slog.Error("failed to run task", slog.String("jobId", payload.JobID), slog.Any("err", err))
+		err = failCheck(ctx, payload, categorizedMessage(categorizeError(err), err.Error()))
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	slotAcquired := false
+	if quota, ok := projectQuotaFor(projectQuotas, payload.ProjectID); ok && stateStore != nil {
+		err = stateStore.AcquireProjectSlot(ctx, payload.ProjectID, payload.CheckID(), quota)
+		switch {
+		case errors.Is(err, ErrProjectQuotaExceeded):
+			slog.Error("failed to acquire project quota slot", slog.String("jobId", payload.JobID), slog.Any("err", err))
+			return nil, err
+		case err != nil:
+			dependencies.Fallback(DependencyStateStore, "acquire project quota slot", err)
+		default:
+			slotAcquired = true
+		}
+	}
+
+	startedAt := time.Now()
+	taskARN, err := runner.Run(ctx, payload, profile)
+	if !errors.Is(err, ErrQuotaExceeded) && !isTaskConfigError(err) {
+		runBreaker.Record(err)
+	}
+	if err != nil {
+		var failure *RunTaskFailureError
+		isFailure := errors.As(err, &failure)
+		if isFailure {
+			slog.Error("failed to run task", slog.String("jobId", payload.JobID), slog.String("reason", failure.Reason), slog.String("detail", failure.Detail), slog.Any("err", err))
+		} else {
+			slog.Error("failed to run task", slog.Any("err", err))
+		}
+		if slotAcquired {
+			releaseErr := stateStore.ReleaseProjectSlot(ctx, payload.ProjectID, payload.CheckID())
+			if releaseErr != nil {
+				slog.Error("failed to release project quota slot", slog.Any("err", releaseErr))
+			}
+		}
+		if !isFailure && !isTaskConfigError(err) {
+			return nil, err
+		}
+		err = failCheck(ctx, payload, categorizedMessage(categorizeError(err), fmt.Sprintf("Failed to start the agent task: %s", err)))
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	launched = true
+	if dedupe != nil {
+		dedupe.Complete(ctx, dedupeKey(payload.CheckID()))
+	}
+
+	jobRecord := &JobRecord{
+		JobID:          payload.CheckID(),
+		TaskARN:        taskARN,
+		Status:         JobStatusStarted,
+		Profile:        profileName,
+		TaskDefinition: taskDefinition,
+		Canary:         canary,
+		Attempts:       1,
+		Payload:        payload,
+		SlotAcquired:   slotAcquired,
+		QueuedAt:       queuedAt(record),
+	}
+	recordActivity(ActivityStarted, payload, jobRecord, "")
+	persisted := false
+	if stateStore != nil {
+		err = stateStore.Put(ctx, jobRecord)
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "save job record", err)
+		} else {
+			dependencies.Recover(DependencyStateStore)
+			persisted = true
+		}
+	}
+
+	// continuations re-read the job record, so jobs that couldn't be saved are waited for inline
+	var inlineWait time.Duration
+	if continuations != nil && persisted {
+		inlineWait = continuations.Config.InlineWait
+	}
+
+	runTaskOutcome, err := waitForAgent(ctx, taskARN, profile.Readiness(), shorterWait(inlineWait, budget), payload)
+	if errors.Is(err, ErrJobCanceled) {
+		stopCanceledAgent(ctx, payload.CheckID(), taskARN)
+		return nil, nil
+	}
+	if errors.Is(err, ErrDeadlineExceeded) {
+		err = abandonAtDeadline(ctx, payload, taskARN)
+		if err != nil {
+			slog.Error("failed to send ADO callback", slog.Any("err", err))
+			return nil, err
+		}
+		return nil, nil
+	}
+	if errors.Is(err, errAgentPending) && inlineWait == 0 {
+		slog.Warn("agent not ready within the wait budget of the record", slog.String("jobId", payload.JobID), slog.Duration("budget", budget))
+		return nil, err
+	}
+	if errors.Is(err, errAgentPending) {
+		err = continuations.sendContinuation(ctx, &ContinuationMessage{JobID: payload.CheckID()})
+		if err != nil {
+			slog.Error("failed to schedule agent re-check", slog.Any("err", err))
+			return nil, err
+		}
+		recordActivity(ActivityProvisioning, payload, jobRecord, "")
+		return nil, nil
+	}
+	if err != nil {
+		slog.Error("failed to get task status", slog.Any("err", err))
+		EmitMetric("StatusCheckFailures", 1, MetricUnitCount, nil)
+		return nil, err
+	}
+
+	if runTaskOutcome == "failed" {
+		reportStoppedAgent(ctx, payload, taskARN)
+		debugFailedAgent(ctx, payload, taskARN)
+	}
+
+	err = finishJob(ctx, jobRecord, runTaskOutcome)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := agentMetadata(ctx, taskARN, payload.AgentName(), startedAt)
+	return &pendingCallback{MessageID: record.MessageId, Payload: payload, Result: runTaskOutcome, Metadata: metadata}, nil
+}
+
+/*
+reportStoppedAgent explains in the logs, metrics and the check's timeline why an agent stopped
+before becoming ready, if the runner can describe it, and uploads it as a log of the check, see uploadStopLog.
+*/
+func reportStoppedAgent(ctx context.Context, payload *ADOPayload, id string) {
+	detailer, ok := runner.(StopDetailer)
+	if !ok {
+		return
+	}
+
+	detail, err := detailer.StopDetail(ctx, id)
+	if err != nil {
+		slog.Error("failed to describe stopped agent", slog.String("jobId", payload.JobID), slog.Any("err", err))
+		return
+	}
+
+	slog.Error("agent stopped before becoming ready", slog.String("jobId", payload.JobID), slog.String("taskArn", detail.ID), slog.String("stopCode", detail.StopCode), slog.String("reason", detail.Reason), slog.Any("exitCodes", detail.ExitCodes))
+	EmitMetric("AgentStoppedBeforeReady", 1, MetricUnitCount, map[string]string{"StopCode": detail.StopCode})
+	azHealth.Record(ctx, detail.AvailabilityZone, detail.Subnet, true)
+	uploadStopLog(ctx, payload, detail)
+
+	err = ADOTimelineFeed(adoClient, adoCfg, payload, categorizedMessage(detail.Category(), "The "+detail.String()))
+	if err != nil {
+		dependencies.Fallback(DependencyTimeline, "post timeline note", err)
+		return
+	}
+	dependencies.Recover(DependencyTimeline)
+}
+
+/*
+finishJob waits for the agent to register and records the job outcome in the state store,
+and against the task definition revision that served the job.
+*/
+func finishJob(ctx context.Context, record *JobRecord, outcome string) error {
+	if outcome == "succeeded" {
+		recordActivity(ActivityRunning, record.Payload, record, "")
+	} else {
+		recordActivity(ActivityStopped, record.Payload, record, "")
+	}
+
+	if outcome == "succeeded" {
+		captureTaskDetails(ctx, record)
+		trackQueueLatency(record)
+	} else {
+		releaseAgent(ctx, record.TaskARN)
+		if _, ok := runner.(*ECSRunner); !ok {
+			// the task state change events release the slots of the ecs backend once every task of the job stopped
+			err := releaseJobSlot(ctx, record)
+			if err != nil {
+				slog.Error("failed to release project quota slot", slog.String("jobId", record.JobID), slog.Any("err", err))
+			}
+		}
+	}
+
+	time.Sleep(time.Duration(adoCfg.AgentWaitSeconds) * time.Second)
+
+	if stateStore == nil {
+		return nil
+	}
+
+	status := JobStatusFailed
+	if outcome == "succeeded" {
+		status = JobStatusSucceeded
+	}
+
+	err := stateStore.UpdateStatus(ctx, record.JobID, status)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "update job status", err)
+		return nil
+	}
+	dependencies.Recover(DependencyStateStore)
+
+	err = trackRevisionOutcome(ctx, record, outcome)
+	if err != nil {
+		slog.Error("failed to track revision outcome", slog.String("taskDefinition", record.TaskDefinition), slog.Any("err", err))
+	}
+	return nil
+}
+
+// releaseAgent releases the resources held by a finished agent, if the runner holds any, see AgentReleaser
+func releaseAgent(ctx context.Context, id string) {
+	releaser, ok := runner.(AgentReleaser)
+	if !ok {
+		return
+	}
+
+	err := releaser.Release(ctx, id)
+	if err != nil {
+		slog.Error("failed to release agent", slog.String("id", id), slog.Any("err", err))
+	}
+}
+
+// pendingCallback is a TaskCompleted callback waiting to be sent
+type pendingCallback struct {
+	MessageID string            // The ID of the SQS message of the job
+	Payload   *ADOPayload       // The ADO payload
+	Result    string            // The reported outcome
+	Metadata  map[string]string // Metadata of the agent, set as variables of the check's timeline record
+}
+
+/*
+sendCallbacks sends TaskCompleted callbacks concurrently, bounded by the configured concurrency,
+and returns the message IDs of the callbacks that failed.
+
+Callbacks that fail during an ADO outage are persisted for replay instead, if the state store is configured,
+see handleReplayCallbacks.
+*/
+func sendCallbacks(ctx context.Context, callbacks []*pendingCallback) (failed []string) {
+	semaphore := make(chan struct{}, adoCfg.CallbackConcurrency)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for _, callback := range callbacks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			err := reporter.Report(ctx, callback.Payload, callback.Result, callback.Metadata)
+			if err != nil {
+				slog.Error("failed to send ADO callback", slog.String("jobId", callback.Payload.JobID), slog.Any("err", err))
+				if persistFailedCallback(ctx, callback, err) {
+					return
+				}
+				mu.Lock()
+				failed = append(failed, callback.MessageID)
+				mu.Unlock()
+				return
+			}
+			recordActivity(ActivityCallback, callback.Payload, nil, callback.Result)
+		}()
+	}
+
+	wg.Wait()
+	return
+}
+
+// failCheck appends a message explaining the failure to the check's timeline and reports the check as failed
+func failCheck(ctx context.Context, payload *ADOPayload, message string) error {
+	err := ADOTimelineFeed(adoClient, adoCfg, payload, message)
+	if err != nil {
+		dependencies.Fallback(DependencyTimeline, "post timeline note", err)
+	} else {
+		dependencies.Recover(DependencyTimeline)
+	}
+
+	return reporter.Report(ctx, payload, "failed", nil)
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+ReadHubProfilesFromEnv reads the following optional environment variable
+and returns the names of the task profiles serving the jobs of each ADO hub, by lowercased hub name:
+  - HUB_PROFILES: A JSON object mapping hub names to task profile names, e.g. '{"build": "large", "release": "small", "checks": "small"}'
+
+This routes release approvals to small short-lived tasks and builds to large ones without producers setting anything.
+*/
+func ReadHubProfilesFromEnv(profiles []TaskProfile) map[string]string {
+	var hubs map[string]string
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("HUB_PROFILES", "{}")), &hubs)
+	if err != nil {
+		slog.Error("failed to parse HUB_PROFILES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	result := map[string]string{}
+	for hub, name := range hubs {
+		if FindProfile(profiles, name) == nil {
+			slog.Error(fmt.Sprintf("failed to parse HUB_PROFILES: unknown profile %s of hub %s", name, hub))
+			os.Exit(1)
+		}
+		result[strings.ToLower(hub)] = name
+	}
+
+	return result
+}
+
+/*
+SelectPayloadProfile returns the task profile serving a payload received from the queue with the given ARN.
+
+Jobs without demands are served by the profile of their hub, see ReadHubProfilesFromEnv,
+if it is among the profiles of the queue, so the queue-level separation between teams is kept.
+Other jobs are served by the profile chosen by SelectQueueProfile.
+*/
+func SelectPayloadProfile(payload *ADOPayload, queueARN string) (*TaskProfile, error) {
+	if name, ok := hubProfiles[strings.ToLower(payload.HubName)]; ok && len(payload.Demands) == 0 {
+		queueProfile, restricted := queueProfileFor(queueProfiles, queueARN)
+		if !restricted || slices.Contains(queueProfile.Profiles, name) {
+			return FindProfile(taskProfiles, name), nil
+		}
+	}
+
+	return SelectQueueProfile(taskProfiles, queueProfiles, queueARN, payload.Demands)
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// jenkinsRunnerPrefix prefixes the StartedBy tag of the agent tasks started for Jenkins agents
+const jenkinsRunnerPrefix = "ecs-jk-"
+
+/*
+JenkinsConfig contains configuration values for the Jenkins compatibility mode,
+which starts inbound (JNLP) agents for the provisioning requests delivered through the queues
+whose queue profile has the jenkins frontend, see QueueProfile.
+*/
+type JenkinsConfig struct {
+	URL           string // The Jenkins controller URL the agents connect to
+	WebSocket     bool   // Whether the agents connect with WebSocket instead of the TCP agent port
+	WebhookSecret string // The secret of the HMAC-SHA256 signatures of the requests, requests are rejected if empty
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - JENKINS_URL: The Jenkins controller URL the agents connect to, requests are rejected if unset (optional)
+  - JENKINS_WEB_SOCKET: Whether the agents connect with WebSocket, e.g. behind a load balancer without the agent port (default: false)
+  - JENKINS_WEBHOOK_SECRET: The secret of the HMAC-SHA256 signatures of the requests, see verifySignedRecord,
+    which can be KMS-encrypted, requests are rejected if unset (optional)
+
+The agent image is expected to be an inbound agent, such as jenkins/inbound-agent,
+configured with the JENKINS_URL, JENKINS_SECRET, JENKINS_AGENT_NAME and JENKINS_WEB_SOCKET environment variables.
+*/
+func (config *JenkinsConfig) ReadFromEnv() {
+	config.URL = ReadEnvVarWithDefault("JENKINS_URL", "")
+	config.WebSocket = ReadEnvVarWithDefault("JENKINS_WEB_SOCKET", "false") == "true"
+	config.WebhookSecret = ReadEnvVarWithDefault("JENKINS_WEBHOOK_SECRET", "")
+}
+
+/*
+JenkinsProvisionRequest is a cloud-provisioning request of Jenkins, relayed through SQS
+by the cloud implementation of the controller once it created the node of the agent, e.g.
+'{"action": "provision", "queueItemId": 42, "label": "ecs", "agentName": "ecs-agent-1", "secret": "..."}'.
+*/
+type JenkinsProvisionRequest struct {
+	Action      string `json:"action"`      // The action, provision (default) or terminate
+	QueueItemID int64  `json:"queueItemId"` // The ID of the queue item the agent is provisioned for
+	Label       string `json:"label"`       // The label expression of the queue item
+	AgentName   string `json:"agentName"`   // The name of the node of the agent
+	Secret      string `json:"secret"`      // The JNLP secret of the node
+}
+
+/*
+handleJenkinsRecord handles a record of a queue with the jenkins frontend, which requires the ecs backend:
+  - provision requests start an inbound agent connecting to the node with its JNLP secret,
+    with the task profile of the queue selected by the label of the queue item, see SelectQueueProfile:
+    each label of a conjunction, e.g. 'linux && docker', demands a capability of that name
+  - terminate requests stop the agent of the node, e.g. once Jenkins retires it
+
+Requests must be signed with JENKINS_WEBHOOK_SECRET, see verifySignedRecord, since an agent runs builds with the task role,
+and agents only connect to JENKINS_URL. Unsigned requests, and every request without JENKINS_WEBHOOK_SECRET or JENKINS_URL, are dropped.
+Unlike ADO checks, nothing is reported back: the agent connects to Jenkins itself.
+*/
+func handleJenkinsRecord(ctx context.Context, record events.SQSMessage) error {
+	var request JenkinsProvisionRequest
+	err := json.Unmarshal([]byte(record.Body), &request)
+	if err != nil || request.AgentName == "" {
+		slog.Error("rejected message that isn't a Jenkins provisioning request", slog.Any("err", err))
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "JenkinsRequest"})
+		return nil
+	}
+
+	logger := slog.With(slog.String("agentName", request.AgentName), slog.Int64("queueItemId", request.QueueItemID))
+
+	if jenkinsCfg.WebhookSecret == "" || jenkinsCfg.URL == "" {
+		logger.Error("rejected Jenkins request, JENKINS_WEBHOOK_SECRET and JENKINS_URL are required")
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "JenkinsRequest"})
+		return nil
+	}
+	err = verifySignedRecord(record, jenkinsCfg.WebhookSecret)
+	if err != nil {
+		logger.Error("rejected unauthorized Jenkins request", slog.Any("err", err))
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "JenkinsSignature"})
+		return nil
+	}
+
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		return fmt.Errorf("the Jenkins mode requires the ecs backend")
+	}
+
+	name := jenkinsRunnerPrefix + request.AgentName
+
+	switch request.Action {
+	case "", "provision":
+		if request.Secret == "" {
+			logger.Error("rejected Jenkins provisioning request without a secret")
+			EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "JenkinsRequest"})
+			return nil
+		}
+
+		var demands []string
+		for _, label := range strings.Split(request.Label, "&&") {
+			if label = strings.TrimSpace(label); label != "" {
+				demands = append(demands, label)
+			}
+		}
+
+		taskARNs, err := startRunnerTask(ctx, ecsRunner, record.EventSourceARN, name, demands, map[string]string{
+			"JENKINS_URL":        jenkinsCfg.URL,
+			"JENKINS_SECRET":     request.Secret,
+			"JENKINS_AGENT_NAME": request.AgentName,
+			"JENKINS_WEB_SOCKET": strconv.FormatBool(jenkinsCfg.WebSocket),
+		})
+		if err != nil {
+			return err
+		}
+
+		logger.Info("started Jenkins agent", slog.Any("taskArns", taskARNs))
+		EmitMetric("JenkinsAgentsStarted", 1, MetricUnitCount, nil)
+	case "terminate":
+		logger.Info("terminating Jenkins agent")
+		return stopRunnerTask(ctx, ecsRunner, name, "Jenkins agent terminated")
+	default:
+		logger.Error("unsupported Jenkins action", slog.String("action", request.Action))
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Actions of queue messages that toggle the kill switch of a task profile, see handleKillSwitchMessage
+const (
+	ActionDisable = "disable" // Disables the launches of the profile
+	ActionEnable  = "enable"  // Enables the launches of the profile again
+)
+
+// KillSwitchAllProfiles is the profile of the kill switch disabling every launch, which only signed messages can toggle
+const KillSwitchAllProfiles = "*"
+
+// ErrLaunchesDisabled is returned for jobs of a profile whose launches are disabled by its kill switch
+var ErrLaunchesDisabled = errors.New("launches disabled")
+
+// KillSwitch is the persisted kill switch of a task profile
+type KillSwitch struct {
+	Key       string    `dynamodbav:"JobId"`            // The state table key, 'killswitch#<profile>'
+	Profile   string    `dynamodbav:"Profile"`          // The task profile, or * for every launch
+	Disabled  bool      `dynamodbav:"Disabled"`         // Whether the launches of the profile are disabled
+	Reason    string    `dynamodbav:"Reason,omitempty"` // The reason given when the switch was toggled
+	ChangedBy string    `dynamodbav:"ChangedBy"`        // The project and job whose token toggled the switch, or hmac for signed messages
+	ChangedAt time.Time `dynamodbav:"ChangedAt"`        // When the switch was toggled
+}
+
+// killSwitchKey returns the state table key of the kill switch of a task profile
+func killSwitchKey(profile string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "killswitch#" + profile}}
+}
+
+// PutKillSwitch writes the kill switch of a task profile
+func (s *StateStore) PutKillSwitch(ctx context.Context, killSwitch *KillSwitch) error {
+	killSwitch.Key = "killswitch#" + killSwitch.Profile
+
+	item, err := attributevalue.MarshalMap(killSwitch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal kill switch: %w", err)
+	}
+
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put kill switch: %w", err)
+	}
+	return nil
+}
+
+// GetKillSwitch returns the kill switch of a task profile, or nil if it was never toggled
+func (s *StateStore) GetKillSwitch(ctx context.Context, profile string) (*KillSwitch, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Key:       killSwitchKey(profile),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kill switch: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	killSwitch := new(KillSwitch)
+	err = attributevalue.UnmarshalMap(result.Item, killSwitch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kill switch: %w", err)
+	}
+	return killSwitch, nil
+}
+
+/*
+checkKillSwitch returns an error wrapping ErrLaunchesDisabled if the launches of a task profile,
+or every launch, are disabled, and emits the LaunchesDisabled metric.
+Launches are allowed without the state store, or if it fails.
+*/
+func checkKillSwitch(ctx context.Context, profile string) error {
+	if stateStore == nil {
+		return nil
+	}
+
+	for _, name := range []string{KillSwitchAllProfiles, profile} {
+		if name == "" {
+			continue
+		}
+
+		killSwitch, err := stateStore.GetKillSwitch(ctx, name)
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "check kill switch", err)
+			return nil
+		}
+		if killSwitch == nil || !killSwitch.Disabled {
+			continue
+		}
+
+		EmitMetric("LaunchesDisabled", 1, MetricUnitCount, map[string]string{"Profile": profile})
+		target := "the pool " + name
+		if name == KillSwitchAllProfiles {
+			target = "every pool"
+		}
+		err = fmt.Errorf("%w: launches of %s were disabled by %s at %s", ErrLaunchesDisabled, target, killSwitch.ChangedBy, formatTimestamp(killSwitch.ChangedAt))
+		if killSwitch.Reason != "" {
+			err = fmt.Errorf("%w: %s", err, killSwitch.Reason)
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+handleKillSwitchMessage disables or enables the launches of a task profile, e.g. '{"action": "disable", "Profile": "linux-large", "Reason": "..."}',
+so pool owners can stop their pool at runtime, e.g. from a pipeline, without changing the controller configuration.
+While a profile is disabled, its jobs fail their check without starting an agent, see checkKillSwitch.
+
+Messages are authorized by authorizeAction, either:
+  - signed with ACTION_SIGNING_SECRET, which may also toggle the kill switch of every launch, with the * profile
+  - or carrying the Job of a running pipeline of one of the 'owners' projects of the profile, see TaskProfile,
+    e.g. '{"action": "disable", "Profile": "linux-large", "Job": {"PlanUrl": "...", "ProjectId": "...", "HubName": "build", "PlanId": "...", "JobId": "...", "AuthToken": "$(System.AccessToken)"}}'
+
+Unauthorized messages are dropped, and emit the RejectedPayloads metric, failures to validate job access tokens are redelivered.
+Toggling a kill switch sends a 'Kill Switch' alert event.
+It requires the state store.
+*/
+func handleKillSwitchMessage(ctx context.Context, record events.SQSMessage, message *ActionMessage) error {
+	logger := slog.With(slog.String("action", message.Action), slog.String("profile", message.Profile))
+
+	if stateStore == nil {
+		return fmt.Errorf("kill switches require the state store")
+	}
+
+	changedBy, err := authorizeKillSwitch(record, message)
+	if err != nil && !errors.Is(err, ErrActionUnauthorized) {
+		return err
+	}
+	if err != nil {
+		logger.Error("rejected kill switch message", slog.Any("err", err))
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "KillSwitchAuthorization"})
+		return nil
+	}
+
+	killSwitch := &KillSwitch{
+		Profile:   message.Profile,
+		Disabled:  message.Action == ActionDisable,
+		Reason:    message.Reason,
+		ChangedBy: changedBy,
+		ChangedAt: time.Now().UTC(),
+	}
+	err = stateStore.PutKillSwitch(ctx, killSwitch)
+	if err != nil {
+		return err
+	}
+
+	alert := map[string]any{
+		"controller": controllerID,
+		"profile":    killSwitch.Profile,
+		"disabled":   killSwitch.Disabled,
+		"reason":     killSwitch.Reason,
+		"changedBy":  killSwitch.ChangedBy,
+		"changedAt":  formatTimestamp(killSwitch.ChangedAt),
+	}
+	logger.Warn("kill switch toggled", slog.Any("alert", alert))
+	EmitMetric("KillSwitchToggles", 1, MetricUnitCount, map[string]string{"Profile": killSwitch.Profile})
+	putAlertEvent(ctx, "Kill Switch", alert)
+	return nil
+}
+
+/*
+authorizeKillSwitch returns who toggles a kill switch, authorized by authorizeAction,
+or an error wrapping ErrActionUnauthorized: unsigned messages may only toggle profiles owned by the project of their job access token.
+*/
+func authorizeKillSwitch(record events.SQSMessage, message *ActionMessage) (string, error) {
+	if message.Profile != KillSwitchAllProfiles && FindProfile(taskProfiles, message.Profile) == nil {
+		return "", fmt.Errorf("%w: unknown profile %q", ErrActionUnauthorized, message.Profile)
+	}
+
+	authorization, err := authorizeAction(record, message)
+	if err != nil {
+		return "", err
+	}
+	if authorization.Signed {
+		return authorization.Principal, nil
+	}
+
+	if message.Profile == KillSwitchAllProfiles {
+		return "", fmt.Errorf("%w: the kill switch of every launch requires a signed message", ErrActionUnauthorized)
+	}
+	owners := FindProfile(taskProfiles, message.Profile).Owners
+	if !slices.ContainsFunc(owners, func(owner string) bool { return strings.EqualFold(owner, authorization.ProjectID) }) {
+		return "", fmt.Errorf("%w: project %s is not an owner of the profile", ErrActionUnauthorized, authorization.ProjectID)
+	}
+	return authorization.Principal, nil
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KMSValuePrefix marks environment variable values that are base64-encoded AWS KMS ciphertexts
+const KMSValuePrefix = "kms:"
+
+/*
+DecryptKMSEnvVars replaces encrypted environment variable values with their plaintext,
+so every configuration reader sees decrypted values. A value is decrypted if it:
+  - starts with 'kms:' followed by a base64-encoded ciphertext, or
+  - belongs to a variable listed in KMS_ENCRYPTED_ENV_VARS (comma-separated), and is a base64-encoded ciphertext
+
+Ciphertexts produced by the AWS Lambda console encryption helpers, which bind the
+function name as encryption context, are supported as well.
+
+The KMS client is only created if a value needs decrypting, so the AWS configuration it needs can load
+while the environment is scanned, and values are decrypted concurrently to keep cold starts short.
+
+See:
+
+https://docs.aws.amazon.com/lambda/latest/dg/configuration-envvars-encryption.html
+*/
+func DecryptKMSEnvVars(ctx context.Context, newClient func() (*kms.Client, error)) error {
+	listed := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("KMS_ENCRYPTED_ENV_VARS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			listed[name] = true
+		}
+	}
+
+	ciphertexts := map[string]string{}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+
+		ciphertext, prefixed := strings.CutPrefix(value, KMSValuePrefix)
+		if prefixed || listed[name] {
+			ciphertexts[name] = ciphertext
+		}
+	}
+
+	if len(ciphertexts) == 0 {
+		return nil
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		plaintexts = map[string]string{}
+		errs       []error
+	)
+	for name, ciphertext := range ciphertexts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			plaintext, err := decryptKMSValue(ctx, client, ciphertext)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to decrypt environment variable %s: %w", name, err))
+				return
+			}
+			plaintexts[name] = plaintext
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for name, plaintext := range plaintexts {
+		err := os.Setenv(name, plaintext)
+		if err != nil {
+			return fmt.Errorf("failed to set environment variable %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// decryptKMSValue decrypts a base64-encoded ciphertext, retrying with the Lambda function name as encryption context
+func decryptKMSValue(ctx context.Context, client *kms.Client, value string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 ciphertext: %w", err)
+	}
+
+	result, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+		if functionName == "" {
+			return "", err
+		}
+
+		var retryErr error
+		result, retryErr = client.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob:    blob,
+			EncryptionContext: map[string]string{"LambdaFunctionName": functionName},
+		})
+		if retryErr != nil {
+			return "", fmt.Errorf("%w, and with the function name as encryption context: %w", err, retryErr)
+		}
+	}
+
+	return string(result.Plaintext), nil
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// LatencySLOConfig contains configuration values for the queue latency SLO of agents
+type LatencySLOConfig struct {
+	Threshold time.Duration // The queue to RUNNING latency that agents should be within
+	Target    float64       // The fraction of agents that should be within the threshold
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - QUEUE_LATENCY_SLO_SECONDS: The queue to RUNNING latency that agents should be within (default: 90)
+  - QUEUE_LATENCY_SLO_TARGET: The fraction of agents that should be within the threshold, e.g. 0.95 (default: 0.95)
+*/
+func (config *LatencySLOConfig) ReadFromEnv() {
+	thresholdStr := ReadEnvVarWithDefault("QUEUE_LATENCY_SLO_SECONDS", "90")
+	threshold, err := strconv.Atoi(thresholdStr)
+	if err != nil || threshold <= 0 {
+		slog.Error("failed to parse QUEUE_LATENCY_SLO_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.Threshold = time.Duration(threshold) * time.Second
+
+	targetStr := ReadEnvVarWithDefault("QUEUE_LATENCY_SLO_TARGET", "0.95")
+	target, err := strconv.ParseFloat(targetStr, 64)
+	if err != nil || target <= 0 || target > 1 {
+		slog.Error("failed to parse QUEUE_LATENCY_SLO_TARGET", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.Target = target
+}
+
+/*
+LatencyTracker tracks the latency between a job being queued and its agent running, per agent pool.
+
+Every sample is emitted as the QueueLatency metric, whose percentile statistics are available in CloudWatch,
+and the p50, p90 and p99 of the samples of an invocation are emitted on Flush,
+along with a 'Queue Latency SLO Burn' alert when more agents than the target allows missed the threshold.
+*/
+type LatencyTracker struct {
+	Config *LatencySLOConfig // The SLO configuration
+
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+}
+
+// Observe records the queue to RUNNING latency of an agent of the pool
+func (t *LatencyTracker) Observe(pool string, latency time.Duration) {
+	EmitMetric("QueueLatency", latency.Seconds(), MetricUnitSeconds, map[string]string{"Pool": pool})
+	if latency > t.Config.Threshold {
+		EmitMetric("QueueLatencySLOBreaches", 1, MetricUnitCount, map[string]string{"Pool": pool})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == nil {
+		t.samples = map[string][]time.Duration{}
+	}
+	t.samples[pool] = append(t.samples[pool], latency)
+}
+
+// Flush emits the latency percentiles of the samples observed since the last flush, and alerts on SLO burn
+func (t *LatencyTracker) Flush(ctx context.Context) {
+	t.mu.Lock()
+	samples := t.samples
+	t.samples = nil
+	t.mu.Unlock()
+
+	for _, pool := range slices.Sorted(maps.Keys(samples)) {
+		latencies := samples[pool]
+		slices.Sort(latencies)
+
+		dimensions := map[string]string{"Pool": pool}
+		EmitMetric("QueueLatencyP50", percentile(latencies, 50).Seconds(), MetricUnitSeconds, dimensions)
+		EmitMetric("QueueLatencyP90", percentile(latencies, 90).Seconds(), MetricUnitSeconds, dimensions)
+		EmitMetric("QueueLatencyP99", percentile(latencies, 99).Seconds(), MetricUnitSeconds, dimensions)
+
+		breaches := 0
+		for _, latency := range latencies {
+			if latency > t.Config.Threshold {
+				breaches++
+			}
+		}
+		breachRate := float64(breaches) / float64(len(latencies))
+		if breachRate <= 1-t.Config.Target {
+			continue
+		}
+
+		alert := map[string]any{
+			"pool":             pool,
+			"thresholdSeconds": t.Config.Threshold.Seconds(),
+			"target":           t.Config.Target,
+			"agents":           len(latencies),
+			"breaches":         breaches,
+			"p99Seconds":       percentile(latencies, 99).Seconds(),
+		}
+		slog.Error("queue latency SLO burning", slog.Any("alert", alert))
+		putAlertEvent(ctx, "Queue Latency SLO Burn", alert)
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+	return latencies[max(rank, 1)-1]
+}
+
+// queuedAt returns when the SQS message of a record was sent, or the zero time if unknown
+func queuedAt(record events.SQSMessage) time.Time {
+	sent, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(sent).UTC()
+}
+
+// latencyPool returns the name of the agent pool that latencies are tracked for
+func latencyPool() string {
+	if adoCfg == nil || adoCfg.PoolID == 0 {
+		return "default"
+	}
+	return strconv.Itoa(adoCfg.PoolID)
+}
+
+/*
+trackQueueLatency observes the queue to RUNNING latency of a job whose agent is ready,
+from when its message was queued to when the last of its tasks began running, see captureTaskDetails,
+or to now for runners that can't describe their tasks.
+*/
+func trackQueueLatency(record *JobRecord) {
+	if record.QueuedAt.IsZero() {
+		return
+	}
+
+	runningAt := time.Time{}
+	for _, task := range record.Tasks {
+		if task.StartedAt.After(runningAt) {
+			runningAt = task.StartedAt
+		}
+	}
+	if runningAt.IsZero() {
+		runningAt = time.Now()
+	}
+
+	latencyTracker.Observe(latencyPool(), runningAt.Sub(record.QueuedAt))
+}
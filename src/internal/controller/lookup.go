@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ErrInvalidTaskConfig is returned when the cluster or task definition can't run agent tasks
+var ErrInvalidTaskConfig = errors.New("invalid task configuration")
+
+// ReadLookupCacheTTLFromEnv reads ECS_LOOKUP_CACHE_TTL_SECONDS, how long cluster and task definition lookups are cached (default: 300)
+func ReadLookupCacheTTLFromEnv() time.Duration {
+	ttlStr := ReadEnvVarWithDefault("ECS_LOOKUP_CACHE_TTL_SECONDS", "300")
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil || ttl < 0 {
+		slog.Error("failed to parse ECS_LOOKUP_CACHE_TTL_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// cachedLookup is a lookup result and when it was fetched
+type cachedLookup[T any] struct {
+	value     *T
+	fetchedAt time.Time
+}
+
+/*
+ECSLookupCache caches DescribeClusters and DescribeTaskDefinition results
+for the life of the execution environment, so the pre-flight checks of every job start
+don't add API round-trips.
+
+Only successful lookups are cached, so a fixed configuration is picked up on the next job.
+*/
+type ECSLookupCache struct {
+	Client *ecs.Client   // The ECS client
+	TTL    time.Duration // How long results are cached, 0 disables caching
+
+	mu              sync.Mutex
+	clusters        map[string]cachedLookup[types.Cluster]
+	taskDefinitions map[string]cachedLookup[types.TaskDefinition]
+}
+
+// Cluster returns the cluster with the given name or ARN
+func (c *ECSLookupCache) Cluster(ctx context.Context, cluster string) (*types.Cluster, error) {
+	if value, ok := cacheGet(c, c.clusters, cluster); ok {
+		return value, nil
+	}
+
+	result, err := c.Client.DescribeClusters(ctx, &ecs.DescribeClustersInput{
+		Clusters: []string{cluster},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe cluster: %w", err)
+	}
+
+	if len(result.Clusters) == 0 {
+		return nil, fmt.Errorf("%w: cluster %s not found", ErrInvalidTaskConfig, cluster)
+	}
+
+	value := &result.Clusters[0]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clusters == nil {
+		c.clusters = map[string]cachedLookup[types.Cluster]{}
+	}
+	c.clusters[cluster] = cachedLookup[types.Cluster]{value: value, fetchedAt: time.Now()}
+	return value, nil
+}
+
+// TaskDefinition returns the task definition with the given family, family:revision or ARN
+func (c *ECSLookupCache) TaskDefinition(ctx context.Context, taskDefinition string) (*types.TaskDefinition, error) {
+	if value, ok := cacheGet(c, c.taskDefinitions, taskDefinition); ok {
+		return value, nil
+	}
+
+	result, err := c.Client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinition),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe task definition: %w", err)
+	}
+
+	value := result.TaskDefinition
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.taskDefinitions == nil {
+		c.taskDefinitions = map[string]cachedLookup[types.TaskDefinition]{}
+	}
+	c.taskDefinitions[taskDefinition] = cachedLookup[types.TaskDefinition]{value: value, fetchedAt: time.Now()}
+	return value, nil
+}
+
+// cacheGet returns a cached lookup result that hasn't expired
+func cacheGet[T any](c *ECSLookupCache, entries map[string]cachedLookup[T], key string) (*T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := entries[key]
+	if !ok || time.Since(entry.fetchedAt) >= c.TTL {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+/*
+isTaskConfigError reports whether an error of the runner is an invalid cluster, task definition or task size,
+which retries can't fix: the check fails with the validation message instead of the record being redelivered,
+and the error isn't counted by the RunTask circuit breaker, since ECS didn't fail.
+*/
+func isTaskConfigError(err error) bool {
+	return errors.Is(err, ErrInvalidTaskConfig) || errors.Is(err, ErrInvalidTaskSize)
+}
+
+/*
+Validate returns an error wrapping ErrInvalidTaskConfig unless the cluster is active,
+and the task definition is active, compatible with the launch type, and uses the configured network mode.
+
+Fargate tasks also return an error wrapping ErrInvalidTaskSize unless their CPU and memory, overridden or from the task definition,
+are supported for the task definition's runtime platform, see ValidateFargateSize.
+*/
+func (c *ECSLookupCache) Validate(ctx context.Context, config *ECSTaskConfig) error {
+	cluster, err := c.Cluster(ctx, config.Cluster)
+	if err != nil {
+		return err
+	}
+
+	if aws.ToString(cluster.Status) != "ACTIVE" {
+		return fmt.Errorf("%w: cluster %s is %s", ErrInvalidTaskConfig, config.Cluster, aws.ToString(cluster.Status))
+	}
+
+	taskDefinition, err := c.TaskDefinition(ctx, config.TaskDefinition)
+	if err != nil {
+		return err
+	}
+
+	if taskDefinition.Status != types.TaskDefinitionStatusActive {
+		return fmt.Errorf("%w: task definition %s is %s", ErrInvalidTaskConfig, config.TaskDefinition, taskDefinition.Status)
+	}
+
+	compatibility := types.CompatibilityFargate
+	if config.LaunchType == string(types.LaunchTypeEc2) {
+		compatibility = types.CompatibilityEc2
+	}
+	// task definitions that don't require compatibilities are EC2-compatible
+	compatible := slices.Contains(taskDefinition.RequiresCompatibilities, compatibility) ||
+		(compatibility == types.CompatibilityEc2 && len(taskDefinition.RequiresCompatibilities) == 0)
+	if !compatible {
+		return fmt.Errorf("%w: task definition %s is not %s-compatible", ErrInvalidTaskConfig, config.TaskDefinition, compatibility)
+	}
+
+	// task definitions that don't set a network mode use bridge on EC2
+	networkMode := string(taskDefinition.NetworkMode)
+	if networkMode == "" {
+		networkMode = string(types.NetworkModeBridge)
+	}
+	if config.NetworkMode != "" && networkMode != config.NetworkMode {
+		return fmt.Errorf("%w: task definition %s uses the %s network mode, not %s", ErrInvalidTaskConfig, config.TaskDefinition, networkMode, config.NetworkMode)
+	}
+
+	if compatibility != types.CompatibilityFargate {
+		return nil
+	}
+
+	cpu, memory := aws.ToString(taskDefinition.Cpu), aws.ToString(taskDefinition.Memory)
+	if config.CPU != "" {
+		cpu = config.CPU
+	}
+	if config.Memory != "" {
+		memory = config.Memory
+	}
+
+	var family types.OSFamily
+	var architecture types.CPUArchitecture
+	if taskDefinition.RuntimePlatform != nil {
+		family = taskDefinition.RuntimePlatform.OperatingSystemFamily
+		architecture = taskDefinition.RuntimePlatform.CpuArchitecture
+	}
+
+	return ValidateFargateSize(cpu, memory, family, architecture)
+}
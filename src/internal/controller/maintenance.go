@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// Maintenance modes
+const (
+	MaintenanceModeOff     = "off"     // Jobs are processed normally
+	MaintenanceModeFail    = "fail"    // Checks fail immediately with the maintenance message
+	MaintenanceModeRequeue = "requeue" // Records are redelivered after the maintenance delay
+)
+
+// ErrMaintenanceMode is returned for records that are requeued because the controller is in maintenance mode
+var ErrMaintenanceMode = errors.New("pools under maintenance")
+
+// MaintenanceConfig contains configuration values for draining pools during maintenance
+type MaintenanceConfig struct {
+	Mode                string // The maintenance mode, one of the MaintenanceMode values
+	Message             string // The message appended to the timeline of failed checks
+	RequeueDelaySeconds int32  // The delay before requeued records are redelivered
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - MAINTENANCE_MODE: off, fail to fail checks immediately without launching agents, or requeue to redeliver records later (default: off)
+  - MAINTENANCE_MESSAGE: The message appended to the timeline of checks failed in maintenance mode (default: Agent pools are under maintenance, please retry later)
+  - MAINTENANCE_REQUEUE_DELAY_SECONDS: The delay before records requeued in maintenance mode are redelivered (default: 900)
+*/
+func (config *MaintenanceConfig) ReadFromEnv() {
+	config.Mode = ReadEnvVarWithDefault("MAINTENANCE_MODE", MaintenanceModeOff)
+	if config.Mode != MaintenanceModeOff && config.Mode != MaintenanceModeFail && config.Mode != MaintenanceModeRequeue {
+		slog.Error("failed to parse MAINTENANCE_MODE", slog.String("value", config.Mode))
+		os.Exit(1)
+	}
+
+	config.Message = ReadEnvVarWithDefault("MAINTENANCE_MESSAGE", "Agent pools are under maintenance, please retry later")
+
+	delayStr := ReadEnvVarWithDefault("MAINTENANCE_REQUEUE_DELAY_SECONDS", "900")
+	delay, err := strconv.ParseInt(delayStr, 10, 32)
+	if err != nil || delay < 0 || delay > sqsMaxVisibilityTimeout {
+		slog.Error("failed to parse MAINTENANCE_REQUEUE_DELAY_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.RequeueDelaySeconds = int32(delay)
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// messageOutcomePrefix prefixes the state table keys of message outcomes
+const messageOutcomePrefix = "message#"
+
+// Outcomes of queue messages, besides the succeeded and failed results of the callbacks of jobs
+const (
+	MessageOutcomeHandled        = "handled"        // The message was handled without a callback, e.g. a stop message, a dropped payload or a re-check
+	MessageOutcomeDeferred       = "deferred"       // The message was deferred by fair-share scheduling and will be redelivered
+	MessageOutcomeRedelivered    = "redelivered"    // Handling the message failed and it will be redelivered
+	MessageOutcomeCallbackFailed = "callbackfailed" // The callback of the job failed and the message will be redelivered
+)
+
+// ErrMessageNotFound is returned when no outcome is recorded for a message
+var ErrMessageNotFound = errors.New("message not found")
+
+/*
+MessageOutcome is what happened to a delivery of a queue message, recorded so operators investigating
+DLQ contents or redeliveries can trace a message to its job and agent, see recordMessageOutcomes.
+*/
+type MessageOutcome struct {
+	Key          string    `dynamodbav:"JobId" json:"-"`                             // The state table key, messageOutcomePrefix followed by the message ID (partition key)
+	MessageID    string    `dynamodbav:"MessageId" json:"messageId"`                 // The SQS message ID
+	CheckID      string    `dynamodbav:"CheckId,omitempty" json:"checkId,omitempty"` // The check ID of the message's job, if it carried an ADO payload
+	TaskARN      string    `dynamodbav:"TaskArn,omitempty" json:"taskArn,omitempty"` // The ID of the agent started for the job, if any
+	Outcome      string    `dynamodbav:"Outcome" json:"outcome"`                     // The callback result, or one of the MessageOutcome values
+	Error        string    `dynamodbav:"Error,omitempty" json:"error,omitempty"`     // The error of a message that will be redelivered
+	ReceiveCount int       `dynamodbav:"ReceiveCount" json:"receiveCount"`           // The number of times the message was received
+	RecordedAt   time.Time `dynamodbav:"RecordedAt" json:"recordedAt"`               // When the outcome was recorded
+	ExpiresAt    int64     `dynamodbav:"ExpiresAt" json:"-"`                         // Epoch seconds after which DynamoDB TTL deletes the outcome
+	History      []string  `dynamodbav:"History,omitempty" json:"history,omitempty"` // The outcomes of the previous deliveries of the message
+}
+
+// newMessageOutcome returns the outcome of a delivery of a queue message, with the check ID of the ADO payload it carries, if any
+func newMessageOutcome(record events.SQSMessage, outcome string, err error) *MessageOutcome {
+	trace := &MessageOutcome{MessageID: record.MessageId, Outcome: outcome, RecordedAt: time.Now().UTC()}
+	trace.ReceiveCount, _ = strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+	if err != nil {
+		trace.Error = err.Error()
+	}
+
+	var payload ADOPayload
+	if json.Unmarshal([]byte(record.Body), &payload) == nil && payload.JobID != "" {
+		trace.CheckID = payload.CheckID()
+	}
+	return trace
+}
+
+/*
+recordMessageOutcomes logs a 'message outcome' record per delivered message, which a CloudWatch Logs Insights query such as
+'filter msg = "message outcome" and messageId = "..."' traces,
+and, with the state store, saves them for the admin API's GET /messages/{messageId}.
+
+The outcomes of redeliveries are saved over the previous ones, whose outcomes are kept in their History.
+*/
+func recordMessageOutcomes(ctx context.Context, outcomes []*MessageOutcome) {
+	for _, trace := range outcomes {
+		if trace.TaskARN == "" && trace.CheckID != "" && stateStore != nil {
+			if jobRecord, err := stateStore.Get(ctx, trace.CheckID); err == nil {
+				trace.TaskARN = jobRecord.TaskARN
+			}
+		}
+
+		slog.Info("message outcome", slog.String("messageId", trace.MessageID), slog.String("checkId", trace.CheckID), slog.String("taskArn", trace.TaskARN), slog.String("outcome", trace.Outcome), slog.Int("receiveCount", trace.ReceiveCount), slog.String("error", trace.Error))
+
+		if stateStore == nil {
+			continue
+		}
+		err := stateStore.PutMessageOutcome(ctx, trace)
+		if err != nil {
+			dependencies.Fallback(DependencyStateStore, "save message outcome", err)
+		}
+	}
+}
+
+// PutMessageOutcome writes the outcome of a delivery of a message, keeping the outcomes of its previous deliveries
+func (s *StateStore) PutMessageOutcome(ctx context.Context, trace *MessageOutcome) error {
+	previous, err := s.GetMessageOutcome(ctx, trace.MessageID)
+	if err == nil {
+		trace.History = append(previous.History, fmt.Sprintf("%s: %s", formatTimestamp(previous.RecordedAt), previous.Outcome))
+	} else if !errors.Is(err, ErrMessageNotFound) {
+		return err
+	}
+
+	trace.Key = messageOutcomePrefix + trace.MessageID
+	trace.ExpiresAt = trace.RecordedAt.Add(s.Config.TTL).Unix()
+
+	item, err := attributevalue.MarshalMap(trace)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message outcome: %w", err)
+	}
+
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put message outcome: %w", err)
+	}
+
+	return nil
+}
+
+// GetMessageOutcome returns the outcome of the last delivery of a message
+func (s *StateStore) GetMessageOutcome(ctx context.Context, messageID string) (trace *MessageOutcome, err error) {
+	key, err := attributevalue.MarshalMap(map[string]string{"JobId": messageOutcomePrefix + messageID})
+	if err != nil {
+		return
+	}
+
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Config.TableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to get message outcome: %w", err)
+		return
+	}
+
+	if result.Item == nil {
+		err = ErrMessageNotFound
+		return
+	}
+
+	trace = new(MessageOutcome)
+	err = attributevalue.UnmarshalMap(result.Item, trace)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal message outcome: %w", err)
+	}
+
+	return
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// MetadataProvider is implemented by runners that can describe a started agent
+type MetadataProvider interface {
+	Metadata(ctx context.Context, id string) (metadata map[string]string, err error) // Returns metadata of the agent, keyed by variable name
+}
+
+/*
+agentMetadata returns the metadata of an agent reported alongside the TaskCompleted callback:
+  - AgentId: the ID of the agent started by the runner
+  - AgentRegion: the AWS region of the controller
+  - AgentStartupSeconds: how long the agent took to start
+  - any metadata of the runner, e.g. AgentTaskArn, AgentCluster, AgentName and AgentImageDigest for the ecs backend
+  - the metadata reported for agents of ADO elastic pools, if the agent is registered in the pool of ADO_PAT and ADO_POOL_ID:
+    AgentPoolId, AgentVersion, AgentOS, AgentComputerName and AgentCapabilities, a JSON object of the user capabilities
+*/
+func agentMetadata(ctx context.Context, id string, name string, startedAt time.Time) map[string]string {
+	metadata := map[string]string{
+		"AgentId":             id,
+		"AgentRegion":         cfg.Region,
+		"AgentStartupSeconds": strconv.FormatInt(int64(time.Since(startedAt).Seconds()), 10),
+	}
+
+	pool, err := poolMetadata(id, name)
+	if err != nil {
+		slog.Warn("failed to describe pool agent metadata", slog.String("id", id), slog.Any("err", err))
+	}
+	maps.Copy(metadata, pool)
+
+	provider, ok := runner.(MetadataProvider)
+	if !ok {
+		return metadata
+	}
+
+	runnerMetadata, err := provider.Metadata(ctx, id)
+	if err != nil {
+		slog.Warn("failed to describe agent metadata", slog.String("id", id), slog.Any("err", err))
+		return metadata
+	}
+
+	maps.Copy(metadata, runnerMetadata)
+	return metadata
+}
+
+// poolMetadata returns the elastic pool metadata of the registered agent of the first task, matched by name, see agentMatches, if any
+func poolMetadata(id string, name string) (metadata map[string]string, err error) {
+	if !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return
+	}
+
+	agents, err := ADOListAgentsWithCapabilities(adoClient, adoCfg)
+	if err != nil {
+		return
+	}
+
+	taskARN, _, _ := strings.Cut(id, ",")
+	index := slices.IndexFunc(agents, func(agent ADOAgent) bool {
+		return agentMatches(agent, taskARN, name)
+	})
+	if index < 0 {
+		return
+	}
+
+	agent := agents[index]
+	capabilities, err := json.Marshal(agent.UserCapabilities)
+	if err != nil {
+		return
+	}
+
+	metadata = map[string]string{
+		"AgentPoolId":       strconv.Itoa(adoCfg.PoolID),
+		"AgentVersion":      agent.Version,
+		"AgentOS":           agent.OSDescription,
+		"AgentComputerName": agent.SystemCapabilities["Agent.ComputerName"],
+		"AgentCapabilities": string(capabilities),
+	}
+	return
+}
+
+// Metadata describes the first task of the job: its ARN, cluster, name and agent container image digest
+func (r *ECSRunner) Metadata(ctx context.Context, id string) (metadata map[string]string, err error) {
+	taskARN, _, _ := strings.Cut(id, ",")
+
+	task, err := DescribeTask(ctx, r.Client, &ECSTaskReadConfig{
+		Cluster: r.Config.Cluster,
+		TaskARN: taskARN,
+	})
+	if err != nil {
+		return
+	}
+
+	metadata = map[string]string{
+		"AgentTaskArn": taskARN,
+		"AgentCluster": aws.ToString(task.ClusterArn),
+		"AgentName":    taskARN[strings.LastIndex(taskARN, "/")+1:],
+	}
+
+	for _, container := range task.Containers {
+		if aws.ToString(container.Name) == r.Config.AgentContainer && container.ImageDigest != nil {
+			metadata["AgentImageDigest"] = aws.ToString(container.ImageDigest)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric units supported by Amazon CloudWatch
+const (
+	MetricUnitCount        = "Count"
+	MetricUnitPercent      = "Percent"
+	MetricUnitSeconds      = "Seconds"
+	MetricUnitMilliseconds = "Milliseconds"
+	MetricUnitNone         = "None"
+)
+
+// emfEnabled is whether metrics are written to the log in the CloudWatch embedded metric format, see PrometheusConfig
+var emfEnabled = true
+
+// prometheusMetrics is nil unless metrics are served on the Prometheus-compatible endpoint
+var prometheusMetrics *PrometheusRegistry
+
+// metricBatch is nil unless the EMF metrics of invocations are batched, see MetricBatch
+var metricBatch *MetricBatch
+
+// metricsNamespace is the CloudWatch namespace of the metrics emitted by the controller
+var metricsNamespace = ReadEnvVarWithDefault("METRICS_NAMESPACE", "AzurePipelinesECSController")
+
+/*
+EmitMetric writes a metric to the log in the CloudWatch embedded metric format,
+which CloudWatch Logs extracts into a CloudWatch metric in the METRICS_NAMESPACE namespace
+(default: AzurePipelinesECSController).
+
+See:
+
+https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+*/
+func EmitMetric(name string, value float64, unit string, dimensions map[string]string) {
+	if prometheusMetrics != nil {
+		prometheusMetrics.Observe(name, value, unit, dimensions)
+	}
+	if !emfEnabled {
+		return
+	}
+	if metricBatch != nil {
+		metricBatch.Add(name, value, unit, dimensions)
+		return
+	}
+
+	writeEMF(dimensions, []emfMetric{{Name: name, Unit: unit, Values: []float64{value}}})
+}
+
+// emfMetric is a metric of an EMF log record and its values
+type emfMetric struct {
+	Name   string    // The metric name
+	Unit   string    // The metric unit
+	Values []float64 // The values, at most emfMaxValues
+}
+
+// Limits of the CloudWatch embedded metric format
+const (
+	emfMaxMetrics = 100 // The maximum number of metrics of a log record
+	emfMaxValues  = 100 // The maximum number of values of a metric
+)
+
+// writeEMF writes metrics with the same dimensions to the log as an EMF record, a metric with several values as an array
+func writeEMF(dimensions map[string]string, metrics []emfMetric) {
+	dimensionKeys := slices.Sorted(maps.Keys(dimensions))
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, metric := range metrics {
+		definitions = append(definitions, map[string]string{"Name": metric.Name, "Unit": metric.Unit})
+	}
+
+	attrs := []any{
+		slog.Any("_aws", map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{
+				{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{dimensionKeys},
+					"Metrics":    definitions,
+				},
+			},
+		}),
+	}
+	for _, metric := range metrics {
+		if len(metric.Values) == 1 {
+			attrs = append(attrs, slog.Float64(metric.Name, metric.Values[0]))
+		} else {
+			attrs = append(attrs, slog.Any(metric.Name, metric.Values))
+		}
+	}
+	for _, key := range dimensionKeys {
+		attrs = append(attrs, slog.String(key, dimensions[key]))
+	}
+
+	slog.Info("metric", attrs...)
+}
+
+// metricGroup is the batched metrics of a set of dimensions
+type metricGroup struct {
+	dimensions map[string]string
+	metrics    []emfMetric
+}
+
+/*
+MetricBatch batches the EMF metrics of an invocation, written by Flush at its end,
+into a log record per set of dimensions, with the values of each metric as an array,
+so high-throughput invocations write a few log records instead of one per metric.
+Groups reaching the EMF limits are written early.
+*/
+type MetricBatch struct {
+	mu     sync.Mutex
+	groups map[string]*metricGroup
+}
+
+// Add batches a metric value
+func (b *MetricBatch) Add(name string, value float64, unit string, dimensions map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var key strings.Builder
+	for _, dimension := range slices.Sorted(maps.Keys(dimensions)) {
+		key.WriteString(dimension + "=" + dimensions[dimension] + "\x00")
+	}
+
+	if b.groups == nil {
+		b.groups = map[string]*metricGroup{}
+	}
+	group, ok := b.groups[key.String()]
+	if !ok {
+		group = &metricGroup{dimensions: maps.Clone(dimensions)}
+		b.groups[key.String()] = group
+	}
+
+	index := slices.IndexFunc(group.metrics, func(metric emfMetric) bool { return metric.Name == name && metric.Unit == unit })
+	if index < 0 {
+		if len(group.metrics) == emfMaxMetrics {
+			writeEMF(group.dimensions, group.metrics)
+			group.metrics = nil
+		}
+		group.metrics = append(group.metrics, emfMetric{Name: name, Unit: unit})
+		index = len(group.metrics) - 1
+	}
+
+	group.metrics[index].Values = append(group.metrics[index].Values, value)
+	if len(group.metrics[index].Values) == emfMaxValues {
+		writeEMF(group.dimensions, group.metrics)
+		group.metrics = nil
+	}
+}
+
+// Flush writes the batched metrics, it's a no-op for a nil batch
+func (b *MetricBatch) Flush() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range slices.Sorted(maps.Keys(b.groups)) {
+		if group := b.groups[key]; len(group.metrics) > 0 {
+			writeEMF(group.dimensions, group.metrics)
+		}
+	}
+	b.groups = nil
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// RunTaskMutator changes the AWS ECS RunTask input of agent tasks before the call
+type RunTaskMutator func(input *ecs.RunTaskInput) error
+
+// RunTaskMutatorConfig configures a RunTaskMutator
+type RunTaskMutatorConfig struct {
+	Name    string            `json:"name"`    // The name of the mutator, one of runTaskMutatorFactories
+	Options map[string]string `json:"options"` // The options of the mutator
+}
+
+/*
+runTaskMutatorFactories creates the mutators by name from their options,
+organization-specific mutators are added by registering them here:
+  - tags: adds the options as tags of the tasks
+  - subnets: restricts the subnets of the tasks to the comma-separated 'allowed' option, failing if none is left
+  - group: sets the task group from the 'template' option, where {key} is replaced by the task tag with that key, e.g. 'ado/{ado:project}'
+*/
+var runTaskMutatorFactories = map[string]func(options map[string]string) (RunTaskMutator, error){
+	"tags":    newTagsMutator,
+	"subnets": newSubnetsMutator,
+	"group":   newGroupMutator,
+}
+
+/*
+ReadRunTaskMutatorsFromEnv reads the following optional environment variable
+and returns the configured mutators, applied in order:
+  - RUN_TASK_MUTATORS: A JSON list of mutators, e.g. '[{"name": "tags", "options": {"team": "platform"}}]'
+*/
+func ReadRunTaskMutatorsFromEnv() (mutators []RunTaskMutator) {
+	var configs []RunTaskMutatorConfig
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("RUN_TASK_MUTATORS", "[]")), &configs)
+	if err != nil {
+		slog.Error("failed to parse RUN_TASK_MUTATORS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	for _, config := range configs {
+		factory, ok := runTaskMutatorFactories[config.Name]
+		if !ok {
+			slog.Error(fmt.Sprintf("failed to parse RUN_TASK_MUTATORS: unknown mutator %s", config.Name))
+			os.Exit(1)
+		}
+
+		mutator, err := factory(config.Options)
+		if err != nil {
+			slog.Error("failed to parse RUN_TASK_MUTATORS", slog.String("mutator", config.Name), slog.Any("err", err))
+			os.Exit(1)
+		}
+		mutators = append(mutators, mutator)
+	}
+
+	return
+}
+
+// applyRunTaskMutators applies the mutators to the RunTask input in order
+func applyRunTaskMutators(input *ecs.RunTaskInput, mutators []RunTaskMutator) error {
+	for _, mutator := range mutators {
+		err := mutator(input)
+		if err != nil {
+			return fmt.Errorf("failed to apply RunTask mutator: %w", err)
+		}
+	}
+	return nil
+}
+
+// newTagsMutator returns a mutator adding the options as tags, overriding tags with the same keys
+func newTagsMutator(options map[string]string) (RunTaskMutator, error) {
+	return func(input *ecs.RunTaskInput) error {
+		input.Tags = slices.DeleteFunc(input.Tags, func(tag types.Tag) bool {
+			_, overridden := options[aws.ToString(tag.Key)]
+			return overridden
+		})
+		input.Tags = append(input.Tags, ecsTags(options)...)
+		return nil
+	}, nil
+}
+
+// newSubnetsMutator returns a mutator restricting the subnets of awsvpc tasks to the allowed ones
+func newSubnetsMutator(options map[string]string) (RunTaskMutator, error) {
+	if options["allowed"] == "" {
+		return nil, fmt.Errorf("the subnets mutator requires the 'allowed' option")
+	}
+	allowed := strings.Split(options["allowed"], ",")
+
+	return func(input *ecs.RunTaskInput) error {
+		if input.NetworkConfiguration == nil || input.NetworkConfiguration.AwsvpcConfiguration == nil {
+			return nil
+		}
+
+		vpc := input.NetworkConfiguration.AwsvpcConfiguration
+		vpc.Subnets = slices.DeleteFunc(slices.Clone(vpc.Subnets), func(subnet string) bool {
+			return !slices.Contains(allowed, subnet)
+		})
+		if len(vpc.Subnets) == 0 {
+			return fmt.Errorf("none of the subnets of the task are allowed")
+		}
+		return nil
+	}, nil
+}
+
+// newGroupMutator returns a mutator setting the task group from a template of task tags
+func newGroupMutator(options map[string]string) (RunTaskMutator, error) {
+	template := options["template"]
+	if template == "" {
+		return nil, fmt.Errorf("the group mutator requires the 'template' option")
+	}
+
+	return func(input *ecs.RunTaskInput) error {
+		tags := map[string]string{}
+		for _, tag := range input.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+
+		group := template
+		for _, key := range slices.Sorted(maps.Keys(tags)) {
+			group = strings.ReplaceAll(group, "{"+key+"}", tags[key])
+		}
+		input.Group = aws.String(group)
+		return nil
+	}, nil
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+)
+
+/*
+ReadPayloadVariablesFromEnv reads the following optional environment variable
+and returns the allow-list of payload variables passed through to the agent container, by variable name:
+  - PAYLOAD_VARIABLES: A JSON object mapping payload 'Variables' names to environment variable names, e.g. '{"TargetEnvironment": "TARGET_ENVIRONMENT"}'
+*/
+func ReadPayloadVariablesFromEnv() (mapping map[string]string) {
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("PAYLOAD_VARIABLES", "{}")), &mapping)
+	if err != nil {
+		slog.Error("failed to parse PAYLOAD_VARIABLES", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return
+}
+
+/*
+applyPayloadVariables returns a copy of the task configuration with the allow-listed variables of the payload
+added to the agent container environment.
+
+Variables that aren't allow-listed are ignored, and variables never override
+the environment set by the task profile, so that pipelines can't forge agent capabilities.
+*/
+func applyPayloadVariables(config *ECSTaskConfig, mapping map[string]string, payload *ADOPayload) *ECSTaskConfig {
+	if len(payload.Variables) == 0 {
+		return config
+	}
+
+	result := *config
+	result.Environment = maps.Clone(config.Environment)
+	if result.Environment == nil {
+		result.Environment = map[string]string{}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(payload.Variables)) {
+		envName, allowed := mapping[name]
+		if !allowed {
+			slog.Warn("ignored payload variable not in PAYLOAD_VARIABLES", slog.String("jobId", payload.JobID), slog.String("name", name))
+			continue
+		}
+		if _, exists := result.Environment[envName]; exists {
+			continue
+		}
+		result.Environment[envName] = payload.Variables[name]
+	}
+
+	return &result
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterTarget is a cluster that a task profile places its agents on
+type ClusterTarget struct {
+	Name     string `json:"name"`     // The cluster name or ARN
+	Capacity int    `json:"capacity"` // The number of tasks the cluster is sized for, 0 to balance by task count alone
+}
+
+// ReadClusterStickinessFromEnv reads CLUSTER_STICKINESS_SECONDS, how long the agents of a project keep being placed on the same cluster (default: 600)
+func ReadClusterStickinessFromEnv() time.Duration {
+	stickinessStr := ReadEnvVarWithDefault("CLUSTER_STICKINESS_SECONDS", "600")
+	stickiness, err := strconv.Atoi(stickinessStr)
+	if err != nil || stickiness < 0 {
+		slog.Error("failed to parse CLUSTER_STICKINESS_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return time.Duration(stickiness) * time.Second
+}
+
+// stickyCluster is the cluster a project was last placed on
+type stickyCluster struct {
+	cluster  string
+	placedAt time.Time
+}
+
+/*
+ClusterPlacer places the agents of task profiles with several clusters on the least utilized one,
+the one with the lowest share of its capacity taken by running and pending tasks,
+or the one with the fewest tasks if the clusters don't set a capacity.
+
+The agents of a project keep being placed on the same cluster for CLUSTER_STICKINESS_SECONDS,
+so a project's jobs share cached images and network paths,
+unless that cluster is at capacity. The clusters must share the network configuration of the agents.
+*/
+type ClusterPlacer struct {
+	Lookups    *ECSLookupCache // The cache of cluster descriptions, whose task counts are as fresh as its TTL
+	Stickiness time.Duration   // How long the agents of a project keep being placed on the same cluster
+
+	mu     sync.Mutex
+	sticky map[string]stickyCluster
+}
+
+// Place returns the cluster of a project's next agent among the given clusters
+func (p *ClusterPlacer) Place(ctx context.Context, projectID string, clusters []ClusterTarget) (cluster string, err error) {
+	utilization := map[string]float64{}
+	for _, target := range clusters {
+		described, lookupErr := p.Lookups.Cluster(ctx, target.Name)
+		if lookupErr != nil {
+			slog.Warn("failed to describe cluster for placement", slog.String("cluster", target.Name), slog.Any("err", lookupErr))
+			continue
+		}
+
+		tasks := float64(described.RunningTasksCount + described.PendingTasksCount)
+		if target.Capacity > 0 {
+			tasks /= float64(target.Capacity)
+		}
+		utilization[target.Name] = tasks
+	}
+
+	if len(utilization) == 0 {
+		err = fmt.Errorf("failed to place task: none of the clusters could be described")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous, ok := p.sticky[projectID]
+	if ok && time.Since(previous.placedAt) < p.Stickiness {
+		index := slices.IndexFunc(clusters, func(target ClusterTarget) bool { return target.Name == previous.cluster })
+		used, described := utilization[previous.cluster]
+		if index >= 0 && described && (clusters[index].Capacity == 0 || used < 1) {
+			cluster = previous.cluster
+			return
+		}
+	}
+
+	for _, target := range clusters {
+		used, described := utilization[target.Name]
+		if described && (cluster == "" || used < utilization[cluster]) {
+			cluster = target.Name
+		}
+	}
+
+	if p.sticky == nil {
+		p.sticky = map[string]stickyCluster{}
+	}
+	p.sticky[projectID] = stickyCluster{cluster: cluster, placedAt: time.Now()}
+	slog.Info("placed agent on the least utilized cluster", slog.String("projectId", projectID), slog.String("cluster", cluster), slog.Float64("utilization", utilization[cluster]))
+	return
+}
+
+/*
+taskCluster returns the cluster of a task from its ARN, 'arn:aws:ecs:<region>:<account>:task/<cluster>/<id>',
+or the given default for task IDs and ARNs of the old format, which don't include the cluster.
+*/
+func taskCluster(taskARN string, defaultCluster string) string {
+	_, resource, found := strings.Cut(taskARN, ":task/")
+	if !found {
+		return defaultCluster
+	}
+	cluster, _, found := strings.Cut(resource, "/")
+	if !found {
+		return defaultCluster
+	}
+	return cluster
+}
+
+// Clusters returns the clusters that the runner's agents are placed on, the default cluster first
+func (r *ECSRunner) Clusters() []string {
+	clusters := []string{r.Config.Cluster}
+	for _, profile := range taskProfiles {
+		for _, target := range profile.Clusters {
+			if !slices.Contains(clusters, target.Name) {
+				clusters = append(clusters, target.Name)
+			}
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// Plan is what the controller would do for a payload, without doing it
+type Plan struct {
+	Backend      string            `json:"backend"`                // The runner backend
+	Profile      string            `json:"profile,omitempty"`      // The task profile selected for the job, empty for the default configuration
+	RunTaskInput *ecs.RunTaskInput `json:"runTaskInput,omitempty"` // The input of the first RunTask call, only planned for the ecs backend
+	Callback     *PlanRequest      `json:"callback"`               // The ADO callback request sent once the agent is ready
+}
+
+// PlanRequest is an HTTP request that the controller would send
+type PlanRequest struct {
+	Method string `json:"method"` // The HTTP method
+	URL    string `json:"url"`    // The request URL
+	Body   any    `json:"body"`   // The JSON request body
+}
+
+/*
+NewPlan returns the RunTask input and ADO callback request that a payload received from the queue with the given ARN would generate,
+with the stable revision of its task profile, without calling either API.
+*/
+func NewPlan(payload *ADOPayload, queueARN string) (plan *Plan, err error) {
+	profile, err := SelectPayloadProfile(payload, queueARN)
+	if err != nil {
+		return
+	}
+
+	plan = &Plan{Backend: fmt.Sprintf("%T", runner)}
+	if profile != nil {
+		plan.Profile = profile.Name
+	}
+
+	if ecsRunner, ok := runner.(*ECSRunner); ok {
+		config := ecsRunner.TaskConfig(payload, profile)
+		plan.RunTaskInput, err = NewRunTaskInput(config)
+		if err != nil {
+			return
+		}
+	}
+
+	callback := &ADOCallbackConfig{Config: adoCfg, Payload: payload, Result: "succeeded"}
+	plan.Callback = &PlanRequest{
+		Method: http.MethodPost,
+		URL:    payload.ADOEventsURL(adoCfg.Instance, adoCfg.APIVersion),
+		Body:   adoCallbackBody(callback),
+	}
+
+	return
+}
+
+/*
+RunCLI runs the controller from the command line with the same environment as the function:
+  - plan [file] [queue]: prints the plan of the payload read from the file, or from stdin if omitted or -, as received from the queue ARN or name, see NewPlan
+*/
+func RunCLI(args []string) int {
+	switch args[0] {
+	case "plan":
+		input := io.Reader(os.Stdin)
+		if len(args) > 1 && args[1] != "-" {
+			file, err := os.Open(args[1])
+			if err != nil {
+				slog.Error("failed to open payload", slog.Any("err", err))
+				return 1
+			}
+			defer file.Close()
+			input = file
+		}
+
+		var payload *ADOPayload
+		err := json.NewDecoder(input).Decode(&payload)
+		if err != nil {
+			slog.Error("failed to parse payload", slog.Any("err", err))
+			return 1
+		}
+
+		queue := ""
+		if len(args) > 2 {
+			queue = args[2]
+		}
+
+		plan, err := NewPlan(payload, queue)
+		if err != nil {
+			slog.Error("failed to plan payload", slog.Any("err", err))
+			return 1
+		}
+
+		output, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			slog.Error("failed to marshal plan", slog.Any("err", err))
+			return 1
+		}
+		fmt.Println(string(output))
+		return 0
+	default:
+		slog.Error(fmt.Sprintf("unknown command: %s", args[0]))
+		return 1
+	}
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ADOJobRequest contains the fields used by the controller from an Azure DevOps agent pool job request
+type ADOJobRequest struct {
+	RequestID  int        `json:"requestId"`  // The job request ID
+	PlanID     string     `json:"planId"`     // The plan ID
+	JobID      string     `json:"jobId"`      // The job ID
+	QueueTime  *time.Time `json:"queueTime"`  // When the job was queued
+	AssignTime *time.Time `json:"assignTime"` // When the job was assigned to an agent, nil while pending
+	FinishTime *time.Time `json:"finishTime"` // When the job finished, nil while pending or running
+}
+
+// ADOPoolJobRequestsURL generates an Azure DevOps API URL for the job requests of an agent pool
+func ADOPoolJobRequestsURL(instance string, apiVersion string, poolID int) string {
+	return fmt.Sprintf("https://%s/_apis/distributedtask/pools/%d/jobrequests?completedRequestCount=0&api-version=%s", instance, poolID, apiVersion)
+}
+
+// ADOPendingJobRequests returns the job requests of the configured agent pool that are not yet assigned to an agent
+func ADOPendingJobRequests(client *http.Client, config *ADOConfig) (pending []ADOJobRequest, err error) {
+	url := ADOPoolJobRequestsURL(config.Instance, config.APIVersion, config.PoolID)
+
+	data, err := adoOrgRequest(client, config, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []ADOJobRequest `json:"value"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		err = fmt.Errorf("failed to parse job requests: %w", err)
+		return
+	}
+
+	for _, request := range result.Value {
+		if request.AssignTime == nil && request.FinishTime == nil {
+			pending = append(pending, request)
+		}
+	}
+
+	return
+}
+
+// ADOAgent contains the fields used by the controller from an Azure DevOps agent pool agent
+type ADOAgent struct {
+	ID        int       `json:"id"`        // The agent ID
+	Name      string    `json:"name"`      // The agent name
+	Status    string    `json:"status"`    // The agent status, online or offline
+	Enabled   bool      `json:"enabled"`   // Whether the agent is enabled
+	CreatedOn time.Time `json:"createdOn"` // When the agent was registered
+
+	StatusChangedOn time.Time `json:"statusChangedOn"` // When the status of the agent last changed, e.g. when it went offline
+
+	Version            string            `json:"version"`            // The agent version
+	OSDescription      string            `json:"osDescription"`      // The agent operating system
+	SystemCapabilities map[string]string `json:"systemCapabilities"` // The capabilities detected by the agent, only listed by ADOListAgentsWithCapabilities
+	UserCapabilities   map[string]string `json:"userCapabilities"`   // The capabilities set on the agent, only listed by ADOListAgentsWithCapabilities
+
+	AssignedRequest *ADOJobRequest `json:"assignedRequest"` // The job request the agent is running, only listed by ADOListAgentsWithAssignedRequests
+}
+
+// StatusSince returns when the agent entered its current status, or when it was registered if ADO didn't report it
+func (agent *ADOAgent) StatusSince() time.Time {
+	if agent.StatusChangedOn.IsZero() {
+		return agent.CreatedOn
+	}
+	return agent.StatusChangedOn
+}
+
+// ADOPoolAgentsURL generates an Azure DevOps API URL for the agents of an agent pool, or a single agent if agentID is not 0
+func ADOPoolAgentsURL(instance string, apiVersion string, poolID int, agentID int) string {
+	if agentID != 0 {
+		return fmt.Sprintf("https://%s/_apis/distributedtask/pools/%d/agents/%d?api-version=%s", instance, poolID, agentID, apiVersion)
+	}
+	return fmt.Sprintf("https://%s/_apis/distributedtask/pools/%d/agents?api-version=%s", instance, poolID, apiVersion)
+}
+
+/*
+ADOListAgents returns the agents of the configured agent pool.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/agents/list
+*/
+func ADOListAgents(client *http.Client, config *ADOConfig) (agents []ADOAgent, err error) {
+	return listAgents(client, config, ADOPoolAgentsURL(config.Instance, config.APIVersion, config.PoolID, 0))
+}
+
+// ADOListAgentsWithCapabilities lists the agents of the configured agent pool, including their capabilities
+func ADOListAgentsWithCapabilities(client *http.Client, config *ADOConfig) (agents []ADOAgent, err error) {
+	return listAgents(client, config, ADOPoolAgentsURL(config.Instance, config.APIVersion, config.PoolID, 0)+"&includeCapabilities=true")
+}
+
+// ADOListAgentsWithAssignedRequests lists the agents of the configured agent pool, including the job requests they are running
+func ADOListAgentsWithAssignedRequests(client *http.Client, config *ADOConfig) (agents []ADOAgent, err error) {
+	return listAgents(client, config, ADOPoolAgentsURL(config.Instance, config.APIVersion, config.PoolID, 0)+"&includeAssignedRequest=true")
+}
+
+/*
+adoListAgentsMaxResponseBytes is the minimum size of the agent lists read into memory,
+since the API returns every agent of the pool in a single response, without paging,
+which exceeds ADO_MAX_RESPONSE_BYTES for pools of a few thousand agents, especially with their capabilities.
+*/
+const adoListAgentsMaxResponseBytes = 64 << 20
+
+// listAgents lists the agents of an agent pool agents URL
+func listAgents(client *http.Client, config *ADOConfig, url string) (agents []ADOAgent, err error) {
+	listConfig := *config
+	listConfig.MaxResponseBytes = max(config.MaxResponseBytes, adoListAgentsMaxResponseBytes)
+
+	data, err := adoOrgRequest(client, &listConfig, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []ADOAgent `json:"value"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		err = fmt.Errorf("failed to parse agents: %w", err)
+		return
+	}
+
+	agents = result.Value
+	return
+}
+
+/*
+ADODeleteAgent deletes an agent from the configured agent pool.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/agents/delete
+*/
+func ADODeleteAgent(client *http.Client, config *ADOConfig, agentID int) error {
+	url := ADOPoolAgentsURL(config.Instance, config.APIVersion, config.PoolID, agentID)
+
+	_, err := adoOrgRequest(client, config, http.MethodDelete, url, nil)
+	return err
+}
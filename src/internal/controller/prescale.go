@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// PreScaleStartedBy is the StartedBy tag of agent tasks started ahead of demand
+const PreScaleStartedBy = "ado-prescale"
+
+// PreScaleConfig contains configuration values for queue-depth based pre-scaling
+type PreScaleConfig struct {
+	Ratio    float64 // Number of agents pre-started per pending job request
+	MaxTasks int     // Upper bound for the number of pre-started agents
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - PRESCALE_RATIO: Number of agents pre-started per pending job request (default: 1.0)
+  - PRESCALE_MAX_TASKS: Upper bound for the number of pre-started agents (default: 10)
+*/
+func (config *PreScaleConfig) ReadFromEnv() {
+	ratioStr := ReadEnvVarWithDefault("PRESCALE_RATIO", "1.0")
+	ratio, err := strconv.ParseFloat(ratioStr, 64)
+	if err != nil {
+		slog.Error("failed to parse PRESCALE_RATIO", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Ratio = ratio
+
+	maxTasksStr := ReadEnvVarWithDefault("PRESCALE_MAX_TASKS", "10")
+	maxTasks, err := strconv.Atoi(maxTasksStr)
+	if err != nil {
+		slog.Error("failed to parse PRESCALE_MAX_TASKS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxTasks = maxTasks
+}
+
+// ListStartedByTasks returns the ARNs of the tasks of a cluster started with a given StartedBy tag that are not stopping
+func ListStartedByTasks(ctx context.Context, client *ecs.Client, cluster string, startedBy string) (taskARNs []string, err error) {
+	paginator := ecs.NewListTasksPaginator(client, &ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		StartedBy:     aws.String(startedBy),
+		DesiredStatus: types.DesiredStatusRunning,
+	})
+
+	for paginator.HasMorePages() {
+		page, pageErr := paginator.NextPage(ctx)
+		if pageErr != nil {
+			err = fmt.Errorf("failed to list tasks: %w", pageErr)
+			return
+		}
+		taskARNs = append(taskARNs, page.TaskArns...)
+	}
+
+	return
+}
+
+/*
+handlePreScale queries the configured ADO agent pool for pending job requests
+and pre-starts agent tasks proportionally, bounded by PRESCALE_MAX_TASKS.
+Pre-started tasks that are still running count towards the target.
+
+It requires the ecs backend, ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID.
+*/
+func handlePreScale(ctx context.Context) error {
+	if taskCfg == nil || !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return fmt.Errorf("pre-scaling requires the ecs backend, ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID")
+	}
+
+	pending, err := ADOPendingJobRequests(adoClient, adoCfg)
+	if err != nil {
+		return fmt.Errorf("failed to get pending job requests: %w", err)
+	}
+
+	running, err := ListStartedByTasks(ctx, ecsClient, taskCfg.Cluster, PreScaleStartedBy)
+	if err != nil {
+		return err
+	}
+
+	target := min(int(math.Ceil(float64(len(pending))*preScaleCfg.Ratio)), preScaleCfg.MaxTasks)
+	toStart := target - len(running)
+
+	slog.Info("pre-scale", slog.Int("pending", len(pending)), slog.Int("running", len(running)), slog.Int("target", target))
+
+	for i := 0; i < toStart; i++ {
+		config := *taskCfg
+		config.SetClientToken(fmt.Sprintf("%s-%d-%d", PreScaleStartedBy, time.Now().UnixNano(), i))
+		config.StartedBy = PreScaleStartedBy
+		config.Tags = controllerTags(nil)
+
+		result, err := RunFargateTask(ctx, ecsClient, &config)
+		if err != nil {
+			return fmt.Errorf("failed to pre-start task: %w", err)
+		}
+
+		for _, task := range result.Tasks {
+			slog.Info("pre-started task", slog.String("taskArn", aws.ToString(task.TaskArn)))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// PrewarmStartedBy is the StartedBy tag of the tasks pulling the agent image on the container instances
+const PrewarmStartedBy = "ado-prewarm"
+
+// ecsStartTaskMaxInstances is the largest number of container instances of a single StartTask call
+const ecsStartTaskMaxInstances = 10
+
+// ImagePrewarmConfig contains configuration values for pulling the agent image ahead of the jobs
+type ImagePrewarmConfig struct {
+	TaskDefinition string   // The task definition of the puller task, with the agent image, defaults to ECS_TASK_DEFINITION
+	Command        []string // The command run by the agent container of the puller task instead of the agent, which exits at once
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - PREWARM_TASK_DEFINITION: The task definition of the puller task, which must use the agent image (default: ECS_TASK_DEFINITION)
+  - PREWARM_COMMAND: The comma-separated command the agent container of the puller task runs instead of the agent, and which exits at once (default: true)
+*/
+func (config *ImagePrewarmConfig) ReadFromEnv() {
+	config.TaskDefinition = ReadEnvVarWithDefault("PREWARM_TASK_DEFINITION", "")
+	config.Command = strings.Split(ReadEnvVarWithDefault("PREWARM_COMMAND", "true"), ",")
+}
+
+/*
+handleImagePrewarm pulls the agent image on every ACTIVE container instance of the cluster, for scheduled invocations,
+by starting a puller task with the agent image on each of them, so agents started later on the instance,
+including the instances added by scale-out since the last run, skip the pull.
+The container instances must keep the image, with ECS_IMAGE_PULL_BEHAVIOR=prefer-cached or once in the ECS agent configuration.
+
+It requires the ecs backend with the EC2 launch type: Fargate doesn't keep images between tasks,
+so only smaller images and SOCI indexes in ECR reduce the ImagePullDuration of Fargate agents.
+*/
+func handleImagePrewarm(ctx context.Context) error {
+	if taskCfg == nil || taskCfg.LaunchType != string(types.LaunchTypeEc2) {
+		return fmt.Errorf("image pre-warming requires the ecs backend with the EC2 launch type")
+	}
+
+	var instances []string
+	paginator := ecs.NewListContainerInstancesPaginator(ecsClient, &ecs.ListContainerInstancesInput{
+		Cluster: aws.String(taskCfg.Cluster),
+		Status:  types.ContainerInstanceStatusActive,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list container instances: %w", err)
+		}
+		instances = append(instances, page.ContainerInstanceArns...)
+	}
+
+	taskDefinition := taskCfg.TaskDefinition
+	if imagePrewarmCfg.TaskDefinition != "" {
+		taskDefinition = imagePrewarmCfg.TaskDefinition
+	}
+
+	warmed := 0
+	for start := 0; start < len(instances); start += ecsStartTaskMaxInstances {
+		batch := instances[start:min(start+ecsStartTaskMaxInstances, len(instances))]
+
+		input := &ecs.StartTaskInput{
+			Cluster:            aws.String(taskCfg.Cluster),
+			TaskDefinition:     aws.String(taskDefinition),
+			ContainerInstances: batch,
+			StartedBy:          aws.String(PrewarmStartedBy),
+			Overrides: &types.TaskOverride{
+				ContainerOverrides: []types.ContainerOverride{
+					{Name: aws.String(taskCfg.AgentContainer), Command: imagePrewarmCfg.Command},
+				},
+			},
+			Tags: ecsTags(controllerTags(nil)),
+		}
+		if taskCfg.NetworkMode == "" || taskCfg.NetworkMode == string(types.NetworkModeAwsvpc) {
+			input.NetworkConfiguration = &types.NetworkConfiguration{
+				AwsvpcConfiguration: &types.AwsVpcConfiguration{
+					Subnets:        taskCfg.Subnets,
+					SecurityGroups: taskCfg.SecurityGroups,
+				},
+			}
+		}
+
+		result, err := ecsClient.StartTask(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to start puller tasks: %w", err)
+		}
+
+		for _, failure := range result.Failures {
+			slog.Warn("failed to start puller task", slog.String("containerInstance", aws.ToString(failure.Arn)), slog.String("reason", aws.ToString(failure.Reason)))
+		}
+		warmed += len(result.Tasks)
+	}
+
+	slog.Info("pre-warmed agent image", slog.Int("containerInstances", len(instances)), slog.Int("pullerTasks", warmed))
+	EmitMetric("PrewarmedInstances", float64(warmed), MetricUnitCount, nil)
+	return nil
+}
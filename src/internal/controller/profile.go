@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"strings"
+)
+
+// ErrNoMatchingProfile is returned when no task profile satisfies the demands of a job
+var ErrNoMatchingProfile = errors.New("no matching pool")
+
+/*
+TaskProfile contains per-pool overrides of the task configuration,
+and the capabilities of the agents it starts, used to route jobs by their demands.
+
+User capabilities are injected as environment variables of the agent container,
+which the agent reports to Azure DevOps as capabilities, so demands on them
+are satisfied by the agent that picks up the job.
+*/
+type TaskProfile struct {
+	Name             string            `json:"name"`             // The profile name
+	TaskDefinition   string            `json:"taskDefinition"`   // The task definition to run, defaults to ECS_TASK_DEFINITION
+	Capabilities     map[string]string `json:"capabilities"`     // The capabilities of the agents provided by the task definition, matched against job demands
+	UserCapabilities map[string]string `json:"userCapabilities"` // Capabilities injected into the agent container environment, matched against job demands
+	TaskRoleARN      string            `json:"taskRoleArn"`      // The task role of the agents, overrides the task definition's role
+	ExecutionRoleARN string            `json:"executionRoleArn"` // The task execution role of the agents, overrides the task definition's role
+	AgentCount       int               `json:"agentCount"`       // The number of agents started for each job, defaults to 1
+	ReadyState       string            `json:"readyState"`       // The state in which agents are ready: RUNNING (default), HEALTHY or REGISTERED
+	TerminalStates   []string          `json:"terminalStates"`   // The runner statuses reported as failures while waiting, defaults to STOPPED
+	ReadyContainer   string            `json:"readyContainer"`   // The container whose status and health gate readiness, defaults to the whole task
+	Canary           *CanaryRollout    `json:"canary"`           // An optional canary task definition revision served to a share of the jobs
+	Clusters         []ClusterTarget   `json:"clusters"`         // The clusters the agents are balanced across, defaults to ECS_CLUSTER
+	CPU              string            `json:"cpu"`              // The task-level CPU of the agents, overrides the task definition's CPU, e.g. 1024
+	Memory           string            `json:"memory"`           // The task-level memory of the agents in MiB, overrides the task definition's memory, e.g. 2048
+	Owners           []string          `json:"owners"`           // The ADO project IDs whose pipelines may toggle the kill switch of the profile with their job access token
+}
+
+// CanaryRollout is a weighted selection between the profile's task definition and a canary revision
+type CanaryRollout struct {
+	TaskDefinition string `json:"taskDefinition"` // The canary task definition revision
+	Weight         int    `json:"weight"`         // The percentage of jobs served by the canary, 0 to 100
+}
+
+/*
+WithRevision returns the profile with the task definition revision that serves a job,
+the canary revision for a weighted share of the jobs, and whether the canary was selected.
+*/
+func (profile *TaskProfile) WithRevision() (*TaskProfile, bool) {
+	if profile == nil || profile.Canary == nil || profile.Canary.TaskDefinition == "" {
+		return profile, false
+	}
+
+	if rand.IntN(100) >= profile.Canary.Weight {
+		return profile, false
+	}
+
+	canary := *profile
+	canary.TaskDefinition = profile.Canary.TaskDefinition
+	return &canary, true
+}
+
+// Readiness returns the readiness semantics of the profile's agents, the defaults for a nil profile
+func (profile *TaskProfile) Readiness() *Readiness {
+	readiness := &Readiness{ReadyState: ReadyStateRunning, TerminalStates: []string{TaskStatusStopped}}
+	if profile == nil {
+		return readiness
+	}
+
+	if profile.ReadyState != "" {
+		readiness.ReadyState = strings.ToUpper(profile.ReadyState)
+	}
+
+	if len(profile.TerminalStates) > 0 {
+		readiness.TerminalStates = profile.TerminalStates
+	}
+
+	readiness.Container = profile.ReadyContainer
+
+	return readiness
+}
+
+/*
+ReadTaskProfilesFromEnv reads the following optional environment variable
+and returns the configured task profiles:
+  - TASK_PROFILES: A JSON list of task profiles, e.g. '[{"name": "linux-large", "taskDefinition": "agent-large", "capabilities": {"Agent.OS": "Linux", "docker": ""}}]'
+
+Profiles may set 'taskRoleArn' and 'executionRoleArn' to run their agents with least-privilege roles,
+the controller's role must be allowed to iam:PassRole them.
+
+Profiles may set 'readyState' and 'terminalStates' to match the readiness semantics of their agent images,
+and 'readyContainer' to gate readiness on the agent container of multi-container task definitions.
+
+Profiles may set 'canary' to serve a weighted share of their jobs with a new task definition revision,
+e.g. '{"taskDefinition": "agent:42", "weight": 10}', which is rolled back automatically on elevated failure rates.
+
+Profiles pin their agents to a task definition revision with a 'taskDefinition' of 'family:revision',
+which the 'driftcheck' command compares against the latest ACTIVE revision of the family, see handleDriftCheck.
+
+Profiles may set 'clusters' to balance their agents across clusters by utilization, see ClusterPlacer,
+e.g. '[{"name": "agents-a", "capacity": 200}, {"name": "agents-b", "capacity": 100}]'.
+
+Profiles may set 'cpu' and 'memory' to size their agents without a task definition per size, e.g. '"cpu": "2048", "memory": "8192"',
+which are validated against the Fargate sizes of the task definition's runtime platform before the tasks are started, see ValidateFargateSize.
+
+Profiles may set 'owners' to the ADO project IDs whose pipelines may disable and enable their launches at runtime,
+with kill switch messages authorized by the job access token of the pipeline, see handleKillSwitchMessage.
+*/
+func ReadTaskProfilesFromEnv() (profiles []TaskProfile) {
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("TASK_PROFILES", "[]")), &profiles)
+	if err != nil {
+		slog.Error("failed to parse TASK_PROFILES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	for _, profile := range profiles {
+		if profile.Name == "" {
+			slog.Error("failed to parse TASK_PROFILES: every profile requires a name")
+			os.Exit(1)
+		}
+
+		if profile.Canary != nil && (profile.Canary.Weight < 0 || profile.Canary.Weight > 100) {
+			slog.Error(fmt.Sprintf("failed to parse TASK_PROFILES: canary weight of profile %s must be between 0 and 100", profile.Name))
+			os.Exit(1)
+		}
+
+		for _, target := range profile.Clusters {
+			if target.Name == "" || target.Capacity < 0 {
+				slog.Error(fmt.Sprintf("failed to parse TASK_PROFILES: clusters of profile %s require a name and a non-negative capacity", profile.Name))
+				os.Exit(1)
+			}
+		}
+
+		readyState := profile.Readiness().ReadyState
+		if readyState != ReadyStateRunning && readyState != ReadyStateHealthy && readyState != ReadyStateRegistered {
+			slog.Error(fmt.Sprintf("failed to parse TASK_PROFILES: unsupported readyState %s of profile %s", profile.ReadyState, profile.Name))
+			os.Exit(1)
+		}
+	}
+
+	return
+}
+
+/*
+ADODemand is a parsed Azure Pipelines demand, either an existence check ('name')
+or an equality check ('name -equals value').
+
+See:
+
+https://learn.microsoft.com/en-us/azure/devops/pipelines/yaml-schema/pool-demands
+*/
+type ADODemand struct {
+	Name  string // The capability name
+	Value string // The required capability value, empty for existence checks
+}
+
+// ParseADODemand parses a demand string
+func ParseADODemand(demand string) (ADODemand, error) {
+	name, value, hasValue := strings.Cut(demand, " -equals ")
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return ADODemand{}, fmt.Errorf("unsupported demand %q", demand)
+	}
+
+	if hasValue {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return ADODemand{}, fmt.Errorf("unsupported demand %q", demand)
+		}
+	}
+
+	return ADODemand{Name: name, Value: value}, nil
+}
+
+// Satisfies reports whether the profile capabilities satisfy every demand, capability names are case-insensitive
+func (profile *TaskProfile) Satisfies(demands []ADODemand) bool {
+	for _, demand := range demands {
+		if !satisfiesDemand(profile.Capabilities, demand) && !satisfiesDemand(profile.UserCapabilities, demand) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiesDemand reports whether a set of capabilities satisfies a demand
+func satisfiesDemand(capabilities map[string]string, demand ADODemand) bool {
+	for name, value := range capabilities {
+		if strings.EqualFold(name, demand.Name) && (demand.Value == "" || strings.EqualFold(value, demand.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+SelectProfile returns the first profile whose capabilities satisfy the demands.
+
+It returns nil, meaning the default task configuration, if no profiles are configured
+or the job has no demands, and ErrNoMatchingProfile if no profile matches.
+*/
+func SelectProfile(profiles []TaskProfile, demandStrings []string) (*TaskProfile, error) {
+	if len(profiles) == 0 || len(demandStrings) == 0 {
+		return nil, nil
+	}
+
+	demands := make([]ADODemand, 0, len(demandStrings))
+	for _, d := range demandStrings {
+		demand, err := ParseADODemand(d)
+		if err != nil {
+			return nil, err
+		}
+		demands = append(demands, demand)
+	}
+
+	for i := range profiles {
+		if profiles[i].Satisfies(demands) {
+			return &profiles[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w for demands %s", ErrNoMatchingProfile, strings.Join(demandStrings, ", "))
+}
+
+// FindProfile returns the profile with the given name, or nil
+func FindProfile(profiles []TaskProfile, name string) *TaskProfile {
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// ApplyToTaskConfig returns a copy of the task configuration with the profile overrides applied
+func (profile *TaskProfile) ApplyToTaskConfig(config *ECSTaskConfig) *ECSTaskConfig {
+	result := *config
+	if profile == nil {
+		return &result
+	}
+
+	if profile.TaskDefinition != "" {
+		result.TaskDefinition = profile.TaskDefinition
+	}
+
+	if profile.TaskRoleARN != "" {
+		result.TaskRoleARN = profile.TaskRoleARN
+	}
+
+	if profile.ExecutionRoleARN != "" {
+		result.ExecutionRoleARN = profile.ExecutionRoleARN
+	}
+
+	if profile.AgentCount > 0 {
+		result.Count = profile.AgentCount
+	}
+
+	if profile.CPU != "" {
+		result.CPU = profile.CPU
+	}
+
+	if profile.Memory != "" {
+		result.Memory = profile.Memory
+	}
+
+	if len(profile.UserCapabilities) > 0 {
+		result.Environment = maps.Clone(config.Environment)
+		if result.Environment == nil {
+			result.Environment = map[string]string{}
+		}
+		maps.Copy(result.Environment, profile.UserCapabilities)
+	}
+
+	return &result
+}
@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrProjectQuotaExceeded is returned when starting an agent would exceed the quota of the job's project
+var ErrProjectQuotaExceeded = errors.New("project quota exceeded")
+
+// projectQuotaDefaultKey is the PROJECT_QUOTAS key of the quota applied to projects without their own entry
+const projectQuotaDefaultKey = "*"
+
+// ProjectQuota contains the limits applied to the agents of a single ADO project
+type ProjectQuota struct {
+	MaxConcurrent    int `json:"maxConcurrent"`    // Maximum number of agents running at the same time, 0 is unlimited
+	MaxStartsPerHour int `json:"maxStartsPerHour"` // Maximum number of agents started per clock hour, 0 is unlimited
+}
+
+/*
+ReadProjectQuotasFromEnv reads the following optional environment variable
+and returns the configured quotas by ADO project ID:
+  - PROJECT_QUOTAS: A JSON object of quotas by ProjectId, the key '*' applies to any other project, e.g. '{"*": {"maxConcurrent": 10, "maxStartsPerHour": 100}}'
+*/
+func ReadProjectQuotasFromEnv() (quotas map[string]ProjectQuota) {
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("PROJECT_QUOTAS", "{}")), &quotas)
+	if err != nil {
+		slog.Error("failed to parse PROJECT_QUOTAS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return
+}
+
+// projectQuotaFor returns the quota of a project and whether one applies
+func projectQuotaFor(quotas map[string]ProjectQuota, projectID string) (ProjectQuota, bool) {
+	if quota, ok := quotas[projectID]; ok {
+		return quota, true
+	}
+	quota, ok := quotas[projectQuotaDefaultKey]
+	return quota, ok
+}
+
+// projectQuotaKey returns the state table key of a project quota counter
+func projectQuotaKey(parts ...string) map[string]types.AttributeValue {
+	key := "quota"
+	for _, part := range parts {
+		key += "#" + part
+	}
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: key}}
+}
+
+/*
+AcquireProjectSlot atomically counts a job against the quota of its project,
+returning an error wrapping ErrProjectQuotaExceeded if a limit is reached.
+
+Counters are items of the state table keyed 'quota#<ProjectId>' (concurrent agents)
+and 'quota#<ProjectId>#<hour>' (starts per hour). The job record is flagged with
+'SlotAcquired', so a redelivered message does not count the job twice.
+Slots are released by ReleaseProjectSlot once every agent of the job stopped, see releaseJobSlot.
+*/
+func (s *StateStore) AcquireProjectSlot(ctx context.Context, projectID string, jobID string, quota ProjectQuota) error {
+	now := time.Now().UTC()
+	hour := now.Format("2006-01-02T15")
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName:           aws.String(s.Config.TableName),
+				Key:                 map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+				UpdateExpression:    aws.String("SET SlotAcquired = :true"),
+				ConditionExpression: aws.String("attribute_not_exists(SlotAcquired)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":true": &types.AttributeValueMemberBOOL{Value: true},
+				},
+			},
+		},
+	}
+
+	concurrent := &types.Update{
+		TableName:        aws.String(s.Config.TableName),
+		Key:              projectQuotaKey(projectID),
+		UpdateExpression: aws.String("ADD Running :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	}
+	if quota.MaxConcurrent > 0 {
+		concurrent.ConditionExpression = aws.String("attribute_not_exists(Running) OR Running < :max")
+		concurrent.ExpressionAttributeValues[":max"] = &types.AttributeValueMemberN{Value: fmt.Sprint(quota.MaxConcurrent)}
+	}
+	items = append(items, types.TransactWriteItem{Update: concurrent})
+
+	if quota.MaxStartsPerHour > 0 {
+		items = append(items, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName:           aws.String(s.Config.TableName),
+				Key:                 projectQuotaKey(projectID, hour),
+				UpdateExpression:    aws.String("ADD Starts :one SET ExpiresAt = :expires"),
+				ConditionExpression: aws.String("attribute_not_exists(Starts) OR Starts < :max"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":one":     &types.AttributeValueMemberN{Value: "1"},
+					":max":     &types.AttributeValueMemberN{Value: fmt.Sprint(quota.MaxStartsPerHour)},
+					":expires": &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(2 * time.Hour).Unix())},
+				},
+			},
+		})
+	}
+
+	_, err := s.Client().TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		reasons := canceled.CancellationReasons
+		for i, reason := range reasons {
+			if aws.ToString(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+			switch i {
+			case 0:
+				return nil // the slot was already acquired for this job
+			case 1:
+				return fmt.Errorf("%w: project %s reached %d concurrent agents", ErrProjectQuotaExceeded, projectID, quota.MaxConcurrent)
+			case 2:
+				return fmt.Errorf("%w: project %s reached %d agent starts this hour", ErrProjectQuotaExceeded, projectID, quota.MaxStartsPerHour)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to acquire project quota slot: %w", err)
+	}
+
+	return nil
+}
+
+/*
+releaseJobSlot releases the project quota slot of a job whose agents all stopped, if it holds one:
+  - with the ecs backend, once the task state change events reported every task of the job stopped, see handleTaskStateChange
+  - with the ecs-service backend, once the service task assigned to the job stopped
+  - with the other backends, which have no task state change events, once the job failed, see finishJob,
+    or once the runner reports the agent of a succeeded job stopped, see releaseFinishedSlots
+
+The reconciliation releases the slots whose events were missed, see releaseFinishedSlots.
+*/
+func releaseJobSlot(ctx context.Context, record *JobRecord) error {
+	if stateStore == nil || !record.SlotAcquired || record.Payload == nil {
+		return nil
+	}
+
+	err := stateStore.ReleaseProjectSlot(ctx, record.Payload.ProjectID, record.JobID)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("released project quota slot", slog.String("projectId", record.Payload.ProjectID), slog.String("jobId", record.JobID))
+	return nil
+}
+
+/*
+releaseFinishedSlots releases the project quota slots of the finished jobs whose agents all stopped, see releaseJobSlot,
+where running are the running tasks of the ecs backend, nil for the other backends, whose agents are checked with Runner.Status.
+Jobs of the ecs-service backend are left to its task state change events, since the tasks of released jobs serve other jobs.
+*/
+func releaseFinishedSlots(ctx context.Context, running map[string]bool) (released int, err error) {
+	if _, ok := runner.(*ECSServiceRunner); ok {
+		return 0, nil
+	}
+
+	err = stateStore.ListHoldingSlotsPages(ctx, func(records []*JobRecord) bool {
+		for _, record := range records {
+			if ctx.Err() != nil {
+				return false
+			}
+			if time.Since(record.UpdatedAt) < reconcileCfg.MinAge || record.Payload == nil {
+				continue
+			}
+
+			if running != nil {
+				if anyTaskRunning(record.TaskARN, running) {
+					continue
+				}
+			} else {
+				status, statusErr := runner.Status(withCheckID(ctx, record.JobID), record.TaskARN)
+				if statusErr != nil || status != TaskStatusStopped {
+					continue
+				}
+			}
+
+			releaseErr := releaseJobSlot(ctx, record)
+			if releaseErr != nil {
+				slog.Error("failed to release project quota slot", slog.String("jobId", record.JobID), slog.Any("err", releaseErr))
+				continue
+			}
+			released++
+		}
+		return true
+	})
+	return
+}
+
+// ReleaseProjectSlot releases the concurrent agent slot of a job acquired by AcquireProjectSlot, at most once
+func (s *StateStore) ReleaseProjectSlot(ctx context.Context, projectID string, jobID string) error {
+	_, err := s.Client().TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName:           aws.String(s.Config.TableName),
+					Key:                 map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+					UpdateExpression:    aws.String("REMOVE SlotAcquired"),
+					ConditionExpression: aws.String("SlotAcquired = :true"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":true": &types.AttributeValueMemberBOOL{Value: true},
+					},
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName:           aws.String(s.Config.TableName),
+					Key:                 projectQuotaKey(projectID),
+					UpdateExpression:    aws.String("ADD Running :minusone"),
+					ConditionExpression: aws.String("Running > :zero"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":minusone": &types.AttributeValueMemberN{Value: "-1"},
+						":zero":     &types.AttributeValueMemberN{Value: "0"},
+					},
+				},
+			},
+		},
+	})
+
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		return nil // the slot was already released, or never acquired
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release project quota slot: %w", err)
+	}
+
+	return nil
+}
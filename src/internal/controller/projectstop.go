@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+/*
+stopProjectAgents stops every in-flight agent of a project, for incident response when its pipelines consume the cluster,
+and returns how many agents were stopped:
+  - with the ecs backend, the controller's tasks tagged with the project are stopped, including tasks of untracked jobs
+  - with the state store, the started jobs of the project are marked as failed, their agents are stopped,
+    and their checks are reported as failed
+
+The agents of tracked jobs are deregistered from the ADO agent pool, see deregisterAgents,
+the others are left to the agent garbage collection.
+
+Only projects served by the access policy can be stopped, see AccessPolicy.CheckProject,
+so the operators of a shared controller can't stop the agents of projects it doesn't serve.
+*/
+func stopProjectAgents(ctx context.Context, projectID string, reason string) (stopped int, err error) {
+	if projectID == "" {
+		err = fmt.Errorf("stopping the agents of a project requires its ProjectId")
+		return
+	}
+
+	err = accessPolicy.CheckProject(&ADOPayload{ProjectID: projectID})
+	if err != nil {
+		return
+	}
+
+	ecsRunner, isECS := runner.(*ECSRunner)
+	if !isECS && stateStore == nil {
+		err = fmt.Errorf("stopping the agents of a project requires the ecs backend or the state store")
+		return
+	}
+
+	logger := slog.With(slog.String("projectId", projectID), slog.String("reason", reason))
+	var errs []error
+	stoppedTasks := map[string]bool{}
+
+	if isECS {
+		var taskARNs []string
+		for _, cluster := range ecsRunner.Clusters() {
+			var listed []string
+			listed, err = ListTaggedTasks(ctx, ecsRunner.Client, ecsRunner.Tagging, cluster, map[string]string{TagController: controllerID, TagProject: projectID})
+			if err != nil {
+				return
+			}
+			taskARNs = append(taskARNs, listed...)
+		}
+		for _, taskARN := range taskARNs {
+			stopErr := runner.Stop(ctx, taskARN, reason)
+			if stopErr != nil {
+				errs = append(errs, stopErr)
+				continue
+			}
+			stoppedTasks[taskARN] = true
+			stopped++
+		}
+	}
+
+	if stateStore != nil {
+		var records []*JobRecord
+		records, err = stateStore.ListByStatus(ctx, JobStatusStarted)
+		if err != nil {
+			return
+		}
+
+		for _, record := range records {
+			if record.Payload == nil || record.Payload.ProjectID != projectID {
+				continue
+			}
+
+			for _, taskARN := range strings.Split(record.TaskARN, ",") {
+				if stoppedTasks[taskARN] {
+					continue
+				}
+				stopErr := runner.Stop(ctx, taskARN, reason)
+				if stopErr != nil {
+					errs = append(errs, stopErr)
+					continue
+				}
+				stoppedTasks[taskARN] = true
+				stopped++
+			}
+
+			deregisterErr := deregisterAgents(record.TaskARN, record.Payload.AgentName())
+			if deregisterErr != nil {
+				logger.Error("failed to deregister agents", slog.String("jobId", record.JobID), slog.Any("err", deregisterErr))
+			}
+
+			updateErr := stateStore.UpdateStatus(ctx, record.JobID, JobStatusFailed)
+			if updateErr != nil {
+				errs = append(errs, updateErr)
+				continue
+			}
+			errs = append(errs, failCheck(ctx, record.Payload, "The agent was stopped: "+reason))
+		}
+	}
+
+	logger.Warn("stopped the agents of a project", slog.Int("stopped", stopped))
+	EmitMetric("ProjectAgentsStopped", float64(stopped), MetricUnitCount, map[string]string{"ProjectId": projectID})
+
+	err = errors.Join(errs...)
+	return
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// prometheusEscaper escapes Prometheus label values
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusBuckets are the upper bounds of the histogram buckets of duration metrics, in seconds
+var prometheusBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+/*
+PrometheusConfig contains configuration values for the Prometheus-compatible metrics endpoint,
+which a sidecar Lambda extension, e.g. an OpenTelemetry collector, scrapes instead of extracting EMF logs.
+*/
+type PrometheusConfig struct {
+	ListenAddress string // The address of the metrics endpoint, the endpoint is disabled if empty
+	EMFEnabled    bool   // Whether metrics are also written to the log in the CloudWatch embedded metric format
+	EMFBatch      bool   // Whether the EMF metrics of an invocation are batched into a log record per set of dimensions, see MetricBatch
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - PROMETHEUS_LISTEN_ADDRESS: The localhost address serving the metrics at /metrics, e.g. 127.0.0.1:9464 (optional)
+  - METRICS_EMF_ENABLED: Whether metrics are also written to the log in the CloudWatch embedded metric format (default: true)
+  - METRICS_EMF_BATCH: Whether the EMF metrics of an invocation are batched into a log record per set of dimensions, written at its end (default: false)
+*/
+func (config *PrometheusConfig) ReadFromEnv() {
+	config.ListenAddress = ReadEnvVarWithDefault("PROMETHEUS_LISTEN_ADDRESS", "")
+
+	emfEnabled, err := strconv.ParseBool(ReadEnvVarWithDefault("METRICS_EMF_ENABLED", "true"))
+	if err != nil {
+		slog.Error("failed to parse METRICS_EMF_ENABLED", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.EMFEnabled = emfEnabled
+
+	emfBatch, err := strconv.ParseBool(ReadEnvVarWithDefault("METRICS_EMF_BATCH", "false"))
+	if err != nil {
+		slog.Error("failed to parse METRICS_EMF_BATCH", slog.Any("err", err))
+		os.Exit(1)
+	}
+	config.EMFBatch = emfBatch
+}
+
+// prometheusSeries is the value of a metric with a set of labels, e.g. {cluster="agents"}
+type prometheusSeries struct {
+	value   float64  // The sum of a counter, the last value of a gauge, or the sum of the observations of a histogram
+	count   uint64   // The number of observations of a histogram
+	buckets []uint64 // The cumulative counts of the observations of a histogram, by prometheusBuckets
+}
+
+// prometheusMetric is a metric family in the Prometheus text exposition format
+type prometheusMetric struct {
+	kind   string                       // The metric type, counter, gauge or histogram
+	series map[string]*prometheusSeries // The series of the metric, by formatted labels
+}
+
+/*
+PrometheusRegistry keeps the metrics emitted during the lifetime of the execution environment in memory
+and serves them in the Prometheus text exposition format.
+
+Metrics are mapped from their CloudWatch units:
+  - Count metrics are counters, suffixed with _total
+  - Seconds and Milliseconds metrics are histograms, in seconds, suffixed with _seconds
+  - other metrics are gauges of their last value
+
+Names are the snake case METRICS_NAMESPACE followed by the snake case metric name,
+and labels are the snake case dimensions.
+Lambda freezes the execution environment between invocations, so the endpoint only answers
+while an invocation or the extension's shutdown phase is running, which is when extensions scrape it.
+*/
+type PrometheusRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]*prometheusMetric
+}
+
+// NewPrometheusRegistry creates a registry and serves it at /metrics on the listen address
+func NewPrometheusRegistry(address string) (registry *PrometheusRegistry, err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		err = fmt.Errorf("failed to listen on %s: %w", address, err)
+		return
+	}
+
+	registry = &PrometheusRegistry{metrics: map[string]*prometheusMetric{}}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", registry)
+	go func() {
+		serveErr := http.Serve(listener, mux)
+		slog.Error("metrics endpoint stopped", slog.Any("err", serveErr))
+	}()
+
+	slog.Info("serving Prometheus metrics", slog.String("address", listener.Addr().String()))
+	return
+}
+
+// Observe records a metric emitted with EmitMetric
+func (r *PrometheusRegistry) Observe(name string, value float64, unit string, dimensions map[string]string) {
+	kind := "gauge"
+	name = prometheusName(metricsNamespace) + "_" + prometheusName(name)
+	switch unit {
+	case MetricUnitCount:
+		kind = "counter"
+		name += "_total"
+	case MetricUnitMilliseconds:
+		value /= 1000
+		fallthrough
+	case MetricUnitSeconds:
+		kind = "histogram"
+		name += "_seconds"
+	}
+
+	labels := prometheusLabels(dimensions)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metric, ok := r.metrics[name]
+	if !ok {
+		metric = &prometheusMetric{kind: kind, series: map[string]*prometheusSeries{}}
+		r.metrics[name] = metric
+	}
+	series, ok := metric.series[labels]
+	if !ok {
+		series = &prometheusSeries{buckets: make([]uint64, len(prometheusBuckets))}
+		metric.series[labels] = series
+	}
+
+	switch metric.kind {
+	case "counter":
+		series.value += value
+	case "histogram":
+		series.value += value
+		series.count++
+		for i, bound := range prometheusBuckets {
+			if value <= bound {
+				series.buckets[i]++
+			}
+		}
+	default:
+		series.value = value
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (r *PrometheusRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var body strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(r.metrics)) {
+		metric := r.metrics[name]
+		fmt.Fprintf(&body, "# TYPE %s %s\n", name, metric.kind)
+
+		for _, labels := range slices.Sorted(maps.Keys(metric.series)) {
+			series := metric.series[labels]
+			if metric.kind != "histogram" {
+				fmt.Fprintf(&body, "%s%s %s\n", name, labels, prometheusValue(series.value))
+				continue
+			}
+
+			for i, bound := range prometheusBuckets {
+				fmt.Fprintf(&body, "%s_bucket%s %d\n", name, withLabel(labels, "le", prometheusValue(bound)), series.buckets[i])
+			}
+			fmt.Fprintf(&body, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(&body, "%s_sum%s %s\n", name, labels, prometheusValue(series.value))
+			fmt.Fprintf(&body, "%s_count%s %d\n", name, labels, series.count)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(body.String()))
+}
+
+// prometheusName converts a CamelCase name to a snake case Prometheus name, e.g. RunTaskFailures to run_task_failures
+func prometheusName(name string) string {
+	var builder strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				builder.WriteByte('_')
+			}
+			builder.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			builder.WriteRune(r)
+		default:
+			builder.WriteByte('_')
+		}
+	}
+	return builder.String()
+}
+
+// prometheusLabels formats the dimensions of a metric as Prometheus labels, sorted by name
+func prometheusLabels(dimensions map[string]string) string {
+	if len(dimensions) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for _, key := range slices.Sorted(maps.Keys(dimensions)) {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, prometheusName(key), prometheusEscaper.Replace(dimensions[key])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to formatted labels
+func withLabel(labels string, name string, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + label + "}"
+}
+
+// prometheusValue formats a sample value
+func prometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Frontends of the queues, the CI systems whose messages they deliver
+const (
+	FrontendADO     = "ado"     // Azure Pipelines checks, see ADOPayload
+	FrontendGitLab  = "gitlab"  // GitLab job webhooks, see handleGitLabRecord
+	FrontendJenkins = "jenkins" // Jenkins cloud-provisioning requests, see handleJenkinsRecord
+	FrontendWebhook = "webhook" // Arbitrary webhooks, mapped to ADO payloads by the template of the queue, see mapWebhookBody
+)
+
+// QueueProfile restricts the task profiles that serve the jobs of an SQS queue
+type QueueProfile struct {
+	Profiles []string `json:"profiles"`           // The names of the task profiles serving the queue, the first one serves jobs without demands
+	Frontend string   `json:"frontend,omitempty"` // The CI system whose messages the queue delivers, one of the Frontend values (default: ado)
+	Template string   `json:"template,omitempty"` // The template mapping the webhooks of the queue to ADO payloads, required by the webhook frontend
+
+	template *template.Template
+}
+
+/*
+ReadQueueProfilesFromEnv reads the following optional environment variable
+and returns the configured queue profiles by queue ARN or name:
+  - QUEUE_PROFILES: A JSON object of queue profiles, e.g. '{"team-a-jobs": {"profiles": ["team-a-linux", "team-a-windows"]}, "gitlab-jobs": {"profiles": ["gitlab"], "frontend": "gitlab"}}'
+
+Queues with the webhook frontend map their messages to ADO payloads with a Go template, see mapWebhookBody, e.g.
+'{"hooks": {"profiles": ["linux"], "frontend": "webhook", "template": "{\"JobId\": {{json .job.id}}, \"PlanUrl\": {{json .callback.url}}}"}}'
+
+Wiring several queues to the function with their own profiles keeps the queue-level access separation between teams,
+whose jobs can only be served by their profiles. Jobs of queues without a queue profile are served by any task profile.
+*/
+func ReadQueueProfilesFromEnv(profiles []TaskProfile) (queues map[string]QueueProfile) {
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("QUEUE_PROFILES", "{}")), &queues)
+	if err != nil {
+		slog.Error("failed to parse QUEUE_PROFILES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	for queue, queueProfile := range queues {
+		if len(queueProfile.Profiles) == 0 {
+			slog.Error(fmt.Sprintf("failed to parse QUEUE_PROFILES: queue %s requires at least one profile", queue))
+			os.Exit(1)
+		}
+		switch queueProfile.Frontend {
+		case "", FrontendADO, FrontendGitLab, FrontendJenkins:
+		case FrontendWebhook:
+			queueProfile.template, err = template.New(queue).Funcs(webhookTemplateFuncs).Option("missingkey=zero").Parse(queueProfile.Template)
+			if err != nil || queueProfile.Template == "" {
+				slog.Error(fmt.Sprintf("failed to parse QUEUE_PROFILES: invalid template of queue %s", queue), slog.Any("err", err))
+				os.Exit(1)
+			}
+			queues[queue] = queueProfile
+		default:
+			slog.Error(fmt.Sprintf("failed to parse QUEUE_PROFILES: unsupported frontend %s of queue %s", queueProfile.Frontend, queue))
+			os.Exit(1)
+		}
+		for _, name := range queueProfile.Profiles {
+			if FindProfile(profiles, name) == nil {
+				slog.Error(fmt.Sprintf("failed to parse QUEUE_PROFILES: unknown profile %s of queue %s", name, queue))
+				os.Exit(1)
+			}
+		}
+	}
+
+	return
+}
+
+// queueProfileFor returns the profile of the queue with the given ARN, matched by ARN or name, and whether one applies
+func queueProfileFor(queues map[string]QueueProfile, queueARN string) (QueueProfile, bool) {
+	if queueProfile, ok := queues[queueARN]; ok {
+		return queueProfile, true
+	}
+	queueProfile, ok := queues[queueARN[strings.LastIndex(queueARN, ":")+1:]]
+	return queueProfile, ok
+}
+
+// queueFrontend returns the frontend of the queue with the given ARN
+func queueFrontend(queues map[string]QueueProfile, queueARN string) string {
+	queueProfile, ok := queueProfileFor(queues, queueARN)
+	if !ok || queueProfile.Frontend == "" {
+		return FrontendADO
+	}
+	return queueProfile.Frontend
+}
+
+/*
+SelectQueueProfile returns the task profile serving a job of the queue with the given ARN,
+chosen by SelectProfile among the profiles of the queue, or the first profile of the queue for jobs without demands.
+Jobs of queues without a queue profile are matched against every profile.
+*/
+func SelectQueueProfile(profiles []TaskProfile, queues map[string]QueueProfile, queueARN string, demandStrings []string) (*TaskProfile, error) {
+	queueProfile, ok := queueProfileFor(queues, queueARN)
+	if !ok {
+		return SelectProfile(profiles, demandStrings)
+	}
+
+	candidates := make([]TaskProfile, 0, len(queueProfile.Profiles))
+	for _, name := range queueProfile.Profiles {
+		candidates = append(candidates, *FindProfile(profiles, name))
+	}
+
+	if len(demandStrings) == 0 {
+		return &candidates[0], nil
+	}
+	return SelectProfile(candidates, demandStrings)
+}
@@ -0,0 +1,21 @@
+package controller
+
+import "github.com/aws/aws-lambda-go/events"
+
+// QueueResponseVersion is the version of the QueueResponse contract, incremented on incompatible changes
+const QueueResponseVersion = 1
+
+/*
+QueueResponse is the JSON response of SQS invocations, see handleQueue:
+the batch item failures that SQS redelivers, and the outcome of every record of the batch,
+so synchronous test invocations and Step Functions integrations can consume the results.
+
+Its fields are only added to within a version, and the outcomes are the documented MessageOutcome values
+or the 'succeeded' and 'failed' results of the records' callbacks.
+*/
+type QueueResponse struct {
+	events.SQSEventResponse
+
+	Version int               `json:"version"` // The version of the contract, QueueResponseVersion
+	Records []*MessageOutcome `json:"records"` // The outcome of every record of the batch, in the order they were handled
+}
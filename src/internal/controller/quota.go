@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+)
+
+// Service Quotas codes of the Fargate On-Demand vCPU resource count quota
+const (
+	FargateServiceCode     = "fargate"
+	FargateVCPUQuotaCode   = "L-3032A538"
+	fargateQuotaRefreshTTL = 5 * time.Minute
+)
+
+// ErrQuotaExceeded is returned when starting a task would exceed the configured Fargate vCPU utilization ceiling
+var ErrQuotaExceeded = errors.New("fargate vCPU utilization ceiling exceeded")
+
+// QuotaConfig contains configuration values for quota-aware launch throttling
+type QuotaConfig struct {
+	Ceiling float64 // Maximum fraction of the Fargate vCPU quota used after a launch, 0 disables throttling
+}
+
+/*
+ReadFromEnv reads the following optional environment variable
+and populates the struct with the values:
+  - QUOTA_UTILIZATION_CEILING: Maximum fraction of the Fargate On-Demand vCPU quota used after a launch, e.g. 0.9 (default: 0, disabled)
+*/
+func (config *QuotaConfig) ReadFromEnv() {
+	ceilingStr := ReadEnvVarWithDefault("QUOTA_UTILIZATION_CEILING", "0")
+	ceiling, err := strconv.ParseFloat(ceilingStr, 64)
+	if err != nil {
+		slog.Error("failed to parse QUOTA_UTILIZATION_CEILING", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Ceiling = ceiling
+}
+
+/*
+FargateQuotaThrottle checks the Fargate On-Demand vCPU quota before a task is started.
+
+Usage is the sum of the vCPU of the running and pending tasks of the cluster,
+so tasks of other clusters in the same account and region are not accounted for.
+The quota value is refreshed every few minutes.
+*/
+type FargateQuotaThrottle struct {
+	ECSClient    *ecs.Client           // The ECS client
+	QuotasClient *servicequotas.Client // The Service Quotas client
+	Lookups      *ECSLookupCache       // The cache of task definition lookups
+	Config       *QuotaConfig          // The throttling configuration
+
+	mu          sync.Mutex
+	quota       float64
+	refreshedAt time.Time
+}
+
+// vcpuQuota returns the Fargate On-Demand vCPU quota
+func (t *FargateQuotaThrottle) vcpuQuota(ctx context.Context) (float64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.refreshedAt) < fargateQuotaRefreshTTL {
+		return t.quota, nil
+	}
+
+	result, err := t.QuotasClient.GetServiceQuota(ctx, &servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(FargateServiceCode),
+		QuotaCode:   aws.String(FargateVCPUQuotaCode),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get Fargate vCPU quota: %w", err)
+	}
+
+	t.quota = aws.ToFloat64(result.Quota.Value)
+	t.refreshedAt = time.Now()
+	return t.quota, nil
+}
+
+/*
+clusterVCPU returns the sum of the vCPU of the running and pending tasks of a cluster,
+including tasks not started by the controller, since they use the same account quota.
+*/
+func clusterVCPU(ctx context.Context, client *ecs.Client, cluster string) (vcpu float64, err error) {
+	taskARNs, err := ListTaggedTasks(ctx, client, nil, cluster, nil)
+	if err != nil {
+		return
+	}
+
+	// DescribeTasks describes up to 100 tasks per call
+	for chunk := range slices.Chunk(taskARNs, 100) {
+		result, describeErr := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   chunk,
+		})
+		if describeErr != nil {
+			err = fmt.Errorf("failed to describe tasks: %w", describeErr)
+			return
+		}
+
+		for _, task := range result.Tasks {
+			vcpu += cpuUnitsToVCPU(aws.ToString(task.Cpu))
+		}
+	}
+
+	return
+}
+
+// cpuUnitsToVCPU converts an ECS CPU units string, e.g. "1024", to vCPU
+func cpuUnitsToVCPU(units string) float64 {
+	value, err := strconv.ParseFloat(units, 64)
+	if err != nil {
+		return 0
+	}
+	return value / 1024
+}
+
+// taskDefinitionVCPU returns the task-level vCPU of a task definition
+func taskDefinitionVCPU(ctx context.Context, lookups *ECSLookupCache, taskDefinition string) (float64, error) {
+	result, err := lookups.TaskDefinition(ctx, taskDefinition)
+	if err != nil {
+		return 0, err
+	}
+
+	return cpuUnitsToVCPU(aws.ToString(result.Cpu)), nil
+}
+
+// taskConfigVCPU returns the vCPU requested by a task configuration, every task with its CPU override, e.g. of its profile, or the task definition's CPU
+func taskConfigVCPU(ctx context.Context, lookups *ECSLookupCache, config *ECSTaskConfig) (float64, error) {
+	vcpu := cpuUnitsToVCPU(config.CPU)
+	if config.CPU == "" {
+		var err error
+		vcpu, err = taskDefinitionVCPU(ctx, lookups, config.TaskDefinition)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return vcpu * float64(max(config.Count, 1)), nil
+}
+
+/*
+Check returns an error wrapping ErrQuotaExceeded if starting the task
+would raise the Fargate vCPU utilization above the configured ceiling,
+and emits the utilization as the FargateVCPUUtilization metric.
+*/
+func (t *FargateQuotaThrottle) Check(ctx context.Context, config *ECSTaskConfig) error {
+	if t.Config.Ceiling <= 0 {
+		return nil
+	}
+
+	quota, err := t.vcpuQuota(ctx)
+	if err != nil {
+		return err
+	}
+
+	used, err := clusterVCPU(ctx, t.ECSClient, config.Cluster)
+	if err != nil {
+		return err
+	}
+
+	requested, err := taskConfigVCPU(ctx, t.Lookups, config)
+	if err != nil {
+		return err
+	}
+
+	utilization := (used + requested) / quota
+	EmitMetric("FargateVCPUUtilization", utilization*100, MetricUnitPercent, map[string]string{"Cluster": config.Cluster})
+
+	if utilization > t.Config.Ceiling {
+		EmitMetric("QuotaThrottledLaunches", 1, MetricUnitCount, map[string]string{"Cluster": config.Cluster})
+		return fmt.Errorf("%w: %.2f of %.0f vCPU would be used, ceiling is %.2f", ErrQuotaExceeded, used+requested, quota, t.Config.Ceiling)
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// States in which an agent is considered ready
+const (
+	ReadyStateRunning    = "RUNNING"    // The runner reports the agent as running
+	ReadyStateHealthy    = "HEALTHY"    // The agent is running and its container health check passes
+	ReadyStateRegistered = "REGISTERED" // The agent is running and registered online in the ADO agent pool
+)
+
+// Readiness contains the states in which a waited-for agent is ready or has failed
+type Readiness struct {
+	ReadyState     string   // One of the ReadyState values
+	TerminalStates []string // The runner statuses reported as failures
+	Container      string   // The container whose status and health gate readiness, empty for the whole task
+}
+
+// HealthChecker is implemented by runners that can report the health check status of a started agent
+type HealthChecker interface {
+	Healthy(ctx context.Context, id string) (healthy bool, err error) // Returns whether the agent's health check passes
+}
+
+/*
+ContainerChecker is implemented by runners that can report the status and health of a single container of a started agent,
+so that sidecars of multi-container task definitions don't gate readiness.
+*/
+type ContainerChecker interface {
+	ContainerStatus(ctx context.Context, id string, container string) (status string, healthy bool, err error) // Returns the normalized status and health of the container
+}
+
+// ReadStatusErrorToleranceFromEnv reads STATUS_ERROR_TOLERANCE, how many consecutive errors reading an agent's status are retried while waiting for it (default: 3)
+func ReadStatusErrorToleranceFromEnv() int {
+	toleranceStr := ReadEnvVarWithDefault("STATUS_ERROR_TOLERANCE", "3")
+	tolerance, err := strconv.Atoi(toleranceStr)
+	if err != nil || tolerance < 0 {
+		slog.Error("failed to parse STATUS_ERROR_TOLERANCE", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return tolerance
+}
+
+// ReadStatusRetryPolicyFromEnv reads the STATUS retry policy of agent status reads, whose attempts default to STATUS_ERROR_TOLERANCE + 1, see ReadRetryPolicyFromEnv
+func ReadStatusRetryPolicyFromEnv() *RetryPolicy {
+	return ReadRetryPolicyFromEnv("STATUS", RetryPolicy{
+		MaxAttempts: ReadStatusErrorToleranceFromEnv() + 1,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+	})
+}
+
+/*
+waitForAgent polls the runner until the agent is ready or reaches a terminal state, and returns the outcome.
+
+If maxWait is positive and the agent is still pending after it, errAgentPending is returned.
+If a payload is given, its job is checked for cancellation every ADO_CANCEL_POLL_SECONDS,
+and ErrJobCanceled is returned once it is canceled, see ADOJobCanceled.
+If the payload sets a Deadline, ErrDeadlineExceeded is returned once it passes while the agent is pending.
+
+Errors reading the agent's status, e.g. a transient DescribeTasks error, are retried consecutively
+with the backoff of the STATUS retry policy, and emit the StatusCheckErrors metric,
+so that they aren't reported like agents that failed.
+*/
+func waitForAgent(ctx context.Context, taskARN string, readiness *Readiness, maxWait time.Duration, payload *ADOPayload) (outcome string, err error) {
+	deadline := time.Now().Add(maxWait)
+	statusErrors := 0
+	poller := &cancellationPoller{payload: payload, polledAt: time.Now()}
+	if payload != nil {
+		ctx = withCheckID(ctx, payload.CheckID())
+	}
+
+	for {
+		if poller.Canceled() {
+			err = ErrJobCanceled
+			return
+		}
+
+		taskStatus, statusErr := agentStatus(ctx, taskARN, readiness)
+		if statusErr != nil {
+			EmitMetric("StatusCheckErrors", 1, MetricUnitCount, nil)
+			statusErrors++
+			if !statusRetryPolicy.ShouldRetry(statusErrors, statusErr) || ctx.Err() != nil {
+				err = statusErr
+				return
+			}
+			slog.Warn("failed to read agent status, retrying", slog.String("id", taskARN), slog.Int("errors", statusErrors), slog.Any("err", statusErr))
+			time.Sleep(statusRetryPolicy.Delay(statusErrors))
+			continue
+		}
+		statusErrors = 0
+
+		if slices.Contains(readiness.TerminalStates, taskStatus) {
+			outcome = "failed"
+			return
+		}
+
+		if taskStatus == TaskStatusRunning {
+			ready, readyErr := isReady(ctx, taskARN, readiness, payload.AgentName())
+			if readyErr != nil {
+				err = readyErr
+				return
+			}
+			if ready {
+				outcome = "succeeded"
+				return
+			}
+		} else if taskStatus == TaskStatusStopped {
+			outcome = "failed"
+			return
+		}
+
+		if payload.DeadlineExceeded() {
+			err = ErrDeadlineExceeded
+			return
+		}
+
+		if maxWait > 0 && time.Now().After(deadline) {
+			err = errAgentPending
+			return
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// agentStatus returns the status of the agent, or of its ready container if one is configured
+func agentStatus(ctx context.Context, id string, readiness *Readiness) (string, error) {
+	if readiness.Container == "" {
+		return runner.Status(ctx, id)
+	}
+
+	checker, ok := runner.(ContainerChecker)
+	if !ok {
+		return "", fmt.Errorf("the runner backend doesn't support readiness containers")
+	}
+
+	status, _, err := checker.ContainerStatus(ctx, id, readiness.Container)
+	return status, err
+}
+
+// isReady reports whether a running agent is in the ready state, name is the deterministic name of its job's agent, if any
+func isReady(ctx context.Context, id string, readiness *Readiness, name string) (bool, error) {
+	switch readiness.ReadyState {
+	case ReadyStateHealthy:
+		if readiness.Container != "" {
+			checker, ok := runner.(ContainerChecker)
+			if !ok {
+				return false, fmt.Errorf("the runner backend doesn't support readiness containers")
+			}
+			_, healthy, err := checker.ContainerStatus(ctx, id, readiness.Container)
+			return healthy, err
+		}
+
+		checker, ok := runner.(HealthChecker)
+		if !ok {
+			return false, fmt.Errorf("the runner backend doesn't support the %s ready state", ReadyStateHealthy)
+		}
+		return checker.Healthy(ctx, id)
+	case ReadyStateRegistered:
+		return isRegistered(ctx, id, name)
+	default:
+		return true, nil
+	}
+}
+
+/*
+isRegistered reports whether every agent started for the job is registered online in the ADO agent pool,
+matching the agents by name, see agentMatches, requires ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID.
+*/
+func isRegistered(ctx context.Context, id string, name string) (bool, error) {
+	if !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return false, fmt.Errorf("the %s ready state requires ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID", ReadyStateRegistered)
+	}
+
+	agents, err := ADOListAgents(adoClient, adoCfg)
+	if err != nil {
+		return false, err
+	}
+
+	for _, taskARN := range strings.Split(id, ",") {
+		registered := slices.ContainsFunc(agents, func(agent ADOAgent) bool {
+			return agent.Status == "online" && agentMatches(agent, taskARN, name)
+		})
+		if !registered {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Healthy reports whether the health check of every task of the job passes
+func (r *ECSRunner) Healthy(ctx context.Context, id string) (bool, error) {
+	for _, taskARN := range strings.Split(id, ",") {
+		task, err := DescribeTask(ctx, r.Client, &ECSTaskReadConfig{
+			Cluster: r.Config.Cluster,
+			TaskARN: taskARN,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if task.HealthStatus != "HEALTHY" {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+/*
+ContainerStatus returns the status of the named container in every task of the job,
+STOPPED if it stopped in any task, RUNNING once it runs in every task, and PENDING otherwise,
+and whether its health check passes in every task.
+Tasks that DescribeTasks reports as MISSING are handled by missingTaskStatus.
+*/
+func (r *ECSRunner) ContainerStatus(ctx context.Context, id string, container string) (status string, healthy bool, err error) {
+	healthy = true
+
+	for _, taskARN := range strings.Split(id, ",") {
+		var task *types.Task
+		task, err = DescribeTask(ctx, r.Client, &ECSTaskReadConfig{
+			Cluster: r.Config.Cluster,
+			TaskARN: taskARN,
+		})
+		if errors.Is(err, ErrTaskMissing) {
+			healthy = false
+			status, err = missingTaskStatus(ctx, taskARN, err)
+			if err != nil || status == TaskStatusStopped {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logAWSError("DescribeTasks", err)
+			return
+		}
+
+		index := slices.IndexFunc(task.Containers, func(c types.Container) bool {
+			return aws.ToString(c.Name) == container
+		})
+		if index < 0 {
+			err = fmt.Errorf("container %s not found in task %s", container, taskARN)
+			return
+		}
+
+		c := task.Containers[index]
+		healthy = healthy && c.HealthStatus == types.HealthStatusHealthy
+
+		containerStatus := aws.ToString(c.LastStatus)
+		switch {
+		case containerStatus == TaskStatusStopped:
+			status = TaskStatusStopped
+			return
+		case containerStatus != TaskStatusRunning:
+			status = TaskStatusPending
+		case status == "":
+			status = TaskStatusRunning
+		}
+	}
+	return
+}
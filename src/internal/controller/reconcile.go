@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReconcileConfig contains configuration values for the reconciliation of the state store against the runner
+type ReconcileConfig struct {
+	OnStart       bool          // Whether the first invocation of an execution environment reconciles the state store
+	OnStartBudget time.Duration // How long the reconciliation of the first invocation may take at most
+	MinAge        time.Duration // How long a started job is left untouched before it is reconciled
+}
+
+// reconcileOnStartShare is the largest share of the remaining invocation time that the reconciliation of the first invocation takes
+const reconcileOnStartShare = 4
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - RECONCILE_ON_START: Whether the first invocation of an execution environment reconciles the state store (default: false)
+  - RECONCILE_ON_START_BUDGET_SECONDS: How long the reconciliation of the first invocation may take at most, and never more
+    than a quarter of the invocation's remaining time, the jobs left are reconciled by the next run (default: 30)
+  - RECONCILE_MIN_AGE_SECONDS: How long a started job is left untouched before it is reconciled, at least the function timeout (default: 900)
+*/
+func (config *ReconcileConfig) ReadFromEnv() {
+	config.OnStart = ReadEnvVarWithDefault("RECONCILE_ON_START", "false") == "true"
+
+	budgetStr := ReadEnvVarWithDefault("RECONCILE_ON_START_BUDGET_SECONDS", "30")
+	budget, err := strconv.Atoi(budgetStr)
+	if err != nil || budget < 1 {
+		slog.Error("failed to parse RECONCILE_ON_START_BUDGET_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.OnStartBudget = time.Duration(budget) * time.Second
+
+	minAgeStr := ReadEnvVarWithDefault("RECONCILE_MIN_AGE_SECONDS", "900")
+	minAge, err := strconv.Atoi(minAgeStr)
+	if err != nil || minAge < 0 {
+		slog.Error("failed to parse RECONCILE_MIN_AGE_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MinAge = time.Duration(minAge) * time.Second
+}
+
+/*
+reconcileOnStartContext returns the context of the reconciliation of the first invocation of an execution environment,
+whose deadline is RECONCILE_ON_START_BUDGET_SECONDS away, or a quarter of the invocation's remaining time if sooner,
+so the records of the invocation keep most of its time.
+*/
+func reconcileOnStartContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	budget := reconcileCfg.OnStartBudget
+	if deadline, ok := ctx.Deadline(); ok {
+		budget = min(budget, time.Until(deadline)/reconcileOnStartShare)
+	}
+	return context.WithTimeout(ctx, budget)
+}
+
+// RunningTasks returns the ARNs of the controller's tasks of its clusters that are pending or running
+func (r *ECSRunner) RunningTasks(ctx context.Context) (taskARNs map[string]bool, err error) {
+	taskARNs = map[string]bool{}
+	for _, cluster := range r.Clusters() {
+		var listed []string
+		listed, err = ListTaggedTasks(ctx, r.Client, r.Tagging, cluster, map[string]string{TagController: controllerID})
+		if err != nil {
+			return
+		}
+
+		for _, taskARN := range listed {
+			taskARNs[taskARN] = true
+		}
+	}
+	return
+}
+
+/*
+handleReconcile reconciles the started jobs of the state store against the runner,
+to recover from invocations that ended while waiting for an agent, e.g. on a function timeout:
+  - jobs whose agents stopped are marked as failed, and their check is reported as failed
+  - jobs whose agents are ready are marked as succeeded, and their check is reported as succeeded,
+    unless agent waits are persisted as continuations, which report them
+
+Only jobs not updated for RECONCILE_MIN_AGE_SECONDS are reconciled, so that jobs still waited for are left alone.
+The project quota slots of finished jobs whose agents all stopped are released, see releaseFinishedSlots.
+The state store is scanned page by page, and the reconciliation stops at the deadline of the context,
+leaving the jobs not reached yet to the next run rather than failing the invocation.
+With the ecs backend, tasks missing from ListTasks whose description expired are considered stopped.
+The ReconciledJobs metric is emitted per outcome.
+*/
+func handleReconcile(ctx context.Context) error {
+	if stateStore == nil {
+		return fmt.Errorf("reconciliation requires STATE_TABLE_NAME")
+	}
+
+	var running map[string]bool
+	if ecsRunner, ok := runner.(*ECSRunner); ok {
+		var err error
+		running, err = ecsRunner.RunningTasks(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	started := 0
+	counts := map[string]int{}
+	err := stateStore.ListByStatusPages(ctx, JobStatusStarted, func(records []*JobRecord) bool {
+		for _, record := range records {
+			if ctx.Err() != nil {
+				return false
+			}
+
+			started++
+			if time.Since(record.UpdatedAt) < reconcileCfg.MinAge || record.Payload == nil {
+				continue
+			}
+
+			outcome, reconcileErr := reconcileJob(ctx, record, running)
+			if reconcileErr != nil {
+				slog.Error("failed to reconcile job", slog.String("jobId", record.JobID), slog.Any("err", reconcileErr))
+				continue
+			}
+			if outcome != "" {
+				counts[outcome]++
+			}
+		}
+		return true
+	})
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	if ctx.Err() == nil {
+		released, releaseErr := releaseFinishedSlots(ctx, running)
+		if releaseErr != nil && ctx.Err() == nil {
+			return releaseErr
+		}
+		if released > 0 {
+			slog.Info("released project quota slots of finished jobs", slog.Int("released", released))
+		}
+	}
+
+	for outcome, count := range counts {
+		EmitMetric("ReconciledJobs", float64(count), MetricUnitCount, map[string]string{"Outcome": outcome})
+	}
+	if ctx.Err() != nil {
+		slog.Warn("reconciliation stopped at its deadline, the jobs left are reconciled by the next run", slog.Int("started", started), slog.Any("reconciled", counts))
+		return nil
+	}
+	slog.Info("reconciled state store", slog.Int("started", started), slog.Any("reconciled", counts))
+	return nil
+}
+
+// reconcileJob reports the outcome of a started job whose agents stopped or are ready, and returns it
+func reconcileJob(ctx context.Context, record *JobRecord, running map[string]bool) (outcome string, err error) {
+	outcome, err = waitForAgent(ctx, record.TaskARN, FindProfile(taskProfiles, record.Profile).Readiness(), time.Nanosecond, nil)
+	if errors.Is(err, errAgentPending) {
+		return "", nil
+	}
+	if err != nil {
+		if running == nil || anyTaskRunning(record.TaskARN, running) {
+			return "", err
+		}
+		outcome, err = "failed", nil
+	}
+
+	if outcome == "succeeded" && continuations != nil {
+		return "", nil
+	}
+
+	slog.Warn("reporting missed job outcome", slog.String("jobId", record.JobID), slog.String("outcome", outcome))
+
+	status := JobStatusFailed
+	if outcome == "succeeded" {
+		status = JobStatusSucceeded
+	}
+	err = stateStore.UpdateStatus(ctx, record.JobID, status)
+	if err != nil {
+		return
+	}
+
+	if outcome == "failed" {
+		releaseAgent(ctx, record.TaskARN)
+	}
+	if outcome == "failed" && (running == nil || !anyTaskRunning(record.TaskARN, running)) {
+		releaseErr := releaseJobSlot(ctx, record)
+		if releaseErr != nil {
+			slog.Error("failed to release project quota slot", slog.Any("err", releaseErr))
+		}
+	}
+
+	err = reporter.Report(ctx, record.Payload, outcome, nil)
+	return
+}
+
+// anyTaskRunning reports whether any agent task of a job is listed as running
+func anyTaskRunning(id string, running map[string]bool) bool {
+	for _, taskARN := range strings.Split(id, ",") {
+		if running[taskARN] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ADORecordingConfig contains configuration values for recording ADO interactions as fixtures
+type ADORecordingConfig struct {
+	Enabled      bool   // Whether ADO requests and responses are recorded
+	Bucket       string // The S3 bucket that fixtures are written to, fixtures are logged if empty
+	Prefix       string // The S3 key prefix of the fixtures
+	MaxBodyBytes int    // The maximum size of the recorded request and response bodies
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - ADO_RECORDING_ENABLED: Whether sanitized ADO requests and responses are recorded as fixtures, for debugging (default: false)
+  - ADO_RECORDING_BUCKET: The S3 bucket that fixtures are written to as JSON, fixtures are logged as 'ado fixture' records if unset
+  - ADO_RECORDING_PREFIX: The S3 key prefix of the fixtures (default: ado-fixtures/)
+  - ADO_RECORDING_MAX_BODY_BYTES: The maximum size of the recorded bodies, longer bodies are truncated (default: 65536)
+*/
+func (config *ADORecordingConfig) ReadFromEnv() {
+	config.Enabled = ReadEnvVarWithDefault("ADO_RECORDING_ENABLED", "false") == "true"
+	config.Bucket = ReadEnvVarWithDefault("ADO_RECORDING_BUCKET", "")
+	config.Prefix = ReadEnvVarWithDefault("ADO_RECORDING_PREFIX", "ado-fixtures/")
+
+	maxBodyBytesStr := ReadEnvVarWithDefault("ADO_RECORDING_MAX_BODY_BYTES", "65536")
+	maxBodyBytes, err := strconv.Atoi(maxBodyBytesStr)
+	if err != nil || maxBodyBytes < 0 {
+		slog.Error("failed to parse ADO_RECORDING_MAX_BODY_BYTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxBodyBytes = maxBodyBytes
+}
+
+// ADOFixtureMessage is a sanitized request or response of a recorded ADO interaction
+type ADOFixtureMessage struct {
+	Method       string              `json:"method,omitempty"`       // The request method
+	URL          string              `json:"url,omitempty"`          // The request URL
+	StatusCode   int                 `json:"statusCode,omitempty"`   // The response status code
+	Headers      map[string][]string `json:"headers"`                // The headers, with credentials redacted
+	Body         string              `json:"body"`                   // The body, with credentials redacted
+	BodyEncoding string              `json:"bodyEncoding,omitempty"` // base64 for bodies that aren't UTF-8 text, such as compressed log content
+	Truncated    bool                `json:"truncated,omitempty"`    // Whether the body was longer than ADO_RECORDING_MAX_BODY_BYTES
+}
+
+// ADOFixture is a recorded ADO request and its response, replayable with ADOFixtureReplayer
+type ADOFixture struct {
+	RecordedAt time.Time          `json:"recordedAt"`         // When the request was sent
+	DurationMs int64              `json:"durationMs"`         // How long the request took
+	Request    ADOFixtureMessage  `json:"request"`            // The request
+	Response   *ADOFixtureMessage `json:"response,omitempty"` // The response, unless the request failed without one
+	Error      string             `json:"error,omitempty"`    // The error of a request that failed without a response
+}
+
+// ADOTransport returns the transport of the ADO client, recording its requests if enabled
+func (config *ADORecordingConfig) ADOTransport(awsCfg aws.Config, next http.RoundTripper) http.RoundTripper {
+	if !config.Enabled {
+		return next
+	}
+
+	transport := &recordingTransport{Config: config, Next: next}
+	if config.Bucket != "" {
+		transport.S3 = s3.NewFromConfig(awsCfg)
+	}
+	slog.Warn("ADO requests are recorded", slog.String("bucket", config.Bucket))
+	return transport
+}
+
+/*
+recordingTransport records ADO requests and their responses as fixtures, see ADOFixture,
+which reproduce the quirks of the ADO API in tests without live credentials.
+
+Credentials are redacted before fixtures are written: the Authorization, Cookie and ADO_EXTRA_HEADERS headers,
+and the JSON fields, form fields and query parameters whose names suggest a secret, such as access tokens.
+Failures to write fixtures are logged and don't fail the requests.
+*/
+type recordingTransport struct {
+	Config *ADORecordingConfig // The recording configuration
+	S3     *s3.Client          // The client of the fixtures bucket, nil to log fixtures
+	Next   http.RoundTripper   // The transport that sends the requests
+
+	sequence atomic.Int64
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fixture := &ADOFixture{RecordedAt: time.Now().UTC()}
+
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	fixture.Request = t.message(req.Header, reqBody)
+	fixture.Request.Method = req.Method
+	fixture.Request.URL = redactURL(req.URL)
+
+	res, err := t.Next.RoundTrip(req)
+	fixture.DurationMs = time.Since(fixture.RecordedAt).Milliseconds()
+	if err != nil {
+		fixture.Error = err.Error()
+		t.write(req.Context(), fixture)
+		return res, err
+	}
+
+	// bodies past the largest size read by ADO requests are cut, which the caller reports as truncated
+	resBody, readErr := io.ReadAll(io.LimitReader(res.Body, max(adoCfg.MaxResponseBytes, adoListAgentsMaxResponseBytes)+1))
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	if readErr != nil {
+		fixture.Error = readErr.Error()
+	}
+
+	response := t.message(res.Header, resBody)
+	response.StatusCode = res.StatusCode
+	fixture.Response = &response
+	t.write(req.Context(), fixture)
+	return res, nil
+}
+
+// message returns the sanitized fixture of a request or response
+func (t *recordingTransport) message(header http.Header, body []byte) (message ADOFixtureMessage) {
+	message.Headers = map[string][]string{}
+	for name, values := range header {
+		if isSecretHeader(name) {
+			values = []string{"REDACTED"}
+		}
+		message.Headers[name] = values
+	}
+
+	body = redactBody(header.Get("Content-Type"), body)
+	if len(body) > t.Config.MaxBodyBytes {
+		body = body[:t.Config.MaxBodyBytes]
+		message.Truncated = true
+	}
+
+	if utf8.Valid(body) {
+		message.Body = string(body)
+	} else {
+		message.Body = base64.StdEncoding.EncodeToString(body)
+		message.BodyEncoding = "base64"
+	}
+	return
+}
+
+// write writes a fixture to S3, or logs it
+func (t *recordingTransport) write(ctx context.Context, fixture *ADOFixture) {
+	if t.S3 == nil {
+		slog.Info("ado fixture", slog.Any("fixture", fixture))
+		return
+	}
+
+	body, err := json.Marshal(fixture)
+	if err != nil {
+		slog.Error("failed to marshal ADO fixture", slog.Any("err", err))
+		return
+	}
+
+	key := fmt.Sprintf("%s%s-%04d.json", t.Config.Prefix, fixture.RecordedAt.Format("2006-01-02T15-04-05.000Z"), t.sequence.Add(1))
+	_, err = t.S3.PutObject(context.WithoutCancel(ctx), &s3.PutObjectInput{
+		Bucket:      aws.String(t.Config.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		slog.Error("failed to write ADO fixture", slog.String("key", key), slog.Any("err", err))
+	}
+}
+
+// isSecretHeader reports whether a header carries credentials: the authorization and cookie headers, and the ADO_EXTRA_HEADERS, which may carry proxy tokens
+func isSecretHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+		return true
+	}
+	for extra := range adoCfg.ExtraHeaders {
+		if strings.EqualFold(name, extra) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecretField reports whether the name of a JSON field, form field or query parameter suggests a secret
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"token", "secret", "password", "assertion"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns a URL with its secret query parameters redacted
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	for name := range query {
+		if isSecretField(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// redactBody returns a JSON or form body with its secret fields redacted, other bodies are returned as is
+func redactBody(contentType string, body []byte) []byte {
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		for name := range form {
+			if isSecretField(name) {
+				form.Set(name, "REDACTED")
+			}
+		}
+		return []byte(form.Encode())
+	case len(body) > 0 && json.Valid(body):
+		var value any
+		_ = json.Unmarshal(body, &value)
+		redacted, err := json.Marshal(redactJSON(value))
+		if err != nil {
+			return body
+		}
+		return redacted
+	default:
+		return body
+	}
+}
+
+// redactJSON redacts the secret fields of a decoded JSON value
+func redactJSON(value any) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		for name, field := range typed {
+			if isSecretField(name) {
+				typed[name] = "REDACTED"
+				continue
+			}
+			typed[name] = redactJSON(field)
+		}
+	case []any:
+		for i, item := range typed {
+			typed[i] = redactJSON(item)
+		}
+	}
+	return value
+}
+
+/*
+ADOFixtureReplayer is a transport serving recorded fixtures instead of sending requests,
+for tests reproducing ADO interactions: each request is answered with the response of the next unused fixture
+with the same method and URL, or fails if there's none.
+*/
+type ADOFixtureReplayer struct {
+	Fixtures []ADOFixture // The recorded fixtures, in the order they were recorded
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *ADOFixtureReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	target := redactURL(req.URL)
+	for i, fixture := range r.Fixtures {
+		if r.used[i] || fixture.Request.Method != req.Method || fixture.Request.URL != target {
+			continue
+		}
+		if r.used == nil {
+			r.used = map[int]bool{}
+		}
+		r.used[i] = true
+
+		if fixture.Response == nil {
+			return nil, fmt.Errorf("replayed fixture: %s", fixture.Error)
+		}
+
+		body := []byte(fixture.Response.Body)
+		if fixture.Response.BodyEncoding == "base64" {
+			var err error
+			body, err = base64.StdEncoding.DecodeString(fixture.Response.Body)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode fixture body: %w", err)
+			}
+		}
+
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", fixture.Response.StatusCode, http.StatusText(fixture.Response.StatusCode)),
+			StatusCode: fixture.Response.StatusCode,
+			Header:     http.Header(fixture.Response.Headers),
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no fixture for %s %s", req.Method, target)
+}
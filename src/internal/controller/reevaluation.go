@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Policies applied when a check of a job is re-evaluated
+const (
+	ReevaluationPolicyFresh = "fresh" // Start a fresh agent for the re-evaluated check
+	ReevaluationPolicyReuse = "reuse" // Report the re-evaluated check as succeeded if the agent of the previous check is still running
+)
+
+// ReevaluationConfig contains configuration values for the handling of re-evaluated checks
+type ReevaluationConfig struct {
+	Policy string // One of the ReevaluationPolicy values
+}
+
+/*
+ReadFromEnv reads the following optional environment variable
+and populates the struct with the values:
+  - CHECK_REEVALUATION_POLICY: How a check re-evaluated by ADO is handled, fresh or reuse (default: fresh)
+*/
+func (config *ReevaluationConfig) ReadFromEnv() {
+	config.Policy = ReadEnvVarWithDefault("CHECK_REEVALUATION_POLICY", ReevaluationPolicyFresh)
+	if config.Policy != ReevaluationPolicyFresh && config.Policy != ReevaluationPolicyReuse {
+		slog.Error(fmt.Sprintf("failed to parse CHECK_REEVALUATION_POLICY: unsupported policy %s", config.Policy))
+		os.Exit(1)
+	}
+}
+
+// latestCheckKey returns the state table key of the pointer to the latest check of a job
+func latestCheckKey(jobID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "job#" + jobID}}
+}
+
+// SetLatestCheck records the latest check of a job and returns the previous one, if any
+func (s *StateStore) SetLatestCheck(ctx context.Context, jobID string, checkID string) (previous string, err error) {
+	result, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.Config.TableName),
+		Key:              latestCheckKey(jobID),
+		UpdateExpression: aws.String("SET CheckId = :check, ExpiresAt = :expires"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":check":   &types.AttributeValueMemberS{Value: checkID},
+			":expires": &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().UTC().Add(s.Config.TTL).Unix())},
+		},
+		ReturnValues: types.ReturnValueUpdatedOld,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to set latest check: %w", err)
+		return
+	}
+
+	if value, ok := result.Attributes["CheckId"].(*types.AttributeValueMemberS); ok {
+		previous = value.Value
+	}
+	return
+}
+
+/*
+reevaluatedCheck detects a check re-evaluated by ADO, a check of a job with a new task instance ID,
+and returns the record of the previous check if its agent can be reused by the re-evaluated one,
+per CHECK_REEVALUATION_POLICY:
+the policy is reuse, the previous check succeeded, and its agent is still running.
+
+Concurrent checks of the same job, e.g. an environment check and a service connection check, never reuse agents,
+since the previous check hasn't succeeded yet.
+The ReevaluatedChecks metric is emitted per decision.
+*/
+func reevaluatedCheck(ctx context.Context, payload *ADOPayload) (previous *JobRecord, err error) {
+	if stateStore == nil || payload.TaskInstanceID == "" {
+		return
+	}
+
+	previousCheckID, err := stateStore.SetLatestCheck(ctx, payload.JobID, payload.CheckID())
+	if err != nil || previousCheckID == "" || previousCheckID == payload.CheckID() {
+		return
+	}
+
+	decision := ReevaluationPolicyFresh
+	defer func() {
+		slog.Info("check re-evaluated", slog.String("jobId", payload.JobID), slog.String("previousCheckId", previousCheckID), slog.String("decision", decision))
+		EmitMetric("ReevaluatedChecks", 1, MetricUnitCount, map[string]string{"Decision": decision})
+	}()
+
+	if reevaluationCfg.Policy != ReevaluationPolicyReuse {
+		return
+	}
+
+	record, getErr := stateStore.Get(ctx, previousCheckID)
+	if getErr != nil || record.Status != JobStatusSucceeded {
+		return
+	}
+
+	status, statusErr := runner.Status(withCheckID(ctx, previousCheckID), record.TaskARN)
+	if statusErr != nil {
+		slog.Warn("failed to get the agent status of the previous check", slog.String("checkId", previousCheckID), slog.Any("err", statusErr))
+		return
+	}
+	if status != TaskStatusRunning {
+		return
+	}
+
+	decision = ReevaluationPolicyReuse
+	previous = record
+	return
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Reporter reports the outcome of a job to the CI system, or to other systems interested in it
+type Reporter interface {
+	Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error // Reports the outcome and the metadata of the agent, if any
+}
+
+/*
+NewReporterFromEnv reads the following optional environment variables
+and returns the reporter of job outcomes:
+  - REPORTERS: A comma-separated list of reporters, every one of which is sent every outcome: ado, eventbridge, sns or webhook (default: ado)
+  - REPORTER_EVENT_BUS: The name or ARN of the EventBridge event bus of the eventbridge reporter, requires events:PutEvents
+  - REPORTER_TOPIC_ARN: The ARN of the SNS topic of the sns reporter, requires sns:Publish
+  - REPORTER_WEBHOOK_URL: The URL that the webhook reporter POSTs outcomes to
+  - REPORTER_WEBHOOK_SECRET: An optional secret signing the webhook bodies, see WebhookReporter
+*/
+func NewReporterFromEnv(cfg aws.Config) Reporter {
+	var reporters MultiReporter
+	for _, name := range strings.Split(ReadEnvVarWithDefault("REPORTERS", "ado"), ",") {
+		switch strings.TrimSpace(name) {
+		case "ado":
+			reporters = append(reporters, &ADOReporter{Client: adoClient, Config: adoCfg, Breaker: adoBreaker})
+		case "eventbridge":
+			reporters = append(reporters, &EventBridgeReporter{Client: eventbridge.NewFromConfig(cfg), EventBus: ReadRequiredEnvVar("REPORTER_EVENT_BUS")})
+		case "sns":
+			reporters = append(reporters, &SNSReporter{Client: sns.NewFromConfig(cfg), TopicARN: ReadRequiredEnvVar("REPORTER_TOPIC_ARN")})
+		case "webhook":
+			reporters = append(reporters, &WebhookReporter{Client: &http.Client{}, URL: ReadRequiredEnvVar("REPORTER_WEBHOOK_URL"), Secret: ReadEnvVarWithDefault("REPORTER_WEBHOOK_SECRET", "")})
+		default:
+			slog.Error(fmt.Sprintf("failed to parse REPORTERS: unsupported reporter %s", name))
+			os.Exit(1)
+		}
+	}
+
+	if len(reporters) == 1 {
+		return reporters[0]
+	}
+	return reporters
+}
+
+// MultiReporter sends every outcome to each of its reporters, and fails if any of them fails
+type MultiReporter []Reporter
+
+// Report implements Reporter
+func (reporters MultiReporter) Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error {
+	var errs []error
+	for _, reporter := range reporters {
+		errs = append(errs, reporter.Report(ctx, payload, result, metadata))
+	}
+	return errors.Join(errs...)
+}
+
+/*
+ADOReporter sets the metadata as variables of the check's timeline record,
+and sends the TaskCompleted callback through the ADO circuit breaker.
+
+Soft failures, errors reported by ADO with a successful status code, are logged and counted
+with the CallbackSoftFailures metric, but not retried, since ADO won't accept the callback later either.
+
+Callbacks are sent once per check: with the state store, callbacks already sent for the check,
+e.g. before SQS redelivered its record, are suppressed, see callbackAlreadySent.
+*/
+type ADOReporter struct {
+	Client  *http.Client    // The ADO client
+	Config  *ADOConfig      // The ADO configuration
+	Breaker *CircuitBreaker // The ADO circuit breaker
+}
+
+// Report implements Reporter
+func (r *ADOReporter) Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error {
+	if callbackAlreadySent(ctx, payload, result) {
+		return nil
+	}
+
+	if len(metadata) > 0 {
+		err := ADOTimelineRecordVariables(r.Client, r.Config, payload, metadata)
+		if err != nil {
+			dependencies.Fallback(DependencyTimeline, "set timeline variables", err)
+		} else {
+			dependencies.Recover(DependencyTimeline)
+		}
+	}
+
+	err := r.Breaker.Allow()
+	if err != nil {
+		return err
+	}
+
+	callbackResponse, err := ADOCallback(r.Client, &ADOCallbackConfig{
+		Config:  r.Config,
+		Payload: payload,
+		Result:  result,
+	})
+	var rejected *ADOCallbackRejectedError
+	if errors.As(err, &rejected) {
+		r.Breaker.Record(nil)
+		slog.Warn("ADO callback soft failure", slog.String("jobId", payload.JobID), slog.String("result", result), slog.String("kind", rejected.Kind), slog.String("typeKey", rejected.TypeKey), slog.String("message", rejected.Message))
+		EmitMetric("CallbackSoftFailures", 1, MetricUnitCount, map[string]string{"Kind": rejected.Kind})
+		recordSentCallback(ctx, payload, result)
+		return nil
+	}
+	r.Breaker.Record(err)
+	if err != nil {
+		return err
+	}
+
+	recordSentCallback(ctx, payload, result)
+
+	slog.Info("ADO response", slog.Any("res", string(callbackResponse)))
+	return nil
+}
+
+// OutcomeEvent is the body of the outcomes sent by the eventbridge, sns and webhook reporters
+type OutcomeEvent struct {
+	Controller string            `json:"controller"`         // The controller ID, see controllerID
+	JobID      string            `json:"jobId"`              // The ADO job ID
+	CheckID    string            `json:"checkId"`            // The check ID of the job, see ADOPayload.CheckID
+	ProjectID  string            `json:"projectId"`          // The ADO project ID
+	PlanID     string            `json:"planId"`             // The ADO plan ID
+	Result     string            `json:"result"`             // The outcome, succeeded or failed
+	Metadata   map[string]string `json:"metadata,omitempty"` // The metadata of the agent, see agentMetadata
+	Time       time.Time         `json:"time"`               // When the outcome was reported
+}
+
+// newOutcomeEvent returns the outcome event of a job
+func newOutcomeEvent(payload *ADOPayload, result string, metadata map[string]string) *OutcomeEvent {
+	return &OutcomeEvent{
+		Controller: controllerID,
+		JobID:      payload.JobID,
+		CheckID:    payload.CheckID(),
+		ProjectID:  payload.ProjectID,
+		PlanID:     payload.PlanID,
+		Result:     result,
+		Metadata:   metadata,
+		Time:       time.Now().UTC(),
+	}
+}
+
+// EventBridgeReporter sends outcomes as 'Job Outcome' events to an EventBridge event bus
+type EventBridgeReporter struct {
+	Client   *eventbridge.Client // The EventBridge client
+	EventBus string              // The name or ARN of the event bus
+}
+
+// Report implements Reporter
+func (r *EventBridgeReporter) Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error {
+	detail, err := json.Marshal(newOutcomeEvent(payload, result, metadata))
+	if err != nil {
+		return fmt.Errorf("failed to marshal outcome event: %w", err)
+	}
+
+	output, err := r.Client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []ebtypes.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(r.EventBus),
+				Source:       aws.String("azure-pipelines-ecs-controller"),
+				DetailType:   aws.String("Job Outcome"),
+				Detail:       aws.String(string(detail)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put outcome event: %w", err)
+	}
+
+	if output.FailedEntryCount > 0 {
+		return fmt.Errorf("failed to put outcome event: %s", aws.ToString(output.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+// SNSReporter publishes outcomes to an SNS topic, with the result as the 'result' message attribute for subscription filters
+type SNSReporter struct {
+	Client   *sns.Client // The SNS client
+	TopicARN string      // The ARN of the topic
+}
+
+// Report implements Reporter
+func (r *SNSReporter) Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error {
+	message, err := json.Marshal(newOutcomeEvent(payload, result, metadata))
+	if err != nil {
+		return fmt.Errorf("failed to marshal outcome event: %w", err)
+	}
+
+	_, err = r.Client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(r.TopicARN),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"result": {DataType: aws.String("String"), StringValue: aws.String(result)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish outcome: %w", err)
+	}
+	return nil
+}
+
+/*
+WebhookReporter POSTs outcomes as JSON to a URL.
+
+If a secret is set, the body is signed with HMAC-SHA256 in the 'X-Signature-256' header,
+as 'sha256=' followed by the hex-encoded signature.
+*/
+type WebhookReporter struct {
+	Client *http.Client // The HTTP client
+	URL    string       // The webhook URL
+	Secret string       // The optional signing secret
+}
+
+// Report implements Reporter
+func (r *WebhookReporter) Report(ctx context.Context, payload *ADOPayload, result string, metadata map[string]string) error {
+	body, err := json.Marshal(newOutcomeEvent(payload, result, metadata))
+	if err != nil {
+		return fmt.Errorf("failed to marshal outcome event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(r.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := r.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute HTTP request: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("failed to send outcome webhook: unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
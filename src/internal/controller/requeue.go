@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// sqsMaxVisibilityTimeout is the maximum visibility timeout of an SQS message, in seconds
+const sqsMaxVisibilityTimeout = 43200
+
+// RequeueConfig contains configuration values for the redelivery of records that failed with a transient error
+type RequeueConfig struct {
+	BaseDelaySeconds int32 // The delay before the first redelivery, doubled on every further receive
+	MaxDelaySeconds  int32 // The maximum delay before a redelivery
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - REQUEUE_BASE_DELAY_SECONDS: The delay before the first redelivery of a record that failed with a transient error, doubled on every further receive (default: 15)
+  - REQUEUE_MAX_DELAY_SECONDS: The maximum delay before a redelivery (default: 300)
+*/
+func (config *RequeueConfig) ReadFromEnv() {
+	baseStr := ReadEnvVarWithDefault("REQUEUE_BASE_DELAY_SECONDS", "15")
+	base, err := strconv.ParseInt(baseStr, 10, 32)
+	if err != nil || base < 0 {
+		slog.Error("failed to parse REQUEUE_BASE_DELAY_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.BaseDelaySeconds = int32(base)
+
+	maxStr := ReadEnvVarWithDefault("REQUEUE_MAX_DELAY_SECONDS", "300")
+	maxDelay, err := strconv.ParseInt(maxStr, 10, 32)
+	if err != nil || maxDelay < 0 || maxDelay > sqsMaxVisibilityTimeout {
+		slog.Error("failed to parse REQUEUE_MAX_DELAY_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxDelaySeconds = int32(maxDelay)
+}
+
+// Delay returns the redelivery delay of a message received the given number of times
+func (config *RequeueConfig) Delay(receiveCount int) int32 {
+	delay := int64(config.BaseDelaySeconds)
+	for i := 1; i < receiveCount && delay < int64(config.MaxDelaySeconds); i++ {
+		delay *= 2
+	}
+	return int32(min(delay, int64(config.MaxDelaySeconds)))
+}
+
+// sqsQueueURLs caches the queue URLs of the SQS queue ARNs, see sqsQueueURL
+var sqsQueueURLs sync.Map
+
+/*
+sqsQueueURL returns the URL of the SQS queue with the given ARN, looked up with GetQueueUrl once per queue,
+since the endpoint of the queue depends on the partition, such as the amazonaws.com.cn domain of aws-cn,
+and on the endpoint configuration of the client, such as FIPS endpoints.
+It requires sqs:GetQueueUrl on the queue, which AWSLambdaSQSQueueExecutionRole doesn't grant.
+*/
+func sqsQueueURL(ctx context.Context, queueARN string) (string, error) {
+	if queueURL, ok := sqsQueueURLs.Load(queueARN); ok {
+		return queueURL.(string), nil
+	}
+
+	parts := strings.Split(queueARN, ":")
+	if len(parts) != 6 || parts[2] != "sqs" {
+		return "", fmt.Errorf("invalid SQS queue ARN %s", queueARN)
+	}
+
+	result, err := sqsClient.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(parts[5]),
+		QueueOwnerAWSAccountId: aws.String(parts[4]),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the URL of SQS queue %s: %w", queueARN, err)
+	}
+
+	queueURL := aws.ToString(result.QueueUrl)
+	sqsQueueURLs.Store(queueARN, queueURL)
+	return queueURL, nil
+}
+
+/*
+requeueWithBackoff delays the redelivery of a record that failed with a transient error,
+such as ECS API throttling or a 5xx error, by changing the visibility timeout of its message.
+
+Records requeued in maintenance mode are redelivered after the maintenance delay,
+and records deferred by the fair share scheduler after its defer delay.
+Records that failed with other errors are redelivered after the queue's visibility timeout,
+and eventually moved to the dead-letter queue by the queue's redrive policy.
+*/
+func requeueWithBackoff(ctx context.Context, record events.SQSMessage, err error) {
+	logger := slog.With(slog.String("messageId", record.MessageId), slog.Any("err", err))
+
+	if !IsTransientError(err) {
+		logger.Error("record failed")
+		return
+	}
+
+	receiveCount, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+	delay := requeueCfg.Delay(receiveCount)
+	reason := ClassifyAWSError(err)
+	if errors.Is(err, ErrMaintenanceMode) {
+		delay = maintenanceCfg.RequeueDelaySeconds
+		reason = "maintenance"
+	}
+	if errors.Is(err, ErrFairShareDeferred) {
+		delay = fairShareCfg.DeferDelaySeconds
+		reason = "fairshare"
+	}
+
+	queueURL, urlErr := sqsQueueURL(ctx, record.EventSourceARN)
+	if urlErr != nil {
+		logger.Error("failed to requeue record", slog.Any("requeueErr", urlErr))
+		return
+	}
+
+	_, visibilityErr := sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     aws.String(record.ReceiptHandle),
+		VisibilityTimeout: delay,
+	})
+	if visibilityErr != nil {
+		logger.Error("failed to requeue record", slog.Any("requeueErr", visibilityErr))
+		return
+	}
+
+	logger.Warn("record requeued after a transient error", slog.Int("delaySeconds", int(delay)))
+	EmitMetric("RequeuedRecords", 1, MetricUnitCount, map[string]string{"ErrorClass": reason})
+}
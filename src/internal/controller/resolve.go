@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TaskOwner is the ADO pipeline job that owns an agent task
+type TaskOwner struct {
+	TaskARN   string `json:"taskArn"`             // The ID of the agent task
+	CheckID   string `json:"checkId"`             // The check ID of the job, see ADOPayload.CheckID
+	JobID     string `json:"jobId"`               // The ADO job ID
+	PlanURL   string `json:"planUrl,omitempty"`   // The plan URL, unknown if the job isn't tracked in the state store
+	PlanID    string `json:"planId,omitempty"`    // The plan ID, unknown if the job isn't tracked in the state store
+	ProjectID string `json:"projectId,omitempty"` // The ADO project ID, unknown if the job isn't tracked in the state store
+	Status    string `json:"status,omitempty"`    // The job lifecycle status, unknown if the job isn't tracked in the state store
+}
+
+/*
+ResolveTask returns the ADO pipeline job that owns an agent task, given its ARN or, for the ecs backend, its ID.
+
+With the ecs backend, the owner is read from the StartedBy tag of the task, set to the check ID of the job,
+and completed from the state store if the job is tracked there.
+With other backends, the owner is looked up in the state store.
+ErrJobNotFound is returned if the owner can't be found.
+*/
+func ResolveTask(ctx context.Context, task string) (owner *TaskOwner, err error) {
+	if ecsClient != nil && taskCfg != nil {
+		return resolveECSTask(ctx, task)
+	}
+
+	if stateStore == nil {
+		err = fmt.Errorf("resolving tasks of the %T backend requires the state store", runner)
+		return
+	}
+
+	record, err := findTaskRecord(ctx, task)
+	if err != nil {
+		return
+	}
+
+	owner = taskOwnerOf(task, record)
+	return
+}
+
+// resolveECSTask returns the owner of a task of the ECS cluster from its StartedBy tag
+func resolveECSTask(ctx context.Context, task string) (owner *TaskOwner, err error) {
+	described, err := DescribeTask(ctx, ecsClient, &ECSTaskReadConfig{
+		Cluster: taskCfg.Cluster,
+		TaskARN: task,
+	})
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrJobNotFound, err)
+		return
+	}
+
+	checkID := aws.ToString(described.StartedBy)
+	if checkID == "" {
+		err = fmt.Errorf("%w: task %s wasn't started for a job", ErrJobNotFound, task)
+		return
+	}
+
+	taskARN := aws.ToString(described.TaskArn)
+	jobID, _, _ := strings.Cut(checkID, "_")
+	owner = &TaskOwner{TaskARN: taskARN, CheckID: checkID, JobID: jobID}
+
+	if stateStore == nil {
+		return
+	}
+
+	record, getErr := stateStore.Get(ctx, checkID)
+	if getErr != nil {
+		return
+	}
+
+	owner = taskOwnerOf(taskARN, record)
+	return
+}
+
+// taskOwnerOf returns the owner of a task started for a tracked job
+func taskOwnerOf(taskARN string, record *JobRecord) *TaskOwner {
+	owner := &TaskOwner{TaskARN: taskARN, CheckID: record.JobID, Status: record.Status}
+	owner.JobID, _, _ = strings.Cut(record.JobID, "_")
+	if record.Payload != nil {
+		owner.JobID = record.Payload.JobID
+		owner.PlanURL = record.Payload.PlanURL
+		owner.PlanID = record.Payload.PlanID
+		owner.ProjectID = record.Payload.ProjectID
+	}
+	return owner
+}
+
+// findTaskRecord returns the record of the job of a task from the state store, or ErrJobNotFound, by scanning the table
+func findTaskRecord(ctx context.Context, taskARN string) (*JobRecord, error) {
+	records, err := stateStore.scan(ctx, "contains(TaskArn, :task)", nil, map[string]types.AttributeValue{
+		":task": &types.AttributeValueMemberS{Value: taskARN},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.HasTask(taskARN) {
+			return record, nil
+		}
+	}
+	return nil, ErrJobNotFound
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Classes of AWS API errors reported in logs and metrics
+const (
+	AWSErrorClassThrottling  = "throttling"
+	AWSErrorClassTimeout     = "timeout"
+	AWSErrorClassServerError = "server"
+	AWSErrorClassTerminal    = "terminal"
+)
+
+// AWSRetryConfig contains the retry and timeout configuration of the AWS ECS client
+type AWSRetryConfig struct {
+	Mode        aws.RetryMode // The retry mode, standard or adaptive
+	Policy      *RetryPolicy  // The attempts and backoff of each API call, the SDK decides which errors are retried
+	CallTimeout time.Duration // The timeout of each API call, including its retries, 0 for no timeout
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - ECS_RETRY_MODE: The retry mode of the ECS client, standard or adaptive (default: adaptive)
+  - ECS_RETRY_MAX_ATTEMPTS: The maximum number of attempts of each ECS API call (default: 5)
+  - ECS_CALL_TIMEOUT_SECONDS: The timeout of each ECS API call, including its retries, 0 for no timeout (default: 10)
+
+The backoff is read with ReadRetryPolicyFromEnv as the ECS policy, whose RETRY_ECS_MAX_ATTEMPTS overrides ECS_RETRY_MAX_ATTEMPTS
+(defaults: 1000ms base delay, 20000ms max delay, full jitter, as the SDK's own backoff).
+*/
+func (config *AWSRetryConfig) ReadFromEnv() {
+	mode, err := aws.ParseRetryMode(ReadEnvVarWithDefault("ECS_RETRY_MODE", string(aws.RetryModeAdaptive)))
+	if err != nil {
+		slog.Error("failed to parse ECS_RETRY_MODE", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Mode = mode
+
+	maxAttemptsStr := ReadEnvVarWithDefault("ECS_RETRY_MAX_ATTEMPTS", "5")
+	maxAttempts, err := strconv.Atoi(maxAttemptsStr)
+	if err != nil || maxAttempts < 1 {
+		slog.Error("failed to parse ECS_RETRY_MAX_ATTEMPTS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Policy = ReadRetryPolicyFromEnv("ECS", RetryPolicy{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   time.Second,
+		MaxDelay:    20 * time.Second,
+		Jitter:      1,
+	})
+
+	timeoutStr := ReadEnvVarWithDefault("ECS_CALL_TIMEOUT_SECONDS", "10")
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil || timeout < 0 {
+		slog.Error("failed to parse ECS_CALL_TIMEOUT_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.CallTimeout = time.Duration(timeout) * time.Second
+}
+
+// ECSOptions applies the retry and timeout configuration to the options of an ECS client
+func (config *AWSRetryConfig) ECSOptions(o *ecs.Options) {
+	o.RetryMode = config.Mode
+	o.RetryMaxAttempts = config.Policy.MaxAttempts
+	o.Retryer = config.Retryer()
+
+	if config.CallTimeout > 0 {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(callTimeoutMiddleware(config.CallTimeout), middleware.Before)
+		})
+	}
+}
+
+// Retryer returns the SDK retryer of the retry mode, with the attempts and backoff of the policy
+func (config *AWSRetryConfig) Retryer() aws.Retryer {
+	standardOptions := func(so *retry.StandardOptions) {
+		so.MaxAttempts = config.Policy.MaxAttempts
+		so.MaxBackoff = config.Policy.MaxDelay
+		so.Backoff = config.Policy
+	}
+
+	if config.Mode == aws.RetryModeAdaptive {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, standardOptions)
+		})
+	}
+	return retry.NewStandard(standardOptions)
+}
+
+// callTimeoutMiddleware bounds the duration of an API call, including its retries
+func callTimeoutMiddleware(timeout time.Duration) middleware.InitializeMiddleware {
+	return middleware.InitializeMiddlewareFunc("CallTimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return next.HandleInitialize(ctx, in)
+	})
+}
+
+/*
+ClassifyAWSError returns the class of an AWS API error:
+  - throttling: the request was throttled, retrying later may succeed
+  - timeout: the call exceeded its timeout
+  - server: the service returned a 5xx status code
+  - terminal: any other error
+*/
+func ClassifyAWSError(err error) string {
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+		return AWSErrorClassThrottling
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return AWSErrorClassTimeout
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() >= 500 {
+		return AWSErrorClassServerError
+	}
+
+	return AWSErrorClassTerminal
+}
+
+// IsTransientError reports whether retrying the failed operation later may succeed
+func IsTransientError(err error) bool {
+	if errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrProjectQuotaExceeded) || errors.Is(err, ErrMaintenanceMode) || errors.Is(err, ErrFairShareDeferred) || errors.Is(err, ErrDedupeInFlight) || errors.Is(err, errAgentPending) {
+		return true
+	}
+	return ClassifyAWSError(err) != AWSErrorClassTerminal
+}
+
+// logAWSError logs an AWS API error with its class and emits the AWSAPIErrors metric
+func logAWSError(operation string, err error) {
+	class := ClassifyAWSError(err)
+	slog.Error("AWS API call failed", slog.String("operation", operation), slog.String("errorClass", class), slog.Any("err", err))
+	EmitMetric("AWSAPIErrors", 1, MetricUnitCount, map[string]string{"Operation": operation, "ErrorClass": class})
+}
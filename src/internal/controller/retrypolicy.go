@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+RetryPolicy is the retry behavior of an operation: how many attempts are made,
+how long is waited between them, and which errors are retried.
+
+The delay before retry n is BaseDelay * 2^(n-1), capped at MaxDelay,
+of which a random fraction of up to Jitter is subtracted, so retries of concurrent instances spread out.
+*/
+type RetryPolicy struct {
+	MaxAttempts int              // The maximum number of attempts, 1 disables retries
+	BaseDelay   time.Duration    // The delay before the first retry
+	MaxDelay    time.Duration    // The maximum delay before a retry
+	Jitter      float64          // The maximum fraction of a delay randomly subtracted from it, between 0 and 1
+	Retryable   func(error) bool // Reports whether an error is retried, every error if nil
+}
+
+/*
+ReadRetryPolicyFromEnv reads the following optional environment variables of a retry policy,
+whose NAME is e.g. ECS, STATUS or ADO, and returns the policy with the given defaults for the unset ones:
+  - RETRY_<NAME>_MAX_ATTEMPTS: The maximum number of attempts, 1 disables retries
+  - RETRY_<NAME>_BASE_DELAY_MS: The delay before the first retry, in milliseconds
+  - RETRY_<NAME>_MAX_DELAY_MS: The maximum delay before a retry, in milliseconds
+  - RETRY_<NAME>_JITTER: The maximum fraction of a delay randomly subtracted from it, between 0 and 1
+*/
+func ReadRetryPolicyFromEnv(name string, defaults RetryPolicy) *RetryPolicy {
+	policy := defaults
+	prefix := "RETRY_" + name + "_"
+
+	maxAttempts, err := strconv.Atoi(ReadEnvVarWithDefault(prefix+"MAX_ATTEMPTS", strconv.Itoa(defaults.MaxAttempts)))
+	if err != nil || maxAttempts < 1 {
+		slog.Error(fmt.Sprintf("failed to parse %sMAX_ATTEMPTS", prefix), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.MaxAttempts = maxAttempts
+
+	baseDelay, err := strconv.Atoi(ReadEnvVarWithDefault(prefix+"BASE_DELAY_MS", strconv.FormatInt(defaults.BaseDelay.Milliseconds(), 10)))
+	if err != nil || baseDelay < 0 {
+		slog.Error(fmt.Sprintf("failed to parse %sBASE_DELAY_MS", prefix), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.BaseDelay = time.Duration(baseDelay) * time.Millisecond
+
+	maxDelay, err := strconv.Atoi(ReadEnvVarWithDefault(prefix+"MAX_DELAY_MS", strconv.FormatInt(defaults.MaxDelay.Milliseconds(), 10)))
+	if err != nil || maxDelay < baseDelay {
+		slog.Error(fmt.Sprintf("failed to parse %sMAX_DELAY_MS", prefix), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.MaxDelay = time.Duration(maxDelay) * time.Millisecond
+
+	jitter, err := strconv.ParseFloat(ReadEnvVarWithDefault(prefix+"JITTER", strconv.FormatFloat(defaults.Jitter, 'f', -1, 64)), 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		slog.Error(fmt.Sprintf("failed to parse %sJITTER", prefix), slog.Any("err", err))
+		os.Exit(1)
+	}
+	policy.Jitter = jitter
+
+	return &policy
+}
+
+// Delay returns the delay before the given retry, the first retry being 1
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// BackoffDelay implements the retry.BackoffDelayer of the AWS SDK, whose attempt is the retry number
+func (p *RetryPolicy) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	return p.Delay(attempt), nil
+}
+
+// ShouldRetry reports whether an error of the given attempt, the first attempt being 1, is retried
+func (p *RetryPolicy) ShouldRetry(attempt int, err error) bool {
+	return attempt < p.MaxAttempts && (p.Retryable == nil || p.Retryable(err))
+}
+
+/*
+Do runs an operation until it succeeds, fails with an error that isn't retried, or runs out of attempts,
+waiting between attempts, and returns its last error.
+Retries emit the Retries metric by operation.
+*/
+func (p *RetryPolicy) Do(ctx context.Context, operation string, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !p.ShouldRetry(attempt, err) {
+			return
+		}
+
+		delay := p.Delay(attempt)
+		slog.Warn("retrying failed operation", slog.String("operation", operation), slog.Int("attempt", attempt), slog.Duration("delay", delay), slog.Any("err", err))
+		EmitMetric("Retries", 1, MetricUnitCount, map[string]string{"Operation": operation})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
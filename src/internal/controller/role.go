@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/*
+binaryRole is the role of the binary, set by Bootstrap from the entry point under cmd,
+so the handlers of the controller can be deployed as separate Lambda functions that only set up what their invocations use.
+The app binary serves every invocation.
+*/
+var binaryRole = RoleAll
+
+// Roles of the binary, see binaryRole
+const (
+	RoleAll        = ""           // Serves every invocation, the single-function deployment
+	RoleController = "controller" // Serves the SQS events of ADO payloads, including webhook frontends, and the ECS task state change events
+	RoleJanitor    = "janitor"    // Serves the scheduled ControllerCommand invocations, such as agentgc or reconcile
+	RoleAdmin      = "admin"      // Serves the admin API through a Lambda function URL
+	RoleWebhook    = "webhook"    // Forwards the webhooks received through a Lambda function URL to the queue of the controller
+)
+
+// Kinds of invocations routed by Handler
+const (
+	InvocationQueue     = "queue"     // An SQS event
+	InvocationTaskEvent = "taskevent" // An ECS task state change event
+	InvocationCommand   = "command"   // A ControllerCommand
+	InvocationAdmin     = "admin"     // A Lambda function URL request of the admin API
+	InvocationWebhook   = "webhook"   // A Lambda function URL request carrying a webhook
+)
+
+// roleInvocations are the kinds of invocations served by each role
+var roleInvocations = map[string][]string{
+	RoleController: {InvocationQueue, InvocationTaskEvent},
+	RoleJanitor:    {InvocationCommand},
+	RoleAdmin:      {InvocationAdmin},
+	RoleWebhook:    {InvocationWebhook},
+}
+
+// ErrWrongRole is returned for invocations that the role of the binary doesn't serve
+var ErrWrongRole = errors.New("invocation not served by this binary")
+
+// checkRole returns an error wrapping ErrWrongRole unless the role of the binary serves the kind of invocation
+func checkRole(invocation string) error {
+	if binaryRole == RoleAll || slices.Contains(roleInvocations[binaryRole], invocation) {
+		return nil
+	}
+	return fmt.Errorf("%w: the %s binary doesn't serve %s invocations", ErrWrongRole, binaryRole, invocation)
+}
+
+// validateRole returns an error if the binary was bootstrapped with an unknown role
+func validateRole() error {
+	if _, ok := roleInvocations[binaryRole]; binaryRole != RoleAll && !ok {
+		return fmt.Errorf("unknown binary role: %s", binaryRole)
+	}
+	return nil
+}
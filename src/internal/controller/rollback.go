@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// RollbackConfig contains configuration values for the automatic rollback of canary revisions
+type RollbackConfig struct {
+	MaxFailureRate float64 // The failure rate above which a canary revision is rolled back
+	MinJobs        int     // The number of jobs a canary revision must serve before its failure rate is evaluated
+	AlertEventBus  string  // The EventBridge event bus that rollback, SLO, availability zone, drift and kill switch alerts are sent to, alerts are only logged if empty
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - CANARY_MAX_FAILURE_RATE: The failure rate above which a canary revision is rolled back, e.g. 0.2 (default: 0.2)
+  - CANARY_MIN_JOBS: The number of jobs a canary revision must serve before its failure rate is evaluated (default: 10)
+  - ALERT_EVENT_BUS: The name or ARN of the EventBridge event bus that rollback, SLO, availability zone, drift and kill switch alerts are sent to, alerts are only logged if unset
+*/
+func (config *RollbackConfig) ReadFromEnv() {
+	rateStr := ReadEnvVarWithDefault("CANARY_MAX_FAILURE_RATE", "0.2")
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		slog.Error("failed to parse CANARY_MAX_FAILURE_RATE", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxFailureRate = rate
+
+	minJobsStr := ReadEnvVarWithDefault("CANARY_MIN_JOBS", "10")
+	minJobs, err := strconv.Atoi(minJobsStr)
+	if err != nil || minJobs < 1 {
+		slog.Error("failed to parse CANARY_MIN_JOBS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MinJobs = minJobs
+	config.AlertEventBus = ReadEnvVarWithDefault("ALERT_EVENT_BUS", "")
+}
+
+// RevisionStats contains the outcomes of the jobs served by a task definition revision
+type RevisionStats struct {
+	Key        string `dynamodbav:"JobId"`                // The state table key, 'revision#<task definition>'
+	Successes  int    `dynamodbav:"Successes"`            // The number of jobs whose agent became ready
+	Failures   int    `dynamodbav:"Failures"`             // The number of jobs whose agent failed
+	RolledBack bool   `dynamodbav:"RolledBack,omitempty"` // Whether the revision was rolled back
+}
+
+// FailureRate returns the fraction of failed jobs
+func (stats *RevisionStats) FailureRate() float64 {
+	total := stats.Successes + stats.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Failures) / float64(total)
+}
+
+// revisionKey returns the state table key of the stats of a task definition revision
+func revisionKey(taskDefinition string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: "revision#" + taskDefinition}}
+}
+
+// RecordRevisionOutcome counts the outcome of a job served by a task definition revision and returns the updated stats
+func (s *StateStore) RecordRevisionOutcome(ctx context.Context, taskDefinition string, succeeded bool) (stats *RevisionStats, err error) {
+	successes, failures := "0", "1"
+	if succeeded {
+		successes, failures = "1", "0"
+	}
+
+	result, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.Config.TableName),
+		Key:              revisionKey(taskDefinition),
+		UpdateExpression: aws.String("ADD Successes :successes, Failures :failures"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":successes": &types.AttributeValueMemberN{Value: successes},
+			":failures":  &types.AttributeValueMemberN{Value: failures},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to record revision outcome: %w", err)
+		return
+	}
+
+	stats = new(RevisionStats)
+	err = attributevalue.UnmarshalMap(result.Attributes, stats)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal revision stats: %w", err)
+	}
+	return
+}
+
+// IsRolledBack reports whether a task definition revision was rolled back
+func (s *StateStore) IsRolledBack(ctx context.Context, taskDefinition string) (bool, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(s.Config.TableName),
+		Key:                  revisionKey(taskDefinition),
+		ProjectionExpression: aws.String("RolledBack"),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get revision stats: %w", err)
+	}
+
+	rolledBack, ok := result.Item["RolledBack"].(*types.AttributeValueMemberBOOL)
+	return ok && rolledBack.Value, nil
+}
+
+// markRolledBack flags a revision as rolled back, and reports whether this call flagged it
+func (s *StateStore) markRolledBack(ctx context.Context, taskDefinition string) (bool, error) {
+	_, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Config.TableName),
+		Key:                 revisionKey(taskDefinition),
+		UpdateExpression:    aws.String("SET RolledBack = :true"),
+		ConditionExpression: aws.String("attribute_not_exists(RolledBack)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to roll back revision: %w", err)
+	}
+	return true, nil
+}
+
+/*
+trackRevisionOutcome counts the outcome of a job against the task definition revision that served it,
+and rolls a canary revision back once its failure rate exceeds CANARY_MAX_FAILURE_RATE
+over at least CANARY_MIN_JOBS jobs, after which its profile serves every job with the previous revision.
+
+Rolling back emits the CanaryRollback metric and a 'Canary Rolled Back' alert event.
+*/
+func trackRevisionOutcome(ctx context.Context, record *JobRecord, outcome string) error {
+	if record.TaskDefinition == "" {
+		return nil
+	}
+
+	stats, err := stateStore.RecordRevisionOutcome(ctx, record.TaskDefinition, outcome == "succeeded")
+	if err != nil {
+		return err
+	}
+
+	if !record.Canary || stats.RolledBack || stats.Successes+stats.Failures < rollbackCfg.MinJobs || stats.FailureRate() <= rollbackCfg.MaxFailureRate {
+		return nil
+	}
+
+	rolledBack, err := stateStore.markRolledBack(ctx, record.TaskDefinition)
+	if err != nil || !rolledBack {
+		return err
+	}
+
+	alert := map[string]any{
+		"profile":        record.Profile,
+		"taskDefinition": record.TaskDefinition,
+		"successes":      stats.Successes,
+		"failures":       stats.Failures,
+		"failureRate":    stats.FailureRate(),
+	}
+	slog.Error("canary revision rolled back", slog.Any("alert", alert))
+	EmitMetric("CanaryRollback", 1, MetricUnitCount, map[string]string{"Profile": record.Profile})
+	putAlertEvent(ctx, "Canary Rolled Back", alert)
+	return nil
+}
+
+// putAlertEvent sends an alert to ALERT_EVENT_BUS, if set, falling back to the logs if EventBridge fails
+func putAlertEvent(ctx context.Context, detailType string, alert map[string]any) {
+	if rollbackCfg.AlertEventBus == "" {
+		return
+	}
+
+	detail, err := json.Marshal(alert)
+	if err != nil {
+		slog.Error("failed to marshal alert", slog.String("detailType", detailType), slog.Any("err", err))
+		return
+	}
+
+	_, err = eventbridge.NewFromConfig(*cfg).PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []ebtypes.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(rollbackCfg.AlertEventBus),
+				Source:       aws.String("azure-pipelines-ecs-controller"),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(string(detail)),
+				Time:         aws.Time(time.Now().UTC()),
+			},
+		},
+	})
+	if err != nil {
+		dependencies.Fallback(DependencyAlerts, "PutEvents", err)
+		return
+	}
+
+	dependencies.Recover(DependencyAlerts)
+}
@@ -0,0 +1,362 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/batch"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go-v2/service/servicequotas"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Normalized statuses reported by every Runner implementation
+const (
+	TaskStatusPending = "PENDING"
+	TaskStatusRunning = "RUNNING"
+	TaskStatusStopped = "STOPPED"
+)
+
+/*
+Runner abstracts the compute backend used to start an Azure Pipelines agent.
+
+Implementations must report the status of the started unit with one of the
+normalized TaskStatus values, so the wait loop behaves the same regardless
+of the backend.
+
+The task profile selected for the job is nil for the default configuration.
+Only the ecs backend applies task profiles.
+*/
+type Runner interface {
+	Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) // Starts an agent for the given payload and returns an identifier for it
+	Status(ctx context.Context, id string) (status string, err error)                          // Returns the normalized status of a started agent
+	Stop(ctx context.Context, id string, reason string) error                                  // Stops a started agent
+}
+
+/*
+AgentReleaser is implemented by runners whose agents hold resources beyond the agent itself, such as the counted agents of an ECS service,
+which are released once the agent finished, or never served its job, see releaseAgent.
+Release must be idempotent.
+*/
+type AgentReleaser interface {
+	Release(ctx context.Context, id string) error // Releases the resources held by a finished agent
+}
+
+/*
+StopDetailer is implemented by runners that can explain why a started agent stopped.
+*/
+type StopDetailer interface {
+	StopDetail(ctx context.Context, id string) (detail *StopDetail, err error) // Returns why the agent stopped
+}
+
+// StopDetail explains why an agent stopped
+type StopDetail struct {
+	ID        string           // The ID of the stopped agent
+	StopCode  string           // The stop code, e.g. EssentialContainerExited
+	Reason    string           // The stop reason
+	ExitCodes map[string]int32 // The exit codes of the containers that exited, by container name
+
+	AvailabilityZone string // The availability zone of the stopped agent, if known
+	Subnet           string // The subnet of the stopped agent, if known
+}
+
+// String returns a one-line description of the stop
+func (detail *StopDetail) String() string {
+	message := fmt.Sprintf("agent task %s stopped", detail.ID)
+	if detail.StopCode != "" {
+		message += fmt.Sprintf(" (%s)", detail.StopCode)
+	}
+	if detail.Reason != "" {
+		message += ": " + detail.Reason
+	}
+	for _, name := range slices.Sorted(maps.Keys(detail.ExitCodes)) {
+		message += fmt.Sprintf(", container %s exited with code %d", name, detail.ExitCodes[name])
+	}
+	return message
+}
+
+/*
+NewRunnerFromEnv creates the Runner selected by the RUNNER_BACKEND environment variable
+and reads the backend-specific configuration from the environment:
+  - ecs: AWS ECS RunTask (default)
+  - ecs-service: desired count of a long-lived AWS ECS service, which requires the state store
+  - batch: AWS Batch SubmitJob
+  - codebuild: AWS CodeBuild StartBuild
+  - eks: Kubernetes Job on an AWS EKS cluster
+  - ec2: AWS EC2 instance launched from a launch template
+*/
+func NewRunnerFromEnv(ctx context.Context, cfg aws.Config) (Runner, error) {
+	backend := ReadEnvVarWithDefault("RUNNER_BACKEND", "ecs")
+
+	retryCfg := new(AWSRetryConfig)
+	retryCfg.ReadFromEnv()
+
+	switch backend {
+	case "ecs":
+		taskCfg = new(ECSTaskConfig)
+		taskCfg.ReadFromEnv()
+		ecsClient = ecs.NewFromConfig(cfg, retryCfg.ECSOptions, faultCfg.ECSOptions)
+		quotaCfg := new(QuotaConfig)
+		quotaCfg.ReadFromEnv()
+		lookups := &ECSLookupCache{Client: ecsClient, TTL: ReadLookupCacheTTLFromEnv()}
+		ecsRunner := &ECSRunner{
+			Client:    ecsClient,
+			Config:    taskCfg,
+			Lookups:   lookups,
+			Variables: ReadPayloadVariablesFromEnv(),
+			Tagging:   resourcegroupstaggingapi.NewFromConfig(cfg),
+			Placement: &ClusterPlacer{Lookups: lookups, Stickiness: ReadClusterStickinessFromEnv()},
+		}
+		if quotaCfg.Ceiling > 0 {
+			ecsRunner.Quota = &FargateQuotaThrottle{
+				ECSClient:    ecsClient,
+				QuotasClient: servicequotas.NewFromConfig(cfg),
+				Lookups:      lookups,
+				Config:       quotaCfg,
+			}
+		}
+		return ecsRunner, nil
+	case "ecs-service":
+		serviceCfg := new(ECSServiceConfig)
+		serviceCfg.ReadFromEnv()
+		if stateStore == nil {
+			return nil, fmt.Errorf("the ecs-service backend requires STATE_TABLE_NAME")
+		}
+		ecsClient = ecs.NewFromConfig(cfg, retryCfg.ECSOptions, faultCfg.ECSOptions)
+		return &ECSServiceRunner{Client: ecsClient, Store: stateStore, Config: serviceCfg}, nil
+	case "batch":
+		batchCfg := new(BatchJobConfig)
+		batchCfg.ReadFromEnv()
+		return &BatchRunner{Client: batch.NewFromConfig(cfg), Config: batchCfg}, nil
+	case "codebuild":
+		buildCfg := new(CodeBuildConfig)
+		buildCfg.ReadFromEnv()
+		return &CodeBuildRunner{Client: codebuild.NewFromConfig(cfg), Config: buildCfg}, nil
+	case "eks":
+		jobCfg := new(EKSJobConfig)
+		jobCfg.ReadFromEnv()
+		return NewEKSRunner(ctx, cfg, jobCfg)
+	case "ec2":
+		instanceCfg := new(EC2InstanceConfig)
+		instanceCfg.ReadFromEnv()
+		return &EC2Runner{Client: ec2.NewFromConfig(cfg), SSM: ssm.NewFromConfig(cfg), Config: instanceCfg}, nil
+	default:
+		return nil, fmt.Errorf("unsupported runner backend: %s", backend)
+	}
+}
+
+// ECSRunner is a Runner that starts agents as AWS ECS Fargate tasks
+type ECSRunner struct {
+	Client    *ecs.Client                      // The ECS client
+	Config    *ECSTaskConfig                   // The task configuration
+	Lookups   *ECSLookupCache                  // The cache of pre-flight cluster and task definition lookups
+	Quota     *FargateQuotaThrottle            // Optional quota-aware launch throttling
+	Variables map[string]string                // The allow-list of payload variables passed to the agent environment, by variable name
+	Tagging   *resourcegroupstaggingapi.Client // The tagging client used to discover the controller's tasks
+	Placement *ClusterPlacer                   // The placement of the agents of profiles with several clusters
+}
+
+/*
+Run starts the Fargate tasks of the job and returns their ARNs, comma-separated.
+
+Jobs start a single agent unless the payload's AgentCount or the profile's agentCount asks for more.
+Allow-listed payload Variables are passed to the agent container environment.
+The tasks are tagged with the controller, pool, project, job and check IDs, see controllerTags.
+If RunTask starts only some of the tasks, the failures are logged and the started agents are kept.
+Agents of profiles with several clusters are started on the cluster chosen by the ClusterPlacer.
+*/
+func (r *ECSRunner) Run(ctx context.Context, payload *ADOPayload, profile *TaskProfile) (id string, err error) {
+	config := azHealth.Apply(ctx, r.TaskConfig(payload, profile))
+
+	if profile != nil && len(profile.Clusters) > 0 {
+		config.Cluster, err = r.Placement.Place(ctx, payload.ProjectID, profile.Clusters)
+		if err != nil {
+			return
+		}
+	}
+
+	err = r.Lookups.Validate(ctx, config)
+	if err != nil {
+		return
+	}
+
+	if r.Quota != nil {
+		err = r.Quota.Check(ctx, config)
+		if err != nil {
+			return
+		}
+	}
+
+	taskARNs, failures, err := RunFargateTasks(ctx, r.Client, config)
+	if err != nil {
+		logAWSError("RunTask", err)
+		return
+	}
+
+	for _, failure := range failures {
+		slog.Warn("failed to start task", slog.String("jobId", payload.JobID), slog.String("arn", aws.ToString(failure.Arn)), slog.String("reason", aws.ToString(failure.Reason)), slog.String("detail", aws.ToString(failure.Detail)))
+	}
+	if len(failures) > 0 {
+		EmitMetric("RunTaskFailures", float64(len(failures)), MetricUnitCount, map[string]string{"Cluster": config.Cluster})
+	}
+
+	if len(taskARNs) == 0 {
+		if len(failures) > 0 {
+			err = NewRunTaskFailureError(failures[0])
+		} else {
+			err = fmt.Errorf("failed to run task: no tasks started")
+		}
+		return
+	}
+
+	slog.Info("run task", slog.String("jobId", payload.JobID), slog.Any("taskArns", taskARNs))
+
+	id = strings.Join(taskARNs, ",")
+	return
+}
+
+// TaskConfig returns the configuration of the tasks started for a payload with a task profile
+func (r *ECSRunner) TaskConfig(payload *ADOPayload, profile *TaskProfile) *ECSTaskConfig {
+	config := profile.ApplyToTaskConfig(r.Config)
+	config.ClientToken = payload.ClientToken(1)
+	config.StartedBy = payload.CheckID()
+	if payload.AgentCount > 0 {
+		config.Count = payload.AgentCount
+	}
+	config = applyPayloadVariables(config, r.Variables, payload)
+	config = applyDeploymentGroup(config, payload)
+	config = applyAgentName(config, payload)
+	config.Tags = controllerTags(payload)
+	return config
+}
+
+/*
+Status returns the task's last status.
+For multi-agent jobs, it returns STOPPED if any task stopped,
+RUNNING once every task is running, and PENDING otherwise.
+Tasks that DescribeTasks reports as MISSING are handled by missingTaskStatus.
+*/
+func (r *ECSRunner) Status(ctx context.Context, id string) (status string, err error) {
+	for _, taskARN := range strings.Split(id, ",") {
+		var task *types.Task
+		task, err = DescribeTask(ctx, r.Client, &ECSTaskReadConfig{
+			Cluster: r.Config.Cluster,
+			TaskARN: taskARN,
+		})
+		if errors.Is(err, ErrTaskMissing) {
+			status, err = missingTaskStatus(ctx, taskARN, err)
+			if err != nil || status == TaskStatusStopped {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logAWSError("DescribeTasks", err)
+			return
+		}
+
+		taskStatus := aws.ToString(task.LastStatus)
+		if taskStatus == TaskStatusRunning {
+			emitImagePullDuration(task)
+		}
+
+		switch {
+		case taskStatus == TaskStatusStopped:
+			status = TaskStatusStopped
+			return
+		case taskStatus != TaskStatusRunning:
+			status = TaskStatusPending
+		case status == "":
+			status = TaskStatusRunning
+		}
+	}
+	return
+}
+
+// StopDetail describes the first stopped task of the job, or the first task that disappeared
+func (r *ECSRunner) StopDetail(ctx context.Context, id string) (detail *StopDetail, err error) {
+	for _, taskARN := range strings.Split(id, ",") {
+		var task *types.Task
+		task, err = DescribeTask(ctx, r.Client, &ECSTaskReadConfig{
+			Cluster: r.Config.Cluster,
+			TaskARN: taskARN,
+		})
+		if errors.Is(err, ErrTaskMissing) {
+			detail = &StopDetail{ID: taskARN, StopCode: ECSFailureMissing, Reason: "the task disappeared, e.g. it was reaped after the stopped-task retention of ECS"}
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if aws.ToString(task.LastStatus) != TaskStatusStopped {
+			continue
+		}
+
+		detail = &StopDetail{
+			ID:        taskARN,
+			StopCode:  string(task.StopCode),
+			Reason:    aws.ToString(task.StoppedReason),
+			ExitCodes: map[string]int32{},
+
+			AvailabilityZone: aws.ToString(task.AvailabilityZone),
+			Subnet:           taskSubnet(*task),
+		}
+		for _, container := range task.Containers {
+			if container.ExitCode != nil {
+				detail.ExitCodes[aws.ToString(container.Name)] = aws.ToInt32(container.ExitCode)
+			}
+		}
+		return
+	}
+
+	err = fmt.Errorf("no stopped task in %s", id)
+	return
+}
+
+/*
+emitImagePullDuration emits the ImagePullDuration metric of a started task,
+from the pull timestamps that ECS records in the task metadata, per task definition family.
+
+Fargate pulls the image for every task, so image size and SOCI indexes,
+rather than pre-pulling, are what reduce this duration.
+*/
+func emitImagePullDuration(task *types.Task) {
+	if task.PullStartedAt == nil || task.PullStoppedAt == nil {
+		return
+	}
+
+	duration := task.PullStoppedAt.Sub(*task.PullStartedAt)
+	family := aws.ToString(task.TaskDefinitionArn)
+	if _, name, found := strings.Cut(family, ":task-definition/"); found {
+		family, _, _ = strings.Cut(name, ":")
+	}
+
+	slog.Info("agent image pulled", slog.String("taskArn", aws.ToString(task.TaskArn)), slog.Duration("duration", duration))
+	EmitMetric("ImagePullDuration", duration.Seconds(), MetricUnitSeconds, map[string]string{"TaskDefinitionFamily": family})
+}
+
+// Stop stops the tasks
+func (r *ECSRunner) Stop(ctx context.Context, id string, reason string) error {
+	var errs []error
+	for _, taskARN := range strings.Split(id, ",") {
+		_, err := r.Client.StopTask(ctx, &ecs.StopTaskInput{
+			Cluster: aws.String(taskCluster(taskARN, r.Config.Cluster)),
+			Task:    aws.String(taskARN),
+			Reason:  aws.String(reason),
+		})
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
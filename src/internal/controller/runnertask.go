@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"strings"
+)
+
+/*
+startRunnerTask starts the agent task of a runner of another CI system, such as a GitHub Actions runner,
+with the task profile of the queue selected by the demands, if any, see SelectQueueProfile,
+and the runner configuration added to its environment, unless the launches of the profile are disabled, see checkKillSwitch.
+
+The task is started by the runner name, which must be unique per job, so stopRunnerTask can find it.
+*/
+func startRunnerTask(ctx context.Context, ecsRunner *ECSRunner, queueARN string, name string, demands []string, environment map[string]string) (taskARNs []string, err error) {
+	profile, err := SelectQueueProfile(taskProfiles, queueProfiles, queueARN, demands)
+	if err != nil {
+		return
+	}
+
+	profileName := ""
+	if profile != nil {
+		profileName = profile.Name
+	}
+	err = checkKillSwitch(ctx, profileName)
+	if err != nil {
+		return
+	}
+
+	config := profile.ApplyToTaskConfig(ecsRunner.Config)
+	config.Environment = maps.Clone(config.Environment)
+	if config.Environment == nil {
+		config.Environment = map[string]string{}
+	}
+	maps.Copy(config.Environment, environment)
+	config.Count = 1
+	config.ClientToken = GenerateClientToken(name)
+	config.StartedBy = name
+	config.Tags = controllerTags(nil)
+
+	taskARNs, failures, err := RunFargateTasks(ctx, ecsRunner.Client, config)
+	if err != nil {
+		logAWSError("RunTask", err)
+		return
+	}
+	if len(taskARNs) == 0 && len(failures) > 0 {
+		err = NewRunTaskFailureError(failures[0])
+	}
+
+	return
+}
+
+// stopRunnerTask stops the agent tasks started for a runner of another CI system, if any
+func stopRunnerTask(ctx context.Context, ecsRunner *ECSRunner, name string, reason string) error {
+	taskARNs, err := ListStartedByTasks(ctx, ecsRunner.Client, ecsRunner.Config.Cluster, name)
+	if err != nil || len(taskARNs) == 0 {
+		return err
+	}
+	return ecsRunner.Stop(ctx, strings.Join(taskARNs, ","), reason)
+}
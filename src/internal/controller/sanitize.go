@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Maximum lengths of payload fields
+const (
+	maxPayloadIDLength       = 64   // The IDs of the plan, project, job, timeline and task instance, and the hub name
+	maxPayloadURLLength      = 2048 // The plan URL
+	maxPayloadTokenLength    = 8192 // The job access token
+	maxPayloadDemandLength   = 256  // Each demand
+	maxPayloadDemands        = 64   // The number of demands
+	maxPayloadVariableLength = 4096 // Each variable name and value
+	maxPayloadVariables      = 64   // The number of variables
+)
+
+// maxAgentCount is the largest AgentCount of a payload, see ReadMaxAgentCountFromEnv
+var maxAgentCount = 10
+
+// ReadMaxAgentCountFromEnv reads MAX_AGENT_COUNT, the largest number of agents a payload may ask for with its AgentCount, at least 1 (default: 10)
+func ReadMaxAgentCountFromEnv() int {
+	countStr := ReadEnvVarWithDefault("MAX_AGENT_COUNT", "10")
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 1 {
+		slog.Error("failed to parse MAX_AGENT_COUNT", slog.Any("err", err))
+		os.Exit(1)
+	}
+	return count
+}
+
+// payloadIDPattern matches the payload fields used in URL paths, tags and agent names
+var payloadIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+/*
+Sanitize returns an ErrInvalidPayload error if a field of the payload is too long or contains characters
+that could inject paths, query strings or headers where it is used, in ADO URLs, task tags, agent names and log lines:
+  - IDs and the hub name are restricted to letters, digits, '.', '_' and '-'
+  - the plan URL must be an absolute https URL without a query, fragment or user info
+  - the access token, demands and variables must not contain control characters
+  - the agent count must be between 0 and MAX_AGENT_COUNT, so a payload can't make an invocation start agents without bound
+*/
+func (payload *ADOPayload) Sanitize() error {
+	ids := [][2]string{
+		{"PlanId", payload.PlanID},
+		{"ProjectId", payload.ProjectID},
+		{"HubName", payload.HubName},
+		{"JobId", payload.JobID},
+		{"TimelineId", payload.TimelineID},
+		{"TaskInstanceId", payload.TaskInstanceID},
+	}
+	for _, id := range ids {
+		if len(id[1]) > maxPayloadIDLength || !payloadIDPattern.MatchString(id[1]) {
+			return fmt.Errorf("%w: invalid %s %.64q", ErrInvalidPayload, id[0], id[1])
+		}
+	}
+
+	if len(payload.PlanURL) > maxPayloadURLLength {
+		return fmt.Errorf("%w: PlanUrl exceeds %d characters", ErrInvalidPayload, maxPayloadURLLength)
+	}
+	if payload.PlanURL != "" {
+		planURL, err := url.Parse(payload.PlanURL)
+		if err != nil || planURL.Scheme != "https" || planURL.Host == "" || planURL.User != nil || planURL.RawQuery != "" || planURL.Fragment != "" {
+			return fmt.Errorf("%w: invalid PlanUrl %.64q", ErrInvalidPayload, payload.PlanURL)
+		}
+	}
+
+	if len(payload.AuthToken) > maxPayloadTokenLength || hasControlCharacters(payload.AuthToken) {
+		return fmt.Errorf("%w: invalid AuthToken", ErrInvalidPayload)
+	}
+
+	if payload.AgentCount < 0 || payload.AgentCount > maxAgentCount {
+		return fmt.Errorf("%w: AgentCount %d is not between 0 and %d", ErrInvalidPayload, payload.AgentCount, maxAgentCount)
+	}
+
+	if len(payload.Demands) > maxPayloadDemands {
+		return fmt.Errorf("%w: more than %d demands", ErrInvalidPayload, maxPayloadDemands)
+	}
+	for _, demand := range payload.Demands {
+		if len(demand) > maxPayloadDemandLength || hasControlCharacters(demand) {
+			return fmt.Errorf("%w: invalid demand %.64q", ErrInvalidPayload, demand)
+		}
+	}
+
+	if len(payload.Variables) > maxPayloadVariables {
+		return fmt.Errorf("%w: more than %d variables", ErrInvalidPayload, maxPayloadVariables)
+	}
+	for name, value := range payload.Variables {
+		if len(name) > maxPayloadVariableLength || len(value) > maxPayloadVariableLength || hasControlCharacters(name) || hasControlCharacters(value) {
+			return fmt.Errorf("%w: invalid variable %.64q", ErrInvalidPayload, name)
+		}
+	}
+
+	return nil
+}
+
+// hasControlCharacters reports whether a string contains control characters, such as CR and LF
+func hasControlCharacters(value string) bool {
+	return strings.IndexFunc(value, unicode.IsControl) >= 0
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// SelfCheckResult is the outcome of a single self-check
+type SelfCheckResult struct {
+	Name   string `json:"name"`   // The check name
+	OK     bool   `json:"ok"`     // Whether the check passed
+	Detail string `json:"detail"` // What was verified, or why the check failed
+}
+
+// selfCheckResult creates a SelfCheckResult from an error
+func selfCheckResult(name string, detail string, err error) SelfCheckResult {
+	if err != nil {
+		return SelfCheckResult{Name: name, OK: false, Detail: err.Error()}
+	}
+	return SelfCheckResult{Name: name, OK: true, Detail: detail}
+}
+
+/*
+RunSelfCheck verifies that the controller can do its job and logs a report:
+  - the execution role can DescribeTasks and DescribeTaskDefinition on the configured cluster and task definition
+  - the execution role is allowed to RunTask the task definition and to PassRole its task and execution roles,
+    using the IAM policy simulator, which requires iam:SimulatePrincipalPolicy and iam:GetRole on the execution role
+  - the ADO endpoint is reachable
+
+The ECS checks only run with the ecs backend.
+*/
+func RunSelfCheck(ctx context.Context, cfg aws.Config) (results []SelfCheckResult) {
+	if taskCfg != nil {
+		results = append(results, selfCheckECS(ctx, cfg)...)
+	}
+
+	results = append(results, selfCheckADO(ctx))
+
+	failed := 0
+	for _, result := range results {
+		if result.OK {
+			slog.Info("self-check passed", slog.String("check", result.Name), slog.String("detail", result.Detail))
+		} else {
+			failed++
+			slog.Error("self-check failed", slog.String("check", result.Name), slog.String("detail", result.Detail))
+		}
+	}
+
+	slog.Info("self-check report", slog.Int("checks", len(results)), slog.Int("failed", failed), slog.Any("results", results))
+	return
+}
+
+// selfCheckECS verifies the ECS and IAM permissions of the execution role
+func selfCheckECS(ctx context.Context, cfg aws.Config) (results []SelfCheckResult) {
+	_, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(taskCfg.Cluster),
+		Tasks:   []string{"self-check"},
+	})
+	results = append(results, selfCheckResult("ecs:DescribeTasks", fmt.Sprintf("cluster %s", taskCfg.Cluster), err))
+
+	taskDefinitions := []string{taskCfg.TaskDefinition}
+	var profileRoles []string
+	for _, profile := range taskProfiles {
+		if profile.TaskDefinition != "" {
+			taskDefinitions = append(taskDefinitions, profile.TaskDefinition)
+		}
+		for _, role := range []string{profile.TaskRoleARN, profile.ExecutionRoleARN} {
+			if role != "" {
+				profileRoles = append(profileRoles, role)
+			}
+		}
+	}
+
+	roleARN, err := executionRoleARN(ctx, cfg)
+	results = append(results, selfCheckResult("iam:GetRole", "resolved the execution role", err))
+
+	for _, taskDefinition := range taskDefinitions {
+		result, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(taskDefinition),
+		})
+		results = append(results, selfCheckResult("ecs:DescribeTaskDefinition", taskDefinition, err))
+		if err != nil || roleARN == "" {
+			continue
+		}
+
+		actions := map[string][]string{
+			"ecs:RunTask": {aws.ToString(result.TaskDefinition.TaskDefinitionArn)},
+		}
+		for _, passRole := range []*string{result.TaskDefinition.TaskRoleArn, result.TaskDefinition.ExecutionRoleArn} {
+			if passRole != nil {
+				actions["iam:PassRole"] = append(actions["iam:PassRole"], aws.ToString(passRole))
+			}
+		}
+
+		for action, resources := range actions {
+			err = simulateAllowed(ctx, iam.NewFromConfig(cfg), roleARN, action, resources)
+			results = append(results, selfCheckResult(action, strings.Join(resources, ", "), err))
+		}
+	}
+
+	if len(profileRoles) > 0 && roleARN != "" {
+		err = simulateAllowed(ctx, iam.NewFromConfig(cfg), roleARN, "iam:PassRole", profileRoles)
+		results = append(results, selfCheckResult("iam:PassRole", strings.Join(profileRoles, ", "), err))
+	}
+
+	return
+}
+
+// executionRoleARN returns the ARN of the IAM role of the current credentials
+func executionRoleARN(ctx context.Context, cfg aws.Config) (string, error) {
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+
+	callerARN := aws.ToString(identity.Arn)
+	_, roleSession, found := strings.Cut(callerARN, ":assumed-role/")
+	if !found {
+		return callerARN, nil
+	}
+
+	roleName, _, _ := strings.Cut(roleSession, "/")
+	role, err := iam.NewFromConfig(cfg).GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(role.Role.Arn), nil
+}
+
+// simulateAllowed returns an error unless the IAM policy simulator allows the action on every resource
+func simulateAllowed(ctx context.Context, client *iam.Client, principalARN string, action string, resources []string) error {
+	result, err := client.SimulatePrincipalPolicy(ctx, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principalARN),
+		ActionNames:     []string{action},
+		ResourceArns:    resources,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to simulate %s: %w", action, err)
+	}
+
+	var errs []error
+	for _, evaluation := range result.EvaluationResults {
+		for _, resource := range evaluation.ResourceSpecificResults {
+			if resource.EvalResourceDecision != iamtypes.PolicyEvaluationDecisionTypeAllowed {
+				errs = append(errs, fmt.Errorf("%s is %s on %s", action, resource.EvalResourceDecision, aws.ToString(resource.EvalResourceName)))
+			}
+		}
+		if len(evaluation.ResourceSpecificResults) == 0 && evaluation.EvalDecision != iamtypes.PolicyEvaluationDecisionTypeAllowed {
+			errs = append(errs, fmt.Errorf("%s is %s", action, evaluation.EvalDecision))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// selfCheckADOTimeout is how long the ADO reachability check waits for a response
+const selfCheckADOTimeout = 10 * time.Second
+
+// selfCheckClient is the HTTP client of the ADO reachability check, which must not wait longer than selfCheckADOTimeout
+var selfCheckClient = &http.Client{Timeout: selfCheckADOTimeout}
+
+// selfCheckADO verifies that the ADO endpoint is reachable, any HTTP response counts as reachable
+func selfCheckADO(ctx context.Context) SelfCheckResult {
+	url := fmt.Sprintf("https://%s/_apis/connectionData", adoCfg.Instance)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return selfCheckResult("ado:reachability", "", fmt.Errorf("failed to create request: %w", err))
+	}
+
+	res, err := selfCheckClient.Do(req)
+	if err != nil {
+		return selfCheckResult("ado:reachability", "", fmt.Errorf("failed to reach %s: %w", url, err))
+	}
+	defer res.Body.Close()
+
+	return selfCheckResult("ado:reachability", fmt.Sprintf("%s returned status %d", url, res.StatusCode), nil)
+}
+
+// handleSelfCheck runs the self-check and returns an error if any check failed
+func handleSelfCheck(ctx context.Context) error {
+	for _, result := range RunSelfCheck(ctx, *cfg) {
+		if !result.OK {
+			return fmt.Errorf("self-check failed: %s: %s", result.Name, result.Detail)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// sentCallbackPrefix prefixes the state table keys of sent callbacks
+const sentCallbackPrefix = "completed#"
+
+// SentCallback records that the TaskCompleted callback of a check was accepted by ADO, so it isn't sent again
+type SentCallback struct {
+	Key       string    `dynamodbav:"JobId"`     // The state table key, sentCallbackPrefix followed by the check ID (partition key)
+	Result    string    `dynamodbav:"Result"`    // The reported outcome
+	SentAt    time.Time `dynamodbav:"SentAt"`    // When the callback was sent
+	ExpiresAt int64     `dynamodbav:"ExpiresAt"` // Epoch seconds after which DynamoDB TTL deletes the record
+}
+
+// sentCallbackKey returns the state table key of the sent callback of a check
+func sentCallbackKey(checkID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: sentCallbackPrefix + checkID}}
+}
+
+// PutSentCallback records that the callback of a check was sent
+func (s *StateStore) PutSentCallback(ctx context.Context, checkID string, result string) error {
+	now := time.Now().UTC()
+	item, err := attributevalue.MarshalMap(&SentCallback{
+		Key:       sentCallbackPrefix + checkID,
+		Result:    result,
+		SentAt:    now,
+		ExpiresAt: now.Add(s.Config.TTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal sent callback: %w", err)
+	}
+
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put sent callback: %w", err)
+	}
+
+	return nil
+}
+
+// GetSentCallback returns the sent callback of a check, or nil if none was sent
+func (s *StateStore) GetSentCallback(ctx context.Context, checkID string) (*SentCallback, error) {
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Key:       sentCallbackKey(checkID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sent callback: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	sent := new(SentCallback)
+	err = attributevalue.UnmarshalMap(result.Item, sent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sent callback: %w", err)
+	}
+	return sent, nil
+}
+
+/*
+callbackAlreadySent reports whether the TaskCompleted callback of a check was already sent, by JobId and TaskInstanceId,
+e.g. when SQS redelivers a record whose callback succeeded in an invocation that failed afterwards,
+since ADO logs errors on repeated completion events. Duplicates emit the DuplicateCallbacks metric.
+
+Callbacks are sent without the state store, or if it fails.
+*/
+func callbackAlreadySent(ctx context.Context, payload *ADOPayload, result string) bool {
+	if stateStore == nil {
+		return false
+	}
+
+	sent, err := stateStore.GetSentCallback(ctx, payload.CheckID())
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "get sent callback", err)
+		return false
+	}
+	if sent == nil {
+		return false
+	}
+
+	slog.Warn("suppressed duplicate ADO callback", slog.String("jobId", payload.JobID), slog.String("checkId", payload.CheckID()),
+		slog.String("result", result), slog.String("sentResult", sent.Result), slog.Time("sentAt", sent.SentAt))
+	EmitMetric("DuplicateCallbacks", 1, MetricUnitCount, nil)
+	return true
+}
+
+// recordSentCallback records that the callback of a check was sent, if the state store is configured
+func recordSentCallback(ctx context.Context, payload *ADOPayload, result string) {
+	if stateStore == nil {
+		return
+	}
+
+	err := stateStore.PutSentCallback(ctx, payload.CheckID(), result)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "record sent callback", err)
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// SmokeTestStartedBy is the StartedBy tag of smoke test canary tasks
+const SmokeTestStartedBy = "ado-smoke-test"
+
+// SmokeTestConfig contains configuration values for the scheduled smoke test
+type SmokeTestConfig struct {
+	TaskDefinition string        // The task definition of the canary task, usually a no-op image, defaults to ECS_TASK_DEFINITION
+	CallbackURL    string        // An optional test endpoint that receives a TaskCompleted-shaped callback
+	Timeout        time.Duration // How long to wait for the canary task to run
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - SMOKE_TEST_TASK_DEFINITION: The task definition of the canary task, usually a no-op image (default: ECS_TASK_DEFINITION)
+  - SMOKE_TEST_CALLBACK_URL: A test endpoint that receives a TaskCompleted-shaped callback, the ADO self-check is used if unset
+  - SMOKE_TEST_TIMEOUT_SECONDS: How long to wait for the canary task to run (default: 300)
+*/
+func (config *SmokeTestConfig) ReadFromEnv() {
+	config.TaskDefinition = ReadEnvVarWithDefault("SMOKE_TEST_TASK_DEFINITION", "")
+	config.CallbackURL = ReadEnvVarWithDefault("SMOKE_TEST_CALLBACK_URL", "")
+
+	timeoutStr := ReadEnvVarWithDefault("SMOKE_TEST_TIMEOUT_SECONDS", "300")
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil || timeout < 1 {
+		slog.Error("failed to parse SMOKE_TEST_TIMEOUT_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Timeout = time.Duration(timeout) * time.Second
+}
+
+/*
+handleSmokeTest verifies the agent provisioning path end to end, for scheduled invocations:
+a canary task is started with the configured task configuration and must reach RUNNING,
+then the callback path is verified with the test endpoint or the ADO reachability self-check.
+
+The outcome is emitted as the SmokeTestPassed metric, 1 or 0, so an alarm can fire before real pipelines need agents.
+*/
+func handleSmokeTest(ctx context.Context) (err error) {
+	defer func() {
+		passed := 1.0
+		if err != nil {
+			passed = 0
+		}
+		EmitMetric("SmokeTestPassed", passed, MetricUnitCount, nil)
+	}()
+
+	if taskCfg == nil {
+		return fmt.Errorf("the smoke test requires the ecs backend")
+	}
+
+	config := *taskCfg
+	config.StartedBy = SmokeTestStartedBy
+	config.Tags = controllerTags(nil)
+	config.Environment = nil
+	config.Count = 1
+	config.SetClientToken(fmt.Sprintf("%s#%d", SmokeTestStartedBy, time.Now().UnixNano()))
+	if smokeTestCfg.TaskDefinition != "" {
+		config.TaskDefinition = smokeTestCfg.TaskDefinition
+	}
+
+	result, err := RunFargateTask(ctx, ecsClient, &config)
+	if err != nil {
+		return fmt.Errorf("failed to start canary task: %w", err)
+	}
+	if len(result.Tasks) == 0 {
+		if len(result.Failures) > 0 {
+			return fmt.Errorf("failed to start canary task: %w", NewRunTaskFailureError(result.Failures[0]))
+		}
+		return fmt.Errorf("failed to start canary task: no tasks started")
+	}
+
+	taskARN := aws.ToString(result.Tasks[0].TaskArn)
+	defer func() {
+		stopErr := runner.Stop(ctx, taskARN, "Smoke test finished")
+		if stopErr != nil {
+			slog.Warn("failed to stop canary task", slog.String("taskArn", taskARN), slog.Any("err", stopErr))
+		}
+	}()
+
+	deadline := time.Now().Add(smokeTestCfg.Timeout)
+	for {
+		status, statusErr := GetTaskLastStatus(ctx, ecsClient, &ECSTaskReadConfig{Cluster: config.Cluster, TaskARN: taskARN})
+		if statusErr != nil {
+			return fmt.Errorf("failed to get canary task status: %w", statusErr)
+		}
+		if status == TaskStatusRunning {
+			break
+		}
+		if status == TaskStatusStopped {
+			return fmt.Errorf("canary task %s stopped before running", taskARN)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("canary task %s not running after %s", taskARN, formatDuration(smokeTestCfg.Timeout))
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	if smokeTestCfg.CallbackURL != "" {
+		_, err = adoRequest(adoClient, adoCfg, "", http.MethodPost, smokeTestCfg.CallbackURL, map[string]string{
+			"name":   "TaskCompleted",
+			"jobId":  SmokeTestStartedBy,
+			"taskId": taskARN,
+			"result": "succeeded",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send test callback: %w", err)
+		}
+	} else if result := selfCheckADO(ctx); !result.OK {
+		return fmt.Errorf("ADO is unreachable: %s", result.Detail)
+	}
+
+	slog.Info("smoke test passed", slog.String("taskArn", taskARN))
+	return nil
+}
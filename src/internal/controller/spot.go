@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ECSStopCodeSpotInterruption is the stop code of tasks stopped because their Spot capacity was reclaimed
+const ECSStopCodeSpotInterruption = "SpotInterruption"
+
+/*
+handleSpotInterruption re-dispatches agents whose Fargate Spot or EC2 Spot capacity was reclaimed.
+
+The interrupted job is looked up in the state store by the task's StartedBy tag,
+marked as interrupted, and a replacement task is started with a new client token.
+A note explaining the retry is appended to the check's timeline.
+*/
+func handleSpotInterruption(ctx context.Context, detail *ECSTaskStateChange) error {
+	logger := slog.With(slog.String("taskArn", detail.TaskARN), slog.String("jobId", detail.StartedBy))
+
+	if stateStore == nil || taskCfg == nil {
+		logger.Warn("spot interruption ignored, re-dispatch requires the ecs backend and the state store")
+		return nil
+	}
+
+	record, err := stateStore.Get(ctx, detail.StartedBy)
+	if errors.Is(err, ErrJobNotFound) {
+		logger.Info("spot interruption ignored, task is not tracked")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !record.HasTask(detail.TaskARN) {
+		logger.Info("spot interruption ignored, job was already re-dispatched")
+		return nil
+	}
+
+	logger.Warn("agent task interrupted", slog.String("reason", detail.StoppedReason))
+
+	record.Status = JobStatusInterrupted
+	err = stateStore.Put(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	replacementARN, err := redispatchTask(ctx, record, detail.TaskARN)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("replacement task started", slog.String("replacementTaskArn", replacementARN))
+
+	note := fmt.Sprintf("Agent task %s was interrupted by a Spot capacity reclaim (%s), started replacement task %s", detail.TaskARN, detail.StoppedReason, replacementARN)
+	err = ADOTimelineFeed(adoClient, adoCfg, record.Payload, note)
+	if err != nil {
+		logger.Error("failed to post timeline note", slog.Any("err", err))
+	}
+
+	return nil
+}
+
+/*
+redispatchTask starts a replacement for one of the tasks of a tracked job with a new client token,
+and records the replacement and the new attempt in the state store.
+The replacement is configured like the agents of the job, see ECSRunner.TaskConfig, without the subnets cooling down,
+and started on the cluster of the replaced task.
+*/
+func redispatchTask(ctx context.Context, record *JobRecord, taskARN string) (replacementARN string, err error) {
+	ecsRunner, ok := runner.(*ECSRunner)
+	if !ok {
+		err = fmt.Errorf("re-dispatching requires the ecs backend")
+		return
+	}
+
+	config := azHealth.Apply(ctx, ecsRunner.TaskConfig(record.Payload, FindProfile(taskProfiles, record.Profile)))
+	config.ClientToken = record.Payload.ClientToken(record.Attempts + 1)
+	config.Cluster = taskCluster(taskARN, config.Cluster)
+	config.Count = 1
+	if record.TaskDefinition != "" {
+		config.TaskDefinition = record.TaskDefinition
+	}
+
+	result, err := RunFargateTask(ctx, ecsRunner.Client, config)
+	if err != nil {
+		err = fmt.Errorf("failed to start replacement task: %w", err)
+		return
+	}
+
+	if len(result.Tasks) == 0 {
+		if len(result.Failures) > 0 {
+			err = fmt.Errorf("failed to start replacement task: %w", NewRunTaskFailureError(result.Failures[0]))
+			return
+		}
+		err = fmt.Errorf("failed to start replacement task: no tasks started")
+		return
+	}
+
+	replacementARN = aws.ToString(result.Tasks[0].TaskArn)
+
+	taskARNs := strings.Split(record.TaskARN, ",")
+	if i := slices.Index(taskARNs, taskARN); i >= 0 {
+		taskARNs[i] = replacementARN
+	} else {
+		taskARNs = []string{replacementARN}
+	}
+	record.TaskARN = strings.Join(taskARNs, ",")
+	record.Attempts++
+	record.Status = JobStatusStarted
+	err = stateStore.Put(ctx, record)
+	return
+}
@@ -0,0 +1,311 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Lifecycle statuses of a tracked ADO job
+const (
+	JobStatusStarted     = "STARTED"
+	JobStatusSucceeded   = "SUCCEEDED"
+	JobStatusFailed      = "FAILED"
+	JobStatusInterrupted = "INTERRUPTED"
+)
+
+// ErrJobNotFound is returned when a job is not tracked in the state store
+var ErrJobNotFound = errors.New("job not found")
+
+/*
+JobRecord contains the state of an ADO job tracked by the controller.
+
+The record keeps the original ADO payload, including the job access token,
+so that the job can be re-dispatched and reported on outside of the invocation that received it.
+*/
+type JobRecord struct {
+	JobID          string        `dynamodbav:"JobId"`                              // The check ID of the job, see ADOPayload.CheckID (partition key)
+	TaskARN        string        `dynamodbav:"TaskArn"`                            // The ID of the agent started by the runner, comma-separated for multi-agent jobs
+	Status         string        `dynamodbav:"Status"`                             // The job lifecycle status
+	Profile        string        `dynamodbav:"Profile"`                            // The name of the task profile selected for the job, empty for the default configuration
+	TaskDefinition string        `dynamodbav:"TaskDefinition,omitempty"`           // The task definition revision that served the job
+	Canary         bool          `dynamodbav:"Canary,omitempty"`                   // Whether the job was served by the profile's canary revision
+	Attempts       int           `dynamodbav:"Attempts"`                           // The number of agents started for the job
+	SlotAcquired   bool          `dynamodbav:"SlotAcquired,omitempty"`             // Whether the job holds a project quota slot
+	UsageTasks     int           `dynamodbav:"UsageTasks,omitempty"`               // The number of stopped tasks accounted in the usage of the job
+	AccountedTasks []string      `dynamodbav:"AccountedTasks,stringset,omitempty"` // The ARNs of the stopped tasks accounted in the usage of the job
+	StoppedTasks   []string      `dynamodbav:"StoppedTasks,stringset,omitempty"`   // The ARNs of the tasks of the job reported stopped by their task state change events
+	VCPUHours      float64       `dynamodbav:"VCPUHours,omitempty"`                // The vCPU-hours used by the stopped tasks of the job
+	MemoryGBHours  float64       `dynamodbav:"MemoryGBHours,omitempty"`            // The memory GB-hours used by the stopped tasks of the job
+	LastStoppedAt  time.Time     `dynamodbav:"LastStoppedAt,unixtime,omitempty"`   // When the last task of the job stopped, in epoch seconds so it compares numerically
+	QueuedAt       time.Time     `dynamodbav:"QueuedAt,omitempty"`                 // When the message of the job was queued, for queue latency tracking
+	Tasks          []TaskDetails `dynamodbav:"Tasks,omitempty"`                    // The details of the agent tasks once running
+	Payload        *ADOPayload   `dynamodbav:"Payload"`                            // The ADO payload
+	CreatedAt      time.Time     `dynamodbav:"CreatedAt"`                          // When the job was first seen
+	UpdatedAt      time.Time     `dynamodbav:"UpdatedAt"`                          // When the record was last written
+	ExpiresAt      int64         `dynamodbav:"ExpiresAt"`                          // Epoch seconds after which DynamoDB TTL deletes the record
+}
+
+// HasTask reports whether the task is one of the agents started for the job
+func (record *JobRecord) HasTask(taskARN string) bool {
+	return slices.Contains(strings.Split(record.TaskARN, ","), taskARN)
+}
+
+// AllTasksStopped reports whether every agent task of the job was reported stopped, see StateStore.MarkTaskStopped
+func (record *JobRecord) AllTasksStopped() bool {
+	for _, taskARN := range strings.Split(record.TaskARN, ",") {
+		if !slices.Contains(record.StoppedTasks, taskARN) {
+			return false
+		}
+	}
+	return true
+}
+
+// StateStoreConfig contains configuration values for the DynamoDB state store
+type StateStoreConfig struct {
+	TableName string        // The DynamoDB table name, the state store is disabled if empty
+	TTL       time.Duration // How long records are kept
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - STATE_TABLE_NAME: The DynamoDB table name with partition key 'JobId', the state store is disabled if unset
+  - STATE_TTL_HOURS: How long records are kept, using the table TTL attribute 'ExpiresAt' (default: 72)
+*/
+func (config *StateStoreConfig) ReadFromEnv() {
+	config.TableName = ReadEnvVarWithDefault("STATE_TABLE_NAME", "")
+
+	ttlStr := ReadEnvVarWithDefault("STATE_TTL_HOURS", "72")
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil {
+		slog.Error("failed to parse STATE_TTL_HOURS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.TTL = time.Duration(ttl) * time.Hour
+}
+
+// StateStore persists JobRecords in a DynamoDB table
+type StateStore struct {
+	Client func() *dynamodb.Client // Returns the DynamoDB client, created on the first call, so invocations that don't use the table don't create it
+	Config *StateStoreConfig       // The state store configuration
+}
+
+// Get returns the record of a job, or ErrJobNotFound
+func (s *StateStore) Get(ctx context.Context, jobID string) (record *JobRecord, err error) {
+	key, err := attributevalue.MarshalMap(map[string]string{"JobId": jobID})
+	if err != nil {
+		return
+	}
+
+	result, err := s.Client().GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.Config.TableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to get job record: %w", err)
+		return
+	}
+
+	if result.Item == nil {
+		err = ErrJobNotFound
+		return
+	}
+
+	record = new(JobRecord)
+	err = attributevalue.UnmarshalMap(result.Item, record)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal job record: %w", err)
+	}
+
+	return
+}
+
+// Put writes the record of a job, setting its timestamps
+func (s *StateStore) Put(ctx context.Context, record *JobRecord) error {
+	now := time.Now().UTC()
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = now
+	}
+	record.UpdatedAt = now
+	record.ExpiresAt = now.Add(s.Config.TTL).Unix()
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job record: %w", err)
+	}
+
+	_, err = s.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put job record: %w", err)
+	}
+
+	return nil
+}
+
+/*
+AddUsage accounts for the compute used by a stopped task of a job, once per task ARN,
+since EventBridge delivers events at least once and may deliver the STOPPED event of a task again.
+It fails with a ConditionalCheckFailedException if the job isn't tracked or the task was already accounted.
+*/
+func (s *StateStore) AddUsage(ctx context.Context, jobID string, taskARN string, vcpuHours float64, memoryGBHours float64, stoppedAt time.Time) error {
+	_, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Config.TableName),
+		Key:                 map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression:    aws.String("ADD UsageTasks :one, VCPUHours :vcpu, MemoryGBHours :memory, AccountedTasks :arns SET LastStoppedAt = :stopped"),
+		ConditionExpression: aws.String("attribute_exists(JobId) AND NOT contains(AccountedTasks, :arn)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":vcpu":    &types.AttributeValueMemberN{Value: strconv.FormatFloat(vcpuHours, 'f', -1, 64)},
+			":memory":  &types.AttributeValueMemberN{Value: strconv.FormatFloat(memoryGBHours, 'f', -1, 64)},
+			":arns":    &types.AttributeValueMemberSS{Value: []string{taskARN}},
+			":arn":     &types.AttributeValueMemberS{Value: taskARN},
+			":stopped": &types.AttributeValueMemberN{Value: strconv.FormatInt(stoppedAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add job usage: %w", err)
+	}
+
+	return nil
+}
+
+// MarkTaskStopped adds a stopped task to the StoppedTasks of its job and returns the updated record, or ErrJobNotFound
+func (s *StateStore) MarkTaskStopped(ctx context.Context, jobID string, taskARN string) (record *JobRecord, err error) {
+	result, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Config.TableName),
+		Key:                 map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression:    aws.String("ADD StoppedTasks :arns"),
+		ConditionExpression: aws.String("attribute_exists(JobId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":arns": &types.AttributeValueMemberSS{Value: []string{taskARN}},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		err = ErrJobNotFound
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to mark task stopped: %w", err)
+		return
+	}
+
+	record = new(JobRecord)
+	err = attributevalue.UnmarshalMap(result.Attributes, record)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal job record: %w", err)
+	}
+	return
+}
+
+// ListHoldingSlotsPages calls fn with every page of the records of the finished jobs that still hold a project quota slot, until fn returns false
+func (s *StateStore) ListHoldingSlotsPages(ctx context.Context, fn func(records []*JobRecord) bool) error {
+	return s.scanPages(ctx, "SlotAcquired = :true AND #status <> :started", map[string]string{"#status": "Status"}, map[string]types.AttributeValue{
+		":true":    &types.AttributeValueMemberBOOL{Value: true},
+		":started": &types.AttributeValueMemberS{Value: JobStatusStarted},
+	}, fn)
+}
+
+// ListStoppedSince returns the records of the jobs whose last task stopped at or after the given time, compared in epoch seconds
+func (s *StateStore) ListStoppedSince(ctx context.Context, since time.Time) (records []*JobRecord, err error) {
+	return s.scan(ctx, "LastStoppedAt >= :since", map[string]string{}, map[string]types.AttributeValue{
+		":since": &types.AttributeValueMemberN{Value: strconv.FormatInt(since.Unix(), 10)},
+	})
+}
+
+// ListByStatus returns the records of the jobs with the given lifecycle status
+func (s *StateStore) ListByStatus(ctx context.Context, status string) (records []*JobRecord, err error) {
+	return s.scan(ctx, "#status = :status", map[string]string{"#status": "Status"}, map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{Value: status},
+	})
+}
+
+// ListByStatusPages calls fn with every page of the records of the jobs with the given lifecycle status, until fn returns false
+func (s *StateStore) ListByStatusPages(ctx context.Context, status string, fn func(records []*JobRecord) bool) error {
+	return s.scanPages(ctx, "#status = :status", map[string]string{"#status": "Status"}, map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{Value: status},
+	}, fn)
+}
+
+// scan returns the job records matching a filter expression
+func (s *StateStore) scan(ctx context.Context, filter string, names map[string]string, values map[string]types.AttributeValue) (records []*JobRecord, err error) {
+	err = s.scanPages(ctx, filter, names, values, func(pageRecords []*JobRecord) bool {
+		records = append(records, pageRecords...)
+		return true
+	})
+	return
+}
+
+// scanPages calls fn with every page of the job records matching a filter expression, until fn returns false
+func (s *StateStore) scanPages(ctx context.Context, filter string, names map[string]string, values map[string]types.AttributeValue, fn func(records []*JobRecord) bool) error {
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(s.Config.TableName),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+
+	paginator := dynamodb.NewScanPaginator(s.Client(), input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan job records: %w", err)
+		}
+
+		var pageRecords []*JobRecord
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageRecords)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal job records: %w", err)
+		}
+		if !fn(pageRecords) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// UpdateStatus sets the lifecycle status of a job without overwriting the rest of its record
+func (s *StateStore) UpdateStatus(ctx context.Context, jobID string, status string) error {
+	now := time.Now().UTC()
+
+	_, err := s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.Config.TableName),
+		Key:              map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression: aws.String("SET #status = :status, UpdatedAt = :now, ExpiresAt = :expires"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":  &types.AttributeValueMemberS{Value: status},
+			":now":     &types.AttributeValueMemberS{Value: now.Format(time.RFC3339Nano)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(s.Config.TTL).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update job status: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ActionStop is the action of queue messages that decommission agents
+const ActionStop = "stop"
+
+/*
+ActionMessage is a queue message that runs an action on provisioned agents instead of carrying an ADO payload,
+e.g. '{"action": "stop", "JobId": "..."}', '{"action": "stop", "TaskArn": "..."}' or '{"action": "stop", "ProjectId": "..."}',
+or toggles the kill switch of a task profile, e.g. '{"action": "disable", "Profile": "...", "Job": {...}}', see handleKillSwitchMessage.
+Action messages are authorized by their signature or the job access token of their Job, see authorizeAction.
+*/
+type ActionMessage struct {
+	Action    string      `json:"action"`    // The action, one of the Action values
+	JobID     string      `json:"JobId"`     // The check ID of the job whose agents are targeted, see ADOPayload.CheckID
+	TaskARN   string      `json:"TaskArn"`   // The ID of the agent targeted, if JobId is not set
+	ProjectID string      `json:"ProjectId"` // The ADO project whose in-flight agents are all targeted, see stopProjectAgents
+	Reason    string      `json:"Reason"`    // An optional reason recorded by the runner, or by the kill switch
+	Profile   string      `json:"Profile"`   // The task profile whose kill switch is toggled
+	Job       *ADOPayload `json:"Job"`       // The job of a running pipeline whose access token authorizes an unsigned message, see authorizeAction
+}
+
+/*
+handleStopMessage stops the agents targeted by a stop message and deregisters them from the ADO agent pool,
+if ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID are set.
+
+If the job of the agents is tracked and its check is still waiting, it is marked as failed
+and its check is reported as failed.
+
+Messages are authorized by authorizeAction: signed messages may stop any agent,
+messages carrying a job access token only the agents of jobs of its project.
+Stopping every agent of a project, with ProjectId, requires a signed message, like the admin API, see stopProjectAgents.
+Unauthorized messages are dropped, and emit the RejectedPayloads metric.
+*/
+func handleStopMessage(ctx context.Context, queued events.SQSMessage, message *ActionMessage) error {
+	authorization, err := authorizeAction(queued, message)
+	if errors.Is(err, ErrActionUnauthorized) {
+		rejectActionMessage(message, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	reason := message.Reason
+	if reason == "" {
+		reason = "Stopped by a stop message"
+	}
+
+	if message.ProjectID != "" {
+		if !authorization.Signed {
+			rejectActionMessage(message, fmt.Errorf("%w: stopping every agent of a project requires a signed message", ErrActionUnauthorized))
+			return nil
+		}
+		_, err = stopProjectAgents(ctx, message.ProjectID, reason)
+		if errors.Is(err, ErrPayloadNotAllowed) {
+			rejectActionMessage(message, fmt.Errorf("%w: %w", ErrActionUnauthorized, err))
+			return nil
+		}
+		return err
+	}
+
+	var record *JobRecord
+	projectID := ""
+	id := message.TaskARN
+	if message.JobID != "" {
+		if stateStore == nil {
+			return fmt.Errorf("stopping agents by JobId requires the state store")
+		}
+		record, err = stateStore.Get(ctx, message.JobID)
+		if errors.Is(err, ErrJobNotFound) {
+			slog.Warn("stop message ignored, job is not tracked", slog.String("jobId", message.JobID))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id = record.TaskARN
+	} else if owner, resolveErr := ResolveTask(ctx, id); resolveErr == nil {
+		projectID = owner.ProjectID
+		if stateStore != nil {
+			record, _ = stateStore.Get(ctx, owner.CheckID)
+		}
+	}
+	if record != nil && record.Payload != nil {
+		projectID = record.Payload.ProjectID
+	}
+
+	if id == "" {
+		return fmt.Errorf("stop message requires JobId or TaskArn")
+	}
+
+	if !authorization.Signed && !strings.EqualFold(authorization.ProjectID, projectID) {
+		rejectActionMessage(message, fmt.Errorf("%w: the token of project %s can't stop agent %s of project %q", ErrActionUnauthorized, authorization.ProjectID, id, projectID))
+		return nil
+	}
+
+	err = runner.Stop(ctx, id, reason)
+	if err != nil {
+		return fmt.Errorf("failed to stop agent: %w", err)
+	}
+
+	slog.Info("agent stopped by a stop message", slog.String("id", id), slog.String("reason", reason), slog.String("principal", authorization.Principal))
+	EmitMetric("StoppedByMessage", 1, MetricUnitCount, nil)
+
+	var name string
+	if record != nil {
+		name = record.Payload.AgentName()
+	}
+	err = deregisterAgents(id, name)
+	if err != nil {
+		slog.Error("failed to deregister agents", slog.String("id", id), slog.Any("err", err))
+	}
+
+	if record == nil || record.Status != JobStatusStarted {
+		return nil
+	}
+
+	err = stateStore.UpdateStatus(ctx, record.JobID, JobStatusFailed)
+	if err != nil {
+		return err
+	}
+
+	if record.Payload != nil {
+		return failCheck(ctx, record.Payload, "The agent was stopped: "+reason)
+	}
+
+	return nil
+}
+
+// deregisterAgents deletes the ADO pool agents of the stopped agent tasks, matched by name, see agentMatches
+func deregisterAgents(id string, name string) error {
+	if !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return nil
+	}
+
+	agents, err := ADOListAgents(adoClient, adoCfg)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, taskARN := range strings.Split(id, ",") {
+		for _, agent := range agents {
+			if !agentMatches(agent, taskARN, name) {
+				continue
+			}
+			err = ADODeleteAgent(adoClient, adoCfg, agent.ID)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			slog.Info("deregistered agent", slog.String("name", agent.Name), slog.Int("agentId", agent.ID))
+		}
+	}
+
+	return errors.Join(errs...)
+}
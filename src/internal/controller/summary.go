@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+InvocationSummary accumulates what an invocation handling a batch of queue records did,
+logged as a single 'invocation summary' record at its end, so log queries don't have to stitch together per-record lines.
+
+A nil summary ignores every call, e.g. for invocations that aren't queue batches.
+*/
+type InvocationSummary struct {
+	mu sync.Mutex
+
+	StartedAt       time.Time      // When the invocation started
+	Records         int            // The number of records handled
+	FailedRecords   int            // The number of handled records reported as batch item failures
+	DeferredRecords int            // The number of records deferred by fair-share scheduling
+	TasksStarted    int            // The number of agent launches accepted by the runner
+	AgentsReady     int            // The number of agents that became ready
+	AgentsStopped   int            // The number of agents that stopped before becoming ready
+	CallbacksSent   int            // The number of TaskCompleted callbacks sent
+	Failures        map[string]int // The number of failed checks, by FailureCategory
+	RecordsDuration time.Duration  // The total time spent handling records
+}
+
+// invocationSummary is the summary of the current queue batch, nil outside of handleQueue
+var invocationSummary *InvocationSummary
+
+// NewInvocationSummary starts the summary of an invocation
+func NewInvocationSummary() *InvocationSummary {
+	return &InvocationSummary{StartedAt: time.Now(), Failures: map[string]int{}}
+}
+
+// Record counts a handled record and the time spent handling it
+func (s *InvocationSummary) Record(duration time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Records++
+	s.RecordsDuration += duration
+}
+
+// Activity counts a lifecycle event of a job, one of the Activity values
+func (s *InvocationSummary) Activity(event string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch event {
+	case ActivityStarted:
+		s.TasksStarted++
+	case ActivityRunning:
+		s.AgentsReady++
+	case ActivityStopped:
+		s.AgentsStopped++
+	case ActivityCallback:
+		s.CallbacksSent++
+	}
+}
+
+// Failure counts a failed check of the given FailureCategory
+func (s *InvocationSummary) Failure(category string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failures[category]++
+}
+
+// Log writes the summary as a single structured log record
+func (s *InvocationSummary) Log() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var average time.Duration
+	if s.Records > 0 {
+		average = s.RecordsDuration / time.Duration(s.Records)
+	}
+
+	slog.Info("invocation summary",
+		slog.Int("records", s.Records),
+		slog.Int("failedRecords", s.FailedRecords),
+		slog.Int("deferredRecords", s.DeferredRecords),
+		slog.Int("tasksStarted", s.TasksStarted),
+		slog.Int("agentsReady", s.AgentsReady),
+		slog.Int("agentsStopped", s.AgentsStopped),
+		slog.Int("callbacksSent", s.CallbacksSent),
+		slog.Any("failuresByCategory", s.Failures),
+		slog.Int64("recordsDurationMs", s.RecordsDuration.Milliseconds()),
+		slog.Int64("averageRecordDurationMs", average.Milliseconds()),
+		slog.Int64("durationMs", time.Since(s.StartedAt).Milliseconds()),
+	)
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	tagtypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+	"github.com/aws/smithy-go"
+)
+
+// Keys of the tags applied to the agent tasks started by the controller
+const (
+	TagController = "ado:controller" // The controller ID, see controllerID
+	TagPool       = "ado:pool"       // The ID of the ADO agent pool where agents register
+	TagProject    = "ado:project"    // The ADO project ID of the job
+	TagJob        = "ado:job-id"     // The ADO job ID
+	TagCheck      = "ado:check-id"   // The check ID of the job, see ADOPayload.CheckID
+	TagAgentName  = "ado:agent-name" // The deterministic name of the job's agent, see ADOPayload.AgentName
+)
+
+// controllerID identifies the agent tasks started by this controller, set with CONTROLLER_ID (default: the function name)
+var controllerID = ReadEnvVarWithDefault("CONTROLLER_ID", ReadEnvVarWithDefault("AWS_LAMBDA_FUNCTION_NAME", "azure-pipelines-ecs-controller"))
+
+// controllerTags returns the tags of an agent task started for a payload, or of a task not started for a job if payload is nil
+func controllerTags(payload *ADOPayload) map[string]string {
+	tags := map[string]string{TagController: controllerID}
+	if adoCfg != nil && adoCfg.PoolID != 0 {
+		tags[TagPool] = strconv.Itoa(adoCfg.PoolID)
+	}
+	if payload != nil {
+		tags[TagProject] = payload.ProjectID
+		tags[TagJob] = payload.JobID
+		tags[TagCheck] = payload.CheckID()
+		if name := payload.AgentName(); name != "" {
+			tags[TagAgentName] = name
+		}
+	}
+	return tags
+}
+
+// ecsTags converts tags to ECS tags, sorted by key
+func ecsTags(tags map[string]string) (result []types.Tag) {
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		result = append(result, types.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return
+}
+
+/*
+ListTaggedTasks returns the ARNs of the tasks of a cluster that are not stopping and have all of the given tags,
+the shared discovery of the controller's agent tasks.
+
+Running tasks are listed with ListTasks, and filtered by tags with the Resource Groups Tagging API GetResources,
+which requires tag:GetResources.
+*/
+func ListTaggedTasks(ctx context.Context, client *ecs.Client, tagging *resourcegroupstaggingapi.Client, cluster string, tags map[string]string) (taskARNs []string, err error) {
+	var running []string
+	paginator := ecs.NewListTasksPaginator(client, &ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		DesiredStatus: types.DesiredStatusRunning,
+	})
+
+	for paginator.HasMorePages() {
+		page, pageErr := paginator.NextPage(ctx)
+		if pageErr != nil {
+			err = fmt.Errorf("failed to list tasks: %w", pageErr)
+			return
+		}
+		running = append(running, page.TaskArns...)
+	}
+
+	if len(tags) == 0 || len(running) == 0 {
+		taskARNs = running
+		return
+	}
+
+	var filters []tagtypes.TagFilter
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		filters = append(filters, tagtypes.TagFilter{Key: aws.String(key), Values: []string{tags[key]}})
+	}
+
+	tagged := map[string]bool{}
+	resources := resourcegroupstaggingapi.NewGetResourcesPaginator(tagging, &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: []string{"ecs:task"},
+		TagFilters:          filters,
+	})
+
+	for resources.HasMorePages() {
+		page, pageErr := resources.NextPage(ctx)
+		if pageErr != nil {
+			err = fmt.Errorf("failed to get tagged resources: %w", pageErr)
+			return
+		}
+		for _, resource := range page.ResourceTagMappingList {
+			tagged[aws.ToString(resource.ResourceARN)] = true
+		}
+	}
+
+	for _, taskARN := range running {
+		if tagged[taskARN] {
+			taskARNs = append(taskARNs, taskARN)
+		}
+	}
+
+	return
+}
+
+// ReadUntaggedFallbackFromEnv reads ECS_UNTAGGED_FALLBACK, whether tasks are started untagged when tagging them is denied, e.g. by an SCP (default: false)
+func ReadUntaggedFallbackFromEnv() bool {
+	return ReadEnvVarWithDefault("ECS_UNTAGGED_FALLBACK", "false") == "true"
+}
+
+// isTagPermissionError reports whether a RunTask call was denied because the caller isn't allowed to tag the tasks
+func isTagPermissionError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "AccessDeniedException" {
+		return false
+	}
+	return strings.Contains(apiErr.ErrorMessage(), "ecs:TagResource")
+}
+
+/*
+runTaskUntaggedOnDenial handles a RunTask call denied because tagging the tasks isn't allowed,
+which is common under restrictive SCPs: it logs a structured warning and,
+if ECS_UNTAGGED_FALLBACK is set, retries the call without tags, managed tags and tag propagation.
+
+Untagged tasks can't be discovered by their tags, so the reconciliation, pre-scaling and admin features
+that list the controller's tasks don't see them.
+*/
+func runTaskUntaggedOnDenial(ctx context.Context, client *ecs.Client, input *ecs.RunTaskInput, err error) (*ecs.RunTaskOutput, error) {
+	slog.Warn("RunTask denied tagging the agent tasks",
+		slog.String("cluster", aws.ToString(input.Cluster)),
+		slog.String("taskDefinition", aws.ToString(input.TaskDefinition)),
+		slog.String("hint", "allow ecs:TagResource on the tasks, or set ECS_UNTAGGED_FALLBACK to start them untagged"),
+		slog.Bool("untaggedFallback", untaggedFallback),
+		slog.Any("err", err),
+	)
+	EmitMetric("TagPermissionDenials", 1, MetricUnitCount, nil)
+
+	if !untaggedFallback {
+		return nil, fmt.Errorf("failed to tag agent tasks, allow ecs:TagResource or set ECS_UNTAGGED_FALLBACK: %w", err)
+	}
+
+	untagged := *input
+	untagged.Tags = nil
+	untagged.EnableECSManagedTags = false
+	untagged.PropagateTags = ""
+	untagged.ClientToken = aws.String(GenerateClientToken(aws.ToString(input.ClientToken) + "#untagged"))
+	return client.RunTask(ctx, &untagged)
+}
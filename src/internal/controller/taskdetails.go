@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// TaskDetails describes an agent task once it is running, for audits
+type TaskDetails struct {
+	TaskARN          string            `dynamodbav:"TaskArn" json:"taskArn"`                                       // The task ARN
+	ImageDigests     map[string]string `dynamodbav:"ImageDigests,omitempty" json:"imageDigests,omitempty"`         // The image digests of the containers, by container name
+	AvailabilityZone string            `dynamodbav:"AvailabilityZone,omitempty" json:"availabilityZone,omitempty"` // The availability zone of the task
+	Subnet           string            `dynamodbav:"Subnet,omitempty" json:"subnet,omitempty"`                     // The subnet of the task, for awsvpc tasks
+	CapacityProvider string            `dynamodbav:"CapacityProvider,omitempty" json:"capacityProvider,omitempty"` // The capacity provider of the task, e.g. FARGATE_SPOT
+	LaunchType       string            `dynamodbav:"LaunchType,omitempty" json:"launchType,omitempty"`             // The launch type of the task
+	PlatformVersion  string            `dynamodbav:"PlatformVersion,omitempty" json:"platformVersion,omitempty"`   // The Fargate platform version of the task
+	StartedAt        time.Time         `dynamodbav:"StartedAt,omitempty" json:"startedAt,omitzero"`                // When the task began running
+}
+
+// TaskDetailer is implemented by runners that can describe the tasks of a running agent
+type TaskDetailer interface {
+	TaskDetails(ctx context.Context, id string) (details []TaskDetails, err error) // Returns the details of the tasks of the agent
+}
+
+// TaskDetails describes the tasks of the job
+func (r *ECSRunner) TaskDetails(ctx context.Context, id string) (details []TaskDetails, err error) {
+	result, err := r.Client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(taskCluster(id, r.Config.Cluster)),
+		Tasks:   strings.Split(id, ","),
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to describe tasks: %w", err)
+		return
+	}
+
+	for _, task := range result.Tasks {
+		detail := TaskDetails{
+			TaskARN:          aws.ToString(task.TaskArn),
+			ImageDigests:     map[string]string{},
+			AvailabilityZone: aws.ToString(task.AvailabilityZone),
+			Subnet:           taskSubnet(task),
+			CapacityProvider: aws.ToString(task.CapacityProviderName),
+			LaunchType:       string(task.LaunchType),
+			PlatformVersion:  aws.ToString(task.PlatformVersion),
+			StartedAt:        aws.ToTime(task.StartedAt).UTC(),
+		}
+		for _, container := range task.Containers {
+			if container.ImageDigest != nil {
+				detail.ImageDigests[aws.ToString(container.Name)] = aws.ToString(container.ImageDigest)
+			}
+		}
+		details = append(details, detail)
+	}
+
+	return
+}
+
+// SetTaskDetails records the details of the running tasks of a job without overwriting the rest of its record
+func (s *StateStore) SetTaskDetails(ctx context.Context, jobID string, details []TaskDetails) error {
+	value, err := attributevalue.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task details: %w", err)
+	}
+
+	_, err = s.Client().UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.Config.TableName),
+		Key:              map[string]types.AttributeValue{"JobId": &types.AttributeValueMemberS{Value: jobID}},
+		UpdateExpression: aws.String("SET Tasks = :tasks"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tasks": value,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set task details: %w", err)
+	}
+
+	return nil
+}
+
+// captureTaskDetails logs the details of the tasks of a job whose agent is running and records them in the job record
+func captureTaskDetails(ctx context.Context, record *JobRecord) {
+	detailer, ok := runner.(TaskDetailer)
+	if !ok {
+		return
+	}
+
+	details, err := detailer.TaskDetails(ctx, record.TaskARN)
+	if err != nil {
+		slog.Warn("failed to describe agent tasks", slog.String("jobId", record.JobID), slog.Any("err", err))
+		return
+	}
+
+	record.Tasks = details
+	for _, detail := range details {
+		azHealth.Record(ctx, detail.AvailabilityZone, detail.Subnet, false)
+	}
+	slog.Info("agent tasks running", slog.String("jobId", record.JobID), slog.Any("tasks", details))
+
+	if stateStore == nil {
+		return
+	}
+
+	err = stateStore.SetTaskDetails(ctx, record.JobID, details)
+	if err != nil {
+		dependencies.Fallback(DependencyStateStore, "set task details", err)
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+/*
+handleTaskStateChange handles 'ECS Task State Change' events of stopped tasks:
+  - the compute used by the task is added to its job's usage, for cost attribution
+  - stopped tasks of the ECS service of the ecs-service backend release the agent of the job they were assigned to
+  - tasks stopped by a Spot interruption are re-dispatched by handleSpotInterruption
+  - other stopped tasks release their job's project quota slot once every task of the job stopped, see releaseJobSlot
+*/
+func handleTaskStateChange(ctx context.Context, detail *ECSTaskStateChange) error {
+	if detail.LastStatus != TaskStatusStopped {
+		return nil
+	}
+
+	if stateStore != nil {
+		err := recordTaskUsage(ctx, detail)
+		if err != nil {
+			slog.Error("failed to record task usage", slog.String("taskArn", detail.TaskARN), slog.Any("err", err))
+		}
+	}
+
+	if serviceRunner, ok := runner.(*ECSServiceRunner); ok {
+		return releaseServiceTask(ctx, serviceRunner, detail.TaskARN)
+	}
+
+	if detail.StopCode == ECSStopCodeSpotInterruption {
+		return handleSpotInterruption(ctx, detail)
+	}
+
+	if stateStore == nil || len(projectQuotas) == 0 {
+		return nil
+	}
+
+	record, err := stateStore.MarkTaskStopped(ctx, detail.StartedBy, detail.TaskARN)
+	if errors.Is(err, ErrJobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !record.HasTask(detail.TaskARN) || !record.AllTasksStopped() {
+		return nil
+	}
+	return releaseJobSlot(ctx, record)
+}
+
+// releaseServiceTask releases the agent and the project quota slot of the job a stopped task of the ECS service was assigned to, if any
+func releaseServiceTask(ctx context.Context, serviceRunner *ECSServiceRunner, taskARN string) error {
+	id, err := serviceRunner.releaseStoppedTask(ctx, taskARN)
+	if err != nil || id == "" {
+		return err
+	}
+
+	_, checkID, _ := strings.Cut(id, "#")
+	record, err := stateStore.Get(ctx, checkID)
+	if errors.Is(err, ErrJobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return releaseJobSlot(ctx, record)
+}
+
+// recordTaskUsage adds the vCPU-hours and memory GB-hours of a stopped task to its job's usage
+func recordTaskUsage(ctx context.Context, detail *ECSTaskStateChange) error {
+	startedAt, err := time.Parse(time.RFC3339Nano, detail.StartedAt)
+	if err != nil {
+		// the task never started running, so it wasn't billed
+		return nil
+	}
+
+	stoppedAt, err := time.Parse(time.RFC3339Nano, detail.StoppedAt)
+	if err != nil {
+		return fmt.Errorf("failed to parse stoppedAt: %w", err)
+	}
+
+	hours := stoppedAt.Sub(startedAt).Hours()
+	vcpuHours := cpuUnitsToVCPU(detail.CPU) * hours
+	memoryGBHours := mebibytesToGB(detail.Memory) * hours
+
+	err = stateStore.AddUsage(ctx, detail.StartedBy, detail.TaskARN, vcpuHours, memoryGBHours, stoppedAt)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// the job isn't tracked, or the event of the task was redelivered
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ECSFailureMissing is the reason of DescribeTasks failures of tasks that don't exist, e.g. stopped tasks past their retention
+const ECSFailureMissing = "MISSING"
+
+// ErrTaskMissing is matched by the *DescribeTaskError of tasks that DescribeTasks reports as MISSING
+var ErrTaskMissing = errors.New("task missing")
+
+// DescribeTaskError is returned by DescribeTask for the failures that DescribeTasks returns instead of the task
+type DescribeTaskError struct {
+	TaskARN string // The ID of the task
+	Reason  string // The reason of the failure, e.g. MISSING
+	Detail  string // The detail of the failure
+}
+
+func (e *DescribeTaskError) Error() string {
+	message := fmt.Sprintf("failed to describe task %s", e.TaskARN)
+	if e.Reason != "" {
+		message += ": " + e.Reason
+	}
+	if e.Detail != "" {
+		message += ": " + e.Detail
+	}
+	return message
+}
+
+// Is matches ErrTaskMissing for MISSING failures
+func (e *DescribeTaskError) Is(target error) bool {
+	return target == ErrTaskMissing && e.Reason == ECSFailureMissing
+}
+
+// NewDescribeTaskError returns the error of the first DescribeTasks failure, if any
+func NewDescribeTaskError(taskARN string, failures []ecstypes.Failure) *DescribeTaskError {
+	err := &DescribeTaskError{TaskARN: taskARN}
+	if len(failures) > 0 {
+		err.Reason = aws.ToString(failures[0].Reason)
+		err.Detail = aws.ToString(failures[0].Detail)
+	}
+	return err
+}
+
+// Behaviors for tasks that disappeared, see TaskMissingConfig
+const (
+	TaskMissingStopped = "stopped" // Missing tasks are reported as stopped
+	TaskMissingError   = "error"   // Missing tasks fail the status check, so the record is redelivered
+)
+
+// TaskMissingConfig contains configuration values for the handling of agent tasks that DescribeTasks reports as MISSING
+type TaskMissingConfig struct {
+	Behavior string        // What a missing task is reported as, stopped or error
+	Grace    time.Duration // How long after its job record was written a missing task is reported as pending, since DescribeTasks is eventually consistent
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - TASK_MISSING_BEHAVIOR: What an agent task that disappeared, e.g. reaped after the stopped-task retention of ECS, is reported as,
+    stopped, which fails its readiness, or error, which fails the status check and redelivers the record (default: stopped)
+  - TASK_MISSING_GRACE_SECONDS: How long after its job record was written in the state store a missing task is reported as pending,
+    since DescribeTasks is eventually consistent right after RunTask (default: 60)
+*/
+func (config *TaskMissingConfig) ReadFromEnv() {
+	config.Behavior = ReadEnvVarWithDefault("TASK_MISSING_BEHAVIOR", TaskMissingStopped)
+	if config.Behavior != TaskMissingStopped && config.Behavior != TaskMissingError {
+		slog.Error("failed to parse TASK_MISSING_BEHAVIOR", slog.String("behavior", config.Behavior))
+		os.Exit(1)
+	}
+
+	graceStr := ReadEnvVarWithDefault("TASK_MISSING_GRACE_SECONDS", "60")
+	grace, err := strconv.Atoi(graceStr)
+	if err != nil || grace < 0 {
+		slog.Error("failed to parse TASK_MISSING_GRACE_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.Grace = time.Duration(grace) * time.Second
+}
+
+/*
+missingTaskStatus returns the status of a task that DescribeTasks reports as MISSING, before declaring it failed:
+  - with the error behavior, the error is returned
+  - with the state store, a task whose job record was written within the grace period is PENDING,
+    since it may not be visible yet right after RunTask, the record is read by the check ID of the context, see withCheckID
+  - any other task disappeared, e.g. it was reaped after the stopped-task retention of ECS, and is STOPPED
+*/
+func missingTaskStatus(ctx context.Context, taskARN string, err error) (string, error) {
+	if taskMissingCfg.Behavior == TaskMissingError {
+		return "", err
+	}
+
+	logger := slog.With(slog.String("taskArn", taskARN))
+	if checkID := checkIDFrom(ctx); stateStore != nil && checkID != "" {
+		record, findErr := stateStore.Get(ctx, checkID)
+		switch {
+		case findErr != nil:
+			logger.Warn("failed to find the job of a missing task", slog.Any("err", findErr))
+		case record.Status == JobStatusStarted && time.Since(record.UpdatedAt) < taskMissingCfg.Grace:
+			logger.Info("task not visible yet", slog.String("jobId", record.JobID))
+			return TaskStatusPending, nil
+		default:
+			logger = logger.With(slog.String("jobId", record.JobID), slog.String("status", record.Status))
+		}
+	}
+
+	logger.Warn("task disappeared", slog.Any("err", err))
+	EmitMetric("TasksDisappeared", 1, MetricUnitCount, nil)
+	return TaskStatusStopped, nil
+}
+
+// checkIDKey is the context key of the check ID of the job whose tasks are read
+type checkIDKey struct{}
+
+// withCheckID returns a context carrying the check ID of the job whose tasks are read, so missing tasks find their job record
+func withCheckID(ctx context.Context, checkID string) context.Context {
+	return context.WithValue(ctx, checkIDKey{}, checkID)
+}
+
+// checkIDFrom returns the check ID carried by the context, or an empty string
+func checkIDFrom(ctx context.Context) string {
+	checkID, _ := ctx.Value(checkIDKey{}).(string)
+	return checkID
+}
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"log/slog"
+	"time"
+)
+
+/*
+formatTimestamp formats a time as RFC 3339 in UTC, e.g. 2024-05-01T12:00:00Z,
+the format of the times in timeline notes, alerts and messages, whatever the time zone of the Lambda environment.
+
+Times are only kept as epoch values where the consumer requires them:
+the ExpiresAt TTL attributes of the state store, the debug tags that the controller parses back, and the EMF Timestamp.
+*/
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatDuration formats a duration rounded to seconds with explicit units, e.g. 1m30s, for timeline notes and messages
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+/*
+replaceLogAttr is the ReplaceAttr of the JSON log handler, so every log record has consistent times and durations:
+  - times, including the time of the record, are in UTC, formatted by the handler as RFC 3339
+  - durations are in milliseconds under the key with the Ms suffix, e.g. slog.Duration("delay", d) is logged as delayMs,
+    like the durations of the invocation summary, instead of the unlabeled nanoseconds of the handler
+*/
+func replaceLogAttr(_ []string, attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindTime:
+		return slog.Time(attr.Key, attr.Value.Time().UTC())
+	case slog.KindDuration:
+		return slog.Int64(attr.Key+"Ms", attr.Value.Duration().Milliseconds())
+	}
+	return attr
+}
@@ -0,0 +1,372 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ECSTaskConfig contains configuration values to trigger the AWS ECS RunTask API
+type ECSTaskConfig struct {
+	Cluster          string            // The cluster name
+	TaskDefinition   string            // The family and revision ( family:revision ) or full ARN of the task definition to run. If a revision isn't specified, the latest ACTIVE revision is used
+	ClientToken      string            // A client token for idempotent requests to the AWS ECS RunTask API
+	StartedBy        string            // An optional tag specified when a task is started, set to the ADO job ID
+	Subnets          []string          // List of subnet IDs
+	SecurityGroups   []string          // List of security group IDs
+	AgentContainer   string            // The name of the agent container in the task definition, target of container overrides
+	Environment      map[string]string // Environment variables injected into the agent container
+	TaskRoleARN      string            // An optional override of the task definition's task role
+	ExecutionRoleARN string            // An optional override of the task definition's task execution role
+	Count            int               // The number of tasks to start, 0 starts a single task
+	CPU              string            // An optional override of the task definition's task-level CPU, e.g. 1024
+	Memory           string            // An optional override of the task definition's task-level memory in MiB, e.g. 2048
+	LaunchType       string            // The launch type, FARGATE or EC2
+	NetworkMode      string            // The network mode of the task definition, the awsvpc network configuration is only sent for awsvpc
+	Tags             map[string]string // The tags of the tasks, see controllerTags
+}
+
+// ECSTaskReadConfig contains configuration values to read information about a single task from AWS ECS
+type ECSTaskReadConfig struct {
+	Cluster string // The cluster name
+	TaskARN string // The task ARN
+}
+
+/*
+ReadFromEnv reads the following required environment variables
+and populates the struct with the values:
+  - ECS_CLUSTER: The ECS cluster name
+  - ECS_TASK_DEFINITION: The family and revision ( family:revision ) or full ARN of the task definition to run. If a revision isn't specified, the latest ACTIVE revision is used
+  - SUBNET_IDS: A comma-separated list of subnet IDs
+  - SECURITY_GROUP_IDS: A comma-separated list of security group IDs
+
+and the following optional environment variables:
+  - ECS_AGENT_CONTAINER: The name of the agent container in the task definition (default: agent)
+  - ECS_LAUNCH_TYPE: The launch type of the tasks, FARGATE or EC2 (default: FARGATE)
+  - ECS_NETWORK_MODE: The network mode of the task definition, awsvpc, or bridge or host with the EC2 launch type (default: awsvpc)
+*/
+func (config *ECSTaskConfig) ReadFromEnv() {
+	config.Cluster = ReadRequiredEnvVar("ECS_CLUSTER")
+	config.TaskDefinition = ReadRequiredEnvVar("ECS_TASK_DEFINITION")
+
+	subnetIDsStr := ReadRequiredEnvVar("SUBNET_IDS")
+	config.Subnets = strings.Split(subnetIDsStr, ",")
+
+	securityGroupIDsStr := ReadRequiredEnvVar("SECURITY_GROUP_IDS")
+	config.SecurityGroups = strings.Split(securityGroupIDsStr, ",")
+
+	config.AgentContainer = ReadEnvVarWithDefault("ECS_AGENT_CONTAINER", "agent")
+
+	config.LaunchType = strings.ToUpper(ReadEnvVarWithDefault("ECS_LAUNCH_TYPE", "FARGATE"))
+	config.NetworkMode = strings.ToLower(ReadEnvVarWithDefault("ECS_NETWORK_MODE", "awsvpc"))
+
+	err := validateNetworkMode(config.LaunchType, config.NetworkMode)
+	if err != nil {
+		slog.Error("failed to parse ECS_NETWORK_MODE", slog.Any("err", err))
+		os.Exit(1)
+	}
+}
+
+// validateNetworkMode returns an error if tasks of the launch type can't use the network mode
+func validateNetworkMode(launchType string, networkMode string) error {
+	switch {
+	case launchType != "FARGATE" && launchType != "EC2":
+		return fmt.Errorf("unsupported launch type %s", launchType)
+	case networkMode != "awsvpc" && networkMode != "bridge" && networkMode != "host":
+		return fmt.Errorf("unsupported network mode %s", networkMode)
+	case launchType == "FARGATE" && networkMode != "awsvpc":
+		return fmt.Errorf("the FARGATE launch type requires the awsvpc network mode, not %s", networkMode)
+	}
+	return nil
+}
+
+/*
+SetClientToken populates the ClientToken field with a
+well-formatted value generated from an input string.
+The client token is used for idempotent requests to the AWS ECS RunTask API.
+
+See:
+
+https://docs.aws.amazon.com/AmazonECS/latest/APIReference/ECS_Idempotency.html#RunTaskIdempotency
+*/
+func (config *ECSTaskConfig) SetClientToken(input string) {
+	config.ClientToken = GenerateClientToken(input)
+}
+
+/*
+ADOPayload contains a parsed JSON payload sent
+from an Azure DevOps 'Generic' service connection check of type 'Invoke REST API'.
+*/
+type ADOPayload struct {
+	PlanURL        string            `json:"PlanUrl"`             // The plan URL (system.CollectionUri)
+	PlanID         string            `json:"PlanId"`              // The plan ID (system.PlanId)
+	ProjectID      string            `json:"ProjectId"`           // The project ID (system.TeamProjectId)
+	HubName        string            `json:"HubName"`             // The hub name (system.HostType)
+	JobID          string            `json:"JobId"`               // The job ID (system.JobId)
+	TimelineID     string            `json:"TimelineId"`          // The timeline ID (system.TimelineId)
+	TaskInstanceID string            `json:"TaskInstanceId"`      // The task instance ID (system.TaskInstanceId)
+	AuthToken      string            `json:"AuthToken"`           // The job access token (system.AccessToken)
+	Demands        []string          `json:"Demands"`             // Optional agent demands of the job, e.g. 'Agent.OS -equals Linux'
+	AgentCount     int               `json:"AgentCount"`          // Optional number of agents to start for the job, overrides the task profile
+	Variables      map[string]string `json:"Variables,omitempty"` // Optional pipeline variables passed to the agent environment, if allow-listed in PAYLOAD_VARIABLES
+	DryRun         bool              `json:"DryRun,omitempty"`    // Optional flag to log the plan of the job instead of starting agents, see NewPlan
+	Deadline       time.Time         `json:"Deadline,omitzero"`   // Optional RFC 3339 time by which the agent must be ready, e.g. the timeout of the check, see DeadlineExceeded
+}
+
+/*
+CheckID returns the ID of the check that sent the payload: the job ID qualified by the task instance ID,
+since the same job may be gated by several checks, e.g. an environment check and a service connection check,
+each of which starts and tracks its own agent.
+*/
+func (payload *ADOPayload) CheckID() string {
+	if payload.TaskInstanceID == "" {
+		return payload.JobID
+	}
+	return payload.JobID + "_" + payload.TaskInstanceID
+}
+
+/*
+ADOEventsURL generates an Azure DevOps API URL for the events endpoint.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/events/post-event?view=azure-devops-rest-7.1&tabs=HTTP
+*/
+func (payload *ADOPayload) ADOEventsURL(instance string, apiVersion string) string {
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s/events?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, apiVersion)
+}
+
+/*
+ADOTimelineFeedURL generates an Azure DevOps API URL for the timeline record feed endpoint
+of the check's task instance.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/timelines
+*/
+func (payload *ADOPayload) ADOTimelineFeedURL(instance string, apiVersion string) string {
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s/timelines/%s/records/%s/feed?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, payload.TimelineID, payload.TaskInstanceID, apiVersion)
+}
+
+/*
+ADOTimelineRecordsURL generates an Azure DevOps API URL for the records endpoint of the check's timeline.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/timelines
+*/
+func (payload *ADOPayload) ADOTimelineRecordsURL(instance string, apiVersion string) string {
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s/timelines/%s/records?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, payload.TimelineID, apiVersion)
+}
+
+/*
+ADOLogsURL generates an Azure DevOps API URL for the logs endpoint of the check's plan,
+or the endpoint of one of its logs if logID is positive.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/logs
+*/
+func (payload *ADOPayload) ADOLogsURL(instance string, apiVersion string, logID int) string {
+	if logID > 0 {
+		return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s/logs/%d?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, logID, apiVersion)
+	}
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s/logs?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, apiVersion)
+}
+
+/*
+ADOPlanURL generates an Azure DevOps API URL for the plan endpoint.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask
+*/
+func (payload *ADOPayload) ADOPlanURL(instance string, apiVersion string) string {
+	return fmt.Sprintf("https://%s/%s/_apis/distributedtask/hubs/%s/plans/%s?api-version=%s", instance, payload.ProjectID, payload.HubName, payload.PlanID, apiVersion)
+}
+
+/*
+ADOConfig contains configuration values for connections to the Azure DevOps REST API.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops
+*/
+type ADOConfig struct {
+	Instance            string // The ADO instance
+	APIVersion          string // The ADO API version
+	AuthUsername        string // Prefix for the authentication token
+	AgentWaitSeconds    int    // Default wait time for agent start
+	PAT                 string // Personal access token for organization-level APIs, such as agent pools
+	PoolID              int    // The ID of the agent pool where agents register
+	ValidatePayload     bool   // Whether to verify with ADO that the payload's plan exists and is in progress before launching
+	ValidateCallback    bool   // Whether to detect errors reported in the bodies of successful TaskCompleted responses
+	MaxResponseBytes    int64  // The maximum size of ADO response bodies read into memory
+	CallbackConcurrency int    // The maximum number of TaskCompleted callbacks sent concurrently
+	MaxRedirects        int    // The maximum number of redirects followed by ADO requests, 0 fails redirected requests
+	LogChunkBytes       int    // The maximum size of the uncompressed log content appended by each ADO log request
+	LogCompression      string // The compression of appended log content, gzip or none
+
+	ExtraHeaders map[string]string // Static headers added to every ADO request, by header name
+}
+
+/*
+ReadFromEnv reads the following required environment variables
+and populates the struct with the values:
+  - ADO_DOMAIN: The ADO domain (default: dev.azure.com)
+  - ADO_ORG: The ADO organization
+  - ADO_API_VERSION: The ADO API version (default: 7.1)
+  - ADO_AUTH_USERNAME: Username for the 'basic auth' configuration, is ignored by the API
+  - ADO_PAT: Personal access token for organization-level APIs, such as agent pools, see AzureADConfig to use Azure AD tokens instead (optional)
+  - ADO_POOL_ID: The ID of the agent pool where agents register (optional)
+  - ADO_VALIDATE_PAYLOAD: Whether to verify with ADO that the payload's plan exists and is in progress before launching (default: false)
+  - ADO_VALIDATE_CALLBACK: Whether to detect errors reported in the bodies of successful TaskCompleted responses (default: false)
+  - ADO_MAX_RESPONSE_BYTES: The maximum size of ADO response bodies read into memory (default: 1048576)
+  - ADO_CALLBACK_CONCURRENCY: The maximum number of TaskCompleted callbacks of a batch sent concurrently (default: 4)
+  - ADO_MAX_REDIRECTS: The maximum number of redirects followed by ADO requests, for environments behind a redirecting gateway,
+    redirect responses fail the request by default, since they are often redirects to a login page (default: 0)
+  - ADO_LOG_CHUNK_BYTES: The maximum size of the uncompressed log content appended by each request of ADOLogUpload (default: 1048576)
+  - ADO_LOG_COMPRESSION: The compression of appended log content, gzip or none (default: gzip)
+  - ADO_EXTRA_HEADERS: A JSON object of static headers added to every ADO request, by header name,
+    e.g. {"X-TFS-FedAuthRedirect": "Suppress"} or the token of a reverse proxy, which can be KMS-encrypted (optional)
+*/
+func (config *ADOConfig) ReadFromEnv() {
+	adoDomain := ReadEnvVarWithDefault("ADO_DOMAIN", "dev.azure.com")
+	adoOrg := ReadRequiredEnvVar("ADO_ORG")
+	config.Instance = fmt.Sprintf("%s/%s", adoDomain, adoOrg)
+	config.APIVersion = ReadEnvVarWithDefault("ADO_API_VERSION", "7.1")
+	config.AuthUsername = ReadEnvVarWithDefault("ADO_AUTH_USERNAME", "ado-callback")
+
+	waitSecondsStr := ReadEnvVarWithDefault("ADO_AGENT_WAIT_SECONDS", "10")
+	waitSeconds, err := strconv.Atoi(waitSecondsStr)
+	if err != nil {
+		slog.Error("failed to parse ADO_AGENT_WAIT_SECONDS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.AgentWaitSeconds = waitSeconds
+
+	config.PAT = ReadEnvVarWithDefault("ADO_PAT", "")
+
+	poolIDStr := ReadEnvVarWithDefault("ADO_POOL_ID", "0")
+	poolID, err := strconv.Atoi(poolIDStr)
+	if err != nil {
+		slog.Error("failed to parse ADO_POOL_ID", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.PoolID = poolID
+
+	config.ValidatePayload = ReadEnvVarWithDefault("ADO_VALIDATE_PAYLOAD", "false") == "true"
+	config.ValidateCallback = ReadEnvVarWithDefault("ADO_VALIDATE_CALLBACK", "false") == "true"
+
+	maxResponseBytesStr := ReadEnvVarWithDefault("ADO_MAX_RESPONSE_BYTES", "1048576")
+	maxResponseBytes, err := strconv.ParseInt(maxResponseBytesStr, 10, 64)
+	if err != nil || maxResponseBytes <= 0 {
+		slog.Error("failed to parse ADO_MAX_RESPONSE_BYTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxResponseBytes = maxResponseBytes
+
+	concurrencyStr := ReadEnvVarWithDefault("ADO_CALLBACK_CONCURRENCY", "4")
+	concurrency, err := strconv.Atoi(concurrencyStr)
+	if err != nil || concurrency < 1 {
+		slog.Error("failed to parse ADO_CALLBACK_CONCURRENCY", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.CallbackConcurrency = concurrency
+
+	maxRedirectsStr := ReadEnvVarWithDefault("ADO_MAX_REDIRECTS", "0")
+	maxRedirects, err := strconv.Atoi(maxRedirectsStr)
+	if err != nil || maxRedirects < 0 {
+		slog.Error("failed to parse ADO_MAX_REDIRECTS", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.MaxRedirects = maxRedirects
+
+	logChunkBytesStr := ReadEnvVarWithDefault("ADO_LOG_CHUNK_BYTES", "1048576")
+	logChunkBytes, err := strconv.Atoi(logChunkBytesStr)
+	if err != nil || logChunkBytes < 1 {
+		slog.Error("failed to parse ADO_LOG_CHUNK_BYTES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	config.LogChunkBytes = logChunkBytes
+
+	config.LogCompression = ReadEnvVarWithDefault("ADO_LOG_COMPRESSION", ADOLogCompressionGzip)
+	if config.LogCompression != ADOLogCompressionGzip && config.LogCompression != ADOLogCompressionNone {
+		slog.Error("failed to parse ADO_LOG_COMPRESSION", slog.String("compression", config.LogCompression))
+		os.Exit(1)
+	}
+
+	err = json.Unmarshal([]byte(ReadEnvVarWithDefault("ADO_EXTRA_HEADERS", "{}")), &config.ExtraHeaders)
+	if err != nil {
+		slog.Error("failed to parse ADO_EXTRA_HEADERS", slog.Any("err", err))
+		os.Exit(1)
+	}
+	for name := range config.ExtraHeaders {
+		if strings.EqualFold(name, "Authorization") {
+			slog.Error("failed to parse ADO_EXTRA_HEADERS: the Authorization header is set by the controller")
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+CheckRedirect is the redirect policy of the ADO client: up to MaxRedirects redirects are followed,
+after which the redirect response is returned, and fails the request as an *ADOError.
+*/
+func (config *ADOConfig) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > config.MaxRedirects {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+/*
+ADOCallbackConfig contains the configurations value
+to generate a callback request to the Azure DevOps service connection.
+*/
+type ADOCallbackConfig struct {
+	Config  *ADOConfig  // The ADO config
+	Payload *ADOPayload // The ADO payload
+	Result  string      // The reported outcome
+}
+
+/*
+ControllerCommand is the payload of direct or scheduled invocations,
+e.g. from an Amazon EventBridge schedule with a constant input,
+that run a controller maintenance job instead of processing ADO payloads.
+*/
+type ControllerCommand struct {
+	Command string `json:"command"` // The command name, e.g. prescale
+}
+
+/*
+ECSTaskStateChange contains the detail of an 'ECS Task State Change' event delivered by Amazon EventBridge.
+
+See:
+
+https://docs.aws.amazon.com/AmazonECS/latest/developerguide/ecs_task_events.html
+*/
+type ECSTaskStateChange struct {
+	TaskARN       string `json:"taskArn"`       // The task ARN
+	ClusterARN    string `json:"clusterArn"`    // The cluster ARN
+	LastStatus    string `json:"lastStatus"`    // The task's last status
+	DesiredStatus string `json:"desiredStatus"` // The task's desired status
+	StartedBy     string `json:"startedBy"`     // The tag specified when the task was started
+	StopCode      string `json:"stopCode"`      // The stop code, e.g. SpotInterruption
+	StoppedReason string `json:"stoppedReason"` // The reason the task was stopped
+	CPU           string `json:"cpu"`           // The task CPU units, e.g. 1024
+	Memory        string `json:"memory"`        // The task memory in MiB, e.g. 2048
+	StartedAt     string `json:"startedAt"`     // When the task started running, RFC 3339
+	StoppedAt     string `json:"stoppedAt"`     // When the task stopped, RFC 3339
+}
@@ -0,0 +1,514 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ECSRunTaskMaxCount is the maximum number of tasks started by a single AWS ECS RunTask call
+const ECSRunTaskMaxCount = 10
+
+// RunFargateTask invokes the AWS ECS RunTask API with a pre-defined configuration.
+func RunFargateTask(ctx context.Context, client *ecs.Client, config *ECSTaskConfig) (*ecs.RunTaskOutput, error) {
+	input, err := NewRunTaskInput(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := client.RunTask(ctx, input)
+	if err != nil && isTagPermissionError(err) {
+		return runTaskUntaggedOnDenial(ctx, client, input, err)
+	}
+	return result, err
+}
+
+/*
+NewRunTaskInput returns the AWS ECS RunTask input of a pre-defined configuration.
+
+The awsvpc network configuration is omitted for the bridge and host network modes of the EC2 launch type,
+and a public IP is only assigned to Fargate tasks.
+The RUN_TASK_MUTATORS are applied to the input before the call.
+*/
+func NewRunTaskInput(config *ECSTaskConfig) (*ecs.RunTaskInput, error) {
+	launchType := types.LaunchTypeFargate
+	if config.LaunchType != "" {
+		launchType = types.LaunchType(config.LaunchType)
+	}
+
+	input := &ecs.RunTaskInput{
+		Cluster:              aws.String(config.Cluster),
+		TaskDefinition:       aws.String(config.TaskDefinition),
+		Count:                aws.Int32(int32(min(max(config.Count, 1), ECSRunTaskMaxCount))),
+		LaunchType:           launchType,
+		PropagateTags:        types.PropagateTagsTaskDefinition,
+		EnableECSManagedTags: *aws.Bool(true),
+		EnableExecuteCommand: *aws.Bool(true),
+		ClientToken:          aws.String(config.ClientToken),
+	}
+
+	if config.NetworkMode == "" || config.NetworkMode == string(types.NetworkModeAwsvpc) {
+		input.NetworkConfiguration = &types.NetworkConfiguration{
+			AwsvpcConfiguration: &types.AwsVpcConfiguration{
+				Subnets:        config.Subnets,
+				SecurityGroups: config.SecurityGroups,
+			},
+		}
+		if launchType == types.LaunchTypeFargate {
+			input.NetworkConfiguration.AwsvpcConfiguration.AssignPublicIp = types.AssignPublicIpEnabled
+		}
+	}
+
+	if config.StartedBy != "" {
+		input.StartedBy = aws.String(config.StartedBy)
+	}
+
+	if len(config.Tags) > 0 {
+		input.Tags = ecsTags(config.Tags)
+	}
+
+	overrides := &types.TaskOverride{}
+
+	if config.TaskRoleARN != "" {
+		overrides.TaskRoleArn = aws.String(config.TaskRoleARN)
+	}
+
+	if config.ExecutionRoleARN != "" {
+		overrides.ExecutionRoleArn = aws.String(config.ExecutionRoleARN)
+	}
+
+	if config.CPU != "" {
+		overrides.Cpu = aws.String(config.CPU)
+	}
+
+	if config.Memory != "" {
+		overrides.Memory = aws.String(config.Memory)
+	}
+
+	if len(config.Environment) > 0 {
+		container := types.ContainerOverride{
+			Name: aws.String(config.AgentContainer),
+		}
+		for _, name := range slices.Sorted(maps.Keys(config.Environment)) {
+			container.Environment = append(container.Environment, types.KeyValuePair{
+				Name:  aws.String(name),
+				Value: aws.String(config.Environment[name]),
+			})
+		}
+		overrides.ContainerOverrides = []types.ContainerOverride{container}
+	}
+
+	if overrides.TaskRoleArn != nil || overrides.ExecutionRoleArn != nil || overrides.Cpu != nil || overrides.Memory != nil || len(overrides.ContainerOverrides) > 0 {
+		input.Overrides = overrides
+	}
+
+	err := applyRunTaskMutators(input, runTaskMutators)
+	if err != nil {
+		return nil, err
+	}
+
+	return input, nil
+}
+
+/*
+RunFargateTasks starts config.Count tasks with as few AWS ECS RunTask calls as possible,
+each starting up to ECSRunTaskMaxCount tasks.
+
+Every call after the first uses a client token derived from the configured one,
+so retries of the whole batch remain idempotent.
+RunTask may start only part of the requested tasks, the failures of the other tasks are returned
+alongside the ARNs of the started tasks, and err is only set when a call fails.
+*/
+func RunFargateTasks(ctx context.Context, client *ecs.Client, config *ECSTaskConfig) (taskARNs []string, failures []types.Failure, err error) {
+	remaining := max(config.Count, 1)
+
+	for chunk := 0; remaining > 0; chunk++ {
+		chunkConfig := *config
+		chunkConfig.Count = min(remaining, ECSRunTaskMaxCount)
+		if chunk > 0 {
+			chunkConfig.SetClientToken(fmt.Sprintf("%s#%d", config.ClientToken, chunk))
+		}
+
+		result, runErr := RunFargateTask(ctx, client, &chunkConfig)
+		if runErr != nil {
+			err = runErr
+			return
+		}
+
+		for _, task := range result.Tasks {
+			taskARNs = append(taskARNs, aws.ToString(task.TaskArn))
+		}
+		failures = append(failures, result.Failures...)
+
+		remaining -= chunkConfig.Count
+	}
+
+	return
+}
+
+// GetTaskLastStatus returns an AWS ECS task's last status
+func GetTaskLastStatus(ctx context.Context, client *ecs.Client, config *ECSTaskReadConfig) (status string, err error) {
+	task, err := DescribeTask(ctx, client, config)
+	if err != nil {
+		return
+	}
+
+	status = aws.ToString(task.LastStatus)
+	return
+}
+
+// DescribeTask returns a single AWS ECS task, or a *DescribeTaskError with the failure that DescribeTasks returned instead
+func DescribeTask(ctx context.Context, client *ecs.Client, config *ECSTaskReadConfig) (task *types.Task, err error) {
+	result, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(taskCluster(config.TaskARN, config.Cluster)),
+		Tasks:   []string{config.TaskARN},
+	})
+	if err != nil {
+		return
+	}
+
+	if len(result.Tasks) > 0 {
+		task = &result.Tasks[0]
+	} else {
+		err = NewDescribeTaskError(config.TaskARN, result.Failures)
+	}
+
+	return
+}
+
+/*
+GenerateClientToken creates a hash of the input string, encodes it to base64,
+and converts it into a string that includes up to 64 ASCII characters.
+This token can be used as a Client Token for idempotent requests to the AWS ECS RunTask API.
+
+See:
+
+https://docs.aws.amazon.com/AmazonECS/latest/APIReference/ECS_Idempotency.html#RunTaskIdempotency
+*/
+func GenerateClientToken(input string) string {
+	hash := sha256.Sum256([]byte(input))
+	encoded := base64.StdEncoding.EncodeToString(hash[:])
+	if len(encoded) > 64 {
+		encoded = encoded[:64]
+	}
+	return encoded
+}
+
+/*
+ReadRequiredEnvVar reads a specified environment variable and returns the value,
+or exits with status 1 if the value is unset or empty.
+*/
+func ReadRequiredEnvVar(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		slog.Error(fmt.Sprintf("missing required environment variable %s", name))
+		os.Exit(1)
+	}
+	return value
+}
+
+/*
+ReadEnvVarWithDefault reads a specified environment variable and returns the value,
+or returns a specified default value if the value is unset or empty.
+*/
+func ReadEnvVarWithDefault(name string, defaultVal string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultVal
+	}
+	return value
+}
+
+/*
+ADOCallback calls back to the Azure DevOps service connection with the process outcome.
+
+With ADO_VALIDATE_CALLBACK, errors reported in the body of a successful response
+are returned as an *ADOCallbackRejectedError.
+
+See:
+
+https://learn.microsoft.com/en-us/azure/devops/pipelines/process/invoke-checks?view=azure-devops
+*/
+func ADOCallback(client *http.Client, config *ADOCallbackConfig) (data string, err error) {
+	url := config.Payload.ADOEventsURL(config.Config.Instance, config.Config.APIVersion)
+
+	resBytes, err := adoRequest(client, config.Config, config.Payload.AuthToken, http.MethodPost, url, adoCallbackBody(config))
+	if err != nil {
+		return
+	}
+
+	data = string(resBytes)
+	if config.Config.ValidateCallback {
+		err = validateCallbackResponse(resBytes)
+	}
+	return
+}
+
+// adoCallbackBody returns the body of the TaskCompleted event sent by ADOCallback
+func adoCallbackBody(config *ADOCallbackConfig) map[string]string {
+	return map[string]string{
+		"name":   "TaskCompleted",
+		"jobId":  config.Payload.JobID,
+		"taskId": config.Payload.TaskInstanceID,
+		"result": config.Result,
+	}
+}
+
+/*
+ADOTimelineFeed appends lines to the timeline record feed of the check's task instance,
+which shows them in the check's log in the Azure DevOps UI.
+
+See:
+
+https://learn.microsoft.com/en-us/azure/devops/pipelines/process/invoke-checks?view=azure-devops
+*/
+func ADOTimelineFeed(client *http.Client, config *ADOConfig, payload *ADOPayload, lines ...string) error {
+	body := map[string]any{
+		"value": lines,
+		"count": len(lines),
+	}
+
+	url := payload.ADOTimelineFeedURL(config.Instance, config.APIVersion)
+
+	_, err := adoRequest(client, config, payload.AuthToken, http.MethodPost, url, body)
+	return err
+}
+
+/*
+ADOTimelineRecordVariables sets variables on the timeline record of the check's task instance,
+which makes machine-readable metadata available to downstream pipeline steps.
+
+See:
+
+https://learn.microsoft.com/en-us/rest/api/azure/devops/distributedtask/records/update
+*/
+func ADOTimelineRecordVariables(client *http.Client, config *ADOConfig, payload *ADOPayload, variables map[string]string) error {
+	values := map[string]map[string]string{}
+	for name, value := range variables {
+		values[name] = map[string]string{"value": value}
+	}
+
+	body := map[string]any{
+		"value": []map[string]any{
+			{
+				"id":        payload.TaskInstanceID,
+				"variables": values,
+			},
+		},
+		"count": 1,
+	}
+
+	url := payload.ADOTimelineRecordsURL(config.Instance, config.APIVersion)
+
+	_, err := adoRequest(client, config, payload.AuthToken, http.MethodPatch, url, body)
+	return err
+}
+
+// ADOPlanStateInProgress is the state of a plan whose checks or jobs are running
+const ADOPlanStateInProgress = "inProgress"
+
+// ErrInvalidPayload is returned for payloads that are rejected: fields that fail ADOPayload.Sanitize, or plans that aren't in progress, see ADOValidatePlan
+var ErrInvalidPayload = errors.New("invalid payload")
+
+/*
+ADOValidatePlan verifies, using the payload's own job access token,
+that the plan referenced by the payload exists and is in progress,
+which rejects fabricated payloads and payloads replayed after the plan completed.
+
+Only a definite not-found, a 404 or a TaskOrchestrationPlanNotFoundException, wraps ErrInvalidPayload:
+other failures, such as ADO outages, are returned as is, so the record is redelivered instead of dropped.
+*/
+func ADOValidatePlan(client *http.Client, config *ADOConfig, payload *ADOPayload) error {
+	url := payload.ADOPlanURL(config.Instance, config.APIVersion)
+
+	resBytes, err := adoRequest(client, config, payload.AuthToken, http.MethodGet, url, nil)
+	var adoErr *ADOError
+	if errors.As(err, &adoErr) && (adoErr.StatusCode == http.StatusNotFound || adoErr.TypeKey == "TaskOrchestrationPlanNotFoundException") {
+		return fmt.Errorf("%w: failed to get plan %s: %w", ErrInvalidPayload, payload.PlanID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get plan %s: %w", payload.PlanID, err)
+	}
+
+	var plan struct {
+		PlanID string `json:"planId"`
+		State  string `json:"state"`
+	}
+	err = json.Unmarshal(resBytes, &plan)
+	if err != nil {
+		return fmt.Errorf("failed to parse plan: %w", err)
+	}
+
+	if !strings.EqualFold(plan.PlanID, payload.PlanID) {
+		return fmt.Errorf("%w: plan %s not found", ErrInvalidPayload, payload.PlanID)
+	}
+
+	if !strings.EqualFold(plan.State, ADOPlanStateInProgress) {
+		return fmt.Errorf("%w: plan %s is %s", ErrInvalidPayload, payload.PlanID, plan.State)
+	}
+
+	return nil
+}
+
+// ReadADORetryPolicyFromEnv reads the ADO retry policy of Azure DevOps REST API requests, which aren't retried by default, see ReadRetryPolicyFromEnv
+func ReadADORetryPolicyFromEnv() *RetryPolicy {
+	return ReadRetryPolicyFromEnv("ADO", RetryPolicy{
+		MaxAttempts: 1,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+		Jitter:      0.5,
+		Retryable:   isADOOutage,
+	})
+}
+
+/*
+adoRequest sends a JSON request to the Azure DevOps REST API authenticated with a job access token or PAT.
+
+The ExtraHeaders of the configuration are added to the request, and may override the default Accept and Content-Type headers.
+Requests that fail without a response or with a 5xx or 429 status code are retried with the ADO retry policy.
+*/
+func adoRequest(client *http.Client, config *ADOConfig, token string, method string, url string, body any) (data []byte, err error) {
+	return sendADORequest(client, config, method, url, body, func(req *http.Request) {
+		req.SetBasicAuth(config.AuthUsername, token)
+	})
+}
+
+// sendADORequest sends a JSON or *ADOStreamBody request to the Azure DevOps REST API, see adoRequest, authorized by a function setting its credentials
+func sendADORequest(client *http.Client, config *ADOConfig, method string, url string, body any, authorize func(req *http.Request)) (data []byte, err error) {
+	headers := map[string]string{
+		"Accept":       "application/json",
+		"Content-Type": "application/json",
+	}
+
+	var bodyBytes []byte
+	if stream, ok := body.(*ADOStreamBody); ok {
+		headers["Content-Type"] = stream.ContentType
+		if stream.ContentEncoding != "" {
+			headers["Content-Encoding"] = stream.ContentEncoding
+		}
+		bodyBytes = stream.Data
+	} else if body != nil {
+		bodyBytes, err = json.Marshal(body)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal JSON body: %w", err)
+			return
+		}
+	}
+
+	err = adoRetryPolicy.Do(context.Background(), "ADO "+method, func() error {
+		req, reqErr := http.NewRequest(method, url, bytes.NewBuffer(bodyBytes))
+		if reqErr != nil {
+			return fmt.Errorf("failed to create HTTP request: %w", reqErr)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		for k, v := range config.ExtraHeaders {
+			req.Header.Set(k, v)
+		}
+
+		authorize(req)
+
+		res, doErr := client.Do(req)
+		if doErr != nil {
+			return fmt.Errorf("failed to execute HTTP request: %w", doErr)
+		}
+
+		data, doErr = readResponse(res, config.MaxResponseBytes)
+		return doErr
+	})
+	return
+}
+
+/*
+ADOError is an error response of the Azure DevOps REST API,
+also used for the Kubernetes API, whose Status error bodies share the message field.
+
+The message and type are parsed from JSON error bodies, other bodies,
+such as HTML error pages of proxies, are reduced to a short excerpt.
+*/
+type ADOError struct {
+	StatusCode int    `json:"-"`         // The HTTP status code
+	Message    string `json:"message"`   // The error message
+	TypeKey    string `json:"typeKey"`   // The error type, e.g. TaskOrchestrationPlanNotFoundException
+	ErrorCode  int    `json:"errorCode"` // The error code
+}
+
+func (e *ADOError) Error() string {
+	if e.TypeKey != "" {
+		return fmt.Sprintf("unexpected status code: %d: %s: %s", e.StatusCode, e.TypeKey, e.Message)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("unexpected status code: %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// adoErrorExcerptBytes is the size of the excerpt of non-JSON error bodies included in errors
+const adoErrorExcerptBytes = 256
+
+/*
+readResponse reads a response body of at most maxBytes bytes,
+and returns an *ADOError for status codes outside 2xx, including redirects that weren't followed,
+or an error for successful responses that aren't JSON.
+*/
+func readResponse(res *http.Response, maxBytes int64) (data []byte, err error) {
+	defer res.Body.Close()
+
+	data, err = io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		err = fmt.Errorf("failed to read response body: %w", err)
+		return
+	}
+
+	truncated := int64(len(data)) > maxBytes
+	if truncated {
+		data = data[:maxBytes]
+	}
+
+	isJSON := strings.HasPrefix(res.Header.Get("Content-Type"), "application/json")
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		adoErr := &ADOError{StatusCode: res.StatusCode}
+		if !isJSON || json.Unmarshal(data, adoErr) != nil {
+			excerpt := data
+			if len(excerpt) > adoErrorExcerptBytes {
+				excerpt = excerpt[:adoErrorExcerptBytes]
+			}
+			adoErr.Message = strings.Join(strings.Fields(string(excerpt)), " ")
+		}
+		err = adoErr
+		data = nil
+		return
+	}
+
+	if truncated {
+		err = fmt.Errorf("response body exceeds %d bytes", maxBytes)
+		data = nil
+		return
+	}
+
+	if len(data) > 0 && !isJSON {
+		err = fmt.Errorf("unexpected content type: %q", res.Header.Get("Content-Type"))
+		data = nil
+		return
+	}
+
+	return
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// WarmPoolStartedBy is the StartedBy tag of idle agent tasks kept by the warm pool
+const WarmPoolStartedBy = "ado-warm"
+
+// WarmPoolWindow is a cron-style schedule during which the warm pool keeps a number of idle agents
+type WarmPoolWindow struct {
+	Cron     string        `json:"cron"` // A 5-field cron expression matching every minute of the window, e.g. '* 8-17 * * 1-5'
+	Size     int           `json:"size"` // The number of warm agents kept during the window
+	schedule *CronSchedule // The parsed cron expression
+}
+
+// WarmPoolConfig contains configuration values for the warm pool
+type WarmPoolConfig struct {
+	Windows  []WarmPoolWindow // The warm capacity windows
+	Location *time.Location   // The time zone used to evaluate the windows
+}
+
+/*
+ReadFromEnv reads the following optional environment variables
+and populates the struct with the values:
+  - WARM_POOL_SCHEDULES: A JSON list of warm capacity windows, e.g. '[{"cron": "* 8-17 * * 1-5", "size": 5}]' (default: no windows)
+  - WARM_POOL_TIMEZONE: The IANA time zone used to evaluate the windows (default: UTC)
+*/
+func (config *WarmPoolConfig) ReadFromEnv() {
+	err := json.Unmarshal([]byte(ReadEnvVarWithDefault("WARM_POOL_SCHEDULES", "[]")), &config.Windows)
+	if err != nil {
+		slog.Error("failed to parse WARM_POOL_SCHEDULES", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	for i := range config.Windows {
+		config.Windows[i].schedule, err = ParseCron(config.Windows[i].Cron)
+		if err != nil {
+			slog.Error("failed to parse WARM_POOL_SCHEDULES", slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	config.Location, err = time.LoadLocation(ReadEnvVarWithDefault("WARM_POOL_TIMEZONE", "UTC"))
+	if err != nil {
+		slog.Error("failed to parse WARM_POOL_TIMEZONE", slog.Any("err", err))
+		os.Exit(1)
+	}
+}
+
+// DesiredSize returns the largest size of the windows active at t, or 0 outside every window
+func (config *WarmPoolConfig) DesiredSize(t time.Time) (size int) {
+	local := t.In(config.Location)
+	for _, window := range config.Windows {
+		if window.schedule.Matches(local) {
+			size = max(size, window.Size)
+		}
+	}
+	return
+}
+
+/*
+handleWarmPool reconciles the warm pool with the capacity windows active now:
+missing idle agent tasks are started, and surplus tasks are stopped,
+which scales the pool to zero outside every window.
+It is meant to run on a schedule, e.g. every few minutes.
+
+Only surplus tasks whose agent isn't running a job are stopped, busy agents are left to finish their job
+and are stopped by a later run, so scaling in requires ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID.
+
+It requires the ecs backend.
+*/
+func handleWarmPool(ctx context.Context) error {
+	if taskCfg == nil {
+		return fmt.Errorf("the warm pool requires the ecs backend")
+	}
+
+	desired := warmPoolCfg.DesiredSize(time.Now())
+
+	running, err := ListStartedByTasks(ctx, ecsClient, taskCfg.Cluster, WarmPoolStartedBy)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("warm pool", slog.Int("desired", desired), slog.Int("running", len(running)))
+
+	for i := len(running); i < desired; i++ {
+		config := *taskCfg
+		config.SetClientToken(fmt.Sprintf("%s-%d-%d", WarmPoolStartedBy, time.Now().UnixNano(), i))
+		config.StartedBy = WarmPoolStartedBy
+		config.Tags = controllerTags(nil)
+
+		result, err := RunFargateTask(ctx, ecsClient, &config)
+		if err != nil {
+			return fmt.Errorf("failed to start warm task: %w", err)
+		}
+
+		for _, task := range result.Tasks {
+			slog.Info("started warm task", slog.String("taskArn", aws.ToString(task.TaskArn)))
+		}
+	}
+
+	surplus := len(running) - desired
+	if surplus <= 0 {
+		return nil
+	}
+	if !hasADOOrgCredentials() || adoCfg.PoolID == 0 {
+		return fmt.Errorf("scaling in the warm pool requires ADO_PAT or AZURE_CLIENT_ID, and ADO_POOL_ID")
+	}
+
+	agents, err := ADOListAgentsWithAssignedRequests(adoClient, adoCfg)
+	if err != nil {
+		return fmt.Errorf("failed to list agents: %w", err)
+	}
+
+	ecsRunner := &ECSRunner{Client: ecsClient, Config: taskCfg}
+	for _, taskARN := range running {
+		if surplus == 0 {
+			break
+		}
+		if warmTaskBusy(agents, taskARN) {
+			slog.Info("kept busy warm task", slog.String("taskArn", taskARN))
+			continue
+		}
+
+		err = ecsRunner.Stop(ctx, taskARN, "scaled in by the warm pool schedule")
+		if err != nil {
+			return fmt.Errorf("failed to stop warm task: %w", err)
+		}
+
+		slog.Info("stopped warm task", slog.String("taskArn", taskARN))
+		surplus--
+	}
+
+	return nil
+}
+
+// warmTaskBusy reports whether the agent of a warm task is running a job, agents that haven't registered yet are idle
+func warmTaskBusy(agents []ADOAgent, taskARN string) bool {
+	for _, agent := range agents {
+		if agentMatches(agent, taskARN, "") && agent.AssignedRequest != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// webhookTemplateFuncs are the functions of the templates of the webhook frontend, in addition to the text/template builtins
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+/*
+mapWebhookBody maps the body of a message of a queue with the webhook frontend to the body of an ADO payload,
+by executing the template of the queue with the decoded JSON body as its data.
+
+The template must render the JSON of an ADOPayload; the json function renders a value as JSON,
+e.g. '{"JobId": {{json .job.id}}, "Demands": {{json .job.labels}}}'.
+This onboards other CI systems with configuration only, as long as they can report back through ADO-compatible callbacks
+or the reporters, see Reporter.
+*/
+func mapWebhookBody(queueProfile QueueProfile, body string) (string, error) {
+	var data any
+	err := json.Unmarshal([]byte(body), &data)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse webhook body: %w", err)
+	}
+
+	var result bytes.Buffer
+	err = queueProfile.template.Execute(&result, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to map webhook body: %w", err)
+	}
+
+	if !json.Valid(result.Bytes()) {
+		return "", fmt.Errorf("failed to map webhook body: the template didn't render JSON")
+	}
+	return result.String(), nil
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// maxWebhookBytes is the largest webhook body forwarded to the queue, the SQS message size limit
+const maxWebhookBytes = 256 * 1024
+
+// webhookReceiverCfg configures the webhook binary, nil in the other binaries
+var webhookReceiverCfg *WebhookReceiverConfig
+
+// WebhookReceiverConfig contains configuration values for forwarding webhooks to the queues of the controller
+type WebhookReceiverConfig struct {
+	QueueURL string            // The SQS queue URL that webhooks are sent to
+	Routes   map[string]string // The SQS queue URLs of request paths, for queues with other frontends, see QueueProfile
+	Headers  []string          // The request headers forwarded as message attributes, such as the signatures of the webhooks
+}
+
+/*
+ReadFromEnv reads the following environment variables
+and populates the struct with the values:
+  - WEBHOOK_QUEUE_URL: The SQS queue URL that webhooks are sent to, requires sqs:SendMessage (required)
+  - WEBHOOK_ROUTES: A JSON object of request paths to the SQS queue URLs of their webhooks, e.g. '{"/gitlab": "https://sqs..."}',
+    so the webhooks of every CI system reach the queue of their frontend, other paths are sent to WEBHOOK_QUEUE_URL (optional)
+  - WEBHOOK_FORWARDED_HEADERS: The comma-separated request headers forwarded as message attributes, when present
+    (default: X-Hub-Signature-256,X-Gitlab-Token,X-Signature-256,X-Signature-Timestamp)
+*/
+func (config *WebhookReceiverConfig) ReadFromEnv() {
+	config.QueueURL = ReadRequiredEnvVar("WEBHOOK_QUEUE_URL")
+
+	routes := ReadEnvVarWithDefault("WEBHOOK_ROUTES", "")
+	if routes != "" {
+		err := json.Unmarshal([]byte(routes), &config.Routes)
+		if err != nil {
+			slog.Error("failed to parse WEBHOOK_ROUTES", slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	headers := ReadEnvVarWithDefault("WEBHOOK_FORWARDED_HEADERS", "X-Hub-Signature-256,X-Gitlab-Token,X-Signature-256,X-Signature-Timestamp")
+	for _, header := range strings.Split(headers, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			config.Headers = append(config.Headers, header)
+		}
+	}
+}
+
+// QueueURLFor returns the SQS queue URL of the webhooks received on a request path
+func (config *WebhookReceiverConfig) QueueURLFor(path string) string {
+	if queueURL, ok := config.Routes[path]; ok {
+		return queueURL
+	}
+	return config.QueueURL
+}
+
+// bootstrapWebhook sets up the webhook binary, which only sends the webhooks it receives to SQS
+func bootstrapWebhook(awsCfg aws.Config) {
+	webhookReceiverCfg = new(WebhookReceiverConfig)
+	webhookReceiverCfg.ReadFromEnv()
+	sqsClient = sqs.NewFromConfig(awsCfg)
+}
+
+/*
+handleWebhookRequest forwards a webhook received through a Lambda function URL to the queue of its request path, see WebhookReceiverConfig,
+with the forwarded headers as message attributes, so the controller handles it like any message of the queue.
+
+The webhook binary doesn't verify the webhooks: the controller does, with the signature or token of its frontend,
+such as GITHUB_WEBHOOK_SECRET or GITLAB_WEBHOOK_TOKEN, so the secrets are only configured on the controller.
+Only POST requests are accepted, and bodies larger than an SQS message are rejected.
+*/
+func handleWebhookRequest(ctx context.Context, request *events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	if request.RequestContext.HTTP.Method != http.MethodPost {
+		return adminResponse(http.StatusMethodNotAllowed, map[string]string{"error": "webhooks must be sent with POST"})
+	}
+
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return adminResponse(http.StatusBadRequest, map[string]string{"error": "invalid base64 body"})
+		}
+		body = string(decoded)
+	}
+	if body == "" {
+		return adminResponse(http.StatusBadRequest, map[string]string{"error": "empty body"})
+	}
+	if len(body) > maxWebhookBytes {
+		EmitMetric("RejectedPayloads", 1, MetricUnitCount, map[string]string{"Reason": "WebhookSize"})
+		return adminResponse(http.StatusRequestEntityTooLarge, map[string]string{"error": "the body is larger than an SQS message"})
+	}
+
+	attributes := map[string]types.MessageAttributeValue{}
+	for _, header := range webhookReceiverCfg.Headers {
+		value := request.Headers[strings.ToLower(header)]
+		if value == "" {
+			continue
+		}
+		attributes[header] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+
+	queueURL := webhookReceiverCfg.QueueURLFor(request.RawPath)
+	result, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+	})
+	if err != nil {
+		slog.Error("failed to forward webhook", slog.String("path", request.RawPath), slog.String("queueUrl", queueURL), slog.Any("err", err))
+		return adminResponse(http.StatusBadGateway, map[string]string{"error": "failed to forward the webhook"})
+	}
+
+	slog.Info("forwarded webhook", slog.String("path", request.RawPath), slog.String("queueUrl", queueURL), slog.String("messageId", aws.ToString(result.MessageId)))
+	EmitMetric("ForwardedWebhooks", 1, MetricUnitCount, nil)
+	return adminResponse(http.StatusAccepted, map[string]string{"messageId": aws.ToString(result.MessageId)})
+}